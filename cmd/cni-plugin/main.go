@@ -3,15 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"os"
+	"strings"
 	"time"
 
+	pb "github.com/jianzi123/ipam/pkg/api/proto"
 	"github.com/jianzi123/ipam/pkg/cni"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 // Environment variables passed by container runtime (CNI spec)
@@ -24,6 +29,30 @@ const (
 	EnvPath        = "CNI_PATH"
 )
 
+// Keys set in CNI_ARGS by kubelet, and IP by a user asking for an address
+const (
+	ArgPodName      = "K8S_POD_NAME"
+	ArgPodNamespace = "K8S_POD_NAMESPACE"
+	ArgIP           = "IP"
+)
+
+// DefaultDaemonSocket is used when the network config sets no daemonSocket
+const DefaultDaemonSocket = "/run/ipam/ipam.sock"
+
+// daemonTimeout bounds each call to the IPAM daemon
+// It leaves room for the daemon to forward a block allocation to the leader
+const daemonTimeout = 30 * time.Second
+
+// cmdArgs holds the inputs of a CNI invocation
+type cmdArgs struct {
+	ContainerID string
+	Netns       string
+	IfName      string
+	Args        string
+	NodeID      string // Empty means the node of the daemon
+	StdinData   []byte
+}
+
 func main() {
 	// Read CNI command from environment
 	command := os.Getenv(EnvCommand)
@@ -50,38 +79,64 @@ func main() {
 
 // handleAdd allocates an IP and configures the interface
 func handleAdd() {
-	// Read network configuration from stdin
-	netConf, err := loadNetConf()
+	args, err := loadArgs()
 	if err != nil {
-		printError(cni.ErrCodeDecodingFailure, "failed to load network config", err.Error())
+		printError(cni.ErrCodeIOFailure, "failed to read stdin", err.Error())
 		os.Exit(1)
 	}
 
-	// Get environment variables
-	containerID := os.Getenv(EnvContainerID)
-	netns := os.Getenv(EnvNetNS)
-	ifname := os.Getenv(EnvIFName)
+	result, cniErr := cmdAdd(args)
+	if cniErr != nil {
+		cniErr.Print()
+		os.Exit(1)
+	}
 
-	if containerID == "" || netns == "" || ifname == "" {
-		printError(cni.ErrCodeInvalidEnvironmentVar, "missing required env vars", "")
+	if err := result.Print(); err != nil {
+		printError(cni.ErrCodeInternal, "failed to print result", err.Error())
 		os.Exit(1)
 	}
+}
+
+// handleDel releases an IP
+func handleDel() {
+	args, err := loadArgs()
+	if err != nil {
+		// For DEL, we should not fail if the config cannot be read
+		os.Exit(0)
+	}
+
+	if cniErr := cmdDel(args); cniErr != nil {
+		cniErr.Print()
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// cmdAdd allocates an IP for the container from the IPAM daemon
+func cmdAdd(args *cmdArgs) (*cni.Result, *cni.Error) {
+	// Read network configuration from stdin
+	netConf, err := parseNetConf(args.StdinData)
+	if err != nil {
+		return nil, cni.NewError(cni.ErrCodeDecodingFailure, "failed to load network config", err.Error())
+	}
 
-	// Get node ID (from hostname by default)
-	nodeID, err := os.Hostname()
+	if args.ContainerID == "" || args.Netns == "" || args.IfName == "" {
+		return nil, cni.NewError(cni.ErrCodeInvalidEnvironmentVar, "missing required env vars", "")
+	}
+
+	requested, err := requestedIP(netConf, parseArgs(args.Args))
 	if err != nil {
-		nodeID = "unknown"
+		return nil, cni.NewError(cni.ErrCodeInvalidNetworkConfig, "invalid requested IP", err.Error())
 	}
 
 	// Allocate IP from IPAM daemon
-	ipResult, err := allocateIP(netConf, nodeID, containerID)
+	ipResult, err := allocateIP(netConf, args, requested)
 	if err != nil {
-		printError(cni.ErrCodeInternal, "failed to allocate IP", err.Error())
-		os.Exit(1)
+		return nil, daemonError("failed to allocate IP", err)
 	}
 
 	// Return result
-	result := &cni.Result{
+	return &cni.Result{
 		CNIVersion: netConf.CNIVersion,
 		IPs: []*cni.IPConfig{
 			{
@@ -90,42 +145,22 @@ func handleAdd() {
 			},
 		},
 		Routes: convertRoutes(ipResult.Routes),
-	}
-
-	if err := result.Print(); err != nil {
-		printError(cni.ErrCodeInternal, "failed to print result", err.Error())
-		os.Exit(1)
-	}
+	}, nil
 }
 
-// handleDel releases an IP
-func handleDel() {
-	// Read network configuration
-	netConf, err := loadNetConf()
-	if err != nil {
-		// For DEL, we should not fail if config is invalid
-		// Just exit successfully
-		os.Exit(0)
+// cmdDel releases the IP of the container to the IPAM daemon
+// Missing config or a container without an IP is not an error, but a failed
+// release is, so that the runtime retries instead of leaking the IP
+func cmdDel(args *cmdArgs) *cni.Error {
+	netConf, err := parseNetConf(args.StdinData)
+	if err != nil || args.ContainerID == "" {
+		return nil
 	}
 
-	containerID := os.Getenv(EnvContainerID)
-	if containerID == "" {
-		os.Exit(0)
-	}
-
-	// Get node ID
-	nodeID, err := os.Hostname()
-	if err != nil {
-		nodeID = "unknown"
+	if err := releaseIP(netConf, args); err != nil {
+		return daemonError("failed to release IP", err)
 	}
-
-	// Release IP
-	// Note: In a real implementation, we'd need to track container ID -> IP mapping
-	// For now, this is simplified
-	_ = releaseIP(netConf, nodeID, containerID)
-
-	// DEL always succeeds
-	os.Exit(0)
+	return nil
 }
 
 // handleCheck validates the interface configuration
@@ -154,13 +189,35 @@ func handleVersion() {
 	os.Exit(0)
 }
 
+// loadArgs reads the invocation inputs from the environment and stdin
+func loadArgs() (*cmdArgs, error) {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stdin: %w", err)
+	}
+
+	// The node ID is left to the daemon, which serves requests without one
+	// for its own node
+	return &cmdArgs{
+		ContainerID: os.Getenv(EnvContainerID),
+		Netns:       os.Getenv(EnvNetNS),
+		IfName:      os.Getenv(EnvIFName),
+		Args:        os.Getenv(EnvArgs),
+		StdinData:   data,
+	}, nil
+}
+
 // loadNetConf loads network configuration from stdin
 func loadNetConf() (*cni.NetConf, error) {
-	data, err := ioutil.ReadAll(os.Stdin)
+	data, err := io.ReadAll(os.Stdin)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read stdin: %w", err)
 	}
+	return parseNetConf(data)
+}
 
+// parseNetConf parses a network configuration
+func parseNetConf(data []byte) (*cni.NetConf, error) {
 	var conf cni.NetConf
 	if err := json.Unmarshal(data, &conf); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
@@ -169,44 +226,141 @@ func loadNetConf() (*cni.NetConf, error) {
 	return &conf, nil
 }
 
-// allocateIP allocates an IP from the IPAM daemon
-func allocateIP(netConf *cni.NetConf, nodeID, containerID string) (*IPAMResult, error) {
-	// Connect to IPAM daemon
-	socket := netConf.IPAM.DaemonSocket
-	if socket == "" {
-		socket = "/run/ipam/ipam.sock"
+// parseArgs parses CNI_ARGS, a list of KEY=VALUE pairs separated by ';'
+func parseArgs(args string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(args, ";") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			continue
+		}
+		result[key] = value
 	}
+	return result
+}
 
-	// Create gRPC connection (simplified - no proto for now)
-	// In real implementation, this would use the generated gRPC client
-	conn, err := grpc.Dial(
-		socket,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
-			return net.Dial("unix", addr)
-		}),
-	)
+// requestedIP returns the IP the container asks for, or "" for any IP
+// The runtimeConfig "ips" capability takes precedence over IP in CNI_ARGS;
+// either may hold one address per interface, with or without a prefix length
+func requestedIP(netConf *cni.NetConf, podArgs map[string]string) (string, error) {
+	var ips []string
+	if netConf.RuntimeConfig != nil && len(netConf.RuntimeConfig.IPs) > 0 {
+		ips = netConf.RuntimeConfig.IPs
+	} else if value := podArgs[ArgIP]; value != "" {
+		ips = strings.Split(value, ",")
+	}
+
+	if len(ips) == 0 {
+		return "", nil
+	}
+	if len(ips) > 1 {
+		return "", fmt.Errorf("only one IP per interface is supported, got %v", ips)
+	}
+
+	addr := strings.TrimSpace(ips[0])
+	if ip, _, err := net.ParseCIDR(addr); err == nil {
+		return ip.String(), nil
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("invalid IP %q", addr)
+}
+
+// dialDaemon connects to the IPAM daemon socket named in the network config
+func dialDaemon(netConf *cni.NetConf) (*grpc.ClientConn, error) {
+	socket := DefaultDaemonSocket
+	if netConf.IPAM != nil && netConf.IPAM.DaemonSocket != "" {
+		socket = netConf.IPAM.DaemonSocket
+	}
+
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to IPAM daemon: %w", err)
 	}
+	return conn, nil
+}
+
+// allocateIP allocates an IP from the IPAM daemon, the requested one unless
+// it is empty
+func allocateIP(netConf *cni.NetConf, args *cmdArgs, requested string) (*IPAMResult, error) {
+	conn, err := dialDaemon(netConf)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	// For now, return a mock result
-	// In real implementation, this would call the gRPC AllocateIP method
+	ctx, cancel := context.WithTimeout(context.Background(), daemonTimeout)
+	defer cancel()
+
+	podArgs := parseArgs(args.Args)
+	resp, err := pb.NewIPAMClient(conn).AllocateIP(ctx, &pb.AllocateIPRequest{
+		NodeId:       args.NodeID,
+		PodName:      podArgs[ArgPodName],
+		PodNamespace: podArgs[ArgPodNamespace],
+		ContainerId:  args.ContainerID,
+		IfName:       args.IfName,
+		Netns:        args.Netns,
+		Ip:           requested,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]RouteInfo, len(resp.Routes))
+	for i, r := range resp.Routes {
+		routes[i] = RouteInfo{Dst: r.Dst, GW: r.Gw}
+	}
+
 	return &IPAMResult{
-		IP:      "10.244.1.5",
-		CIDR:    "10.244.1.5/24",
-		Gateway: "10.244.1.1",
-		Routes:  []RouteInfo{{Dst: "0.0.0.0/0"}},
+		IP:      resp.Ip,
+		CIDR:    resp.Cidr,
+		Gateway: resp.Gateway,
+		Routes:  routes,
 	}, nil
 }
 
-// releaseIP releases an IP to the IPAM daemon
-func releaseIP(netConf *cni.NetConf, nodeID, containerID string) error {
-	// Similar to allocateIP, would use gRPC in real implementation
+// releaseIP releases the IP of the container to the IPAM daemon
+// The daemon looks the IP up by container ID and interface
+func releaseIP(netConf *cni.NetConf, args *cmdArgs) error {
+	conn, err := dialDaemon(netConf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), daemonTimeout)
+	defer cancel()
+
+	resp, err := pb.NewIPAMClient(conn).ReleaseIP(ctx, &pb.ReleaseIPRequest{
+		NodeId:      args.NodeID,
+		Ip:          prevResultIP(netConf),
+		ContainerId: args.ContainerID,
+		IfName:      args.IfName,
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return errors.New(resp.Message)
+	}
 	return nil
 }
 
+// prevResultIP returns the IP the previous ADD returned, or an empty string
+// when the runtime passed no result
+func prevResultIP(netConf *cni.NetConf) string {
+	if netConf.PrevResult == nil {
+		return ""
+	}
+	for _, ipConfig := range netConf.PrevResult.IPs {
+		if ip, _, err := net.ParseCIDR(ipConfig.Address); err == nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
 // IPAMResult represents the result from IPAM
 type IPAMResult struct {
 	IP      string
@@ -233,6 +387,16 @@ func convertRoutes(routes []RouteInfo) []*cni.Route {
 	return result
 }
 
+// daemonError converts an error calling the daemon to a CNI error
+// An unreachable daemon asks the runtime to try again later
+func daemonError(msg string, err error) *cni.Error {
+	code := cni.ErrCodeInternal
+	if status.Code(err) == codes.Unavailable {
+		code = cni.ErrCodeTryAgainLater
+	}
+	return cni.NewError(code, msg, err.Error())
+}
+
 // printError prints a CNI error and exits
 func printError(code uint, msg, details string) {
 	err := cni.NewError(code, msg, details)
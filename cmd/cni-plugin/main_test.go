@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jianzi123/ipam/pkg/cni"
+	"github.com/jianzi123/ipam/pkg/ipam"
+	"github.com/jianzi123/ipam/pkg/server"
+	"github.com/jianzi123/ipam/pkg/store"
+)
+
+// startDaemon serves an in-process IPAM daemon on a temporary Unix socket
+func startDaemon(t *testing.T) (string, *ipam.Pool, *store.Store) {
+	t.Helper()
+
+	ipamStore, err := store.NewStore(filepath.Join(t.TempDir(), "ipam.db"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	t.Cleanup(func() { ipamStore.Close() })
+
+	socketPath, pool := serveDaemon(t, ipamStore)
+	return socketPath, pool, ipamStore
+}
+
+// serveDaemon serves an in-process IPAM daemon backed by ipamStore, which
+// may be nil
+func serveDaemon(t *testing.T, ipamStore store.MappingStore) (string, *ipam.Pool) {
+	t.Helper()
+
+	pool, err := ipam.NewPool(ipam.PoolConfig{
+		ClusterCIDR: "10.244.0.0/16",
+		BlockSize:   24,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "ipam.sock")
+	srv := server.NewServer(pool, nil, ipamStore)
+	if _, err := srv.GetIPAMServer().Reconcile(); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	go srv.StartUnix(socketPath)
+	t.Cleanup(srv.Stop)
+
+	// Wait for the daemon to listen
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("unix", socketPath)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Daemon did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return socketPath, pool
+}
+
+// netConf returns a network config pointing at socketPath
+func netConf(t *testing.T, socketPath string, prevResult *cni.Result) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(&cni.NetConf{
+		CNIVersion: cni.CNIVersion040,
+		Name:       "k8s-pod-network",
+		Type:       "ipam-cni",
+		IPAM: &cni.IPAM{
+			Type:         "ipam-plugin",
+			DaemonSocket: socketPath,
+		},
+		PrevResult: prevResult,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	return data
+}
+
+func TestPlugin(t *testing.T) {
+	newArgs := func(containerID string, stdin []byte) *cmdArgs {
+		return &cmdArgs{
+			ContainerID: containerID,
+			Netns:       "/var/run/netns/" + containerID,
+			IfName:      "eth0",
+			Args:        fmt.Sprintf("IgnoreUnknown=1;%s=default;%s=pod-%s", ArgPodNamespace, ArgPodName, containerID),
+			NodeID:      "node1",
+			StdinData:   stdin,
+		}
+	}
+
+	t.Run("ADD allocates from the daemon and DEL releases", func(t *testing.T) {
+		socketPath, pool, ipamStore := startDaemon(t)
+
+		result, cniErr := cmdAdd(newArgs("container-1", netConf(t, socketPath, nil)))
+		if cniErr != nil {
+			t.Fatalf("ADD failed: %v", cniErr)
+		}
+		if len(result.IPs) != 1 || result.IPs[0].Gateway == "" || len(result.Routes) != 1 {
+			t.Fatalf("Unexpected result %+v", result)
+		}
+		ip, ipNet, err := net.ParseCIDR(result.IPs[0].Address)
+		if err != nil || !ipNet.Contains(net.ParseIP(result.IPs[0].Gateway)) {
+			t.Fatalf("Unexpected address %s with gateway %s", result.IPs[0].Address, result.IPs[0].Gateway)
+		}
+
+		mapping, err := ipamStore.GetIPMapping("container-1", "eth0")
+		if err != nil {
+			t.Fatalf("Expected a mapping for container-1: %v", err)
+		}
+		if !mapping.HasIP(ip.String()) || mapping.NodeID != "node1" || mapping.Netns != "/var/run/netns/container-1" ||
+			mapping.PodName != "pod-container-1" || mapping.PodNamespace != "default" {
+			t.Errorf("Unexpected mapping %+v", mapping)
+		}
+
+		// kubelet retrying the ADD gets the same IP
+		retried, cniErr := cmdAdd(newArgs("container-1", netConf(t, socketPath, nil)))
+		if cniErr != nil || retried.IPs[0].Address != result.IPs[0].Address {
+			t.Fatalf("Expected retried ADD to return %s, got %+v (%v)", result.IPs[0].Address, retried, cniErr)
+		}
+
+		// A second container gets a different IP
+		second, cniErr := cmdAdd(newArgs("container-2", netConf(t, socketPath, nil)))
+		if cniErr != nil {
+			t.Fatalf("ADD failed: %v", cniErr)
+		}
+		if second.IPs[0].Address == result.IPs[0].Address {
+			t.Errorf("Expected distinct IPs, both got %s", second.IPs[0].Address)
+		}
+
+		// DEL needs no prevResult, the daemon looks the IP up by container
+		if cniErr := cmdDel(newArgs("container-1", netConf(t, socketPath, nil))); cniErr != nil {
+			t.Fatalf("DEL failed: %v", cniErr)
+		}
+		if _, err := ipamStore.GetIPMapping("container-1", "eth0"); err == nil {
+			t.Error("Expected mapping for container-1 to be deleted")
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP after DEL, got %d", stats.UsedIPs)
+		}
+
+		// Repeating the DEL succeeds
+		if cniErr := cmdDel(newArgs("container-1", netConf(t, socketPath, nil))); cniErr != nil {
+			t.Errorf("Repeated DEL failed: %v", cniErr)
+		}
+	})
+
+	t.Run("DEL releases the IP of prevResult without a store", func(t *testing.T) {
+		socketPath, pool := serveDaemon(t, nil)
+
+		result, cniErr := cmdAdd(newArgs("container-1", netConf(t, socketPath, nil)))
+		if cniErr != nil {
+			t.Fatalf("ADD failed: %v", cniErr)
+		}
+
+		// Without a prevResult there is nothing to release, but DEL succeeds
+		if cniErr := cmdDel(newArgs("container-1", netConf(t, socketPath, nil))); cniErr != nil {
+			t.Fatalf("DEL without prevResult failed: %v", cniErr)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected the IP to stay allocated, got %d used", stats.UsedIPs)
+		}
+
+		if cniErr := cmdDel(newArgs("container-1", netConf(t, socketPath, result))); cniErr != nil {
+			t.Fatalf("DEL failed: %v", cniErr)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 0 {
+			t.Errorf("Expected %s to be released, got %d used", result.IPs[0].Address, stats.UsedIPs)
+		}
+
+		// Repeating the DEL succeeds
+		if cniErr := cmdDel(newArgs("container-1", netConf(t, socketPath, result))); cniErr != nil {
+			t.Errorf("Repeated DEL failed: %v", cniErr)
+		}
+	})
+
+	t.Run("Each interface of a container gets its own IP", func(t *testing.T) {
+		socketPath, pool, ipamStore := startDaemon(t)
+
+		eth0, cniErr := cmdAdd(newArgs("container-1", netConf(t, socketPath, nil)))
+		if cniErr != nil {
+			t.Fatalf("ADD for eth0 failed: %v", cniErr)
+		}
+		args := newArgs("container-1", netConf(t, socketPath, nil))
+		args.IfName = "net1"
+		net1, cniErr := cmdAdd(args)
+		if cniErr != nil {
+			t.Fatalf("ADD for net1 failed: %v", cniErr)
+		}
+		if eth0.IPs[0].Address == net1.IPs[0].Address {
+			t.Errorf("Expected distinct IPs, both interfaces got %s", eth0.IPs[0].Address)
+		}
+
+		// DEL of net1 leaves eth0 alone
+		if cniErr := cmdDel(args); cniErr != nil {
+			t.Fatalf("DEL failed: %v", cniErr)
+		}
+		mappings, err := ipamStore.ListMappingsByContainer("container-1")
+		if err != nil || len(mappings) != 1 || mappings[0].IfName != "eth0" {
+			t.Errorf("Expected only eth0 to be left, got %+v (%v)", mappings, err)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP after DEL, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("ADD allocates the requested IP", func(t *testing.T) {
+		socketPath, pool, _ := startDaemon(t)
+		pool.AllocateBlockCIDRForNode("node1", "10.244.9.0/24")
+
+		args := newArgs("container-1", netConf(t, socketPath, nil))
+		args.Args += ";" + ArgIP + "=10.244.9.20"
+		result, cniErr := cmdAdd(args)
+		if cniErr != nil || result.IPs[0].Address != "10.244.9.20/24" {
+			t.Fatalf("Expected 10.244.9.20/24 from CNI_ARGS, got %+v (%v)", result, cniErr)
+		}
+
+		// The ips capability wins over CNI_ARGS
+		var conf cni.NetConf
+		json.Unmarshal(netConf(t, socketPath, nil), &conf)
+		conf.RuntimeConfig = &cni.RuntimeConfig{IPs: []string{"10.244.9.30/24"}}
+		stdin, _ := json.Marshal(&conf)
+		args = newArgs("container-2", stdin)
+		args.Args += ";" + ArgIP + "=10.244.9.21"
+		result, cniErr = cmdAdd(args)
+		if cniErr != nil || result.IPs[0].Address != "10.244.9.30/24" {
+			t.Fatalf("Expected 10.244.9.30/24 from runtimeConfig, got %+v (%v)", result, cniErr)
+		}
+
+		// An IP in use is an error rather than another address
+		args = newArgs("container-3", netConf(t, socketPath, nil))
+		args.Args += ";" + ArgIP + "=10.244.9.20"
+		if _, cniErr := cmdAdd(args); cniErr == nil {
+			t.Error("Expected ADD of an IP in use to fail")
+		}
+
+		for _, value := range []string{"10.244.9.40,10.244.9.41", "not-an-ip"} {
+			args := newArgs("container-4", netConf(t, socketPath, nil))
+			args.Args += ";" + ArgIP + "=" + value
+			if _, cniErr := cmdAdd(args); cniErr == nil || cniErr.Code != cni.ErrCodeInvalidNetworkConfig {
+				t.Errorf("%s: expected invalid network config, got %v", value, cniErr)
+			}
+		}
+	})
+
+	t.Run("ADD requires the runtime environment", func(t *testing.T) {
+		args := newArgs("container-1", netConf(t, "/nonexistent.sock", nil))
+		args.Netns = ""
+
+		if _, cniErr := cmdAdd(args); cniErr == nil || cniErr.Code != cni.ErrCodeInvalidEnvironmentVar {
+			t.Errorf("Expected invalid environment error, got %v", cniErr)
+		}
+	})
+
+	t.Run("Unreachable daemon asks the runtime to retry", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "missing.sock")
+
+		if _, cniErr := cmdAdd(newArgs("container-1", netConf(t, socketPath, nil))); cniErr == nil || cniErr.Code != cni.ErrCodeTryAgainLater {
+			t.Errorf("Expected try again later from ADD, got %v", cniErr)
+		}
+
+		if cniErr := cmdDel(newArgs("container-1", netConf(t, socketPath, nil))); cniErr == nil || cniErr.Code != cni.ErrCodeTryAgainLater {
+			t.Errorf("Expected try again later from DEL, got %v", cniErr)
+		}
+	})
+
+	t.Run("CNI_ARGS parsing", func(t *testing.T) {
+		args := parseArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=kube-system;K8S_POD_NAME=coredns-0;invalid")
+		if args[ArgPodNamespace] != "kube-system" || args[ArgPodName] != "coredns-0" || len(args) != 3 {
+			t.Errorf("Unexpected args %v", args)
+		}
+	})
+}
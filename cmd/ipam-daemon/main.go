@@ -7,9 +7,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/jianzi123/ipam/pkg/allocator"
 	"github.com/jianzi123/ipam/pkg/ipam"
 	"github.com/jianzi123/ipam/pkg/metrics"
 	"github.com/jianzi123/ipam/pkg/raft"
@@ -19,17 +22,39 @@ import (
 )
 
 var (
-	nodeID       = flag.String("node-id", "", "Unique node identifier")
-	bindAddr     = flag.String("bind-addr", "0.0.0.0:7000", "Raft bind address")
-	dataDir      = flag.String("data-dir", "/var/lib/ipam", "Data directory")
-	bootstrap    = flag.Bool("bootstrap", false, "Bootstrap new cluster")
-	joinAddr     = flag.String("join", "", "Address of node to join")
-	clusterCIDR  = flag.String("cluster-cidr", "10.244.0.0/16", "Cluster CIDR")
-	blockSize    = flag.Int("block-size", 24, "IP block size (CIDR prefix)")
-	grpcAddr     = flag.String("grpc-addr", "0.0.0.0:9090", "gRPC server address")
-	unixSocket   = flag.String("unix-socket", "/run/ipam/ipam.sock", "Unix socket path")
-	metricsAddr  = flag.String("metrics-addr", "0.0.0.0:2112", "Prometheus metrics address")
-	enableStore  = flag.Bool("enable-store", true, "Enable persistent IP mapping store")
+	nodeID        = flag.String("node-id", "", "Unique node identifier")
+	bindAddr      = flag.String("bind-addr", "0.0.0.0:7000", "Raft bind address")
+	advertiseAddr = flag.String("advertise-addr", "", "Raft address advertised to other nodes (defaults to bind address)")
+	dataDir       = flag.String("data-dir", "/var/lib/ipam", "Data directory")
+	bootstrap     = flag.Bool("bootstrap", false, "Bootstrap new cluster")
+	joinAddr      = flag.String("join", "", "Address of node to join")
+	peers         = flag.String("peers", "", "Comma-separated cluster peers to try when joining")
+	clusterCIDR   = flag.String("cluster-cidr", "10.244.0.0/16", "Cluster CIDR")
+	blockSize     = flag.Int("block-size", 24, "IP block size (CIDR prefix)")
+	gatewayMode   = flag.String("gateway", string(allocator.GatewayFirst), "Gateway address of each block: first, last, explicit (at --gateway-offset) or none")
+	gatewayOffset = flag.Int("gateway-offset", 0, "Offset of the gateway from the network address of each block, for --gateway=explicit")
+	reserved      = flag.String("reserved-offsets", "", "Comma-separated offsets of further addresses reserved in each block; negative ones count back from the broadcast address")
+	ipStrategy    = flag.String("ip-strategy", string(allocator.StrategyLowest), "Which free IP of a block is allocated next: lowest, next-fit, random or hash (of the container ID)")
+	strategySeed  = flag.Int64("ip-strategy-seed", 0, "Seed of the random IP selection strategy")
+	quarantine    = flag.Duration("release-quarantine", allocator.DefaultQuarantine, "How long a released IP waits before it is reused, unless its block is otherwise full (0 reuses it at once)")
+	grpcAddr      = flag.String("grpc-addr", "0.0.0.0:9090", "gRPC server address")
+	unixSocket    = flag.String("unix-socket", "/run/ipam/ipam.sock", "Unix socket path")
+	metricsAddr   = flag.String("metrics-addr", "0.0.0.0:2112", "Prometheus metrics address")
+	enableStore   = flag.Bool("enable-store", true, "Enable the IP mapping store")
+	storeBackend  = flag.String("store-backend", string(store.BackendBolt), "IP mapping store backend: bolt, or memory for ephemeral single-node setups")
+	logFormat     = flag.String("log-format", string(raft.LogFormatBinary), "Encoding of new Raft log entries: binary, or json during rolling upgrades")
+	leaseTTL      = flag.Duration("lease-ttl", raft.DefaultLeaseTTL, "How long a node lease renewal stays valid")
+	leaseGrace    = flag.Duration("lease-grace-period", raft.DefaultLeaseGracePeriod, "Time after lease expiry before a node's blocks are reclaimed (negative disables)")
+	pinNodes      = flag.String("pin-nodes", "", "Comma-separated nodes whose blocks are never reclaimed")
+	batchInterval = flag.Duration("batch-interval", raft.DefaultBatchInterval, "Interval for batching IP usage updates through Raft")
+	gcLister      = flag.String("gc-lister", "", "Source of live containers for IP mapping garbage collection: file, netns, or empty to disable")
+	gcLivePath    = flag.String("gc-live-path", "", "File or directory listing live container IDs, for the file lister")
+	gcNetnsRoot   = flag.String("gc-netns-root", "", "Prefix for network namespace paths, for the netns lister")
+	gcInterval    = flag.Duration("gc-interval", server.DefaultGCInterval, "Interval between IP mapping garbage collection passes")
+	gcMinAge      = flag.Duration("gc-min-age", server.DefaultGCMinAge, "Age below which IP mappings are never garbage collected")
+	gcDryRun      = flag.Bool("gc-dry-run", false, "Log stale IP mappings without releasing them")
+	audit         = flag.Bool("audit", true, "Record allocation changes in the store's audit log")
+	auditMaxAge   = flag.Duration("audit-retention", store.DefaultAuditRetention, "How long audit log events are kept")
 )
 
 func main() {
@@ -52,9 +77,36 @@ func main() {
 	log.Printf("  Block Size: /%d", *blockSize)
 
 	// Create IP pool
+	gateway, err := allocator.ParseGatewayMode(*gatewayMode)
+	if err != nil {
+		log.Fatalf("Invalid gateway: %v", err)
+	}
+	var reservedOffsets []int
+	for _, item := range splitList(*reserved) {
+		offset, err := strconv.Atoi(item)
+		if err != nil {
+			log.Fatalf("Invalid reserved offset %q: %v", item, err)
+		}
+		reservedOffsets = append(reservedOffsets, offset)
+	}
+	strategy, err := allocator.ParseStrategy(*ipStrategy)
+	if err != nil {
+		log.Fatalf("Invalid IP strategy: %v", err)
+	}
+
 	pool, err := ipam.NewPool(ipam.PoolConfig{
 		ClusterCIDR: *clusterCIDR,
 		BlockSize:   *blockSize,
+		Reservation: allocator.Reservation{
+			Gateway:       gateway,
+			GatewayOffset: *gatewayOffset,
+			Offsets:       reservedOffsets,
+		},
+		Selection: allocator.Selection{
+			Strategy: strategy,
+			Seed:     *strategySeed,
+		},
+		Quarantine: *quarantine,
 	})
 	if err != nil {
 		log.Fatalf("Failed to create IP pool: %v", err)
@@ -62,14 +114,20 @@ func main() {
 
 	// Create Raft node
 	raftNode, err := raft.NewNode(&raft.NodeConfig{
-		NodeID:    *nodeID,
-		BindAddr:  *bindAddr,
-		DataDir:   *dataDir,
-		Bootstrap: *bootstrap,
-		JoinAddr:  *joinAddr,
+		NodeID:           *nodeID,
+		BindAddr:         *bindAddr,
+		AdvertiseAddr:    *advertiseAddr,
+		DataDir:          *dataDir,
+		Bootstrap:        *bootstrap,
+		JoinAddr:         *joinAddr,
+		Peers:            splitList(*peers),
 		HeartbeatTimeout: 1 * time.Second,
 		ElectionTimeout:  1 * time.Second,
 		CommitTimeout:    1 * time.Second,
+		BatchInterval:    *batchInterval,
+		LogFormat:        raft.LogFormat(*logFormat),
+		LeaseTTL:         *leaseTTL,
+		LeaseGracePeriod: *leaseGrace,
 	}, pool)
 	if err != nil {
 		log.Fatalf("Failed to create Raft node: %v", err)
@@ -94,15 +152,33 @@ func main() {
 		log.Printf("Leader is: %s", raftNode.Leader())
 	}
 
-	// Initialize persistent store if enabled
-	var ipamStore *store.Store
+	// Pin nodes whose blocks must survive lease expiry
+	for _, pinned := range splitList(*pinNodes) {
+		if err := raftNode.PinNode(pinned, true); err != nil {
+			log.Printf("Warning: failed to pin node %s: %v", pinned, err)
+		} else {
+			log.Printf("Pinned node %s", pinned)
+		}
+	}
+
+	// Initialize IP mapping store if enabled
+	var ipamStore store.MappingStore
 	if *enableStore {
+		backend, err := store.ParseBackend(*storeBackend)
+		if err != nil {
+			log.Fatalf("Invalid store backend: %v", err)
+		}
+
 		storePath := fmt.Sprintf("%s/ipam.db", *dataDir)
-		ipamStore, err = store.NewStore(storePath)
+		ipamStore, err = store.Open(backend, storePath)
 		if err != nil {
 			log.Printf("Warning: failed to create store: %v", err)
 		} else {
-			log.Printf("Persistent store initialized at %s", storePath)
+			if backend == store.BackendMemory {
+				log.Printf("In-memory store initialized, IP mappings are lost on restart")
+			} else {
+				log.Printf("Persistent store initialized at %s", storePath)
+			}
 			defer ipamStore.Close()
 		}
 	}
@@ -128,6 +204,14 @@ func main() {
 
 	// Create gRPC server
 	grpcServer := server.NewServer(pool, raftNode, ipamStore)
+	grpcServer.GetIPAMServer().SetAudit(*audit)
+	grpcServer.GetIPAMServer().SetNodeID(*nodeID)
+
+	// Drop audit events past their retention
+	if ipamStore != nil && *audit {
+		go pruneAudit(ipamStore, *auditMaxAge)
+		log.Printf("Audit log enabled, keeping events for %s", *auditMaxAge)
+	}
 
 	// Start gRPC server on Unix socket
 	go func() {
@@ -145,13 +229,62 @@ func main() {
 		}
 	}()
 
+	// Replay stored mappings once the pool has caught up with the cluster;
+	// allocations are refused until then
+	if ipamStore != nil {
+		for {
+			err := raftNode.WaitForSync(30 * time.Second)
+			if err == nil {
+				break
+			}
+			log.Printf("Warning: waiting for Raft to catch up: %v", err)
+		}
+
+		report, err := grpcServer.GetIPAMServer().Reconcile()
+		if err != nil {
+			log.Fatalf("Failed to reconcile IP mappings: %v", err)
+		}
+		log.Printf("Restored %d IPs from the store", report.Restored)
+		for _, orphan := range report.Orphaned {
+			log.Printf("Warning: IP %s of container %s interface %q on node %s is outside any known block: %v",
+				orphan.IP, orphan.Mapping.ContainerID, orphan.Mapping.IfName, orphan.Mapping.NodeID, orphan.Reason)
+		}
+
+		// Release the IPs of containers that are gone
+		if *gcLister != "" {
+			var lister server.ContainerLister
+			switch *gcLister {
+			case "file":
+				if *gcLivePath == "" {
+					log.Fatalf("--gc-live-path is required by the file lister")
+				}
+				lister = &server.FileLister{Path: *gcLivePath}
+			case "netns":
+				lister = &server.NetnsLister{Root: *gcNetnsRoot}
+			default:
+				log.Fatalf("Unknown garbage collection lister %q", *gcLister)
+			}
+
+			gc := server.NewGarbageCollector(grpcServer.GetIPAMServer(), server.GCConfig{
+				NodeID:   *nodeID,
+				Lister:   lister,
+				Interval: *gcInterval,
+				MinAge:   *gcMinAge,
+				DryRun:   *gcDryRun,
+			})
+			gc.Start()
+			defer gc.Stop()
+			log.Printf("IP mapping garbage collection started (lister: %s, dry run: %v)", *gcLister, *gcDryRun)
+		}
+	}
+
 	// Print initial pool stats
 	stats := pool.GetStats()
 	log.Printf("Pool initialized: %s", stats.String())
 
-	// Example: Allocate a block for this node (for testing)
-	if raftNode.IsLeader() {
-		log.Printf("Allocating test block for node: %s", *nodeID)
+	// Pre-allocate a block for this node, followers forward to the leader
+	if _, err := pool.GetNodeBlocks(*nodeID); err != nil {
+		log.Printf("Allocating initial block for node: %s", *nodeID)
 		blockInfo, err := raftNode.AllocateBlock(*nodeID)
 		if err != nil {
 			log.Printf("Failed to allocate block: %v", err)
@@ -183,3 +316,31 @@ func main() {
 
 	log.Printf("Shutdown complete")
 }
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// pruneAudit deletes audit events older than retention, once at start and
+// then hourly
+func pruneAudit(auditLog store.AuditLog, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := auditLog.PruneAudit(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Warning: failed to prune audit log: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Pruned %d audit events older than %s", deleted, retention)
+		}
+		<-ticker.C
+	}
+}
@@ -3,45 +3,97 @@ package allocator
 import (
 	"errors"
 	"fmt"
+	"math/bits"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
 var (
-	ErrNoAvailableIP = errors.New("no available IP in the block")
-	ErrInvalidIP     = errors.New("invalid IP address")
-	ErrIPNotInBlock  = errors.New("IP not in this block")
+	ErrNoAvailableIP  = errors.New("no available IP in the block")
+	ErrInvalidIP      = errors.New("invalid IP address")
+	ErrIPNotInBlock   = errors.New("IP not in this block")
+	ErrIPNotAllocated = errors.New("IP not allocated")
+	ErrIPReserved     = errors.New("IP is reserved")
+	ErrIPInUse        = errors.New("IP already in use")
 )
 
 // IPBlock represents an IP address block allocated to a node
 type IPBlock struct {
 	CIDR      *net.IPNet
 	NodeID    string
-	Total     int       // Total usable IPs
-	Used      int       // Used IP count
+	Gateway   net.IP // Nil if the block has no gateway
+	Total     int    // Total allocatable IPs, excluding reserved ones
+	Used      int    // Used IP count
 	CreatedAt time.Time
-	bitmap    *Bitmap   // Internal bitmap for fast allocation
+	bitmap    *Bitmap    // Internal bitmap for fast allocation
+	reserved  []int      // Sorted positions set in the bitmap but never allocated
+	selection Selection  // How the next address is picked
+	cursor    int        // Position next-fit searches from
+	draws     uint64     // Number of random positions drawn
+	released  quarantine // Released positions cooling down before reuse
 	mu        sync.RWMutex
 }
 
 // Bitmap represents a bitmap for IP allocation
-// Uses uint64 array for efficient bit operations
+// Uses uint64 array for efficient bit operations, summarized in two levels
+// so a search skips full words 4096 at a time
 type Bitmap struct {
 	bits      []uint64
-	size      int // Total number of bits
-	allocated int // Number of allocated bits
+	free      []uint64 // Bit i is set while word i of bits has a free bit
+	freeTop   []uint64 // Bit i is set while word i of free is non-zero
+	size      int      // Total number of bits
+	allocated int      // Number of allocated bits
 }
 
 // NewBitmap creates a new bitmap with given size
 func NewBitmap(size int) *Bitmap {
 	// Calculate number of uint64 needed
 	n := (size + 63) / 64
-	return &Bitmap{
+	b := &Bitmap{
 		bits:      make([]uint64, n),
 		size:      size,
 		allocated: 0,
 	}
+	b.buildSummary()
+	return b
+}
+
+// buildSummary rebuilds both summary levels from the bit words
+func (b *Bitmap) buildSummary() {
+	b.free = make([]uint64, (len(b.bits)+63)/64)
+	b.freeTop = make([]uint64, (len(b.free)+63)/64)
+	for idx := range b.bits {
+		b.updateSummary(idx)
+	}
+}
+
+// paddedWord returns a bit word with the bits beyond size set, so they count
+// as allocated
+func (b *Bitmap) paddedWord(idx int) uint64 {
+	word := b.bits[idx]
+	if tail := b.size % 64; tail != 0 && idx == len(b.bits)-1 {
+		word |= ^uint64(0) << uint(tail)
+	}
+	return word
+}
+
+// updateSummary refreshes the summary bits of a word after it changed
+func (b *Bitmap) updateSummary(idx int) {
+	mid, bit := idx/64, uint(idx%64)
+	if b.paddedWord(idx) != ^uint64(0) {
+		b.free[mid] |= 1 << bit
+	} else {
+		b.free[mid] &^= 1 << bit
+	}
+
+	top, bit := mid/64, uint(mid%64)
+	if b.free[mid] != 0 {
+		b.freeTop[top] |= 1 << bit
+	} else {
+		b.freeTop[top] &^= 1 << bit
+	}
 }
 
 // Set marks a bit as allocated
@@ -60,6 +112,7 @@ func (b *Bitmap) Set(pos int) error {
 
 	b.bits[idx] |= (1 << bit)
 	b.allocated++
+	b.updateSummary(idx)
 	return nil
 }
 
@@ -79,6 +132,7 @@ func (b *Bitmap) Clear(pos int) error {
 
 	b.bits[idx] &^= (1 << bit)
 	b.allocated--
+	b.updateSummary(idx)
 	return nil
 }
 
@@ -96,23 +150,77 @@ func (b *Bitmap) IsSet(pos int) bool {
 // FindFirstZero finds the first unallocated bit
 // Returns -1 if no free bit is found
 func (b *Bitmap) FindFirstZero() int {
-	for i := 0; i < len(b.bits); i++ {
-		if b.bits[i] != ^uint64(0) { // Not all bits are set
-			// Find first zero bit in this uint64
-			for j := 0; j < 64; j++ {
-				pos := i*64 + j
-				if pos >= b.size {
-					return -1
-				}
-				if !b.IsSet(pos) {
-					return pos
-				}
-			}
+	// Each level points at a word of the next one that has a free bit
+	for top, summary := range b.freeTop {
+		if summary == 0 {
+			continue
+		}
+		return b.firstZeroInTop(top)
+	}
+	return -1
+}
+
+// FindNextZero finds the first unallocated bit at or after start, wrapping
+// around to the beginning
+// Returns -1 if no free bit is found
+func (b *Bitmap) FindNextZero(start int) int {
+	if start <= 0 || start >= b.size {
+		return b.FindFirstZero()
+	}
+	if pos := b.findZeroFrom(start); pos >= 0 {
+		return pos
+	}
+	return b.FindFirstZero()
+}
+
+// findZeroFrom finds the first unallocated bit at or after start without
+// wrapping, moving up the summary levels only past full regions
+func (b *Bitmap) findZeroFrom(start int) int {
+	// Bits before start count as allocated
+	idx := start / 64
+	if word := b.paddedWord(idx) | (1<<uint(start%64) - 1); word != ^uint64(0) {
+		return idx*64 + bits.TrailingZeros64(^word)
+	}
+
+	// A later word summarized in the same summary word
+	idx++
+	mid := idx / 64
+	if mid < len(b.free) {
+		if summary := b.free[mid] &^ (1<<uint(idx%64) - 1); summary != 0 {
+			return b.firstZeroInWord(mid*64 + bits.TrailingZeros64(summary))
+		}
+	}
+
+	// A later summary word in the same top word
+	mid++
+	top := mid / 64
+	if top < len(b.freeTop) {
+		if summary := b.freeTop[top] &^ (1<<uint(mid%64) - 1); summary != 0 {
+			mid = top*64 + bits.TrailingZeros64(summary)
+			return b.firstZeroInWord(mid*64 + bits.TrailingZeros64(b.free[mid]))
+		}
+	}
+
+	for top++; top < len(b.freeTop); top++ {
+		if b.freeTop[top] != 0 {
+			return b.firstZeroInTop(top)
 		}
 	}
 	return -1
 }
 
+// firstZeroInTop returns the first unallocated bit under a non-zero top
+// summary word
+func (b *Bitmap) firstZeroInTop(top int) int {
+	mid := top*64 + bits.TrailingZeros64(b.freeTop[top])
+	return b.firstZeroInWord(mid*64 + bits.TrailingZeros64(b.free[mid]))
+}
+
+// firstZeroInWord returns the first unallocated bit of a word with one
+func (b *Bitmap) firstZeroInWord(idx int) int {
+	return idx*64 + bits.TrailingZeros64(^b.bits[idx])
+}
+
 // Count returns number of allocated bits
 func (b *Bitmap) Count() int {
 	return b.allocated
@@ -123,8 +231,44 @@ func (b *Bitmap) Available() int {
 	return b.size - b.allocated
 }
 
+// Words returns a copy of the underlying bit words
+func (b *Bitmap) Words() []uint64 {
+	words := make([]uint64, len(b.bits))
+	copy(words, b.bits)
+	return words
+}
+
+// NewBitmapFromWords rebuilds a bitmap of the given size from its bit words
+// The allocated count is recomputed from the words
+func NewBitmapFromWords(size int, words []uint64) (*Bitmap, error) {
+	b := NewBitmap(size)
+	if len(words) != len(b.bits) {
+		return nil, fmt.Errorf("bitmap of size %d needs %d words, got %d", size, len(b.bits), len(words))
+	}
+
+	copy(b.bits, words)
+
+	// Bits beyond size must never be set
+	if tail := size % 64; tail != 0 && b.bits[len(b.bits)-1]>>uint(tail) != 0 {
+		return nil, fmt.Errorf("bitmap has bits set beyond size %d", size)
+	}
+
+	for _, w := range b.bits {
+		b.allocated += bits.OnesCount64(w)
+	}
+	b.buildSummary()
+	return b, nil
+}
+
 // NewIPBlock creates a new IP block from CIDR
+// The first usable address is reserved as the gateway
 func NewIPBlock(cidr string, nodeID string) (*IPBlock, error) {
+	return NewIPBlockWithReservation(cidr, nodeID, Reservation{})
+}
+
+// NewIPBlockWithReservation creates a new IP block from CIDR whose reserved
+// addresses are never allocated
+func NewIPBlockWithReservation(cidr string, nodeID string, reservation Reservation) (*IPBlock, error) {
 	_, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid CIDR %s: %w", cidr, err)
@@ -141,24 +285,147 @@ func NewIPBlock(cidr string, nodeID string) (*IPBlock, error) {
 		return nil, fmt.Errorf("CIDR %s has no usable IPs", cidr)
 	}
 
-	return &IPBlock{
+	block := &IPBlock{
 		CIDR:      ipNet,
 		NodeID:    nodeID,
-		Total:     usable,
 		Used:      0,
 		CreatedAt: time.Now(),
 		bitmap:    NewBitmap(usable),
-	}, nil
+	}
+	if err := block.reserve(reservation); err != nil {
+		return nil, fmt.Errorf("invalid reservation for CIDR %s: %w", cidr, err)
+	}
+	return block, nil
+}
+
+// reserve sets the reserved positions aside in the bitmap
+// A reserved position a pod already holds stays set but counts as reserved
+// from now on: it leaves Used, and releasing it returns ErrIPReserved
+func (block *IPBlock) reserve(reservation Reservation) error {
+	if err := reservation.Validate(block.bitmap.size); err != nil {
+		return err
+	}
+
+	reserved, gateway, err := reservation.positions(block.bitmap.size)
+	if err != nil {
+		return err
+	}
+
+	for _, pos := range reserved {
+		if !block.bitmap.IsSet(pos) {
+			block.bitmap.Set(pos)
+		}
+	}
+
+	block.reserved = reserved
+	block.Total = block.bitmap.size - len(reserved)
+	block.Used = block.bitmap.Count() - len(reserved)
+	block.Gateway = nil
+	if gateway >= 0 {
+		block.Gateway = block.positionToIP(gateway)
+	}
+	return nil
+}
+
+// isReserved reports whether a position is reserved
+// Must be called with lock held
+func (block *IPBlock) isReserved(pos int) bool {
+	i := sort.SearchInts(block.reserved, pos)
+	return i < len(block.reserved) && block.reserved[i] == pos
+}
+
+// Reserved returns the reserved addresses of the block
+func (block *IPBlock) Reserved() []net.IP {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	ips := make([]net.IP, len(block.reserved))
+	for i, pos := range block.reserved {
+		ips[i] = block.positionToIP(pos)
+	}
+	return ips
+}
+
+// BlockSnapshot is a serializable copy of an IPBlock's state
+// Reserved addresses are set in the bitmap, so replicas that predate
+// reservations treat them as allocated
+type BlockSnapshot struct {
+	CIDR      string    `json:"cidr"`
+	NodeID    string    `json:"node_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Bitmap    []uint64  `json:"bitmap"`
+}
+
+// Snapshot returns a point-in-time copy of the block state
+func (block *IPBlock) Snapshot() BlockSnapshot {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	return BlockSnapshot{
+		CIDR:      block.CIDR.String(),
+		NodeID:    block.NodeID,
+		CreatedAt: block.CreatedAt,
+		Bitmap:    block.bitmap.Words(),
+	}
+}
+
+// RestoreIPBlock rebuilds an IP block from a snapshot, reserving the
+// addresses of reservation
+// Snapshots taken before an address was reserved get it set aside, even if
+// a pod holds it; the pod keeps the address, which is never handed out again
+func RestoreIPBlock(snap BlockSnapshot, reservation Reservation) (*IPBlock, error) {
+	block, err := NewIPBlockWithReservation(snap.CIDR, snap.NodeID, reservation)
+	if err != nil {
+		return nil, err
+	}
+
+	bitmap, err := NewBitmapFromWords(block.bitmap.size, snap.Bitmap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitmap for block %s: %w", snap.CIDR, err)
+	}
+
+	block.bitmap = bitmap
+	block.CreatedAt = snap.CreatedAt
+	if err := block.reserve(reservation); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// RestoreIPBlockFrom rebuilds an IP block from a snapshot taken under the
+// reservation previous, freeing the addresses only previous reserved
+// Addresses only reservation sets aside are reserved as RestoreIPBlock does,
+// including one a pod holds
+func RestoreIPBlockFrom(snap BlockSnapshot, previous, reservation Reservation) (*IPBlock, error) {
+	block, err := RestoreIPBlock(snap, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reserved positions are never handed out, so their bits are not pods
+	for _, pos := range block.reserved {
+		block.bitmap.Clear(pos)
+	}
+	if err := block.reserve(reservation); err != nil {
+		return nil, fmt.Errorf("invalid reservation for CIDR %s: %w", snap.CIDR, err)
+	}
+	return block, nil
 }
 
 // Allocate allocates an IP from the block
 // Returns the allocated IP address
 func (block *IPBlock) Allocate() (net.IP, error) {
+	return block.AllocateFor("")
+}
+
+// AllocateFor allocates an IP from the block for a container, whose ID the
+// hash strategy picks the address from
+func (block *IPBlock) AllocateFor(key string) (net.IP, error) {
 	block.mu.Lock()
 	defer block.mu.Unlock()
 
-	// Find first available position
-	pos := block.bitmap.FindFirstZero()
+	// Find an available position as the selection strategy says
+	pos := block.pick(key)
 	if pos == -1 {
 		return nil, ErrNoAvailableIP
 	}
@@ -176,8 +443,46 @@ func (block *IPBlock) Allocate() (net.IP, error) {
 	return ip, nil
 }
 
+// AllocateSpecific allocates a particular IP of the block
+// Returns ErrIPNotInBlock outside the block, ErrIPReserved for a reserved,
+// network or broadcast address and ErrIPInUse if it is already allocated
+// A quarantined IP asked for by address is handed out
+func (block *IPBlock) AllocateSpecific(ip net.IP) error {
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	if ip == nil {
+		return ErrInvalidIP
+	}
+	if !block.CIDR.Contains(ip) {
+		return ErrIPNotInBlock
+	}
+
+	pos := block.ipToPosition(ip)
+	if pos < 0 || pos >= block.bitmap.size || block.isReserved(pos) {
+		return ErrIPReserved
+	}
+	if block.bitmap.IsSet(pos) {
+		return ErrIPInUse
+	}
+
+	if err := block.bitmap.Set(pos); err != nil {
+		return err
+	}
+
+	block.released.remove(pos)
+	block.Used++
+	return nil
+}
+
 // Release releases an IP back to the block
 func (block *IPBlock) Release(ip net.IP) error {
+	return block.ReleaseFor(ip, "")
+}
+
+// ReleaseFor releases an IP a container held back to the block
+// The hash strategy lets that container take it back during the quarantine
+func (block *IPBlock) ReleaseFor(ip net.IP, key string) error {
 	block.mu.Lock()
 	defer block.mu.Unlock()
 
@@ -188,19 +493,90 @@ func (block *IPBlock) Release(ip net.IP) error {
 
 	// Convert IP to position
 	pos := block.ipToPosition(ip)
-	if pos < 0 || pos >= block.Total {
+	if pos < 0 || pos >= block.bitmap.size {
 		return ErrInvalidIP
 	}
 
+	if block.isReserved(pos) {
+		return ErrIPReserved
+	}
+	if !block.bitmap.IsSet(pos) {
+		return ErrIPNotAllocated
+	}
+
 	// Clear the bit
 	if err := block.bitmap.Clear(pos); err != nil {
 		return err
 	}
 
+	block.Used--
+	block.released.add(pos, key)
+	return nil
+}
+
+// MarkAllocated marks a specific IP as allocated
+// Marking an IP that is already allocated is a no-op so replayed updates are idempotent
+func (block *IPBlock) MarkAllocated(ip net.IP) error {
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	pos, err := block.position(ip)
+	if err != nil {
+		return err
+	}
+
+	// Reserved IPs are already set aside
+	if block.bitmap.IsSet(pos) {
+		return nil
+	}
+
+	if err := block.bitmap.Set(pos); err != nil {
+		return err
+	}
+
+	block.released.remove(pos)
+	block.Used++
+	return nil
+}
+
+// MarkReleased marks a specific IP as free
+// Marking an IP that is already free is a no-op so replayed updates are idempotent
+func (block *IPBlock) MarkReleased(ip net.IP) error {
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	pos, err := block.position(ip)
+	if err != nil {
+		return err
+	}
+
+	// Reserved IPs stay set aside
+	if !block.bitmap.IsSet(pos) || block.isReserved(pos) {
+		return nil
+	}
+
+	if err := block.bitmap.Clear(pos); err != nil {
+		return err
+	}
+
 	block.Used--
 	return nil
 }
 
+// position validates an IP and returns its bitmap position
+// Must be called with lock held
+func (block *IPBlock) position(ip net.IP) (int, error) {
+	if !block.CIDR.Contains(ip) {
+		return -1, ErrIPNotInBlock
+	}
+
+	pos := block.ipToPosition(ip)
+	if pos < 0 || pos >= block.bitmap.size {
+		return -1, ErrInvalidIP
+	}
+	return pos, nil
+}
+
 // Contains checks if an IP is in this block and allocated
 func (block *IPBlock) Contains(ip net.IP) bool {
 	block.mu.RLock()
@@ -211,7 +587,7 @@ func (block *IPBlock) Contains(ip net.IP) bool {
 	}
 
 	pos := block.ipToPosition(ip)
-	return block.bitmap.IsSet(pos)
+	return block.bitmap.IsSet(pos) && !block.isReserved(pos)
 }
 
 // Available returns number of available IPs
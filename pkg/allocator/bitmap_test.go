@@ -1,10 +1,49 @@
 package allocator
 
 import (
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"testing"
 )
 
+// linearFindFirstZero is the search the summary index replaced, scanning
+// every word from the start and then a word's bits one at a time; kept as a
+// reference for tests and benchmarks
+func linearFindFirstZero(b *Bitmap) int {
+	for i := 0; i < len(b.bits); i++ {
+		if b.bits[i] != ^uint64(0) {
+			for j := 0; j < 64; j++ {
+				pos := i*64 + j
+				if pos >= b.size {
+					return -1
+				}
+				if !b.IsSet(pos) {
+					return pos
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// nearlyFullBitmap returns a bitmap of size bits whose only free bit is the
+// last one
+func nearlyFullBitmap(size int) *Bitmap {
+	words := make([]uint64, (size+63)/64)
+	for i := range words {
+		words[i] = ^uint64(0)
+	}
+	if tail := size % 64; tail != 0 {
+		words[len(words)-1] = ^uint64(0) >> uint(64-tail)
+	}
+
+	bm, _ := NewBitmapFromWords(size, words)
+	bm.Clear(size - 1)
+	return bm
+}
+
 func TestBitmap(t *testing.T) {
 	t.Run("Basic operations", func(t *testing.T) {
 		bm := NewBitmap(100)
@@ -56,6 +95,91 @@ func TestBitmap(t *testing.T) {
 		}
 	})
 
+	t.Run("FindFirstZero skips full words", func(t *testing.T) {
+		// Sizes around the word and summary boundaries
+		for _, size := range []int{1, 63, 64, 65, 4095, 4096, 4097, 300000} {
+			bm := nearlyFullBitmap(size)
+			if pos := bm.FindFirstZero(); pos != size-1 {
+				t.Errorf("Size %d: expected first zero at %d, got %d", size, size-1, pos)
+			}
+
+			bm.Set(size - 1)
+			if pos := bm.FindFirstZero(); pos != -1 {
+				t.Errorf("Size %d: expected no zero in a full bitmap, got %d", size, pos)
+			}
+		}
+
+		if pos := NewBitmap(0).FindFirstZero(); pos != -1 {
+			t.Errorf("Expected no zero in an empty bitmap, got %d", pos)
+		}
+	})
+
+	t.Run("FindFirstZero matches a linear search", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		bm := NewBitmap(10000)
+
+		for i := 0; i < 50000; i++ {
+			pos := rng.Intn(bm.size)
+			if bm.IsSet(pos) {
+				bm.Clear(pos)
+			} else {
+				bm.Set(pos)
+			}
+
+			// Fill from the front now and then so the first zero moves far
+			if i%1000 == 0 {
+				for first := bm.FindFirstZero(); first >= 0 && first < 9000; first = bm.FindFirstZero() {
+					bm.Set(first)
+				}
+			}
+
+			if got, want := bm.FindFirstZero(), linearFindFirstZero(bm); got != want {
+				t.Fatalf("Step %d: expected first zero at %d, got %d", i, want, got)
+			}
+		}
+
+		restored, err := NewBitmapFromWords(bm.size, bm.Words())
+		if err != nil {
+			t.Fatalf("NewBitmapFromWords failed: %v", err)
+		}
+		if got, want := restored.FindFirstZero(), linearFindFirstZero(bm); got != want {
+			t.Errorf("Expected restored first zero at %d, got %d", want, got)
+		}
+	})
+
+	t.Run("FindNextZero wraps around", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(2))
+		for _, size := range []int{1, 64, 65, 4097, 70000} {
+			bm := NewBitmap(size)
+			for i := 0; i < size*9/10; i++ {
+				bm.Set(rng.Intn(size))
+			}
+
+			for i := 0; i < 200; i++ {
+				start := rng.Intn(size)
+				want := -1
+				for j := 0; j < size; j++ {
+					if pos := (start + j) % size; !bm.IsSet(pos) {
+						want = pos
+						break
+					}
+				}
+				if got := bm.FindNextZero(start); got != want {
+					t.Fatalf("Size %d: expected next zero from %d at %d, got %d", size, start, want, got)
+				}
+			}
+		}
+
+		bm := nearlyFullBitmap(130)
+		if pos := bm.FindNextZero(200); pos != 129 {
+			t.Errorf("Expected an out of range start to wrap to 129, got %d", pos)
+		}
+		bm.Set(129)
+		if pos := bm.FindNextZero(5); pos != -1 {
+			t.Errorf("Expected no zero in a full bitmap, got %d", pos)
+		}
+	})
+
 	t.Run("Available count", func(t *testing.T) {
 		bm := NewBitmap(100)
 
@@ -79,8 +203,12 @@ func TestIPBlock(t *testing.T) {
 			t.Fatalf("NewIPBlock failed: %v", err)
 		}
 
-		if block.Total != 254 {
-			t.Errorf("Expected 254 usable IPs, got %d", block.Total)
+		// 254 usable IPs, less the gateway
+		if block.Total != 253 {
+			t.Errorf("Expected 253 allocatable IPs, got %d", block.Total)
+		}
+		if !block.Gateway.Equal(net.ParseIP("10.244.1.1")) {
+			t.Errorf("Expected gateway 10.244.1.1, got %s", block.Gateway)
 		}
 		if block.NodeID != "node1" {
 			t.Errorf("Expected node1, got %s", block.NodeID)
@@ -90,13 +218,13 @@ func TestIPBlock(t *testing.T) {
 	t.Run("Allocate and release", func(t *testing.T) {
 		block, _ := NewIPBlock("10.244.1.0/24", "node1")
 
-		// Allocate first IP
+		// Allocate first IP, after the gateway
 		ip1, err := block.Allocate()
 		if err != nil {
 			t.Fatalf("Allocate failed: %v", err)
 		}
 
-		expectedIP := net.ParseIP("10.244.1.1")
+		expectedIP := net.ParseIP("10.244.1.2")
 		if !ip1.Equal(expectedIP) {
 			t.Errorf("Expected IP %s, got %s", expectedIP, ip1)
 		}
@@ -111,7 +239,7 @@ func TestIPBlock(t *testing.T) {
 			t.Fatalf("Second allocate failed: %v", err)
 		}
 
-		expectedIP2 := net.ParseIP("10.244.1.2")
+		expectedIP2 := net.ParseIP("10.244.1.3")
 		if !ip2.Equal(expectedIP2) {
 			t.Errorf("Expected IP %s, got %s", expectedIP2, ip2)
 		}
@@ -125,6 +253,14 @@ func TestIPBlock(t *testing.T) {
 			t.Errorf("Expected used count 1 after release, got %d", block.Used)
 		}
 
+		// Releasing a free IP leaves the count alone
+		if err := block.Release(ip1); !errors.Is(err, ErrIPNotAllocated) {
+			t.Errorf("Expected ErrIPNotAllocated on double release, got %v", err)
+		}
+		if block.Used != 1 {
+			t.Errorf("Expected used count 1 after double release, got %d", block.Used)
+		}
+
 		// Next allocation should reuse ip1
 		ip3, err := block.Allocate()
 		if err != nil {
@@ -136,6 +272,38 @@ func TestIPBlock(t *testing.T) {
 		}
 	})
 
+	t.Run("Allocate specific IP", func(t *testing.T) {
+		block, _ := NewIPBlock("10.244.1.0/24", "node1")
+
+		ip := net.ParseIP("10.244.1.100")
+		if err := block.AllocateSpecific(ip); err != nil {
+			t.Fatalf("AllocateSpecific failed: %v", err)
+		}
+		if !block.Contains(ip) || block.Used != 1 {
+			t.Errorf("Expected %s to be allocated, got %s", ip, block)
+		}
+
+		for _, c := range []struct {
+			ip  string
+			err error
+		}{
+			{"10.244.1.100", ErrIPInUse},
+			{"10.244.2.100", ErrIPNotInBlock},
+			{"10.244.1.1", ErrIPReserved},
+			{"10.244.1.0", ErrIPReserved},
+			{"10.244.1.255", ErrIPReserved},
+		} {
+			if err := block.AllocateSpecific(net.ParseIP(c.ip)); !errors.Is(err, c.err) {
+				t.Errorf("%s: expected %v, got %v", c.ip, c.err, err)
+			}
+		}
+
+		// Later allocations go around the claimed IP
+		if next, _ := block.Allocate(); !next.Equal(net.ParseIP("10.244.1.2")) {
+			t.Errorf("Expected 10.244.1.2, got %s", next)
+		}
+	})
+
 	t.Run("Contains check", func(t *testing.T) {
 		block, _ := NewIPBlock("10.244.1.0/24", "node1")
 
@@ -163,7 +331,7 @@ func TestIPBlock(t *testing.T) {
 		}
 
 		usage := block.Usage()
-		expectedUsage := 127.0 / 254.0
+		expectedUsage := 127.0 / 253.0
 		if usage < expectedUsage-0.01 || usage > expectedUsage+0.01 {
 			t.Errorf("Expected ~50%% usage, got %.2f%%", usage*100)
 		}
@@ -172,10 +340,10 @@ func TestIPBlock(t *testing.T) {
 	t.Run("Exhaust block", func(t *testing.T) {
 		// Use a small block for faster test
 		block, _ := NewIPBlock("10.244.1.0/29", "node1")
-		// /29 has 8 IPs total, 6 usable
+		// /29 has 8 IPs total, 6 usable, 5 besides the gateway
 
 		// Allocate all IPs
-		for i := 0; i < 6; i++ {
+		for i := 0; i < 5; i++ {
 			if _, err := block.Allocate(); err != nil {
 				t.Fatalf("Allocate %d failed: %v", i, err)
 			}
@@ -186,6 +354,52 @@ func TestIPBlock(t *testing.T) {
 			t.Errorf("Expected ErrNoAvailableIP, got %v", err)
 		}
 	})
+
+	t.Run("Snapshot and restore", func(t *testing.T) {
+		block, _ := NewIPBlock("10.244.1.0/24", "node1")
+
+		for i := 0; i < 70; i++ {
+			block.Allocate()
+		}
+		block.Release(net.ParseIP("10.244.1.5"))
+
+		restored, err := RestoreIPBlock(block.Snapshot(), Reservation{})
+		if err != nil {
+			t.Fatalf("RestoreIPBlock failed: %v", err)
+		}
+
+		if restored.Used != 69 {
+			t.Errorf("Expected used count 69, got %d", restored.Used)
+		}
+		if restored.NodeID != "node1" || !restored.CreatedAt.Equal(block.CreatedAt) {
+			t.Errorf("Restored block metadata mismatch: %s", restored)
+		}
+		if restored.Contains(net.ParseIP("10.244.1.5")) {
+			t.Error("Expected released IP to stay free after restore")
+		}
+
+		// Next allocation should fill the same hole as the original
+		ip, _ := restored.Allocate()
+		if !ip.Equal(net.ParseIP("10.244.1.5")) {
+			t.Errorf("Expected 10.244.1.5, got %s", ip)
+		}
+	})
+
+	t.Run("Restore rejects bad bitmap", func(t *testing.T) {
+		block, _ := NewIPBlock("10.244.1.0/24", "node1")
+		snap := block.Snapshot()
+
+		snap.Bitmap = snap.Bitmap[:1]
+		if _, err := RestoreIPBlock(snap, Reservation{}); err == nil {
+			t.Error("Expected error for truncated bitmap")
+		}
+
+		snap = block.Snapshot()
+		snap.Bitmap[len(snap.Bitmap)-1] = ^uint64(0)
+		if _, err := RestoreIPBlock(snap, Reservation{}); err == nil {
+			t.Error("Expected error for bits beyond block size")
+		}
+	})
 }
 
 func BenchmarkBitmapSet(b *testing.B) {
@@ -214,6 +428,45 @@ func BenchmarkBitmapFindFirstZero(b *testing.B) {
 	}
 }
 
+// BenchmarkBitmapFindFirstZeroNearlyFull compares the summary search with the
+// linear one on bitmaps whose only free bit is the last
+func BenchmarkBitmapFindFirstZeroNearlyFull(b *testing.B) {
+	for _, size := range []int{1 << 8, 1 << 16, 1 << 22} {
+		bm := nearlyFullBitmap(size)
+
+		b.Run(fmt.Sprintf("summary/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bm.FindFirstZero()
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearFindFirstZero(bm)
+			}
+		})
+	}
+}
+
+// BenchmarkBitmapFillLarge allocates every bit of a /96-sized bitmap in turn,
+// the pattern of a block filling up
+func BenchmarkBitmapFillLarge(b *testing.B) {
+	const size = 1 << 22
+
+	bm := NewBitmap(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pos := bm.FindFirstZero()
+		if pos == -1 {
+			b.StopTimer()
+			bm = NewBitmap(size)
+			b.StartTimer()
+			pos = bm.FindFirstZero()
+		}
+		bm.Set(pos)
+	}
+}
+
 func BenchmarkIPBlockAllocate(b *testing.B) {
 	block, _ := NewIPBlock("10.244.1.0/24", "node1")
 
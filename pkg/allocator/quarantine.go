@@ -0,0 +1,153 @@
+package allocator
+
+import (
+	"time"
+)
+
+// DefaultQuarantine is how long a released IP waits before it is reused, so
+// stale conntrack and ARP entries of the old pod expire first
+const DefaultQuarantine = 30 * time.Second
+
+// quarantine holds recently released positions of a block back from reuse
+// It is local state of the daemon allocating from the block: the bitmap
+// shows the positions free and snapshots leave them out, so other replicas
+// never see it and a restart ends every cool-down
+type quarantine struct {
+	coolDown time.Duration
+	until    map[int]time.Time // Released position -> end of its cool-down
+	keys     map[int]string    // Released position -> container that held it
+	now      func() time.Time  // Nil means time.Now
+}
+
+// clock returns the current time
+func (q *quarantine) clock() time.Time {
+	if q.now != nil {
+		return q.now()
+	}
+	return time.Now()
+}
+
+// add starts the cool-down of a position released by the container key
+func (q *quarantine) add(pos int, key string) {
+	if q.coolDown <= 0 {
+		return
+	}
+	if q.until == nil {
+		q.until = make(map[int]time.Time)
+		q.keys = make(map[int]string)
+	}
+	q.until[pos] = q.clock().Add(q.coolDown)
+	if key != "" {
+		q.keys[pos] = key
+	} else {
+		delete(q.keys, pos)
+	}
+}
+
+// remove ends the cool-down of a position
+func (q *quarantine) remove(pos int) {
+	delete(q.until, pos)
+	delete(q.keys, pos)
+}
+
+// holds reports whether a position is still cooling down at now for any
+// container but the one that released it
+func (q *quarantine) holds(pos int, key string, now time.Time) bool {
+	until, ok := q.until[pos]
+	if !ok || !now.Before(until) {
+		return false
+	}
+	return key == "" || q.keys[pos] != key
+}
+
+// expire drops the positions whose cool-down ended by now
+func (q *quarantine) expire(now time.Time) {
+	for pos, until := range q.until {
+		if !now.Before(until) {
+			q.remove(pos)
+		}
+	}
+}
+
+// count returns the number of positions still cooling down at now
+func (q *quarantine) count(now time.Time) int {
+	n := 0
+	for _, until := range q.until {
+		if now.Before(until) {
+			n++
+		}
+	}
+	return n
+}
+
+// SetQuarantine sets how long released IPs of the block wait before they are
+// allocated again, unless nothing else is free
+// Zero disables the quarantine and ends every current cool-down
+func (block *IPBlock) SetQuarantine(coolDown time.Duration) {
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	block.released.coolDown = coolDown
+	if coolDown <= 0 {
+		block.released.until = nil
+		block.released.keys = nil
+	}
+}
+
+// Quarantined returns the number of free IPs still cooling down
+// They are included in Available, since a block with nothing else free still
+// hands them out
+func (block *IPBlock) Quarantined() int {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	return block.released.count(block.released.clock())
+}
+
+// findFree returns the first free position at or after start, wrapping
+// around, that is not cooling down unless the container key released it
+// When every free position is cooling down it takes the one released first
+// Must be called with lock held
+func (block *IPBlock) findFree(start int, key string) int {
+	pos := block.bitmap.FindNextZero(start)
+	if pos < 0 || len(block.released.until) == 0 {
+		return pos
+	}
+
+	now := block.released.clock()
+	block.released.expire(now)
+
+	first, oldest := pos, -1
+	for block.released.holds(pos, key, now) {
+		if oldest < 0 || block.released.until[pos].Before(block.released.until[oldest]) {
+			oldest = pos
+		}
+		if pos = block.bitmap.FindNextZero(pos + 1); pos == first {
+			// Only quarantined addresses are left
+			pos = oldest
+			break
+		}
+	}
+
+	block.released.remove(pos)
+	return pos
+}
+
+// keepQuarantine carries over the cool-downs of positions still free from
+// the block a restore replaces
+// Must be called with both locks held
+func (block *IPBlock) keepQuarantine(from *IPBlock) {
+	block.released.until, block.released.keys = nil, nil
+	for pos, until := range from.released.until {
+		if pos < block.bitmap.size && !block.bitmap.IsSet(pos) {
+			if block.released.until == nil {
+				block.released.until = make(map[int]time.Time)
+				block.released.keys = make(map[int]string)
+			}
+			block.released.until[pos] = until
+			if key, ok := from.released.keys[pos]; ok {
+				block.released.keys[pos] = key
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package allocator
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	// newBlock returns a block with a cool-down of a minute and a clock the
+	// test moves by hand
+	newBlock := func(t *testing.T, cidr string) (*IPBlock, *time.Time) {
+		block, err := NewIPBlock(cidr, "node1")
+		if err != nil {
+			t.Fatalf("NewIPBlock failed: %v", err)
+		}
+		now := time.Date(2024, 5, 7, 9, 0, 0, 0, time.UTC)
+		block.released.now = func() time.Time { return now }
+		block.SetQuarantine(time.Minute)
+		return block, &now
+	}
+
+	t.Run("Released IPs wait for the cool-down", func(t *testing.T) {
+		block, now := newBlock(t, "10.244.1.0/24")
+		first, _ := block.Allocate()
+		block.Allocate()
+		if err := block.Release(first); err != nil {
+			t.Fatalf("Release failed: %v", err)
+		}
+
+		if block.Quarantined() != 1 || block.Available() != 252 {
+			t.Errorf("Expected 1 quarantined IP among 252 available, got %d and %d", block.Quarantined(), block.Available())
+		}
+		if ip, _ := block.Allocate(); ip.Equal(first) {
+			t.Errorf("Expected %s to be quarantined, got it again", first)
+		}
+
+		*now = now.Add(time.Minute)
+		if block.Quarantined() != 0 {
+			t.Errorf("Expected the cool-down to be over, got %d quarantined", block.Quarantined())
+		}
+		if ip, _ := block.Allocate(); !ip.Equal(first) {
+			t.Errorf("Expected %s after the cool-down, got %s", first, ip)
+		}
+	})
+
+	t.Run("A full block reuses the oldest quarantined IP", func(t *testing.T) {
+		// .1 is the gateway, leaving .2 to .6
+		block, now := newBlock(t, "10.244.1.0/29")
+		for i := 0; i < 5; i++ {
+			block.Allocate()
+		}
+		block.Release(net.ParseIP("10.244.1.5"))
+		*now = now.Add(time.Second)
+		block.Release(net.ParseIP("10.244.1.3"))
+
+		for _, expected := range []string{"10.244.1.5", "10.244.1.3"} {
+			if ip, err := block.Allocate(); err != nil || !ip.Equal(net.ParseIP(expected)) {
+				t.Errorf("Expected %s, got %s (%v)", expected, ip, err)
+			}
+		}
+		if block.Quarantined() != 0 || block.Available() != 0 {
+			t.Errorf("Expected a full block, got %d quarantined and %d available", block.Quarantined(), block.Available())
+		}
+	})
+
+	t.Run("Strategies skip quarantined IPs", func(t *testing.T) {
+		block, _ := newBlock(t, "10.244.1.0/24")
+		block.SetSelection(Selection{Strategy: StrategyHash})
+		ip, _ := block.AllocateFor("container-1")
+		block.Release(ip)
+
+		if again, _ := block.AllocateFor("container-1"); again.Equal(ip) {
+			t.Errorf("Expected %s to be quarantined, got it again", ip)
+		}
+	})
+
+	t.Run("Hash gives a container its own quarantined IP back", func(t *testing.T) {
+		block, _ := newBlock(t, "10.244.1.0/24")
+		block.SetSelection(Selection{Strategy: StrategyHash})
+		ip, _ := block.AllocateFor("container-1")
+		if err := block.ReleaseFor(ip, "container-1"); err != nil {
+			t.Fatalf("ReleaseFor failed: %v", err)
+		}
+
+		// Other containers still skip it
+		if other, _ := block.AllocateFor("container-2"); other.Equal(ip) {
+			t.Errorf("Expected %s to be quarantined for container-2", ip)
+		}
+		if again, _ := block.AllocateFor("container-1"); !again.Equal(ip) {
+			t.Errorf("Expected container-1 to get %s back, got %s", ip, again)
+		}
+		if block.Quarantined() != 0 {
+			t.Errorf("Expected no quarantined IP, got %d", block.Quarantined())
+		}
+	})
+
+	t.Run("Restores keep the cool-downs", func(t *testing.T) {
+		block, _ := newBlock(t, "10.244.1.0/24")
+		first, _ := block.Allocate()
+		second, _ := block.Allocate()
+		block.Release(first)
+		block.Release(second)
+
+		// Another replica allocated the second IP meanwhile
+		snap := block.Snapshot()
+		replica, _ := RestoreIPBlock(snap, Reservation{})
+		replica.MarkAllocated(second)
+
+		restored, err := RestoreIPBlock(replica.Snapshot(), Reservation{})
+		if err != nil {
+			t.Fatalf("RestoreIPBlock failed: %v", err)
+		}
+		restored.released.now = block.released.now
+		restored.SetQuarantine(time.Minute)
+		restored.KeepLocalState(block)
+
+		if restored.Quarantined() != 1 {
+			t.Errorf("Expected 1 quarantined IP, got %d", restored.Quarantined())
+		}
+		if ip, _ := restored.Allocate(); ip.Equal(first) {
+			t.Errorf("Expected %s to stay quarantined, got it again", first)
+		}
+	})
+
+	t.Run("Marking an IP allocated ends its cool-down", func(t *testing.T) {
+		block, _ := newBlock(t, "10.244.1.0/24")
+		ip, _ := block.Allocate()
+		block.Release(ip)
+		block.MarkAllocated(ip)
+
+		if block.Quarantined() != 0 {
+			t.Errorf("Expected no quarantined IP, got %d", block.Quarantined())
+		}
+	})
+
+	t.Run("Zero disables the quarantine", func(t *testing.T) {
+		block, _ := newBlock(t, "10.244.1.0/24")
+		ip, _ := block.Allocate()
+		block.Release(ip)
+		block.SetQuarantine(0)
+
+		if again, _ := block.Allocate(); !again.Equal(ip) {
+			t.Errorf("Expected %s at once, got %s", ip, again)
+		}
+	})
+}
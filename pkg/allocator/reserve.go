@@ -0,0 +1,168 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// GatewayMode selects which address of a block is its gateway
+type GatewayMode string
+
+const (
+	// GatewayFirst uses the first usable address, network + 1
+	GatewayFirst GatewayMode = "first"
+
+	// GatewayLast uses the last usable address, broadcast - 1
+	GatewayLast GatewayMode = "last"
+
+	// GatewayExplicit uses the address at Reservation.GatewayOffset
+	GatewayExplicit GatewayMode = "explicit"
+
+	// GatewayNone gives blocks no gateway, for networks routed elsewhere
+	GatewayNone GatewayMode = "none"
+)
+
+// ParseGatewayMode parses a gateway mode name
+func ParseGatewayMode(name string) (GatewayMode, error) {
+	switch mode := GatewayMode(name); mode {
+	case GatewayFirst, GatewayLast, GatewayExplicit, GatewayNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown gateway mode %q", name)
+	}
+}
+
+// Reservation selects the addresses of every block that are never handed
+// out: the gateway and any offsets the operator sets aside
+// Offsets count from the network address; negative ones count back from the
+// broadcast address, so -1 is the last usable address
+type Reservation struct {
+	Gateway       GatewayMode `json:"gateway,omitempty"`        // Empty means GatewayFirst
+	GatewayOffset int         `json:"gateway_offset,omitempty"` // For GatewayExplicit
+	Offsets       []int       `json:"offsets,omitempty"`
+}
+
+// Equal reports whether two reservations set aside the same addresses
+func (r Reservation) Equal(other Reservation) bool {
+	offset, ok := r.gatewayOffset()
+	otherOffset, otherOK := other.gatewayOffset()
+	if offset != otherOffset || ok != otherOK {
+		return false
+	}
+
+	offsets := make(map[int]bool, len(r.Offsets))
+	for _, o := range r.Offsets {
+		offsets[o] = true
+	}
+	otherOffsets := make(map[int]bool, len(other.Offsets))
+	for _, o := range other.Offsets {
+		if !offsets[o] {
+			return false
+		}
+		otherOffsets[o] = true
+	}
+	return len(offsets) == len(otherOffsets)
+}
+
+// gatewayOffset returns the offset of the gateway, or false without one
+func (r Reservation) gatewayOffset() (int, bool) {
+	switch r.Gateway {
+	case GatewayNone:
+		return 0, false
+	case GatewayLast:
+		return -1, true
+	case GatewayExplicit:
+		return r.GatewayOffset, true
+	default:
+		return 1, true
+	}
+}
+
+// Validate checks that the reservation fits blocks with the given number of
+// usable addresses and leaves at least one of them to allocate
+func (r Reservation) Validate(usable int) error {
+	if r.Gateway != "" {
+		if _, err := ParseGatewayMode(string(r.Gateway)); err != nil {
+			return err
+		}
+	}
+	if r.Gateway == GatewayExplicit && r.GatewayOffset == 0 {
+		return fmt.Errorf("explicit gateway needs a non-zero offset")
+	}
+
+	reserved, _, err := r.positions(usable)
+	if err != nil {
+		return err
+	}
+	if len(reserved) >= usable {
+		return fmt.Errorf("reservation leaves no allocatable address among %d", usable)
+	}
+	return nil
+}
+
+// GatewayFor returns the gateway address of a block, or nil without one
+func (r Reservation) GatewayFor(cidr *net.IPNet) net.IP {
+	offset, ok := r.gatewayOffset()
+	if !ok {
+		return nil
+	}
+
+	block := &IPBlock{CIDR: cidr}
+	pos, err := offsetPosition(offset, usableAddresses(cidr))
+	if err != nil {
+		return nil
+	}
+	return block.positionToIP(pos)
+}
+
+// positions returns the sorted bitmap positions reserved in a block with the
+// given number of usable addresses, and the gateway position or -1
+func (r Reservation) positions(usable int) ([]int, int, error) {
+	seen := make(map[int]bool)
+	gateway := -1
+
+	if offset, ok := r.gatewayOffset(); ok {
+		pos, err := offsetPosition(offset, usable)
+		if err != nil {
+			return nil, -1, fmt.Errorf("invalid gateway: %w", err)
+		}
+		seen[pos] = true
+		gateway = pos
+	}
+
+	for _, offset := range r.Offsets {
+		pos, err := offsetPosition(offset, usable)
+		if err != nil {
+			return nil, -1, fmt.Errorf("invalid reserved address: %w", err)
+		}
+		seen[pos] = true
+	}
+
+	reserved := make([]int, 0, len(seen))
+	for pos := range seen {
+		reserved = append(reserved, pos)
+	}
+	sort.Ints(reserved)
+	return reserved, gateway, nil
+}
+
+// offsetPosition converts an offset from the network address, or back from
+// the broadcast address when negative, to a bitmap position
+func offsetPosition(offset, usable int) (int, error) {
+	pos := offset - 1
+	if offset < 0 {
+		pos = usable + offset
+	}
+	if offset == 0 || pos < 0 || pos >= usable {
+		return -1, fmt.Errorf("offset %d is not a usable address of a block with %d", offset, usable)
+	}
+	return pos, nil
+}
+
+// usableAddresses returns the number of addresses of a block between its
+// network and broadcast addresses
+func usableAddresses(cidr *net.IPNet) int {
+	ones, bits := cidr.Mask.Size()
+	return (1 << (bits - ones)) - 2
+}
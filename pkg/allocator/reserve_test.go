@@ -0,0 +1,128 @@
+package allocator
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReservation(t *testing.T) {
+	t.Run("Gateway modes", func(t *testing.T) {
+		for _, c := range []struct {
+			reservation Reservation
+			gateway     string
+			first       string
+		}{
+			{Reservation{}, "10.244.1.1", "10.244.1.2"},
+			{Reservation{Gateway: GatewayFirst}, "10.244.1.1", "10.244.1.2"},
+			{Reservation{Gateway: GatewayLast}, "10.244.1.254", "10.244.1.1"},
+			{Reservation{Gateway: GatewayExplicit, GatewayOffset: 10}, "10.244.1.10", "10.244.1.1"},
+			{Reservation{Gateway: GatewayExplicit, GatewayOffset: -2}, "10.244.1.253", "10.244.1.1"},
+		} {
+			block, err := NewIPBlockWithReservation("10.244.1.0/24", "node1", c.reservation)
+			if err != nil {
+				t.Fatalf("NewIPBlockWithReservation(%+v) failed: %v", c.reservation, err)
+			}
+			if !block.Gateway.Equal(net.ParseIP(c.gateway)) || block.Total != 253 {
+				t.Errorf("%+v: expected gateway %s of 253 IPs, got %s of %d", c.reservation, c.gateway, block.Gateway, block.Total)
+			}
+			if ip, _ := block.Allocate(); !ip.Equal(net.ParseIP(c.first)) {
+				t.Errorf("%+v: expected first IP %s, got %s", c.reservation, c.first, ip)
+			}
+		}
+
+		block, _ := NewIPBlockWithReservation("10.244.1.0/24", "node1", Reservation{Gateway: GatewayNone})
+		if block.Gateway != nil || block.Total != 254 {
+			t.Errorf("Expected no gateway and 254 IPs, got %s and %d", block.Gateway, block.Total)
+		}
+		if ip, _ := block.Allocate(); !ip.Equal(net.ParseIP("10.244.1.1")) {
+			t.Errorf("Expected 10.244.1.1 without a gateway, got %s", ip)
+		}
+	})
+
+	t.Run("Reserved offsets are never allocated", func(t *testing.T) {
+		block, err := NewIPBlockWithReservation("10.244.1.0/29", "node1", Reservation{Offsets: []int{2, -1, 1}})
+		if err != nil {
+			t.Fatalf("NewIPBlockWithReservation failed: %v", err)
+		}
+
+		// .1 gateway, .2 and .6 reserved, leaving .3 to .5
+		if block.Total != 3 || block.Available() != 3 || len(block.Reserved()) != 3 {
+			t.Fatalf("Expected 3 allocatable IPs besides 3 reserved, got %s with %v", block, block.Reserved())
+		}
+		for _, expected := range []string{"10.244.1.3", "10.244.1.4", "10.244.1.5"} {
+			if ip, err := block.Allocate(); err != nil || !ip.Equal(net.ParseIP(expected)) {
+				t.Errorf("Expected %s, got %s (%v)", expected, ip, err)
+			}
+		}
+		if _, err := block.Allocate(); !errors.Is(err, ErrNoAvailableIP) {
+			t.Errorf("Expected ErrNoAvailableIP, got %v", err)
+		}
+		if block.Usage() != 1 {
+			t.Errorf("Expected a full block, got %.2f", block.Usage())
+		}
+
+		gateway := net.ParseIP("10.244.1.1")
+		if block.Contains(gateway) {
+			t.Error("Expected the gateway not to count as allocated")
+		}
+		if err := block.Release(gateway); !errors.Is(err, ErrIPReserved) {
+			t.Errorf("Expected ErrIPReserved, got %v", err)
+		}
+		if err := block.MarkReleased(gateway); err != nil || block.Available() != 0 {
+			t.Errorf("Expected MarkReleased to leave the gateway reserved, got %v with %d available", err, block.Available())
+		}
+		if err := block.MarkAllocated(gateway); err != nil || block.Used != 3 {
+			t.Errorf("Expected MarkAllocated of the gateway to be a no-op, got %v with %d used", err, block.Used)
+		}
+	})
+
+	t.Run("Invalid reservations are rejected", func(t *testing.T) {
+		for _, reservation := range []Reservation{
+			{Gateway: "middle"},
+			{Gateway: GatewayExplicit},
+			{Gateway: GatewayExplicit, GatewayOffset: 7},
+			{Offsets: []int{0}},
+			{Offsets: []int{-7}},
+			{Gateway: GatewayNone, Offsets: []int{1, 2, 3, 4, 5, 6}},
+		} {
+			if _, err := NewIPBlockWithReservation("10.244.1.0/29", "node1", reservation); err == nil {
+				t.Errorf("Expected %+v to be rejected for a /29", reservation)
+			}
+		}
+
+		if _, err := ParseGatewayMode("middle"); err == nil {
+			t.Error("Expected ParseGatewayMode to reject middle")
+		}
+	})
+
+	t.Run("Restore reserves addresses of older snapshots", func(t *testing.T) {
+		// A block from before reservations, where a pod got the gateway
+		block, _ := NewIPBlockWithReservation("10.244.1.0/24", "node1", Reservation{Gateway: GatewayNone})
+		for i := 0; i < 3; i++ {
+			block.Allocate()
+		}
+
+		restored, err := RestoreIPBlock(block.Snapshot(), Reservation{Offsets: []int{10}})
+		if err != nil {
+			t.Fatalf("RestoreIPBlock failed: %v", err)
+		}
+
+		// The pod's hold on .1 folds into the reservation
+		if restored.Total != 252 || restored.Used != 2 || restored.Available() != 250 {
+			t.Errorf("Expected 2 of 252 IPs used and 250 available, got %s with %d available", restored, restored.Available())
+		}
+		if err := restored.Release(net.ParseIP("10.244.1.1")); !errors.Is(err, ErrIPReserved) {
+			t.Errorf("Expected ErrIPReserved, got %v", err)
+		}
+		if ip, _ := restored.Allocate(); !ip.Equal(net.ParseIP("10.244.1.4")) {
+			t.Errorf("Expected 10.244.1.4, got %s", ip)
+		}
+
+		// Reservations survive another round trip
+		again, err := RestoreIPBlock(restored.Snapshot(), Reservation{Offsets: []int{10}})
+		if err != nil || again.Used != restored.Used || again.Available() != restored.Available() {
+			t.Errorf("Expected %s, got %s (%v)", restored, again, err)
+		}
+	})
+}
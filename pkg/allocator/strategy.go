@@ -0,0 +1,147 @@
+package allocator
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Strategy selects which free address of a block is allocated next
+type Strategy string
+
+const (
+	// StrategyLowest takes the lowest free address, reusing released ones
+	// right away
+	StrategyLowest Strategy = "lowest"
+
+	// StrategyNextFit takes the first free address after the previous
+	// allocation, cycling through the block before reusing an address
+	StrategyNextFit Strategy = "next-fit"
+
+	// StrategyRandom takes the first free address after a position drawn
+	// from a sequence seeded by Selection.Seed
+	StrategyRandom Strategy = "random"
+
+	// StrategyHash takes the first free address after a position hashed from
+	// the container ID, so a recreated container tends to get its old address
+	StrategyHash Strategy = "hash"
+)
+
+// ParseStrategy parses a selection strategy name
+func ParseStrategy(name string) (Strategy, error) {
+	switch strategy := Strategy(name); strategy {
+	case StrategyLowest, StrategyNextFit, StrategyRandom, StrategyHash:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown IP selection strategy %q", name)
+	}
+}
+
+// Selection configures how blocks pick the address to allocate
+// The random sequence of each block depends only on the seed, the block
+// CIDR and the number of draws so far
+type Selection struct {
+	Strategy Strategy `json:"strategy,omitempty"` // Empty means StrategyLowest
+	Seed     int64    `json:"seed,omitempty"`     // For StrategyRandom
+}
+
+// Validate checks that the selection names a known strategy
+func (s Selection) Validate() error {
+	if s.Strategy == "" {
+		return nil
+	}
+	_, err := ParseStrategy(string(s.Strategy))
+	return err
+}
+
+// Equal reports whether two selections pick addresses the same way
+func (s Selection) Equal(other Selection) bool {
+	strategy, otherStrategy := s.Strategy, other.Strategy
+	if strategy == "" {
+		strategy = StrategyLowest
+	}
+	if otherStrategy == "" {
+		otherStrategy = StrategyLowest
+	}
+	if strategy != otherStrategy {
+		return false
+	}
+	return strategy != StrategyRandom || s.Seed == other.Seed
+}
+
+// SetSelection changes how the block picks the address to allocate
+func (block *IPBlock) SetSelection(selection Selection) error {
+	if err := selection.Validate(); err != nil {
+		return err
+	}
+
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	block.selection = selection
+	return nil
+}
+
+// KeepLocalState carries over the state only the daemon allocating from a
+// block tracks, the next-fit cursor, the random draws and the quarantine,
+// from the block it replaces on restore
+// Snapshots leave it out, since other replicas only see the outcome
+func (block *IPBlock) KeepLocalState(from *IPBlock) {
+	if from == block {
+		return
+	}
+
+	from.mu.RLock()
+	defer from.mu.RUnlock()
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	if from.cursor < block.bitmap.size {
+		block.cursor = from.cursor
+	}
+	block.draws = from.draws
+	block.keepQuarantine(from)
+}
+
+// pick returns the bitmap position to allocate for key, or -1 if the block
+// is full
+// Must be called with lock held
+func (block *IPBlock) pick(key string) int {
+	size := block.bitmap.size
+	if size == 0 {
+		return -1
+	}
+
+	switch block.selection.Strategy {
+	case StrategyNextFit:
+		pos := block.findFree(block.cursor, "")
+		if pos >= 0 {
+			block.cursor = (pos + 1) % size
+		}
+		return pos
+	case StrategyRandom:
+		start := splitmix64(uint64(block.selection.Seed) ^ hashString(block.CIDR.String()) + block.draws)
+		block.draws++
+		return block.findFree(int(start%uint64(size)), "")
+	case StrategyHash:
+		if key != "" {
+			// The container may take back the IP it released at once
+			return block.findFree(int(hashString(key)%uint64(size)), key)
+		}
+	}
+	return block.findFree(0, "")
+}
+
+// hashString hashes a string with 64-bit FNV-1a
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// splitmix64 scrambles x into a well-distributed 64-bit value
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
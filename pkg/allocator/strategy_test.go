@@ -0,0 +1,158 @@
+package allocator
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSelection(t *testing.T) {
+	newBlock := func(t *testing.T, selection Selection) *IPBlock {
+		block, err := NewIPBlock("10.244.1.0/24", "node1")
+		if err != nil {
+			t.Fatalf("NewIPBlock failed: %v", err)
+		}
+		if err := block.SetSelection(selection); err != nil {
+			t.Fatalf("SetSelection(%+v) failed: %v", selection, err)
+		}
+		return block
+	}
+
+	t.Run("Lowest reuses a released IP", func(t *testing.T) {
+		for _, selection := range []Selection{{}, {Strategy: StrategyLowest}} {
+			block := newBlock(t, selection)
+			first, _ := block.Allocate()
+			block.Allocate()
+			block.Release(first)
+
+			if ip, _ := block.Allocate(); !ip.Equal(first) {
+				t.Errorf("%+v: expected %s again, got %s", selection, first, ip)
+			}
+		}
+	})
+
+	t.Run("Next-fit cycles through the block", func(t *testing.T) {
+		block := newBlock(t, Selection{Strategy: StrategyNextFit})
+		first, _ := block.Allocate()
+		second, _ := block.Allocate()
+		block.Release(first)
+
+		if ip, _ := block.Allocate(); !ip.Equal(net.ParseIP("10.244.1.4")) {
+			t.Errorf("Expected 10.244.1.4 after %s, got %s", second, ip)
+		}
+
+		// Once the cursor reaches the end it wraps to the released IP
+		for i := 0; i < 250; i++ {
+			block.Allocate()
+		}
+		if ip, err := block.Allocate(); err != nil || !ip.Equal(first) {
+			t.Errorf("Expected to wrap around to %s, got %s (%v)", first, ip, err)
+		}
+		if _, err := block.Allocate(); !errors.Is(err, ErrNoAvailableIP) {
+			t.Errorf("Expected ErrNoAvailableIP, got %v", err)
+		}
+	})
+
+	t.Run("Random depends only on the seed", func(t *testing.T) {
+		allocate := func(seed int64) []string {
+			block := newBlock(t, Selection{Strategy: StrategyRandom, Seed: seed})
+			var ips []string
+			for i := 0; i < 5; i++ {
+				ip, err := block.Allocate()
+				if err != nil {
+					t.Fatalf("Allocate failed: %v", err)
+				}
+				ips = append(ips, ip.String())
+			}
+			return ips
+		}
+
+		a, b, c := allocate(7), allocate(7), allocate(8)
+		for i := range a {
+			if a[i] != b[i] {
+				t.Fatalf("Expected the same IPs for the same seed, got %v and %v", a, b)
+			}
+		}
+		if a[0] == c[0] && a[1] == c[1] && a[2] == c[2] {
+			t.Errorf("Expected other IPs for another seed, got %v and %v", a, c)
+		}
+
+		// Every IP is still handed out before the block is full
+		block := newBlock(t, Selection{Strategy: StrategyRandom, Seed: 7})
+		for i := 0; i < 253; i++ {
+			if _, err := block.Allocate(); err != nil {
+				t.Fatalf("Allocation %d failed: %v", i, err)
+			}
+		}
+		if _, err := block.Allocate(); !errors.Is(err, ErrNoAvailableIP) {
+			t.Errorf("Expected ErrNoAvailableIP, got %v", err)
+		}
+	})
+
+	t.Run("Hash gives a container its old IP back", func(t *testing.T) {
+		block := newBlock(t, Selection{Strategy: StrategyHash})
+		ip, _ := block.AllocateFor("container-1")
+		other, _ := block.AllocateFor("container-2")
+		if ip.Equal(other) {
+			t.Fatalf("Expected different IPs, got %s twice", ip)
+		}
+
+		block.Release(ip)
+		if again, _ := block.AllocateFor("container-1"); !again.Equal(ip) {
+			t.Errorf("Expected %s again, got %s", ip, again)
+		}
+		if again, _ := newBlock(t, Selection{Strategy: StrategyHash}).AllocateFor("container-1"); !again.Equal(ip) {
+			t.Errorf("Expected %s in another block of the same CIDR, got %s", ip, again)
+		}
+
+		// Without a container ID it takes the lowest IP
+		if ip, _ := block.Allocate(); !ip.Equal(net.ParseIP("10.244.1.2")) {
+			t.Errorf("Expected 10.244.1.2, got %s", ip)
+		}
+	})
+
+	t.Run("Restores keep the local strategy state", func(t *testing.T) {
+		for _, selection := range []Selection{
+			{Strategy: StrategyNextFit},
+			{Strategy: StrategyRandom, Seed: 42},
+		} {
+			block := newBlock(t, selection)
+			for i := 0; i < 3; i++ {
+				block.Allocate()
+			}
+
+			data, err := json.Marshal(block.Snapshot())
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			var snap BlockSnapshot
+			if err := json.Unmarshal(data, &snap); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			restored, err := RestoreIPBlock(snap, Reservation{})
+			if err != nil {
+				t.Fatalf("RestoreIPBlock failed: %v", err)
+			}
+			restored.SetSelection(selection)
+			restored.KeepLocalState(block)
+
+			for i := 0; i < 3; i++ {
+				want, _ := block.Allocate()
+				if got, _ := restored.Allocate(); !got.Equal(want) {
+					t.Errorf("%+v: expected the restored block to allocate %s, got %s", selection, want, got)
+				}
+			}
+		}
+	})
+
+	t.Run("Unknown strategies are rejected", func(t *testing.T) {
+		if _, err := ParseStrategy("best-fit"); err == nil {
+			t.Error("Expected ParseStrategy to reject best-fit")
+		}
+		block, _ := NewIPBlock("10.244.1.0/24", "node1")
+		if err := block.SetSelection(Selection{Strategy: "best-fit"}); err == nil {
+			t.Error("Expected SetSelection to reject best-fit")
+		}
+	})
+}
@@ -0,0 +1,1616 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        (unknown)
+// source: pkg/api/proto/ipam.proto
+
+package proto
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// AllocateIPRequest requests an IP allocation
+// Each interface of a container gets its own IP, which must lie in one of the
+// node's blocks when ip is set
+type AllocateIPRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	NodeId        string                 `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`                   // Node identifier
+	PodName       string                 `protobuf:"bytes,2,opt,name=pod_name,json=podName,proto3" json:"pod_name,omitempty"`                // Pod name
+	PodNamespace  string                 `protobuf:"bytes,3,opt,name=pod_namespace,json=podNamespace,proto3" json:"pod_namespace,omitempty"` // Pod namespace
+	ContainerId   string                 `protobuf:"bytes,4,opt,name=container_id,json=containerId,proto3" json:"container_id,omitempty"`    // Container ID
+	IfName        string                 `protobuf:"bytes,5,opt,name=if_name,json=ifName,proto3" json:"if_name,omitempty"`                   // Interface name inside the container (e.g., "eth0")
+	Netns         string                 `protobuf:"bytes,6,opt,name=netns,proto3" json:"netns,omitempty"`                                   // Network namespace path of the container
+	Ip            string                 `protobuf:"bytes,7,opt,name=ip,proto3" json:"ip,omitempty"`                                         // Specific IP to allocate (optional)
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateIPRequest) Reset() {
+	*x = AllocateIPRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateIPRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateIPRequest) ProtoMessage() {}
+
+func (x *AllocateIPRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateIPRequest.ProtoReflect.Descriptor instead.
+func (*AllocateIPRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AllocateIPRequest) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *AllocateIPRequest) GetPodName() string {
+	if x != nil {
+		return x.PodName
+	}
+	return ""
+}
+
+func (x *AllocateIPRequest) GetPodNamespace() string {
+	if x != nil {
+		return x.PodNamespace
+	}
+	return ""
+}
+
+func (x *AllocateIPRequest) GetContainerId() string {
+	if x != nil {
+		return x.ContainerId
+	}
+	return ""
+}
+
+func (x *AllocateIPRequest) GetIfName() string {
+	if x != nil {
+		return x.IfName
+	}
+	return ""
+}
+
+func (x *AllocateIPRequest) GetNetns() string {
+	if x != nil {
+		return x.Netns
+	}
+	return ""
+}
+
+func (x *AllocateIPRequest) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+// AllocateIPResponse returns allocated IP information
+type AllocateIPResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ip            string                 `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`           // Allocated IP address (e.g., "10.244.1.5")
+	Cidr          string                 `protobuf:"bytes,2,opt,name=cidr,proto3" json:"cidr,omitempty"`       // IP with prefix (e.g., "10.244.1.5/24")
+	Gateway       string                 `protobuf:"bytes,3,opt,name=gateway,proto3" json:"gateway,omitempty"` // Gateway IP
+	Routes        []*Route               `protobuf:"bytes,4,rep,name=routes,proto3" json:"routes,omitempty"`   // Routes to configure
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateIPResponse) Reset() {
+	*x = AllocateIPResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateIPResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateIPResponse) ProtoMessage() {}
+
+func (x *AllocateIPResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateIPResponse.ProtoReflect.Descriptor instead.
+func (*AllocateIPResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AllocateIPResponse) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *AllocateIPResponse) GetCidr() string {
+	if x != nil {
+		return x.Cidr
+	}
+	return ""
+}
+
+func (x *AllocateIPResponse) GetGateway() string {
+	if x != nil {
+		return x.Gateway
+	}
+	return ""
+}
+
+func (x *AllocateIPResponse) GetRoutes() []*Route {
+	if x != nil {
+		return x.Routes
+	}
+	return nil
+}
+
+// Route represents a routing entry
+type Route struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Dst           string                 `protobuf:"bytes,1,opt,name=dst,proto3" json:"dst,omitempty"` // Destination CIDR (e.g., "0.0.0.0/0")
+	Gw            string                 `protobuf:"bytes,2,opt,name=gw,proto3" json:"gw,omitempty"`   // Gateway IP (optional)
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Route) Reset() {
+	*x = Route{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Route) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Route) ProtoMessage() {}
+
+func (x *Route) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Route.ProtoReflect.Descriptor instead.
+func (*Route) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Route) GetDst() string {
+	if x != nil {
+		return x.Dst
+	}
+	return ""
+}
+
+func (x *Route) GetGw() string {
+	if x != nil {
+		return x.Gw
+	}
+	return ""
+}
+
+// ReleaseIPRequest requests to release an IP
+// With a container ID the IP is looked up in the daemon's store, so node_id
+// and ip may be left empty; without if_name every interface is released
+type ReleaseIPRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	NodeId        string                 `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`                // Node identifier
+	Ip            string                 `protobuf:"bytes,2,opt,name=ip,proto3" json:"ip,omitempty"`                                      // IP to release
+	ContainerId   string                 `protobuf:"bytes,3,opt,name=container_id,json=containerId,proto3" json:"container_id,omitempty"` // Container ID
+	IfName        string                 `protobuf:"bytes,4,opt,name=if_name,json=ifName,proto3" json:"if_name,omitempty"`                // Interface name inside the container (optional)
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReleaseIPRequest) Reset() {
+	*x = ReleaseIPRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReleaseIPRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReleaseIPRequest) ProtoMessage() {}
+
+func (x *ReleaseIPRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReleaseIPRequest.ProtoReflect.Descriptor instead.
+func (*ReleaseIPRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ReleaseIPRequest) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *ReleaseIPRequest) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *ReleaseIPRequest) GetContainerId() string {
+	if x != nil {
+		return x.ContainerId
+	}
+	return ""
+}
+
+func (x *ReleaseIPRequest) GetIfName() string {
+	if x != nil {
+		return x.IfName
+	}
+	return ""
+}
+
+// ReleaseIPResponse confirms IP release
+type ReleaseIPResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReleaseIPResponse) Reset() {
+	*x = ReleaseIPResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReleaseIPResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReleaseIPResponse) ProtoMessage() {}
+
+func (x *ReleaseIPResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReleaseIPResponse.ProtoReflect.Descriptor instead.
+func (*ReleaseIPResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ReleaseIPResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *ReleaseIPResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+// GetNodeBlocksRequest requests blocks for a node
+type GetNodeBlocksRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	NodeId        string                 `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetNodeBlocksRequest) Reset() {
+	*x = GetNodeBlocksRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetNodeBlocksRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetNodeBlocksRequest) ProtoMessage() {}
+
+func (x *GetNodeBlocksRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetNodeBlocksRequest.ProtoReflect.Descriptor instead.
+func (*GetNodeBlocksRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *GetNodeBlocksRequest) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+// GetNodeBlocksResponse returns node's IP blocks
+type GetNodeBlocksResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Blocks        []*IPBlock             `protobuf:"bytes,1,rep,name=blocks,proto3" json:"blocks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetNodeBlocksResponse) Reset() {
+	*x = GetNodeBlocksResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetNodeBlocksResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetNodeBlocksResponse) ProtoMessage() {}
+
+func (x *GetNodeBlocksResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetNodeBlocksResponse.ProtoReflect.Descriptor instead.
+func (*GetNodeBlocksResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *GetNodeBlocksResponse) GetBlocks() []*IPBlock {
+	if x != nil {
+		return x.Blocks
+	}
+	return nil
+}
+
+// IPBlock represents an IP address block
+type IPBlock struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Cidr          string                 `protobuf:"bytes,1,opt,name=cidr,proto3" json:"cidr,omitempty"`                             // CIDR notation (e.g., "10.244.1.0/24")
+	NodeId        string                 `protobuf:"bytes,2,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`           // Node this block is allocated to
+	Total         int32                  `protobuf:"varint,3,opt,name=total,proto3" json:"total,omitempty"`                          // Total usable IPs
+	Used          int32                  `protobuf:"varint,4,opt,name=used,proto3" json:"used,omitempty"`                            // Used IP count
+	Available     int32                  `protobuf:"varint,5,opt,name=available,proto3" json:"available,omitempty"`                  // Available IP count
+	CreatedAt     int64                  `protobuf:"varint,6,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"` // Creation timestamp (Unix seconds)
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IPBlock) Reset() {
+	*x = IPBlock{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IPBlock) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IPBlock) ProtoMessage() {}
+
+func (x *IPBlock) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IPBlock.ProtoReflect.Descriptor instead.
+func (*IPBlock) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *IPBlock) GetCidr() string {
+	if x != nil {
+		return x.Cidr
+	}
+	return ""
+}
+
+func (x *IPBlock) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *IPBlock) GetTotal() int32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *IPBlock) GetUsed() int32 {
+	if x != nil {
+		return x.Used
+	}
+	return 0
+}
+
+func (x *IPBlock) GetAvailable() int32 {
+	if x != nil {
+		return x.Available
+	}
+	return 0
+}
+
+func (x *IPBlock) GetCreatedAt() int64 {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return 0
+}
+
+// GetPoolStatsRequest requests pool statistics
+type GetPoolStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetPoolStatsRequest) Reset() {
+	*x = GetPoolStatsRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetPoolStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetPoolStatsRequest) ProtoMessage() {}
+
+func (x *GetPoolStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetPoolStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetPoolStatsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{8}
+}
+
+// GetPoolStatsResponse returns pool statistics
+type GetPoolStatsResponse struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	TotalNodes     int32                  `protobuf:"varint,1,opt,name=total_nodes,json=totalNodes,proto3" json:"total_nodes,omitempty"`
+	TotalBlocks    int32                  `protobuf:"varint,2,opt,name=total_blocks,json=totalBlocks,proto3" json:"total_blocks,omitempty"`
+	TotalIps       int32                  `protobuf:"varint,3,opt,name=total_ips,json=totalIps,proto3" json:"total_ips,omitempty"`
+	UsedIps        int32                  `protobuf:"varint,4,opt,name=used_ips,json=usedIps,proto3" json:"used_ips,omitempty"`
+	AvailableIps   int32                  `protobuf:"varint,5,opt,name=available_ips,json=availableIps,proto3" json:"available_ips,omitempty"`
+	NodeStats      map[string]*NodeStats  `protobuf:"bytes,6,rep,name=node_stats,json=nodeStats,proto3" json:"node_stats,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	QuarantinedIps int32                  `protobuf:"varint,7,opt,name=quarantined_ips,json=quarantinedIps,proto3" json:"quarantined_ips,omitempty"` // Released IPs cooling down, among available_ips
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *GetPoolStatsResponse) Reset() {
+	*x = GetPoolStatsResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetPoolStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetPoolStatsResponse) ProtoMessage() {}
+
+func (x *GetPoolStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetPoolStatsResponse.ProtoReflect.Descriptor instead.
+func (*GetPoolStatsResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetPoolStatsResponse) GetTotalNodes() int32 {
+	if x != nil {
+		return x.TotalNodes
+	}
+	return 0
+}
+
+func (x *GetPoolStatsResponse) GetTotalBlocks() int32 {
+	if x != nil {
+		return x.TotalBlocks
+	}
+	return 0
+}
+
+func (x *GetPoolStatsResponse) GetTotalIps() int32 {
+	if x != nil {
+		return x.TotalIps
+	}
+	return 0
+}
+
+func (x *GetPoolStatsResponse) GetUsedIps() int32 {
+	if x != nil {
+		return x.UsedIps
+	}
+	return 0
+}
+
+func (x *GetPoolStatsResponse) GetAvailableIps() int32 {
+	if x != nil {
+		return x.AvailableIps
+	}
+	return 0
+}
+
+func (x *GetPoolStatsResponse) GetNodeStats() map[string]*NodeStats {
+	if x != nil {
+		return x.NodeStats
+	}
+	return nil
+}
+
+func (x *GetPoolStatsResponse) GetQuarantinedIps() int32 {
+	if x != nil {
+		return x.QuarantinedIps
+	}
+	return 0
+}
+
+// NodeStats represents per-node statistics
+type NodeStats struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	NodeId         string                 `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	Blocks         int32                  `protobuf:"varint,2,opt,name=blocks,proto3" json:"blocks,omitempty"`
+	TotalIps       int32                  `protobuf:"varint,3,opt,name=total_ips,json=totalIps,proto3" json:"total_ips,omitempty"`
+	UsedIps        int32                  `protobuf:"varint,4,opt,name=used_ips,json=usedIps,proto3" json:"used_ips,omitempty"`
+	AvailableIps   int32                  `protobuf:"varint,5,opt,name=available_ips,json=availableIps,proto3" json:"available_ips,omitempty"`
+	QuarantinedIps int32                  `protobuf:"varint,6,opt,name=quarantined_ips,json=quarantinedIps,proto3" json:"quarantined_ips,omitempty"` // Released IPs cooling down, among available_ips
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *NodeStats) Reset() {
+	*x = NodeStats{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NodeStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NodeStats) ProtoMessage() {}
+
+func (x *NodeStats) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NodeStats.ProtoReflect.Descriptor instead.
+func (*NodeStats) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *NodeStats) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *NodeStats) GetBlocks() int32 {
+	if x != nil {
+		return x.Blocks
+	}
+	return 0
+}
+
+func (x *NodeStats) GetTotalIps() int32 {
+	if x != nil {
+		return x.TotalIps
+	}
+	return 0
+}
+
+func (x *NodeStats) GetUsedIps() int32 {
+	if x != nil {
+		return x.UsedIps
+	}
+	return 0
+}
+
+func (x *NodeStats) GetAvailableIps() int32 {
+	if x != nil {
+		return x.AvailableIps
+	}
+	return 0
+}
+
+func (x *NodeStats) GetQuarantinedIps() int32 {
+	if x != nil {
+		return x.QuarantinedIps
+	}
+	return 0
+}
+
+// AllocateBlockRequest requests a new block for a node
+type AllocateBlockRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	NodeId        string                 `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	RequestId     string                 `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"` // Retries with the same ID allocate at most one block
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateBlockRequest) Reset() {
+	*x = AllocateBlockRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateBlockRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateBlockRequest) ProtoMessage() {}
+
+func (x *AllocateBlockRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateBlockRequest.ProtoReflect.Descriptor instead.
+func (*AllocateBlockRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *AllocateBlockRequest) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *AllocateBlockRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+// AllocateBlockResponse returns allocated block info
+type AllocateBlockResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Block         *IPBlock               `protobuf:"bytes,1,opt,name=block,proto3" json:"block,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateBlockResponse) Reset() {
+	*x = AllocateBlockResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateBlockResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateBlockResponse) ProtoMessage() {}
+
+func (x *AllocateBlockResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateBlockResponse.ProtoReflect.Descriptor instead.
+func (*AllocateBlockResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *AllocateBlockResponse) GetBlock() *IPBlock {
+	if x != nil {
+		return x.Block
+	}
+	return nil
+}
+
+// ReleaseBlockRequest requests to release a block
+type ReleaseBlockRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	NodeId        string                 `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	Cidr          string                 `protobuf:"bytes,2,opt,name=cidr,proto3" json:"cidr,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReleaseBlockRequest) Reset() {
+	*x = ReleaseBlockRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReleaseBlockRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReleaseBlockRequest) ProtoMessage() {}
+
+func (x *ReleaseBlockRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReleaseBlockRequest.ProtoReflect.Descriptor instead.
+func (*ReleaseBlockRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *ReleaseBlockRequest) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *ReleaseBlockRequest) GetCidr() string {
+	if x != nil {
+		return x.Cidr
+	}
+	return ""
+}
+
+// ReleaseBlockResponse confirms block release
+type ReleaseBlockResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReleaseBlockResponse) Reset() {
+	*x = ReleaseBlockResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReleaseBlockResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReleaseBlockResponse) ProtoMessage() {}
+
+func (x *ReleaseBlockResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReleaseBlockResponse.ProtoReflect.Descriptor instead.
+func (*ReleaseBlockResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *ReleaseBlockResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *ReleaseBlockResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+// QueryAuditLogRequest selects audit events; empty fields match everything
+type QueryAuditLogRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ip            string                 `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`                                      // IP address
+	ContainerId   string                 `protobuf:"bytes,2,opt,name=container_id,json=containerId,proto3" json:"container_id,omitempty"` // Container ID
+	NodeId        string                 `protobuf:"bytes,3,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`                // Node identifier
+	Since         int64                  `protobuf:"varint,4,opt,name=since,proto3" json:"since,omitempty"`                               // Start of the period, inclusive (Unix seconds)
+	Until         int64                  `protobuf:"varint,5,opt,name=until,proto3" json:"until,omitempty"`                               // End of the period, exclusive (Unix seconds)
+	Limit         int32                  `protobuf:"varint,6,opt,name=limit,proto3" json:"limit,omitempty"`                               // Maximum number of events, keeping the newest
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryAuditLogRequest) Reset() {
+	*x = QueryAuditLogRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryAuditLogRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryAuditLogRequest) ProtoMessage() {}
+
+func (x *QueryAuditLogRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryAuditLogRequest.ProtoReflect.Descriptor instead.
+func (*QueryAuditLogRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *QueryAuditLogRequest) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *QueryAuditLogRequest) GetContainerId() string {
+	if x != nil {
+		return x.ContainerId
+	}
+	return ""
+}
+
+func (x *QueryAuditLogRequest) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *QueryAuditLogRequest) GetSince() int64 {
+	if x != nil {
+		return x.Since
+	}
+	return 0
+}
+
+func (x *QueryAuditLogRequest) GetUntil() int64 {
+	if x != nil {
+		return x.Until
+	}
+	return 0
+}
+
+func (x *QueryAuditLogRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+// QueryAuditLogResponse returns audit events, oldest first
+type QueryAuditLogResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Events        []*AuditEvent          `protobuf:"bytes,1,rep,name=events,proto3" json:"events,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryAuditLogResponse) Reset() {
+	*x = QueryAuditLogResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryAuditLogResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryAuditLogResponse) ProtoMessage() {}
+
+func (x *QueryAuditLogResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryAuditLogResponse.ProtoReflect.Descriptor instead.
+func (*QueryAuditLogResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *QueryAuditLogResponse) GetEvents() []*AuditEvent {
+	if x != nil {
+		return x.Events
+	}
+	return nil
+}
+
+// AuditEvent records an IP or block changing hands
+type AuditEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Time          int64                  `protobuf:"varint,1,opt,name=time,proto3" json:"time,omitempty"` // Event timestamp (Unix seconds)
+	Type          string                 `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`  // allocate, release, block_allocate or block_release
+	NodeId        string                 `protobuf:"bytes,3,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	ContainerId   string                 `protobuf:"bytes,4,opt,name=container_id,json=containerId,proto3" json:"container_id,omitempty"`
+	IfName        string                 `protobuf:"bytes,5,opt,name=if_name,json=ifName,proto3" json:"if_name,omitempty"`
+	PodName       string                 `protobuf:"bytes,6,opt,name=pod_name,json=podName,proto3" json:"pod_name,omitempty"`
+	PodNamespace  string                 `protobuf:"bytes,7,opt,name=pod_namespace,json=podNamespace,proto3" json:"pod_namespace,omitempty"`
+	Ip            string                 `protobuf:"bytes,8,opt,name=ip,proto3" json:"ip,omitempty"`
+	BlockCidr     string                 `protobuf:"bytes,9,opt,name=block_cidr,json=blockCidr,proto3" json:"block_cidr,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AuditEvent) Reset() {
+	*x = AuditEvent{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AuditEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AuditEvent) ProtoMessage() {}
+
+func (x *AuditEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AuditEvent.ProtoReflect.Descriptor instead.
+func (*AuditEvent) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *AuditEvent) GetTime() int64 {
+	if x != nil {
+		return x.Time
+	}
+	return 0
+}
+
+func (x *AuditEvent) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetContainerId() string {
+	if x != nil {
+		return x.ContainerId
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetIfName() string {
+	if x != nil {
+		return x.IfName
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetPodName() string {
+	if x != nil {
+		return x.PodName
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetPodNamespace() string {
+	if x != nil {
+		return x.PodNamespace
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *AuditEvent) GetBlockCidr() string {
+	if x != nil {
+		return x.BlockCidr
+	}
+	return ""
+}
+
+// GetIPHistoryRequest asks who held an IP during a period
+type GetIPHistoryRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ip            string                 `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	Since         int64                  `protobuf:"varint,2,opt,name=since,proto3" json:"since,omitempty"` // Start of the period (Unix seconds)
+	Until         int64                  `protobuf:"varint,3,opt,name=until,proto3" json:"until,omitempty"` // End of the period, 0 for now (Unix seconds)
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetIPHistoryRequest) Reset() {
+	*x = GetIPHistoryRequest{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetIPHistoryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetIPHistoryRequest) ProtoMessage() {}
+
+func (x *GetIPHistoryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetIPHistoryRequest.ProtoReflect.Descriptor instead.
+func (*GetIPHistoryRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *GetIPHistoryRequest) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *GetIPHistoryRequest) GetSince() int64 {
+	if x != nil {
+		return x.Since
+	}
+	return 0
+}
+
+func (x *GetIPHistoryRequest) GetUntil() int64 {
+	if x != nil {
+		return x.Until
+	}
+	return 0
+}
+
+// GetIPHistoryResponse returns the holdings of the IP, oldest first
+type GetIPHistoryResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Holdings      []*IPHolding           `protobuf:"bytes,1,rep,name=holdings,proto3" json:"holdings,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetIPHistoryResponse) Reset() {
+	*x = GetIPHistoryResponse{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetIPHistoryResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetIPHistoryResponse) ProtoMessage() {}
+
+func (x *GetIPHistoryResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetIPHistoryResponse.ProtoReflect.Descriptor instead.
+func (*GetIPHistoryResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *GetIPHistoryResponse) GetHoldings() []*IPHolding {
+	if x != nil {
+		return x.Holdings
+	}
+	return nil
+}
+
+// IPHolding is a period during which a container held an IP
+type IPHolding struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ip            string                 `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	NodeId        string                 `protobuf:"bytes,2,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+	ContainerId   string                 `protobuf:"bytes,3,opt,name=container_id,json=containerId,proto3" json:"container_id,omitempty"`
+	IfName        string                 `protobuf:"bytes,4,opt,name=if_name,json=ifName,proto3" json:"if_name,omitempty"`
+	PodName       string                 `protobuf:"bytes,5,opt,name=pod_name,json=podName,proto3" json:"pod_name,omitempty"`
+	PodNamespace  string                 `protobuf:"bytes,6,opt,name=pod_namespace,json=podNamespace,proto3" json:"pod_namespace,omitempty"`
+	From          int64                  `protobuf:"varint,7,opt,name=from,proto3" json:"from,omitempty"` // Allocation time, 0 if before the retained log (Unix seconds)
+	To            int64                  `protobuf:"varint,8,opt,name=to,proto3" json:"to,omitempty"`     // Release time, 0 while still held (Unix seconds)
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IPHolding) Reset() {
+	*x = IPHolding{}
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IPHolding) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IPHolding) ProtoMessage() {}
+
+func (x *IPHolding) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_api_proto_ipam_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IPHolding.ProtoReflect.Descriptor instead.
+func (*IPHolding) Descriptor() ([]byte, []int) {
+	return file_pkg_api_proto_ipam_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *IPHolding) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *IPHolding) GetNodeId() string {
+	if x != nil {
+		return x.NodeId
+	}
+	return ""
+}
+
+func (x *IPHolding) GetContainerId() string {
+	if x != nil {
+		return x.ContainerId
+	}
+	return ""
+}
+
+func (x *IPHolding) GetIfName() string {
+	if x != nil {
+		return x.IfName
+	}
+	return ""
+}
+
+func (x *IPHolding) GetPodName() string {
+	if x != nil {
+		return x.PodName
+	}
+	return ""
+}
+
+func (x *IPHolding) GetPodNamespace() string {
+	if x != nil {
+		return x.PodNamespace
+	}
+	return ""
+}
+
+func (x *IPHolding) GetFrom() int64 {
+	if x != nil {
+		return x.From
+	}
+	return 0
+}
+
+func (x *IPHolding) GetTo() int64 {
+	if x != nil {
+		return x.To
+	}
+	return 0
+}
+
+var File_pkg_api_proto_ipam_proto protoreflect.FileDescriptor
+
+const file_pkg_api_proto_ipam_proto_rawDesc = "" +
+	"\n" +
+	"\x18pkg/api/proto/ipam.proto\x12\x04ipam\"\xce\x01\n" +
+	"\x11AllocateIPRequest\x12\x17\n" +
+	"\anode_id\x18\x01 \x01(\tR\x06nodeId\x12\x19\n" +
+	"\bpod_name\x18\x02 \x01(\tR\apodName\x12#\n" +
+	"\rpod_namespace\x18\x03 \x01(\tR\fpodNamespace\x12!\n" +
+	"\fcontainer_id\x18\x04 \x01(\tR\vcontainerId\x12\x17\n" +
+	"\aif_name\x18\x05 \x01(\tR\x06ifName\x12\x14\n" +
+	"\x05netns\x18\x06 \x01(\tR\x05netns\x12\x0e\n" +
+	"\x02ip\x18\a \x01(\tR\x02ip\"w\n" +
+	"\x12AllocateIPResponse\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\x12\x12\n" +
+	"\x04cidr\x18\x02 \x01(\tR\x04cidr\x12\x18\n" +
+	"\agateway\x18\x03 \x01(\tR\agateway\x12#\n" +
+	"\x06routes\x18\x04 \x03(\v2\v.ipam.RouteR\x06routes\")\n" +
+	"\x05Route\x12\x10\n" +
+	"\x03dst\x18\x01 \x01(\tR\x03dst\x12\x0e\n" +
+	"\x02gw\x18\x02 \x01(\tR\x02gw\"w\n" +
+	"\x10ReleaseIPRequest\x12\x17\n" +
+	"\anode_id\x18\x01 \x01(\tR\x06nodeId\x12\x0e\n" +
+	"\x02ip\x18\x02 \x01(\tR\x02ip\x12!\n" +
+	"\fcontainer_id\x18\x03 \x01(\tR\vcontainerId\x12\x17\n" +
+	"\aif_name\x18\x04 \x01(\tR\x06ifName\"G\n" +
+	"\x11ReleaseIPResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"/\n" +
+	"\x14GetNodeBlocksRequest\x12\x17\n" +
+	"\anode_id\x18\x01 \x01(\tR\x06nodeId\">\n" +
+	"\x15GetNodeBlocksResponse\x12%\n" +
+	"\x06blocks\x18\x01 \x03(\v2\r.ipam.IPBlockR\x06blocks\"\x9d\x01\n" +
+	"\aIPBlock\x12\x12\n" +
+	"\x04cidr\x18\x01 \x01(\tR\x04cidr\x12\x17\n" +
+	"\anode_id\x18\x02 \x01(\tR\x06nodeId\x12\x14\n" +
+	"\x05total\x18\x03 \x01(\x05R\x05total\x12\x12\n" +
+	"\x04used\x18\x04 \x01(\x05R\x04used\x12\x1c\n" +
+	"\tavailable\x18\x05 \x01(\x05R\tavailable\x12\x1d\n" +
+	"\n" +
+	"created_at\x18\x06 \x01(\x03R\tcreatedAt\"\x15\n" +
+	"\x13GetPoolStatsRequest\"\xf9\x02\n" +
+	"\x14GetPoolStatsResponse\x12\x1f\n" +
+	"\vtotal_nodes\x18\x01 \x01(\x05R\n" +
+	"totalNodes\x12!\n" +
+	"\ftotal_blocks\x18\x02 \x01(\x05R\vtotalBlocks\x12\x1b\n" +
+	"\ttotal_ips\x18\x03 \x01(\x05R\btotalIps\x12\x19\n" +
+	"\bused_ips\x18\x04 \x01(\x05R\ausedIps\x12#\n" +
+	"\ravailable_ips\x18\x05 \x01(\x05R\favailableIps\x12H\n" +
+	"\n" +
+	"node_stats\x18\x06 \x03(\v2).ipam.GetPoolStatsResponse.NodeStatsEntryR\tnodeStats\x12'\n" +
+	"\x0fquarantined_ips\x18\a \x01(\x05R\x0equarantinedIps\x1aM\n" +
+	"\x0eNodeStatsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12%\n" +
+	"\x05value\x18\x02 \x01(\v2\x0f.ipam.NodeStatsR\x05value:\x028\x01\"\xc2\x01\n" +
+	"\tNodeStats\x12\x17\n" +
+	"\anode_id\x18\x01 \x01(\tR\x06nodeId\x12\x16\n" +
+	"\x06blocks\x18\x02 \x01(\x05R\x06blocks\x12\x1b\n" +
+	"\ttotal_ips\x18\x03 \x01(\x05R\btotalIps\x12\x19\n" +
+	"\bused_ips\x18\x04 \x01(\x05R\ausedIps\x12#\n" +
+	"\ravailable_ips\x18\x05 \x01(\x05R\favailableIps\x12'\n" +
+	"\x0fquarantined_ips\x18\x06 \x01(\x05R\x0equarantinedIps\"N\n" +
+	"\x14AllocateBlockRequest\x12\x17\n" +
+	"\anode_id\x18\x01 \x01(\tR\x06nodeId\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\tR\trequestId\"<\n" +
+	"\x15AllocateBlockResponse\x12#\n" +
+	"\x05block\x18\x01 \x01(\v2\r.ipam.IPBlockR\x05block\"B\n" +
+	"\x13ReleaseBlockRequest\x12\x17\n" +
+	"\anode_id\x18\x01 \x01(\tR\x06nodeId\x12\x12\n" +
+	"\x04cidr\x18\x02 \x01(\tR\x04cidr\"J\n" +
+	"\x14ReleaseBlockResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"\xa4\x01\n" +
+	"\x14QueryAuditLogRequest\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\x12!\n" +
+	"\fcontainer_id\x18\x02 \x01(\tR\vcontainerId\x12\x17\n" +
+	"\anode_id\x18\x03 \x01(\tR\x06nodeId\x12\x14\n" +
+	"\x05since\x18\x04 \x01(\x03R\x05since\x12\x14\n" +
+	"\x05until\x18\x05 \x01(\x03R\x05until\x12\x14\n" +
+	"\x05limit\x18\x06 \x01(\x05R\x05limit\"A\n" +
+	"\x15QueryAuditLogResponse\x12(\n" +
+	"\x06events\x18\x01 \x03(\v2\x10.ipam.AuditEventR\x06events\"\xf8\x01\n" +
+	"\n" +
+	"AuditEvent\x12\x12\n" +
+	"\x04time\x18\x01 \x01(\x03R\x04time\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x17\n" +
+	"\anode_id\x18\x03 \x01(\tR\x06nodeId\x12!\n" +
+	"\fcontainer_id\x18\x04 \x01(\tR\vcontainerId\x12\x17\n" +
+	"\aif_name\x18\x05 \x01(\tR\x06ifName\x12\x19\n" +
+	"\bpod_name\x18\x06 \x01(\tR\apodName\x12#\n" +
+	"\rpod_namespace\x18\a \x01(\tR\fpodNamespace\x12\x0e\n" +
+	"\x02ip\x18\b \x01(\tR\x02ip\x12\x1d\n" +
+	"\n" +
+	"block_cidr\x18\t \x01(\tR\tblockCidr\"Q\n" +
+	"\x13GetIPHistoryRequest\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\x12\x14\n" +
+	"\x05since\x18\x02 \x01(\x03R\x05since\x12\x14\n" +
+	"\x05until\x18\x03 \x01(\x03R\x05until\"C\n" +
+	"\x14GetIPHistoryResponse\x12+\n" +
+	"\bholdings\x18\x01 \x03(\v2\x0f.ipam.IPHoldingR\bholdings\"\xd4\x01\n" +
+	"\tIPHolding\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\x12\x17\n" +
+	"\anode_id\x18\x02 \x01(\tR\x06nodeId\x12!\n" +
+	"\fcontainer_id\x18\x03 \x01(\tR\vcontainerId\x12\x17\n" +
+	"\aif_name\x18\x04 \x01(\tR\x06ifName\x12\x19\n" +
+	"\bpod_name\x18\x05 \x01(\tR\apodName\x12#\n" +
+	"\rpod_namespace\x18\x06 \x01(\tR\fpodNamespace\x12\x12\n" +
+	"\x04from\x18\a \x01(\x03R\x04from\x12\x0e\n" +
+	"\x02to\x18\b \x01(\x03R\x02to2\xb8\x04\n" +
+	"\x04IPAM\x12?\n" +
+	"\n" +
+	"AllocateIP\x12\x17.ipam.AllocateIPRequest\x1a\x18.ipam.AllocateIPResponse\x12<\n" +
+	"\tReleaseIP\x12\x16.ipam.ReleaseIPRequest\x1a\x17.ipam.ReleaseIPResponse\x12H\n" +
+	"\rGetNodeBlocks\x12\x1a.ipam.GetNodeBlocksRequest\x1a\x1b.ipam.GetNodeBlocksResponse\x12E\n" +
+	"\fGetPoolStats\x12\x19.ipam.GetPoolStatsRequest\x1a\x1a.ipam.GetPoolStatsResponse\x12H\n" +
+	"\rAllocateBlock\x12\x1a.ipam.AllocateBlockRequest\x1a\x1b.ipam.AllocateBlockResponse\x12E\n" +
+	"\fReleaseBlock\x12\x19.ipam.ReleaseBlockRequest\x1a\x1a.ipam.ReleaseBlockResponse\x12H\n" +
+	"\rQueryAuditLog\x12\x1a.ipam.QueryAuditLogRequest\x1a\x1b.ipam.QueryAuditLogResponse\x12E\n" +
+	"\fGetIPHistory\x12\x19.ipam.GetIPHistoryRequest\x1a\x1a.ipam.GetIPHistoryResponseB/Z-github.com/jianzi123/ipam/pkg/api/proto;protob\x06proto3"
+
+var (
+	file_pkg_api_proto_ipam_proto_rawDescOnce sync.Once
+	file_pkg_api_proto_ipam_proto_rawDescData []byte
+)
+
+func file_pkg_api_proto_ipam_proto_rawDescGZIP() []byte {
+	file_pkg_api_proto_ipam_proto_rawDescOnce.Do(func() {
+		file_pkg_api_proto_ipam_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pkg_api_proto_ipam_proto_rawDesc), len(file_pkg_api_proto_ipam_proto_rawDesc)))
+	})
+	return file_pkg_api_proto_ipam_proto_rawDescData
+}
+
+var file_pkg_api_proto_ipam_proto_msgTypes = make([]protoimpl.MessageInfo, 22)
+var file_pkg_api_proto_ipam_proto_goTypes = []any{
+	(*AllocateIPRequest)(nil),     // 0: ipam.AllocateIPRequest
+	(*AllocateIPResponse)(nil),    // 1: ipam.AllocateIPResponse
+	(*Route)(nil),                 // 2: ipam.Route
+	(*ReleaseIPRequest)(nil),      // 3: ipam.ReleaseIPRequest
+	(*ReleaseIPResponse)(nil),     // 4: ipam.ReleaseIPResponse
+	(*GetNodeBlocksRequest)(nil),  // 5: ipam.GetNodeBlocksRequest
+	(*GetNodeBlocksResponse)(nil), // 6: ipam.GetNodeBlocksResponse
+	(*IPBlock)(nil),               // 7: ipam.IPBlock
+	(*GetPoolStatsRequest)(nil),   // 8: ipam.GetPoolStatsRequest
+	(*GetPoolStatsResponse)(nil),  // 9: ipam.GetPoolStatsResponse
+	(*NodeStats)(nil),             // 10: ipam.NodeStats
+	(*AllocateBlockRequest)(nil),  // 11: ipam.AllocateBlockRequest
+	(*AllocateBlockResponse)(nil), // 12: ipam.AllocateBlockResponse
+	(*ReleaseBlockRequest)(nil),   // 13: ipam.ReleaseBlockRequest
+	(*ReleaseBlockResponse)(nil),  // 14: ipam.ReleaseBlockResponse
+	(*QueryAuditLogRequest)(nil),  // 15: ipam.QueryAuditLogRequest
+	(*QueryAuditLogResponse)(nil), // 16: ipam.QueryAuditLogResponse
+	(*AuditEvent)(nil),            // 17: ipam.AuditEvent
+	(*GetIPHistoryRequest)(nil),   // 18: ipam.GetIPHistoryRequest
+	(*GetIPHistoryResponse)(nil),  // 19: ipam.GetIPHistoryResponse
+	(*IPHolding)(nil),             // 20: ipam.IPHolding
+	nil,                           // 21: ipam.GetPoolStatsResponse.NodeStatsEntry
+}
+var file_pkg_api_proto_ipam_proto_depIdxs = []int32{
+	2,  // 0: ipam.AllocateIPResponse.routes:type_name -> ipam.Route
+	7,  // 1: ipam.GetNodeBlocksResponse.blocks:type_name -> ipam.IPBlock
+	21, // 2: ipam.GetPoolStatsResponse.node_stats:type_name -> ipam.GetPoolStatsResponse.NodeStatsEntry
+	7,  // 3: ipam.AllocateBlockResponse.block:type_name -> ipam.IPBlock
+	17, // 4: ipam.QueryAuditLogResponse.events:type_name -> ipam.AuditEvent
+	20, // 5: ipam.GetIPHistoryResponse.holdings:type_name -> ipam.IPHolding
+	10, // 6: ipam.GetPoolStatsResponse.NodeStatsEntry.value:type_name -> ipam.NodeStats
+	0,  // 7: ipam.IPAM.AllocateIP:input_type -> ipam.AllocateIPRequest
+	3,  // 8: ipam.IPAM.ReleaseIP:input_type -> ipam.ReleaseIPRequest
+	5,  // 9: ipam.IPAM.GetNodeBlocks:input_type -> ipam.GetNodeBlocksRequest
+	8,  // 10: ipam.IPAM.GetPoolStats:input_type -> ipam.GetPoolStatsRequest
+	11, // 11: ipam.IPAM.AllocateBlock:input_type -> ipam.AllocateBlockRequest
+	13, // 12: ipam.IPAM.ReleaseBlock:input_type -> ipam.ReleaseBlockRequest
+	15, // 13: ipam.IPAM.QueryAuditLog:input_type -> ipam.QueryAuditLogRequest
+	18, // 14: ipam.IPAM.GetIPHistory:input_type -> ipam.GetIPHistoryRequest
+	1,  // 15: ipam.IPAM.AllocateIP:output_type -> ipam.AllocateIPResponse
+	4,  // 16: ipam.IPAM.ReleaseIP:output_type -> ipam.ReleaseIPResponse
+	6,  // 17: ipam.IPAM.GetNodeBlocks:output_type -> ipam.GetNodeBlocksResponse
+	9,  // 18: ipam.IPAM.GetPoolStats:output_type -> ipam.GetPoolStatsResponse
+	12, // 19: ipam.IPAM.AllocateBlock:output_type -> ipam.AllocateBlockResponse
+	14, // 20: ipam.IPAM.ReleaseBlock:output_type -> ipam.ReleaseBlockResponse
+	16, // 21: ipam.IPAM.QueryAuditLog:output_type -> ipam.QueryAuditLogResponse
+	19, // 22: ipam.IPAM.GetIPHistory:output_type -> ipam.GetIPHistoryResponse
+	15, // [15:23] is the sub-list for method output_type
+	7,  // [7:15] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_pkg_api_proto_ipam_proto_init() }
+func file_pkg_api_proto_ipam_proto_init() {
+	if File_pkg_api_proto_ipam_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pkg_api_proto_ipam_proto_rawDesc), len(file_pkg_api_proto_ipam_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   22,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pkg_api_proto_ipam_proto_goTypes,
+		DependencyIndexes: file_pkg_api_proto_ipam_proto_depIdxs,
+		MessageInfos:      file_pkg_api_proto_ipam_proto_msgTypes,
+	}.Build()
+	File_pkg_api_proto_ipam_proto = out.File
+	file_pkg_api_proto_ipam_proto_goTypes = nil
+	file_pkg_api_proto_ipam_proto_depIdxs = nil
+}
@@ -0,0 +1,407 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: pkg/api/proto/ipam.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	IPAM_AllocateIP_FullMethodName    = "/ipam.IPAM/AllocateIP"
+	IPAM_ReleaseIP_FullMethodName     = "/ipam.IPAM/ReleaseIP"
+	IPAM_GetNodeBlocks_FullMethodName = "/ipam.IPAM/GetNodeBlocks"
+	IPAM_GetPoolStats_FullMethodName  = "/ipam.IPAM/GetPoolStats"
+	IPAM_AllocateBlock_FullMethodName = "/ipam.IPAM/AllocateBlock"
+	IPAM_ReleaseBlock_FullMethodName  = "/ipam.IPAM/ReleaseBlock"
+	IPAM_QueryAuditLog_FullMethodName = "/ipam.IPAM/QueryAuditLog"
+	IPAM_GetIPHistory_FullMethodName  = "/ipam.IPAM/GetIPHistory"
+)
+
+// IPAMClient is the client API for IPAM service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// IPAM service provides IP address management for CNI plugins
+type IPAMClient interface {
+	// AllocateIP allocates an IP address for a pod
+	AllocateIP(ctx context.Context, in *AllocateIPRequest, opts ...grpc.CallOption) (*AllocateIPResponse, error)
+	// ReleaseIP releases an IP address
+	ReleaseIP(ctx context.Context, in *ReleaseIPRequest, opts ...grpc.CallOption) (*ReleaseIPResponse, error)
+	// GetNodeBlocks returns all IP blocks allocated to a node
+	GetNodeBlocks(ctx context.Context, in *GetNodeBlocksRequest, opts ...grpc.CallOption) (*GetNodeBlocksResponse, error)
+	// GetPoolStats returns pool statistics
+	GetPoolStats(ctx context.Context, in *GetPoolStatsRequest, opts ...grpc.CallOption) (*GetPoolStatsResponse, error)
+	// AllocateBlock allocates a new IP block for a node (admin operation)
+	AllocateBlock(ctx context.Context, in *AllocateBlockRequest, opts ...grpc.CallOption) (*AllocateBlockResponse, error)
+	// ReleaseBlock releases an IP block from a node (admin operation)
+	ReleaseBlock(ctx context.Context, in *ReleaseBlockRequest, opts ...grpc.CallOption) (*ReleaseBlockResponse, error)
+	// QueryAuditLog returns recorded allocation changes
+	QueryAuditLog(ctx context.Context, in *QueryAuditLogRequest, opts ...grpc.CallOption) (*QueryAuditLogResponse, error)
+	// GetIPHistory returns who held an IP during a period
+	GetIPHistory(ctx context.Context, in *GetIPHistoryRequest, opts ...grpc.CallOption) (*GetIPHistoryResponse, error)
+}
+
+type iPAMClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIPAMClient(cc grpc.ClientConnInterface) IPAMClient {
+	return &iPAMClient{cc}
+}
+
+func (c *iPAMClient) AllocateIP(ctx context.Context, in *AllocateIPRequest, opts ...grpc.CallOption) (*AllocateIPResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AllocateIPResponse)
+	err := c.cc.Invoke(ctx, IPAM_AllocateIP_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) ReleaseIP(ctx context.Context, in *ReleaseIPRequest, opts ...grpc.CallOption) (*ReleaseIPResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReleaseIPResponse)
+	err := c.cc.Invoke(ctx, IPAM_ReleaseIP_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) GetNodeBlocks(ctx context.Context, in *GetNodeBlocksRequest, opts ...grpc.CallOption) (*GetNodeBlocksResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetNodeBlocksResponse)
+	err := c.cc.Invoke(ctx, IPAM_GetNodeBlocks_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) GetPoolStats(ctx context.Context, in *GetPoolStatsRequest, opts ...grpc.CallOption) (*GetPoolStatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetPoolStatsResponse)
+	err := c.cc.Invoke(ctx, IPAM_GetPoolStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) AllocateBlock(ctx context.Context, in *AllocateBlockRequest, opts ...grpc.CallOption) (*AllocateBlockResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AllocateBlockResponse)
+	err := c.cc.Invoke(ctx, IPAM_AllocateBlock_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) ReleaseBlock(ctx context.Context, in *ReleaseBlockRequest, opts ...grpc.CallOption) (*ReleaseBlockResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReleaseBlockResponse)
+	err := c.cc.Invoke(ctx, IPAM_ReleaseBlock_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) QueryAuditLog(ctx context.Context, in *QueryAuditLogRequest, opts ...grpc.CallOption) (*QueryAuditLogResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueryAuditLogResponse)
+	err := c.cc.Invoke(ctx, IPAM_QueryAuditLog_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) GetIPHistory(ctx context.Context, in *GetIPHistoryRequest, opts ...grpc.CallOption) (*GetIPHistoryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetIPHistoryResponse)
+	err := c.cc.Invoke(ctx, IPAM_GetIPHistory_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IPAMServer is the server API for IPAM service.
+// All implementations must embed UnimplementedIPAMServer
+// for forward compatibility.
+//
+// IPAM service provides IP address management for CNI plugins
+type IPAMServer interface {
+	// AllocateIP allocates an IP address for a pod
+	AllocateIP(context.Context, *AllocateIPRequest) (*AllocateIPResponse, error)
+	// ReleaseIP releases an IP address
+	ReleaseIP(context.Context, *ReleaseIPRequest) (*ReleaseIPResponse, error)
+	// GetNodeBlocks returns all IP blocks allocated to a node
+	GetNodeBlocks(context.Context, *GetNodeBlocksRequest) (*GetNodeBlocksResponse, error)
+	// GetPoolStats returns pool statistics
+	GetPoolStats(context.Context, *GetPoolStatsRequest) (*GetPoolStatsResponse, error)
+	// AllocateBlock allocates a new IP block for a node (admin operation)
+	AllocateBlock(context.Context, *AllocateBlockRequest) (*AllocateBlockResponse, error)
+	// ReleaseBlock releases an IP block from a node (admin operation)
+	ReleaseBlock(context.Context, *ReleaseBlockRequest) (*ReleaseBlockResponse, error)
+	// QueryAuditLog returns recorded allocation changes
+	QueryAuditLog(context.Context, *QueryAuditLogRequest) (*QueryAuditLogResponse, error)
+	// GetIPHistory returns who held an IP during a period
+	GetIPHistory(context.Context, *GetIPHistoryRequest) (*GetIPHistoryResponse, error)
+	mustEmbedUnimplementedIPAMServer()
+}
+
+// UnimplementedIPAMServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIPAMServer struct{}
+
+func (UnimplementedIPAMServer) AllocateIP(context.Context, *AllocateIPRequest) (*AllocateIPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AllocateIP not implemented")
+}
+func (UnimplementedIPAMServer) ReleaseIP(context.Context, *ReleaseIPRequest) (*ReleaseIPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseIP not implemented")
+}
+func (UnimplementedIPAMServer) GetNodeBlocks(context.Context, *GetNodeBlocksRequest) (*GetNodeBlocksResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNodeBlocks not implemented")
+}
+func (UnimplementedIPAMServer) GetPoolStats(context.Context, *GetPoolStatsRequest) (*GetPoolStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPoolStats not implemented")
+}
+func (UnimplementedIPAMServer) AllocateBlock(context.Context, *AllocateBlockRequest) (*AllocateBlockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AllocateBlock not implemented")
+}
+func (UnimplementedIPAMServer) ReleaseBlock(context.Context, *ReleaseBlockRequest) (*ReleaseBlockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReleaseBlock not implemented")
+}
+func (UnimplementedIPAMServer) QueryAuditLog(context.Context, *QueryAuditLogRequest) (*QueryAuditLogResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAuditLog not implemented")
+}
+func (UnimplementedIPAMServer) GetIPHistory(context.Context, *GetIPHistoryRequest) (*GetIPHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetIPHistory not implemented")
+}
+func (UnimplementedIPAMServer) mustEmbedUnimplementedIPAMServer() {}
+func (UnimplementedIPAMServer) testEmbeddedByValue()              {}
+
+// UnsafeIPAMServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IPAMServer will
+// result in compilation errors.
+type UnsafeIPAMServer interface {
+	mustEmbedUnimplementedIPAMServer()
+}
+
+func RegisterIPAMServer(s grpc.ServiceRegistrar, srv IPAMServer) {
+	// If the following call pancis, it indicates UnimplementedIPAMServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&IPAM_ServiceDesc, srv)
+}
+
+func _IPAM_AllocateIP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateIPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).AllocateIP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_AllocateIP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).AllocateIP(ctx, req.(*AllocateIPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_ReleaseIP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseIPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).ReleaseIP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_ReleaseIP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).ReleaseIP(ctx, req.(*ReleaseIPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_GetNodeBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNodeBlocksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).GetNodeBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_GetNodeBlocks_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).GetNodeBlocks(ctx, req.(*GetNodeBlocksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_GetPoolStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPoolStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).GetPoolStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_GetPoolStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).GetPoolStats(ctx, req.(*GetPoolStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_AllocateBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateBlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).AllocateBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_AllocateBlock_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).AllocateBlock(ctx, req.(*AllocateBlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_ReleaseBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseBlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).ReleaseBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_ReleaseBlock_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).ReleaseBlock(ctx, req.(*ReleaseBlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_QueryAuditLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryAuditLogRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).QueryAuditLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_QueryAuditLog_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).QueryAuditLog(ctx, req.(*QueryAuditLogRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_GetIPHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetIPHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).GetIPHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_GetIPHistory_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).GetIPHistory(ctx, req.(*GetIPHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// IPAM_ServiceDesc is the grpc.ServiceDesc for IPAM service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var IPAM_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ipam.IPAM",
+	HandlerType: (*IPAMServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AllocateIP",
+			Handler:    _IPAM_AllocateIP_Handler,
+		},
+		{
+			MethodName: "ReleaseIP",
+			Handler:    _IPAM_ReleaseIP_Handler,
+		},
+		{
+			MethodName: "GetNodeBlocks",
+			Handler:    _IPAM_GetNodeBlocks_Handler,
+		},
+		{
+			MethodName: "GetPoolStats",
+			Handler:    _IPAM_GetPoolStats_Handler,
+		},
+		{
+			MethodName: "AllocateBlock",
+			Handler:    _IPAM_AllocateBlock_Handler,
+		},
+		{
+			MethodName: "ReleaseBlock",
+			Handler:    _IPAM_ReleaseBlock_Handler,
+		},
+		{
+			MethodName: "QueryAuditLog",
+			Handler:    _IPAM_QueryAuditLog_Handler,
+		},
+		{
+			MethodName: "GetIPHistory",
+			Handler:    _IPAM_GetIPHistory_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/api/proto/ipam.proto",
+}
@@ -17,6 +17,20 @@ type NetConf struct {
 	Name       string `json:"name"`
 	Type       string `json:"type"`
 	IPAM       *IPAM  `json:"ipam,omitempty"`
+
+	// PrevResult is the result of the previous ADD, passed on DEL and CHECK
+	// DEL releases its IP, which a daemon without a store needs
+	PrevResult *Result `json:"prevResult,omitempty"`
+
+	// RuntimeConfig holds the capability arguments set by the runtime
+	RuntimeConfig *RuntimeConfig `json:"runtimeConfig,omitempty"`
+}
+
+// RuntimeConfig represents the runtime capability arguments the plugin uses
+type RuntimeConfig struct {
+	// IPs are the addresses asked for through the "ips" capability, with or
+	// without a prefix length
+	IPs []string `json:"ips,omitempty"`
 }
 
 // IPAM represents the IPAM configuration
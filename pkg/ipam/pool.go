@@ -3,8 +3,11 @@ package ipam
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/jianzi123/ipam/pkg/allocator"
 )
@@ -16,6 +19,7 @@ var (
 	ErrInvalidCIDR     = errors.New("invalid CIDR")
 	ErrBlockInUse      = errors.New("block still has allocated IPs")
 	ErrDuplicateBlock  = errors.New("block already exists")
+	ErrIPOutOfRange    = errors.New("IP not in any block of the node")
 )
 
 // Pool manages IP blocks for all nodes in the cluster
@@ -23,6 +27,15 @@ type Pool struct {
 	clusterCIDR *net.IPNet
 	blockSize   int // CIDR prefix length for each block (e.g., 24 for /24)
 
+	// reservation selects the addresses of every block that are never allocated
+	reservation allocator.Reservation
+
+	// selection picks which free address of a block is allocated next
+	selection allocator.Selection
+
+	// quarantine is how long released IPs wait before they are reused
+	quarantine time.Duration
+
 	// nodeBlocks maps node ID to list of IP blocks
 	nodeBlocks map[string][]*allocator.IPBlock
 
@@ -34,8 +47,11 @@ type Pool struct {
 
 // PoolConfig holds configuration for IP pool
 type PoolConfig struct {
-	ClusterCIDR string // e.g., "10.244.0.0/16"
-	BlockSize   int    // e.g., 24 for /24 blocks
+	ClusterCIDR string                // e.g., "10.244.0.0/16"
+	BlockSize   int                   // e.g., 24 for /24 blocks
+	Reservation allocator.Reservation // Gateway and other reserved addresses of each block
+	Selection   allocator.Selection   // IP selection strategy of each block
+	Quarantine  time.Duration         // Cool-down of released IPs, zero reuses them at once
 }
 
 // NewPool creates a new IP pool
@@ -51,9 +67,22 @@ func NewPool(config PoolConfig) (*Pool, error) {
 		return nil, fmt.Errorf("invalid block size %d for CIDR /%d", config.BlockSize, ones)
 	}
 
+	if usable := (1 << (bits - config.BlockSize)) - 2; usable > 0 {
+		if err := config.Reservation.Validate(usable); err != nil {
+			return nil, fmt.Errorf("invalid reservation for /%d blocks: %w", config.BlockSize, err)
+		}
+	}
+
+	if err := config.Selection.Validate(); err != nil {
+		return nil, err
+	}
+
 	return &Pool{
 		clusterCIDR:     cidr,
 		blockSize:       config.BlockSize,
+		reservation:     config.Reservation,
+		selection:       config.Selection,
+		quarantine:      config.Quarantine,
 		nodeBlocks:      make(map[string][]*allocator.IPBlock),
 		allocatedBlocks: make(map[string]bool),
 	}, nil
@@ -71,8 +100,57 @@ func (p *Pool) AllocateBlockForNode(nodeID string) (*allocator.IPBlock, error) {
 		return nil, err
 	}
 
+	return p.addBlock(nodeID, blockCIDR)
+}
+
+// AllocateBlockCIDRForNode assigns a specific block CIDR to a node
+// The CIDR must be a block-sized subnet of the cluster CIDR that is not yet allocated
+func (p *Pool) AllocateBlockCIDRForNode(nodeID string, blockCIDR string) (*allocator.IPBlock, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	canonical, err := p.validateBlockCIDR(blockCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.allocatedBlocks[canonical] {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateBlock, canonical)
+	}
+
+	return p.addBlock(nodeID, canonical)
+}
+
+// Reservation returns the addresses every block of the pool reserves
+func (p *Pool) Reservation() allocator.Reservation {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.reservation
+}
+
+// Selection returns the IP selection strategy of the pool's blocks
+func (p *Pool) Selection() allocator.Selection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.selection
+}
+
+// NextAvailableBlock returns the CIDR that the next block allocation would use
+// The pool is not modified
+func (p *Pool) NextAvailableBlock() (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.findAvailableBlock()
+}
+
+// addBlock creates a block and assigns it to a node
+// Must be called with lock held
+func (p *Pool) addBlock(nodeID string, blockCIDR string) (*allocator.IPBlock, error) {
 	// Create IP block
-	block, err := allocator.NewIPBlock(blockCIDR, nodeID)
+	block, err := p.newBlock(blockCIDR, nodeID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create IP block: %w", err)
 	}
@@ -84,6 +162,44 @@ func (p *Pool) AllocateBlockForNode(nodeID string) (*allocator.IPBlock, error) {
 	return block, nil
 }
 
+// newBlock creates a block with the pool's reservation and selection strategy
+// Must be called with lock held
+func (p *Pool) newBlock(blockCIDR string, nodeID string) (*allocator.IPBlock, error) {
+	block, err := allocator.NewIPBlockWithReservation(blockCIDR, nodeID, p.reservation)
+	if err != nil {
+		return nil, err
+	}
+	if err := block.SetSelection(p.selection); err != nil {
+		return nil, err
+	}
+	block.SetQuarantine(p.quarantine)
+	return block, nil
+}
+
+// validateBlockCIDR checks that a CIDR is a block-aligned subnet of the cluster CIDR
+// Returns the canonical CIDR string
+func (p *Pool) validateBlockCIDR(blockCIDR string) (string, error) {
+	ip, ipNet, err := net.ParseCIDR(blockCIDR)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidCIDR, blockCIDR)
+	}
+
+	ones, _ := ipNet.Mask.Size()
+	if ones != p.blockSize {
+		return "", fmt.Errorf("%w: %s is not a /%d block", ErrInvalidCIDR, blockCIDR, p.blockSize)
+	}
+
+	if !ip.Equal(ipNet.IP) {
+		return "", fmt.Errorf("%w: %s is not aligned to a block boundary", ErrInvalidCIDR, blockCIDR)
+	}
+
+	if !p.clusterCIDR.Contains(ipNet.IP) {
+		return "", fmt.Errorf("%w: %s is outside cluster CIDR %s", ErrInvalidCIDR, blockCIDR, p.clusterCIDR)
+	}
+
+	return ipNet.String(), nil
+}
+
 // ReleaseBlockForNode releases an IP block from a node
 func (p *Pool) ReleaseBlockForNode(nodeID string, blockCIDR string) error {
 	p.mu.Lock()
@@ -121,6 +237,41 @@ func (p *Pool) ReleaseBlockForNode(nodeID string, blockCIDR string) error {
 	return nil
 }
 
+// ReclaimNode removes every block of a node, including blocks with allocated IPs
+// It returns the CIDRs of the removed blocks
+func (p *Pool) ReclaimNode(nodeID string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	blocks, exists := p.nodeBlocks[nodeID]
+	if !exists {
+		return nil, ErrNodeNotFound
+	}
+
+	cidrs := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		cidr := block.CIDR.String()
+		delete(p.allocatedBlocks, cidr)
+		cidrs = append(cidrs, cidr)
+	}
+	delete(p.nodeBlocks, nodeID)
+
+	return cidrs, nil
+}
+
+// NodeIDs returns the sorted IDs of all nodes known to the pool
+func (p *Pool) NodeIDs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	nodeIDs := make([]string, 0, len(p.nodeBlocks))
+	for nodeID := range p.nodeBlocks {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
+
 // GetNodeBlocks returns all blocks allocated to a node
 func (p *Pool) GetNodeBlocks(nodeID string) ([]*allocator.IPBlock, error) {
 	p.mu.RLock()
@@ -152,7 +303,7 @@ func (p *Pool) AllocateIPForNode(nodeID string) (net.IP, *allocator.IPBlock, err
 			return nil, nil, err
 		}
 
-		block, err := allocator.NewIPBlock(blockCIDR, nodeID)
+		block, err := p.newBlock(blockCIDR, nodeID)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -163,10 +314,8 @@ func (p *Pool) AllocateIPForNode(nodeID string) (net.IP, *allocator.IPBlock, err
 	}
 
 	// Try to allocate from existing blocks
-	for _, block := range blocks {
-		if ip, err := block.Allocate(); err == nil {
-			return ip, block, nil
-		}
+	if ip, block, err := allocateFrom(blocks, ""); err == nil {
+		return ip, block, nil
 	}
 
 	// All blocks are full, allocate new block
@@ -175,7 +324,7 @@ func (p *Pool) AllocateIPForNode(nodeID string) (net.IP, *allocator.IPBlock, err
 		return nil, nil, err
 	}
 
-	block, err := allocator.NewIPBlock(blockCIDR, nodeID)
+	block, err := p.newBlock(blockCIDR, nodeID)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -192,9 +341,117 @@ func (p *Pool) AllocateIPForNode(nodeID string) (net.IP, *allocator.IPBlock, err
 	return ip, block, nil
 }
 
+// AllocateIPFromExistingBlocks allocates an IP for a pod from the node's current blocks
+// Unlike AllocateIPForNode it never creates blocks, so block assignment can go through Raft
+// Returns allocator.ErrNoAvailableIP when every block of the node is full
+func (p *Pool) AllocateIPFromExistingBlocks(nodeID string) (net.IP, *allocator.IPBlock, error) {
+	return p.AllocateIPFromExistingBlocksFor(nodeID, "")
+}
+
+// AllocateIPFromExistingBlocksFor is AllocateIPFromExistingBlocks for a
+// container, whose ID the hash selection strategy picks the address from
+func (p *Pool) AllocateIPFromExistingBlocksFor(nodeID string, containerID string) (net.IP, *allocator.IPBlock, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	blocks, exists := p.nodeBlocks[nodeID]
+	if !exists {
+		return nil, nil, ErrNodeNotFound
+	}
+
+	return allocateFrom(blocks, containerID)
+}
+
+// allocateFrom allocates an IP for a container from the first block with a
+// free IP that is not cooling down, falling back to quarantined IPs only when
+// every block is otherwise full
+func allocateFrom(blocks []*allocator.IPBlock, containerID string) (net.IP, *allocator.IPBlock, error) {
+	for _, block := range blocks {
+		if block.Available() > block.Quarantined() {
+			if ip, err := block.AllocateFor(containerID); err == nil {
+				return ip, block, nil
+			}
+		}
+	}
+
+	for _, block := range blocks {
+		if ip, err := block.AllocateFor(containerID); err == nil {
+			return ip, block, nil
+		}
+	}
+
+	return nil, nil, allocator.ErrNoAvailableIP
+}
+
+// AllocateSpecificIP allocates a particular IP for a pod from the node's blocks
+// Returns ErrIPOutOfRange when no block of the node holds the IP, and
+// allocator.ErrIPReserved or allocator.ErrIPInUse when it cannot be handed out
+func (p *Pool) AllocateSpecificIP(nodeID string, ip net.IP) (*allocator.IPBlock, error) {
+	if ip == nil {
+		return nil, allocator.ErrInvalidIP
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, block := range p.nodeBlocks[nodeID] {
+		if block.CIDR.Contains(ip) {
+			if err := block.AllocateSpecific(ip); err != nil {
+				return nil, fmt.Errorf("cannot allocate %s: %w", ip, err)
+			}
+			return block, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s on node %s", ErrIPOutOfRange, ip, nodeID)
+}
+
+// SetIPState marks an IP in one of the node's blocks as allocated or free
+// Used to apply replicated allocation changes; setting the current state is a no-op
+func (p *Pool) SetIPState(nodeID string, ip net.IP, allocated bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	blocks, exists := p.nodeBlocks[nodeID]
+	if !exists {
+		return ErrNodeNotFound
+	}
+
+	for _, block := range blocks {
+		if block.CIDR.Contains(ip) {
+			if allocated {
+				return block.MarkAllocated(ip)
+			}
+			return block.MarkReleased(ip)
+		}
+	}
+
+	return ErrBlockNotFound
+}
+
+// IPState reports whether an IP in one of the node's blocks is allocated
+func (p *Pool) IPState(nodeID string, ip net.IP) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, block := range p.nodeBlocks[nodeID] {
+		if block.CIDR.Contains(ip) {
+			return block.Contains(ip), nil
+		}
+	}
+
+	return false, ErrBlockNotFound
+}
+
 // ReleaseIP releases an IP address
 // Searches all blocks to find which one contains the IP
 func (p *Pool) ReleaseIP(ip net.IP, nodeID string) error {
+	return p.ReleaseIPFor(ip, nodeID, "")
+}
+
+// ReleaseIPFor releases an IP a container held, which the hash strategy
+// lets it take back during the quarantine
+func (p *Pool) ReleaseIPFor(ip net.IP, nodeID string, containerID string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -206,7 +463,7 @@ func (p *Pool) ReleaseIP(ip net.IP, nodeID string) error {
 	// Find which block contains this IP
 	for _, block := range blocks {
 		if block.CIDR.Contains(ip) {
-			return block.Release(ip)
+			return block.ReleaseFor(ip, containerID)
 		}
 	}
 
@@ -234,17 +491,143 @@ func (p *Pool) GetStats() PoolStats {
 			nodeStats.TotalIPs += block.Total
 			nodeStats.UsedIPs += block.Used
 			nodeStats.AvailableIPs += block.Available()
+			nodeStats.QuarantinedIPs += block.Quarantined()
 		}
 
 		stats.NodeStats[nodeID] = nodeStats
 		stats.TotalIPs += nodeStats.TotalIPs
 		stats.UsedIPs += nodeStats.UsedIPs
 		stats.AvailableIPs += nodeStats.AvailableIPs
+		stats.QuarantinedIPs += nodeStats.QuarantinedIPs
 	}
 
 	return stats
 }
 
+// PoolSnapshot is a serializable copy of the complete pool state
+// Restores apply the reservation and selection the pool was configured with;
+// snapshots taken before either existed have no Reservation or Selection
+type PoolSnapshot struct {
+	ClusterCIDR string                               `json:"cluster_cidr"`
+	BlockSize   int                                  `json:"block_size"`
+	Reservation *allocator.Reservation               `json:"reservation,omitempty"`
+	Selection   *allocator.Selection                 `json:"selection,omitempty"`
+	NodeBlocks  map[string][]allocator.BlockSnapshot `json:"node_blocks"`
+}
+
+// Snapshot returns a point-in-time copy of the pool state
+// Blocks keep their per-node order so a restored pool allocates identically
+func (p *Pool) Snapshot() PoolSnapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	reservation := p.reservation
+	reservation.Offsets = append([]int(nil), reservation.Offsets...)
+	selection := p.selection
+
+	snap := PoolSnapshot{
+		ClusterCIDR: p.clusterCIDR.String(),
+		BlockSize:   p.blockSize,
+		Reservation: &reservation,
+		Selection:   &selection,
+		NodeBlocks:  make(map[string][]allocator.BlockSnapshot, len(p.nodeBlocks)),
+	}
+
+	for nodeID, blocks := range p.nodeBlocks {
+		nodeSnaps := make([]allocator.BlockSnapshot, len(blocks))
+		for i, block := range blocks {
+			nodeSnaps[i] = block.Snapshot()
+		}
+		snap.NodeBlocks[nodeID] = nodeSnaps
+	}
+
+	return snap
+}
+
+// Restore replaces the pool state with the contents of a snapshot
+// The pool is modified in place so existing references stay valid
+func (p *Pool) Restore(snap PoolSnapshot) error {
+	_, cidr, err := net.ParseCIDR(snap.ClusterCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid cluster CIDR in snapshot: %w", err)
+	}
+
+	ones, bits := cidr.Mask.Size()
+	if snap.BlockSize <= ones || snap.BlockSize > bits {
+		return fmt.Errorf("invalid block size %d for CIDR /%d in snapshot", snap.BlockSize, ones)
+	}
+
+	p.mu.RLock()
+	reservation := p.reservation
+	selection := p.selection
+	quarantine := p.quarantine
+	current := make(map[string]*allocator.IPBlock)
+	for _, blocks := range p.nodeBlocks {
+		for _, block := range blocks {
+			current[block.CIDR.String()] = block
+		}
+	}
+	p.mu.RUnlock()
+
+	// The configured reservation wins; addresses only the snapshot's
+	// reservation set aside are freed again
+	previous := reservation
+	if snap.Reservation != nil && !snap.Reservation.Equal(reservation) {
+		previous = *snap.Reservation
+		log.Printf("Warning: snapshot reservation %+v differs from the configured %+v, applying the configured one",
+			previous, reservation)
+	}
+	// The selection is a per-daemon setting, so the configured one wins too
+	if snap.Selection != nil && !snap.Selection.Equal(selection) {
+		log.Printf("Warning: snapshot selection %+v differs from the configured %+v, applying the configured one",
+			*snap.Selection, selection)
+	}
+
+	nodeBlocks := make(map[string][]*allocator.IPBlock, len(snap.NodeBlocks))
+	allocatedBlocks := make(map[string]bool)
+
+	for nodeID, blockSnaps := range snap.NodeBlocks {
+		blocks := make([]*allocator.IPBlock, 0, len(blockSnaps))
+		for _, blockSnap := range blockSnaps {
+			block, err := allocator.RestoreIPBlockFrom(blockSnap, previous, reservation)
+			if err != nil {
+				return fmt.Errorf("failed to restore block for node %s: %w", nodeID, err)
+			}
+			if err := block.SetSelection(selection); err != nil {
+				return fmt.Errorf("invalid selection: %w", err)
+			}
+			block.SetQuarantine(quarantine)
+
+			blockCIDR := block.CIDR.String()
+			if old, ok := current[blockCIDR]; ok && old.NodeID == block.NodeID {
+				block.KeepLocalState(old)
+			}
+			if !cidr.Contains(block.CIDR.IP) {
+				return fmt.Errorf("%w: block %s outside cluster CIDR %s", ErrInvalidCIDR, blockCIDR, cidr)
+			}
+			if allocatedBlocks[blockCIDR] {
+				return fmt.Errorf("%w: %s", ErrDuplicateBlock, blockCIDR)
+			}
+
+			blocks = append(blocks, block)
+			allocatedBlocks[blockCIDR] = true
+		}
+		nodeBlocks[nodeID] = blocks
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clusterCIDR = cidr
+	p.blockSize = snap.BlockSize
+	p.reservation = reservation
+	p.selection = selection
+	p.nodeBlocks = nodeBlocks
+	p.allocatedBlocks = allocatedBlocks
+
+	return nil
+}
+
 // findAvailableBlock finds next available block CIDR within cluster CIDR
 // Must be called with lock held
 func (p *Pool) findAvailableBlock() (string, error) {
@@ -287,16 +670,18 @@ type PoolStats struct {
 	TotalIPs       int
 	UsedIPs        int
 	AvailableIPs   int
+	QuarantinedIPs int // Free IPs cooling down after release, among AvailableIPs
 	NodeStats      map[string]NodeStats
 }
 
 // NodeStats contains per-node statistics
 type NodeStats struct {
-	NodeID       string
-	Blocks       int
-	TotalIPs     int
-	UsedIPs      int
-	AvailableIPs int
+	NodeID         string
+	Blocks         int
+	TotalIPs       int
+	UsedIPs        int
+	AvailableIPs   int
+	QuarantinedIPs int // Free IPs cooling down after release, among AvailableIPs
 }
 
 // String returns string representation of stats
@@ -1,9 +1,14 @@
 package ipam
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/jianzi123/ipam/pkg/allocator"
 )
 
 func TestPool(t *testing.T) {
@@ -38,8 +43,9 @@ func TestPool(t *testing.T) {
 			t.Errorf("Expected node1, got %s", block.NodeID)
 		}
 
-		if block.Total != 254 {
-			t.Errorf("Expected 254 IPs, got %d", block.Total)
+		// The gateway is not counted
+		if block.Total != 253 {
+			t.Errorf("Expected 253 IPs, got %d", block.Total)
 		}
 
 		// Allocate another block
@@ -171,6 +177,44 @@ func TestPool(t *testing.T) {
 		}
 	})
 
+	t.Run("Reclaim node", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+		})
+
+		pool.AllocateBlockForNode("node1")
+		pool.AllocateBlockForNode("node2")
+		pool.AllocateIPForNode("node1")
+		pool.AllocateBlockForNode("node1")
+
+		if nodeIDs := pool.NodeIDs(); !reflect.DeepEqual(nodeIDs, []string{"node1", "node2"}) {
+			t.Errorf("Expected [node1 node2], got %v", nodeIDs)
+		}
+
+		// Blocks with allocated IPs are reclaimed too
+		cidrs, err := pool.ReclaimNode("node1")
+		if err != nil {
+			t.Fatalf("ReclaimNode failed: %v", err)
+		}
+		if !reflect.DeepEqual(cidrs, []string{"10.244.0.0/24", "10.244.2.0/24"}) {
+			t.Errorf("Unexpected reclaimed blocks %v", cidrs)
+		}
+		if _, err := pool.GetNodeBlocks("node1"); err != ErrNodeNotFound {
+			t.Errorf("Expected ErrNodeNotFound, got %v", err)
+		}
+
+		// Reclaimed blocks can be handed out again
+		block, _ := pool.AllocateBlockForNode("node3")
+		if block.CIDR.String() != "10.244.0.0/24" {
+			t.Errorf("Expected 10.244.0.0/24 to be reused, got %s", block.CIDR)
+		}
+
+		if _, err := pool.ReclaimNode("node1"); err != ErrNodeNotFound {
+			t.Errorf("Expected ErrNodeNotFound, got %v", err)
+		}
+	})
+
 	t.Run("Stats calculation", func(t *testing.T) {
 		pool, _ := NewPool(PoolConfig{
 			ClusterCIDR: "10.244.0.0/16",
@@ -227,6 +271,395 @@ func TestPool(t *testing.T) {
 			t.Errorf("Expected ErrCIDRExhausted, got %v", err)
 		}
 	})
+
+	t.Run("Allocate specific block CIDR", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+		})
+
+		next, err := pool.NextAvailableBlock()
+		if err != nil || next != "10.244.0.0/24" {
+			t.Fatalf("Expected next block 10.244.0.0/24, got %s (%v)", next, err)
+		}
+
+		block, err := pool.AllocateBlockCIDRForNode("node1", "10.244.5.0/24")
+		if err != nil {
+			t.Fatalf("AllocateBlockCIDRForNode failed: %v", err)
+		}
+		if block.CIDR.String() != "10.244.5.0/24" || block.NodeID != "node1" {
+			t.Errorf("Unexpected block %s", block)
+		}
+
+		// Same CIDR for another node conflicts
+		if _, err := pool.AllocateBlockCIDRForNode("node2", "10.244.5.0/24"); !errors.Is(err, ErrDuplicateBlock) {
+			t.Errorf("Expected ErrDuplicateBlock, got %v", err)
+		}
+
+		// Invalid CIDRs are rejected
+		for _, cidr := range []string{"garbage", "10.244.6.0/25", "10.244.6.1/24", "10.245.0.0/24"} {
+			if _, err := pool.AllocateBlockCIDRForNode("node2", cidr); !errors.Is(err, ErrInvalidCIDR) {
+				t.Errorf("Expected ErrInvalidCIDR for %s, got %v", cidr, err)
+			}
+		}
+
+		// Automatic allocation skips the claimed block
+		for i := 0; i < 5; i++ {
+			pool.AllocateBlockForNode("node2")
+		}
+		next, _ = pool.NextAvailableBlock()
+		if next != "10.244.6.0/24" {
+			t.Errorf("Expected next block 10.244.6.0/24, got %s", next)
+		}
+	})
+
+	t.Run("Allocate from existing blocks only", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/28",
+			BlockSize:   30,
+		})
+
+		if _, _, err := pool.AllocateIPFromExistingBlocks("node1"); err != ErrNodeNotFound {
+			t.Errorf("Expected ErrNodeNotFound, got %v", err)
+		}
+
+		// A /30 has two usable IPs, one of them the gateway
+		pool.AllocateBlockForNode("node1")
+		for i := 0; i < 1; i++ {
+			if _, _, err := pool.AllocateIPFromExistingBlocks("node1"); err != nil {
+				t.Fatalf("Allocation %d failed: %v", i, err)
+			}
+		}
+
+		if _, _, err := pool.AllocateIPFromExistingBlocks("node1"); err != allocator.ErrNoAvailableIP {
+			t.Errorf("Expected ErrNoAvailableIP, got %v", err)
+		}
+		if stats := pool.GetStats(); stats.TotalBlocks != 1 {
+			t.Errorf("Expected no new blocks, got %d", stats.TotalBlocks)
+		}
+	})
+
+	t.Run("Allocate specific IP", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+		})
+		block, _ := pool.AllocateBlockCIDRForNode("node1", "10.244.5.0/24")
+		pool.AllocateBlockCIDRForNode("node2", "10.244.6.0/24")
+
+		got, err := pool.AllocateSpecificIP("node1", net.ParseIP("10.244.5.9"))
+		if err != nil || got != block {
+			t.Fatalf("Expected 10.244.5.9 from %s, got %v (%v)", block, got, err)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP, got %d", stats.UsedIPs)
+		}
+
+		for _, c := range []struct {
+			ip  string
+			err error
+		}{
+			{"10.244.5.9", allocator.ErrIPInUse},
+			{"10.244.5.1", allocator.ErrIPReserved},
+			{"10.244.6.9", ErrIPOutOfRange},
+			{"192.168.0.9", ErrIPOutOfRange},
+		} {
+			if _, err := pool.AllocateSpecificIP("node1", net.ParseIP(c.ip)); !errors.Is(err, c.err) {
+				t.Errorf("%s: expected %v, got %v", c.ip, c.err, err)
+			}
+		}
+		if _, err := pool.AllocateSpecificIP("node1", nil); !errors.Is(err, allocator.ErrInvalidIP) {
+			t.Errorf("Expected ErrInvalidIP, got %v", err)
+		}
+	})
+
+	t.Run("Set IP state", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+		})
+		pool.AllocateBlockForNode("node1")
+		ip := net.ParseIP("10.244.0.9")
+
+		// Applying the same state twice is a no-op
+		for i := 0; i < 2; i++ {
+			if err := pool.SetIPState("node1", ip, true); err != nil {
+				t.Fatalf("SetIPState failed: %v", err)
+			}
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP, got %d", stats.UsedIPs)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := pool.SetIPState("node1", ip, false); err != nil {
+				t.Fatalf("SetIPState failed: %v", err)
+			}
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 0 {
+			t.Errorf("Expected 0 used IPs, got %d", stats.UsedIPs)
+		}
+
+		if err := pool.SetIPState("node2", ip, true); err != ErrNodeNotFound {
+			t.Errorf("Expected ErrNodeNotFound, got %v", err)
+		}
+		if err := pool.SetIPState("node1", net.ParseIP("10.244.1.9"), true); err != ErrBlockNotFound {
+			t.Errorf("Expected ErrBlockNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Snapshot and restore", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+		})
+
+		for i := 0; i < 5; i++ {
+			pool.AllocateIPForNode("node1")
+		}
+		pool.AllocateBlockForNode("node1")
+		pool.AllocateIPForNode("node2")
+
+		// Restore into a pool created with a different config
+		restored, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.0.0.0/8",
+			BlockSize:   16,
+		})
+		if err := restored.Restore(pool.Snapshot()); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+
+		if !reflect.DeepEqual(restored.Snapshot(), pool.Snapshot()) {
+			t.Error("Restored pool snapshot differs from original")
+		}
+
+		stats := restored.GetStats()
+		if stats.TotalBlocks != 3 || stats.UsedIPs != 6 {
+			t.Errorf("Expected 3 blocks and 6 used IPs, got %s", stats)
+		}
+
+		// New blocks must not collide with restored ones
+		block, err := restored.AllocateBlockForNode("node3")
+		if err != nil {
+			t.Fatalf("AllocateBlockForNode failed: %v", err)
+		}
+		if block.CIDR.String() != "10.244.3.0/24" {
+			t.Errorf("Expected 10.244.3.0/24, got %s", block.CIDR)
+		}
+	})
+
+	t.Run("Blocks reserve the configured addresses", func(t *testing.T) {
+		pool, err := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+			Reservation: allocator.Reservation{Gateway: allocator.GatewayLast, Offsets: []int{1}},
+		})
+		if err != nil {
+			t.Fatalf("NewPool failed: %v", err)
+		}
+
+		ip, block, err := pool.AllocateIPForNode("node1")
+		if err != nil {
+			t.Fatalf("AllocateIPForNode failed: %v", err)
+		}
+		if !ip.Equal(net.ParseIP("10.244.0.2")) || !block.Gateway.Equal(net.ParseIP("10.244.0.254")) {
+			t.Errorf("Expected 10.244.0.2 with gateway 10.244.0.254, got %s with %s", ip, block.Gateway)
+		}
+		if stats := pool.GetStats(); stats.TotalIPs != 252 || stats.AvailableIPs != 251 {
+			t.Errorf("Expected 251 of 252 IPs available, got %s", stats)
+		}
+
+		_, cidr, _ := net.ParseCIDR("10.244.7.0/24")
+		if gateway := pool.Reservation().GatewayFor(cidr); !gateway.Equal(net.ParseIP("10.244.7.254")) {
+			t.Errorf("Expected gateway 10.244.7.254, got %s", gateway)
+		}
+
+		// A reservation must fit the block size
+		_, err = NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   30,
+			Reservation: allocator.Reservation{Offsets: []int{2}},
+		})
+		if err == nil {
+			t.Error("Expected a reservation of every /30 address to be rejected")
+		}
+	})
+
+	t.Run("Restore applies the configured reservation", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+			Reservation: allocator.Reservation{Gateway: allocator.GatewayNone},
+		})
+		pool.AllocateIPForNode("node1")
+
+		// Addresses only the snapshot reserved are freed again
+		reserved, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+			Reservation: allocator.Reservation{Offsets: []int{10}},
+		})
+		reserved.AllocateIPForNode("node1")
+		restored, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+			Reservation: allocator.Reservation{Gateway: allocator.GatewayNone},
+		})
+		if err := restored.Restore(reserved.Snapshot()); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if !reflect.DeepEqual(restored.Reservation(), pool.Reservation()) {
+			t.Errorf("Expected the configured reservation %+v, got %+v", pool.Reservation(), restored.Reservation())
+		}
+		if stats := restored.GetStats(); stats.TotalIPs != 254 || stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 of 254 IPs used, got %s", stats)
+		}
+		if ip, _, _ := restored.AllocateIPFromExistingBlocks("node1"); !ip.Equal(net.ParseIP("10.244.0.1")) {
+			t.Errorf("Expected the former gateway 10.244.0.1, got %s", ip)
+		}
+
+		// A pod holding the address that becomes the gateway keeps it, but
+		// it counts as reserved from then on
+		gateway, _ := NewPool(PoolConfig{ClusterCIDR: "10.244.0.0/16", BlockSize: 24})
+		if err := gateway.Restore(pool.Snapshot()); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if stats := gateway.GetStats(); stats.TotalIPs != 253 || stats.UsedIPs != 0 {
+			t.Errorf("Expected the pod on the gateway to leave Used, got %s", stats)
+		}
+		if err := gateway.ReleaseIP(net.ParseIP("10.244.0.1"), "node1"); !errors.Is(err, allocator.ErrIPReserved) {
+			t.Errorf("Expected ErrIPReserved releasing the gateway a pod held, got %v", err)
+		}
+		if ip, _, _ := gateway.AllocateIPFromExistingBlocks("node1"); !ip.Equal(net.ParseIP("10.244.0.2")) {
+			t.Errorf("Expected 10.244.0.2, got %s", ip)
+		}
+
+		// Snapshots from before reservations keep the configured one, which
+		// takes over the gateway address a pod held
+		snap := pool.Snapshot()
+		snap.Reservation = nil
+		legacy, _ := NewPool(PoolConfig{ClusterCIDR: "10.244.0.0/16", BlockSize: 24})
+		if err := legacy.Restore(snap); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if legacy.Reservation().Gateway != "" {
+			t.Errorf("Expected the configured reservation, got %+v", legacy.Reservation())
+		}
+		if stats := legacy.GetStats(); stats.TotalIPs != 253 || stats.UsedIPs != 0 || stats.AvailableIPs != 253 {
+			t.Errorf("Expected 253 free IPs, got %s", stats)
+		}
+		if ip, _, _ := legacy.AllocateIPFromExistingBlocks("node1"); !ip.Equal(net.ParseIP("10.244.0.2")) {
+			t.Errorf("Expected 10.244.0.2, got %s", ip)
+		}
+	})
+
+	t.Run("Restore applies the configured selection", func(t *testing.T) {
+		pool, err := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+			Selection:   allocator.Selection{Strategy: allocator.StrategyNextFit},
+		})
+		if err != nil {
+			t.Fatalf("NewPool failed: %v", err)
+		}
+		first, _, _ := pool.AllocateIPForNode("node1")
+		pool.AllocateIPForNode("node1")
+		pool.ReleaseIP(first, "node1")
+
+		// A replica configured for lowest-first keeps its strategy
+		restored, _ := NewPool(PoolConfig{ClusterCIDR: "10.244.0.0/16", BlockSize: 24})
+		if err := restored.Restore(pool.Snapshot()); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if restored.Selection().Strategy != "" {
+			t.Errorf("Expected the configured selection, got %+v", restored.Selection())
+		}
+		if got, _, _ := restored.AllocateIPFromExistingBlocks("node1"); !got.Equal(first) {
+			t.Errorf("Expected lowest-first to reuse %s, got %s", first, got)
+		}
+		restored.ReleaseIP(first, "node1")
+
+		// The cursor is local, a restore keeps the one of the allocating pool
+		if err := pool.Restore(restored.Snapshot()); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if got, _, _ := pool.AllocateIPFromExistingBlocksFor("node1", "container-1"); !got.Equal(net.ParseIP("10.244.0.4")) {
+			t.Errorf("Expected 10.244.0.4 after the cursor, got %s", got)
+		}
+
+		if _, err := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+			Selection:   allocator.Selection{Strategy: "best-fit"},
+		}); err == nil {
+			t.Error("Expected an unknown strategy to be rejected")
+		}
+	})
+
+	t.Run("Released IPs are quarantined", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   29,
+			Quarantine:  time.Hour,
+		})
+
+		// Fill a /29 block of 5 IPs, then free one
+		var ips []net.IP
+		for i := 0; i < 5; i++ {
+			ip, _, err := pool.AllocateIPForNode("node1")
+			if err != nil {
+				t.Fatalf("AllocateIPForNode failed: %v", err)
+			}
+			ips = append(ips, ip)
+		}
+		pool.ReleaseIP(ips[0], "node1")
+
+		stats := pool.GetStats()
+		if stats.QuarantinedIPs != 1 || stats.NodeStats["node1"].QuarantinedIPs != 1 || stats.AvailableIPs != 1 {
+			t.Errorf("Expected 1 quarantined IP among 1 available, got %+v", stats)
+		}
+
+		// Restoring a snapshot keeps the local cool-downs
+		if err := pool.Restore(pool.Snapshot()); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if stats := pool.GetStats(); stats.QuarantinedIPs != 1 {
+			t.Errorf("Expected 1 quarantined IP after restore, got %d", stats.QuarantinedIPs)
+		}
+
+		// The only block is otherwise full, so the quarantined IP is reused
+		// rather than claiming a new block
+		if ip, _, _ := pool.AllocateIPFromExistingBlocks("node1"); !ip.Equal(ips[0]) {
+			t.Errorf("Expected %s, got %s", ips[0], ip)
+		}
+
+		// With another block that has free IPs, those go first
+		pool.AllocateIPForNode("node1")
+		pool.ReleaseIP(ips[1], "node1")
+		if ip, block, _ := pool.AllocateIPFromExistingBlocks("node1"); ip.Equal(ips[1]) || block.CIDR.Contains(ips[1]) {
+			t.Errorf("Expected an IP of the second block, got %s", ip)
+		}
+	})
+
+	t.Run("Restore rejects duplicate blocks", func(t *testing.T) {
+		pool, _ := NewPool(PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+		})
+		pool.AllocateBlockForNode("node1")
+
+		snap := pool.Snapshot()
+		snap.NodeBlocks["node2"] = snap.NodeBlocks["node1"]
+
+		if err := pool.Restore(snap); !errors.Is(err, ErrDuplicateBlock) {
+			t.Errorf("Expected ErrDuplicateBlock, got %v", err)
+		}
+
+		// Failed restore must leave the pool untouched
+		if stats := pool.GetStats(); stats.TotalNodes != 1 {
+			t.Errorf("Expected 1 node after failed restore, got %d", stats.TotalNodes)
+		}
+	})
 }
 
 func BenchmarkPoolAllocateIP(b *testing.B) {
@@ -13,13 +13,13 @@ type Collector struct {
 	metrics  *Metrics
 	pool     *ipam.Pool
 	raftNode *raft.Node
-	store    *store.Store
+	store    store.MappingStore
 	interval time.Duration
 	stopCh   chan struct{}
 }
 
 // NewCollector creates a new metrics collector
-func NewCollector(metrics *Metrics, pool *ipam.Pool, raftNode *raft.Node, store *store.Store, interval time.Duration) *Collector {
+func NewCollector(metrics *Metrics, pool *ipam.Pool, raftNode *raft.Node, store store.MappingStore, interval time.Duration) *Collector {
 	return &Collector{
 		metrics:  metrics,
 		pool:     pool,
@@ -74,6 +74,7 @@ func (c *Collector) collectPoolMetrics() {
 			nodeStats.AvailableIPs,
 			nodeStats.UsedIPs,
 			nodeStats.TotalIPs,
+			nodeStats.QuarantinedIPs,
 		)
 
 		// Update block count
@@ -21,9 +21,10 @@ type Metrics struct {
 	ReleaseDuration    prometheus.Histogram
 
 	// Pool metrics
-	AvailableIPs *prometheus.GaugeVec
-	UsedIPs      *prometheus.GaugeVec
-	TotalIPs     *prometheus.GaugeVec
+	AvailableIPs   *prometheus.GaugeVec
+	UsedIPs        *prometheus.GaugeVec
+	TotalIPs       *prometheus.GaugeVec
+	QuarantinedIPs *prometheus.GaugeVec
 
 	// Block metrics
 	BlocksPerNode *prometheus.GaugeVec
@@ -92,6 +93,10 @@ func NewMetrics() *Metrics {
 			Name: "ipam_total_ips",
 			Help: "Total number of IPs per node",
 		}, []string{"node"}),
+		QuarantinedIPs: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipam_quarantined_ips",
+			Help: "Number of released IPs per node still cooling down before reuse",
+		}, []string{"node"}),
 
 		// Block gauges
 		BlocksPerNode: promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -162,10 +167,11 @@ func (m *Metrics) RecordBlockRelease() {
 }
 
 // UpdatePoolMetrics updates pool-related metrics
-func (m *Metrics) UpdatePoolMetrics(nodeID string, available, used, total int) {
+func (m *Metrics) UpdatePoolMetrics(nodeID string, available, used, total, quarantined int) {
 	m.AvailableIPs.WithLabelValues(nodeID).Set(float64(available))
 	m.UsedIPs.WithLabelValues(nodeID).Set(float64(used))
 	m.TotalIPs.WithLabelValues(nodeID).Set(float64(total))
+	m.QuarantinedIPs.WithLabelValues(nodeID).Set(float64(quarantined))
 }
 
 // UpdateBlockMetrics updates block-related metrics
@@ -0,0 +1,188 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// logFormatVersion is the version byte leading every binary log entry
+// Bump it when the entry layout changes incompatibly
+const logFormatVersion byte = 1
+
+// legacyJSONPrefix starts every JSON entry written before the binary format
+const legacyJSONPrefix byte = '{'
+
+var (
+	// ErrUnsupportedLogVersion is returned for entries written in a newer format
+	ErrUnsupportedLogVersion = errors.New("unsupported log format version")
+
+	// ErrUnknownCommandType is returned for command types this version does not know
+	ErrUnknownCommandType = errors.New("unknown command type")
+
+	// ErrMalformedCommand is returned for entries that cannot be decoded
+	ErrMalformedCommand = errors.New("malformed command")
+)
+
+// LogFormat selects how new commands are written to the Raft log
+type LogFormat string
+
+const (
+	// LogFormatBinary writes versioned msgpack entries
+	LogFormatBinary LogFormat = "binary"
+
+	// LogFormatJSON writes JSON entries that versions before the binary
+	// format can read, for use while a rolling upgrade is in progress
+	LogFormatJSON LogFormat = "json"
+)
+
+// ParseLogFormat parses a log format name
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch format := LogFormat(name); format {
+	case LogFormatBinary, LogFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q", name)
+	}
+}
+
+// commandNames maps command types to their names in JSON entries
+var commandNames = map[CommandType]string{
+	CommandAllocateBlock: "allocate_block",
+	CommandReleaseBlock:  "release_block",
+	CommandUpdateUsage:   "update_usage",
+	CommandRenewLease:    "renew_lease",
+	CommandPinNode:       "pin_node",
+	CommandReclaimNode:   "reclaim_node",
+}
+
+// legacyCommand is the layout of JSON log entries
+type legacyCommand struct {
+	Type      string          `json:"type"`
+	NodeID    string          `json:"node_id"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Origin    string          `json:"origin,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+}
+
+// newCommand builds a command whose payload is encoded in format
+func newCommand(format LogFormat, cmdType CommandType, nodeID string, payload interface{}) (Command, error) {
+	cmd := Command{Type: cmdType, NodeID: nodeID, format: format}
+	if payload == nil {
+		return cmd, nil
+	}
+
+	var data []byte
+	var err error
+	if format == LogFormatJSON {
+		data, err = json.Marshal(payload)
+	} else {
+		data, err = encodeMsgpack(payload)
+	}
+	if err != nil {
+		return Command{}, fmt.Errorf("failed to encode %s data: %w", cmdType, err)
+	}
+	cmd.Data = data
+	return cmd, nil
+}
+
+// encodeCommand encodes a command as a log entry in the command's format
+func encodeCommand(cmd Command) ([]byte, error) {
+	if cmd.format == LogFormatJSON {
+		name, ok := commandNames[cmd.Type]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s cannot be written as JSON", ErrUnknownCommandType, cmd.Type)
+		}
+		return json.Marshal(legacyCommand{
+			Type:      name,
+			NodeID:    cmd.NodeID,
+			Data:      cmd.Data,
+			Origin:    cmd.Origin,
+			RequestID: cmd.RequestID,
+		})
+	}
+
+	data, err := encodeMsgpack(&cmd)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{logFormatVersion}, data...), nil
+}
+
+// decodeCommand decodes a log entry in any supported format
+func decodeCommand(data []byte) (Command, error) {
+	if len(data) == 0 {
+		return Command{}, fmt.Errorf("%w: empty entry", ErrMalformedCommand)
+	}
+
+	switch data[0] {
+	case legacyJSONPrefix:
+		var legacy legacyCommand
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return Command{}, fmt.Errorf("%w: %v", ErrMalformedCommand, err)
+		}
+
+		cmd := Command{
+			NodeID:    legacy.NodeID,
+			Data:      legacy.Data,
+			Origin:    legacy.Origin,
+			RequestID: legacy.RequestID,
+			format:    LogFormatJSON,
+		}
+		for cmdType, name := range commandNames {
+			if name == legacy.Type {
+				cmd.Type = cmdType
+				return cmd, nil
+			}
+		}
+		return Command{}, fmt.Errorf("%w: %q", ErrUnknownCommandType, legacy.Type)
+
+	case logFormatVersion:
+		var cmd Command
+		if err := decodeMsgpack(data[1:], &cmd); err != nil {
+			return Command{}, fmt.Errorf("%w: %v", ErrMalformedCommand, err)
+		}
+		cmd.format = LogFormatBinary
+		return cmd, nil
+
+	default:
+		return Command{}, fmt.Errorf("%w: %d", ErrUnsupportedLogVersion, data[0])
+	}
+}
+
+// decodeData decodes the command payload into v
+func (c Command) decodeData(v interface{}) error {
+	var err error
+	if c.format == LogFormatJSON {
+		err = json.Unmarshal(c.Data, v)
+	} else {
+		err = decodeMsgpack(c.Data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal data: %w", err)
+	}
+	return nil
+}
+
+// msgpackHandle returns the codec settings of binary entries
+// WriteExt keeps strings and byte slices distinct on the wire
+func msgpackHandle() *codec.MsgpackHandle {
+	return &codec.MsgpackHandle{WriteExt: true}
+}
+
+// encodeMsgpack encodes v as msgpack
+func encodeMsgpack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, msgpackHandle()).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMsgpack decodes msgpack data into v
+func decodeMsgpack(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle()).Decode(v)
+}
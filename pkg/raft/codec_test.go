@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCommandCodec(t *testing.T) {
+	t.Run("Binary round trip", func(t *testing.T) {
+		cmd := newTestCommand(t, CommandUpdateUsage, "node1", UpdateUsageData{
+			Changes: []IPChange{{NodeID: "node1", IP: "10.244.0.1", Allocated: true}},
+		})
+		cmd.Origin = "origin"
+		cmd.RequestID = "request-1"
+
+		data, err := encodeCommand(cmd)
+		if err != nil {
+			t.Fatalf("encodeCommand failed: %v", err)
+		}
+		if data[0] != logFormatVersion {
+			t.Fatalf("Expected version byte %d, got %d", logFormatVersion, data[0])
+		}
+
+		decoded, err := decodeCommand(data)
+		if err != nil {
+			t.Fatalf("decodeCommand failed: %v", err)
+		}
+		if decoded.Type != cmd.Type || decoded.NodeID != "node1" || decoded.Origin != "origin" || decoded.RequestID != "request-1" {
+			t.Errorf("Decoded command differs: %+v", decoded)
+		}
+
+		var usage UpdateUsageData
+		if err := decoded.decodeData(&usage); err != nil {
+			t.Fatalf("decodeData failed: %v", err)
+		}
+		if len(usage.Changes) != 1 || usage.Changes[0].IP != "10.244.0.1" || !usage.Changes[0].Allocated {
+			t.Errorf("Decoded payload differs: %+v", usage)
+		}
+	})
+
+	t.Run("JSON format is readable by older versions", func(t *testing.T) {
+		cmd, err := newCommand(LogFormatJSON, CommandReleaseBlock, "node1", ReleaseBlockData{CIDR: "10.244.1.0/24"})
+		if err != nil {
+			t.Fatalf("newCommand failed: %v", err)
+		}
+
+		data, err := encodeCommand(cmd)
+		if err != nil {
+			t.Fatalf("encodeCommand failed: %v", err)
+		}
+
+		var legacy legacyCommand
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			t.Fatalf("Entry is not JSON: %v", err)
+		}
+		if legacy.Type != "release_block" || string(legacy.Data) != `{"cidr":"10.244.1.0/24"}` {
+			t.Errorf("Unexpected legacy entry: %s", data)
+		}
+
+		decoded, err := decodeCommand(data)
+		if err != nil || decoded.Type != CommandReleaseBlock {
+			t.Errorf("decodeCommand failed: %+v %v", decoded, err)
+		}
+	})
+
+	t.Run("Binary entries are smaller than JSON", func(t *testing.T) {
+		payload := UpdateUsageData{Changes: []IPChange{
+			{NodeID: "node1", IP: "10.244.0.1", Allocated: true},
+			{NodeID: "node1", IP: "10.244.0.2", Allocated: false},
+		}}
+
+		binaryCmd, _ := newCommand(LogFormatBinary, CommandUpdateUsage, "node1", payload)
+		jsonCmd, _ := newCommand(LogFormatJSON, CommandUpdateUsage, "node1", payload)
+		binaryData, _ := encodeCommand(binaryCmd)
+		jsonData, _ := encodeCommand(jsonCmd)
+
+		if len(binaryData) >= len(jsonData) {
+			t.Errorf("Expected binary entry (%d bytes) to be smaller than JSON (%d bytes)", len(binaryData), len(jsonData))
+		}
+	})
+
+	t.Run("Rejects unsupported entries", func(t *testing.T) {
+		if _, err := decodeCommand(nil); !errors.Is(err, ErrMalformedCommand) {
+			t.Errorf("Expected ErrMalformedCommand for empty entry, got %v", err)
+		}
+		if _, err := decodeCommand([]byte{logFormatVersion + 1}); !errors.Is(err, ErrUnsupportedLogVersion) {
+			t.Errorf("Expected ErrUnsupportedLogVersion, got %v", err)
+		}
+		if _, err := decodeCommand([]byte(`{"type":"future_command"}`)); !errors.Is(err, ErrUnknownCommandType) {
+			t.Errorf("Expected ErrUnknownCommandType, got %v", err)
+		}
+		if _, err := decodeCommand([]byte(`{"type":`)); !errors.Is(err, ErrMalformedCommand) {
+			t.Errorf("Expected ErrMalformedCommand for bad JSON, got %v", err)
+		}
+	})
+
+	t.Run("Parse log format", func(t *testing.T) {
+		if format, err := ParseLogFormat("json"); err != nil || format != LogFormatJSON {
+			t.Errorf("Expected json format, got %q %v", format, err)
+		}
+		if _, err := ParseLogFormat("xml"); err == nil {
+			t.Error("Expected error for unknown format")
+		}
+	})
+}
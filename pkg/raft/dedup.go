@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"math"
+)
+
+// dedupTableSize bounds the number of request IDs remembered by the FSM
+// It must be the same on every replica so they evict the same entries
+const dedupTableSize = 10000
+
+// RequestRecord is the stored outcome of an applied request
+type RequestRecord struct {
+	ID       string      `json:"id"`
+	Response FSMResponse `json:"response"`
+}
+
+// dedupTable remembers the responses of recently applied requests
+// Entries are evicted in apply order, which is identical on all replicas
+type dedupTable struct {
+	size      int
+	responses map[string]*FSMResponse
+	order     []string
+}
+
+// newDedupTable creates a table holding at most size requests
+func newDedupTable(size int) *dedupTable {
+	return &dedupTable{
+		size:      size,
+		responses: make(map[string]*FSMResponse),
+	}
+}
+
+// get returns the response recorded for a request ID
+func (d *dedupTable) get(id string) (*FSMResponse, bool) {
+	response, ok := d.responses[id]
+	return response, ok
+}
+
+// put records the response of a request, evicting the oldest if full
+func (d *dedupTable) put(id string, response *FSMResponse) {
+	if _, ok := d.responses[id]; ok {
+		return
+	}
+
+	if len(d.order) >= d.size {
+		delete(d.responses, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	d.responses[id] = response
+	d.order = append(d.order, id)
+}
+
+// records returns the table contents, oldest first
+func (d *dedupTable) records() []RequestRecord {
+	records := make([]RequestRecord, 0, len(d.order))
+	for _, id := range d.order {
+		records = append(records, RequestRecord{ID: id, Response: *d.responses[id]})
+	}
+	return records
+}
+
+// restore replaces the table contents with records, oldest first
+func (d *dedupTable) restore(records []RequestRecord) {
+	d.responses = make(map[string]*FSMResponse, len(records))
+	d.order = nil
+	for _, record := range records {
+		response := record.Response
+		response.Data = normalizeData(response.Data)
+		d.put(record.ID, &response)
+	}
+}
+
+// normalizeData restores the value types of response data decoded from a
+// JSON snapshot, which turns integers into float64 and string lists into
+// []interface{}, so replayed responses match the original ones
+func normalizeData(data map[string]interface{}) map[string]interface{} {
+	for key, value := range data {
+		switch v := value.(type) {
+		case float64:
+			if v == math.Trunc(v) {
+				data[key] = int(v)
+			}
+		case []interface{}:
+			strs := make([]string, 0, len(v))
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					strs = append(strs, s)
+				}
+			}
+			if len(strs) == len(v) {
+				data[key] = strs
+			}
+		}
+	}
+	return data
+}
@@ -2,11 +2,15 @@ package raft
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strings"
 	"sync"
 
 	"github.com/hashicorp/raft"
+	"github.com/jianzi123/ipam/pkg/allocator"
 	"github.com/jianzi123/ipam/pkg/ipam"
 )
 
@@ -15,25 +19,69 @@ import (
 type FSM struct {
 	pool *ipam.Pool
 	mu   sync.RWMutex
+
+	// origin identifies the Node instance driving this FSM
+	// Usage updates it submitted were already applied to the local pool
+	origin string
+
+	// usage batches the local pool changes of the Node driving this FSM,
+	// nil for a bare FSM
+	usage *UsageBatcher
+
+	// requests holds the responses of recently applied requests by ID
+	requests *dedupTable
+
+	// leases tracks node liveness; reclaims is the reclamation audit trail
+	leases   map[string]*NodeLease
+	reclaims []ReclaimRecord
 }
 
 // CommandType represents the type of Raft command
-type CommandType string
+// Values are part of the log format and must never be reused
+type CommandType uint8
 
 const (
-	CommandAllocateBlock CommandType = "allocate_block"
-	CommandReleaseBlock  CommandType = "release_block"
-	CommandUpdateUsage   CommandType = "update_usage"
+	CommandAllocateBlock CommandType = 1
+	CommandReleaseBlock  CommandType = 2
+	CommandUpdateUsage   CommandType = 3
+	CommandRenewLease    CommandType = 4
+	CommandPinNode       CommandType = 5
+	CommandReclaimNode   CommandType = 6
 )
 
+// IgnoreUnknownTypeFlag marks command types that replicas which do not
+// know them may skip. Any other unknown command halts the replica
+const IgnoreUnknownTypeFlag CommandType = 0x80
+
+// String returns the command type name
+func (t CommandType) String() string {
+	if name, ok := commandNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("command_type(%d)", uint8(t))
+}
+
 // Command represents a Raft log command
 type Command struct {
-	Type   CommandType     `json:"type"`
-	NodeID string          `json:"node_id"`
-	Data   json.RawMessage `json:"data,omitempty"`
+	Type   CommandType `codec:"t"`
+	NodeID string      `codec:"n"`
+
+	// Data is the command payload, encoded in the same format as the command
+	Data []byte `codec:"d,omitempty"`
+
+	// Origin identifies the Node instance that submitted the command
+	Origin string `codec:"o,omitempty"`
+
+	// RequestID identifies the client request, so a retried command
+	// returns the original response instead of being applied twice
+	RequestID string `codec:"r,omitempty"`
+
+	// format is the encoding of the command, set by newCommand and decodeCommand
+	format LogFormat
 }
 
 // AllocateBlockData contains data for block allocation
+// The leader chooses the CIDR so every replica applies the same block
 type AllocateBlockData struct {
 	CIDR string `json:"cidr"`
 }
@@ -43,16 +91,24 @@ type ReleaseBlockData struct {
 	CIDR string `json:"cidr"`
 }
 
-// UpdateUsageData contains usage update information
+// UpdateUsageData contains a batch of per-IP allocation changes
 type UpdateUsageData struct {
-	CIDR      string `json:"cidr"`
-	UsedCount int    `json:"used_count"`
+	Changes []IPChange `json:"changes"`
+}
+
+// IPChange records the latest allocation state of a single pod IP
+type IPChange struct {
+	NodeID    string `json:"node_id"`
+	IP        string `json:"ip"`
+	Allocated bool   `json:"allocated"`
 }
 
 // NewFSM creates a new IPAM FSM
 func NewFSM(pool *ipam.Pool) *FSM {
 	return &FSM{
-		pool: pool,
+		pool:     pool,
+		requests: newDedupTable(dedupTableSize),
+		leases:   make(map[string]*NodeLease),
 	}
 }
 
@@ -62,11 +118,37 @@ func (f *FSM) Apply(log *raft.Log) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	var cmd Command
-	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+	cmd, err := decodeCommand(log.Data)
+	if err != nil {
+		// Entries from a newer version must not be skipped, or this replica
+		// silently diverges from the ones that applied them
+		if errors.Is(err, ErrUnsupportedLogVersion) || errors.Is(err, ErrUnknownCommandType) {
+			panic(fmt.Sprintf("raft log entry %d cannot be applied, upgrade this node: %v", log.Index, err))
+		}
 		return &FSMResponse{Success: false, Error: fmt.Sprintf("failed to unmarshal command: %v", err)}
 	}
 
+	if cmd.RequestID != "" {
+		if response, ok := f.requests.get(cmd.RequestID); ok {
+			replay := *response
+			replay.Replayed = true
+			return &replay
+		}
+	}
+
+	response := f.applyCommand(cmd)
+
+	// Conflicts are resubmitted under the same request ID, so only
+	// final outcomes are remembered
+	if cmd.RequestID != "" && !response.Conflict {
+		f.requests.put(cmd.RequestID, response)
+	}
+
+	return response
+}
+
+// applyCommand dispatches a decoded command
+func (f *FSM) applyCommand(cmd Command) *FSMResponse {
 	switch cmd.Type {
 	case CommandAllocateBlock:
 		return f.applyAllocateBlock(cmd)
@@ -74,35 +156,62 @@ func (f *FSM) Apply(log *raft.Log) interface{} {
 		return f.applyReleaseBlock(cmd)
 	case CommandUpdateUsage:
 		return f.applyUpdateUsage(cmd)
-	default:
-		return &FSMResponse{Success: false, Error: fmt.Sprintf("unknown command type: %s", cmd.Type)}
+	case CommandRenewLease:
+		return f.applyRenewLease(cmd)
+	case CommandPinNode:
+		return f.applyPinNode(cmd)
+	case CommandReclaimNode:
+		return f.applyReclaimNode(cmd)
 	}
+
+	if cmd.Type&IgnoreUnknownTypeFlag != 0 {
+		return &FSMResponse{Success: true}
+	}
+	panic(fmt.Sprintf("raft log entry with %s cannot be applied, upgrade this node", cmd.Type))
 }
 
-// applyAllocateBlock allocates a new IP block for a node
-func (f *FSM) applyAllocateBlock(cmd Command) interface{} {
-	block, err := f.pool.AllocateBlockForNode(cmd.NodeID)
+// applyAllocateBlock assigns the block chosen by the leader to a node
+func (f *FSM) applyAllocateBlock(cmd Command) *FSMResponse {
+	var data AllocateBlockData
+	if len(cmd.Data) > 0 {
+		if err := cmd.decodeData(&data); err != nil {
+			return &FSMResponse{Success: false, Error: err.Error()}
+		}
+	}
+
+	var block *allocator.IPBlock
+	var err error
+	if data.CIDR == "" {
+		// Entries written before the leader chose the CIDR pick it at apply time
+		block, err = f.pool.AllocateBlockForNode(cmd.NodeID)
+	} else {
+		block, err = f.pool.AllocateBlockCIDRForNode(cmd.NodeID, data.CIDR)
+	}
 	if err != nil {
-		return &FSMResponse{Success: false, Error: err.Error()}
+		return &FSMResponse{
+			Success:  false,
+			Error:    err.Error(),
+			Conflict: errors.Is(err, ipam.ErrDuplicateBlock),
+		}
 	}
 
 	return &FSMResponse{
 		Success: true,
 		Data: map[string]interface{}{
-			"cidr":     block.CIDR.String(),
-			"node_id":  block.NodeID,
-			"total":    block.Total,
-			"used":     block.Used,
+			"cidr":      block.CIDR.String(),
+			"node_id":   block.NodeID,
+			"total":     block.Total,
+			"used":      block.Used,
 			"available": block.Available(),
 		},
 	}
 }
 
 // applyReleaseBlock releases an IP block from a node
-func (f *FSM) applyReleaseBlock(cmd Command) interface{} {
+func (f *FSM) applyReleaseBlock(cmd Command) *FSMResponse {
 	var data ReleaseBlockData
-	if err := json.Unmarshal(cmd.Data, &data); err != nil {
-		return &FSMResponse{Success: false, Error: fmt.Sprintf("failed to unmarshal data: %v", err)}
+	if err := cmd.decodeData(&data); err != nil {
+		return &FSMResponse{Success: false, Error: err.Error()}
 	}
 
 	if err := f.pool.ReleaseBlockForNode(cmd.NodeID, data.CIDR); err != nil {
@@ -112,10 +221,42 @@ func (f *FSM) applyReleaseBlock(cmd Command) interface{} {
 	return &FSMResponse{Success: true}
 }
 
-// applyUpdateUsage updates usage statistics for a block
-func (f *FSM) applyUpdateUsage(cmd Command) interface{} {
-	// For now, usage is tracked locally in blocks
-	// This could be extended to replicate usage stats if needed
+// applyUpdateUsage applies a batch of per-IP allocation changes
+func (f *FSM) applyUpdateUsage(cmd Command) *FSMResponse {
+	var data UpdateUsageData
+	if err := cmd.decodeData(&data); err != nil {
+		return &FSMResponse{Success: false, Error: err.Error()}
+	}
+
+	// The submitting node changed its pool before batching the update, so
+	// its changes are applied again idempotently, in case a restore dropped
+	// them, unless a newer local change of the IP is still pending
+	own := cmd.Origin != "" && cmd.Origin == f.origin
+
+	var failed []string
+	for _, change := range data.Changes {
+		if own && f.usage != nil && !f.usage.commit(change) {
+			continue
+		}
+
+		ip := net.ParseIP(change.IP)
+		if ip == nil {
+			failed = append(failed, fmt.Sprintf("%s: invalid IP address", change.IP))
+			continue
+		}
+
+		if err := f.pool.SetIPState(change.NodeID, ip, change.Allocated); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", change.IP, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return &FSMResponse{
+			Success: false,
+			Error:   fmt.Sprintf("failed to apply %d of %d changes: %s", len(failed), len(data.Changes), strings.Join(failed, "; ")),
+		}
+	}
+
 	return &FSMResponse{Success: true}
 }
 
@@ -125,11 +266,23 @@ func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	// Get current pool stats to snapshot
-	stats := f.pool.GetStats()
+	// Copy the full pool state so Persist can run concurrently with Apply,
+	// leaving out local changes that are not committed yet
+	pool := f.pool.Snapshot()
+	if f.usage != nil {
+		if reverts := f.usage.uncommitted(); len(reverts) > 0 {
+			var err error
+			if pool, err = committedPool(pool, reverts); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	return &FSMSnapshot{
-		stats: stats,
+		pool:     pool,
+		requests: f.requests.records(),
+		leases:   f.leaseList(),
+		reclaims: append([]ReclaimRecord(nil), f.reclaims...),
 	}, nil
 }
 
@@ -146,31 +299,106 @@ func (f *FSM) Restore(snapshot io.ReadCloser) error {
 		return fmt.Errorf("failed to decode snapshot: %w", err)
 	}
 
-	// Restore pool state by re-creating blocks
-	// In a real implementation, you'd restore the full pool state
-	// For now, we'll keep the existing pool and log the restore
-	// This is a simplified version
+	// Older snapshots predate request IDs (version 1) and leases (version 2)
+	// and restore them empty
+	if snapshotData.Version < 1 || snapshotData.Version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshotData.Version)
+	}
+
+	// Replace the pool state with the snapshot contents
+	if err := f.pool.Restore(snapshotData.Pool); err != nil {
+		return fmt.Errorf("failed to restore pool: %w", err)
+	}
+	f.replayUnapplied()
+	f.requests.restore(snapshotData.Requests)
+
+	f.leases = make(map[string]*NodeLease, len(snapshotData.Leases))
+	for _, lease := range snapshotData.Leases {
+		lease := lease
+		f.leases[lease.NodeID] = &lease
+	}
+	f.reclaims = snapshotData.Reclaims
 
 	return nil
 }
 
+// replayUnapplied applies the local changes that are not committed yet to a
+// restored pool, remembering the restored state as their committed state
+func (f *FSM) replayUnapplied() {
+	if f.usage == nil {
+		return
+	}
+
+	for _, change := range f.usage.unapplied() {
+		ip := net.ParseIP(change.IP)
+		if ip == nil {
+			continue
+		}
+
+		// The block may be gone from the restored state
+		allocated, err := f.pool.IPState(change.NodeID, ip)
+		if err != nil {
+			continue
+		}
+		f.usage.rebase(IPChange{NodeID: change.NodeID, IP: change.IP, Allocated: allocated})
+		f.pool.SetIPState(change.NodeID, ip, change.Allocated)
+	}
+}
+
+// committedPool returns a copy of a pool snapshot with local changes reverted
+// to their committed state
+func committedPool(snap ipam.PoolSnapshot, reverts []IPChange) (ipam.PoolSnapshot, error) {
+	config := ipam.PoolConfig{ClusterCIDR: snap.ClusterCIDR, BlockSize: snap.BlockSize}
+	if snap.Reservation != nil {
+		config.Reservation = *snap.Reservation
+	}
+	pool, err := ipam.NewPool(config)
+	if err != nil {
+		return snap, fmt.Errorf("failed to copy pool: %w", err)
+	}
+	if err := pool.Restore(snap); err != nil {
+		return snap, fmt.Errorf("failed to copy pool: %w", err)
+	}
+
+	for _, change := range reverts {
+		if ip := net.ParseIP(change.IP); ip != nil {
+			pool.SetIPState(change.NodeID, ip, change.Allocated)
+		}
+	}
+	return pool.Snapshot(), nil
+}
+
 // FSMResponse represents the response from an FSM apply operation
 type FSMResponse struct {
 	Success bool                   `json:"success"`
 	Error   string                 `json:"error,omitempty"`
 	Data    map[string]interface{} `json:"data,omitempty"`
+
+	// Conflict is set when the command lost a race against committed state
+	// and may succeed if it is rebuilt and resubmitted
+	Conflict bool `json:"conflict,omitempty"`
+
+	// Replayed is set when the response of an earlier apply of the same
+	// request ID is returned, and the command changed nothing
+	Replayed bool `json:"replayed,omitempty"`
 }
 
 // FSMSnapshot represents a point-in-time snapshot of the FSM
 type FSMSnapshot struct {
-	stats ipam.PoolStats
+	pool     ipam.PoolSnapshot
+	requests []RequestRecord
+	leases   []NodeLease
+	reclaims []ReclaimRecord
 }
 
 // Persist writes the snapshot to the given sink
 func (s *FSMSnapshot) Persist(sink raft.SnapshotSink) error {
-	// Convert stats to snapshot data
 	data := SnapshotData{
-		Stats: s.stats,
+		Version:  snapshotVersion,
+		Pool:     s.pool,
+		Requests: s.requests,
+		Leases:   s.leases,
+		Reclaims: s.reclaims,
 	}
 
 	// Encode as JSON
@@ -185,10 +413,17 @@ func (s *FSMSnapshot) Persist(sink raft.SnapshotSink) error {
 
 // Release is called when the snapshot is no longer needed
 func (s *FSMSnapshot) Release() {
-	// Nothing to release in this simple implementation
+	// Nothing to release, the snapshot owns a private copy of the pool state
 }
 
+// snapshotVersion is the current snapshot format version
+const snapshotVersion = 3
+
 // SnapshotData represents the data stored in a snapshot
 type SnapshotData struct {
-	Stats ipam.PoolStats `json:"stats"`
+	Version  int               `json:"version"`
+	Pool     ipam.PoolSnapshot `json:"pool"`
+	Requests []RequestRecord   `json:"requests,omitempty"`
+	Leases   []NodeLease       `json:"leases,omitempty"`
+	Reclaims []ReclaimRecord   `json:"reclaims,omitempty"`
 }
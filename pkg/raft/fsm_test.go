@@ -0,0 +1,544 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jianzi123/ipam/pkg/ipam"
+)
+
+// newTestPool creates a pool with the default test layout
+func newTestPool(t *testing.T) *ipam.Pool {
+	t.Helper()
+
+	pool, err := ipam.NewPool(ipam.PoolConfig{
+		ClusterCIDR: "10.244.0.0/16",
+		BlockSize:   24,
+	})
+	if err != nil {
+		t.Fatalf("NewPool failed: %v", err)
+	}
+	return pool
+}
+
+// newTestRaftConfig returns a Raft config tuned for fast in-memory tests
+func newTestRaftConfig(id string) *raft.Config {
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	config.LogOutput = io.Discard
+	return config
+}
+
+// waitForLeader waits until the given Raft instance becomes leader
+func waitForLeader(t *testing.T, r *raft.Raft) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if r.State() == raft.Leader {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for leader election")
+}
+
+// newTestCommand builds a binary command with the given payload
+func newTestCommand(t *testing.T, cmdType CommandType, nodeID string, payload interface{}) Command {
+	t.Helper()
+
+	cmd, err := newCommand(LogFormatBinary, cmdType, nodeID, payload)
+	if err != nil {
+		t.Fatalf("newCommand failed: %v", err)
+	}
+	return cmd
+}
+
+// applyCommand applies a command directly to the FSM
+func applyCommand(t *testing.T, fsm *FSM, index uint64, cmd Command) *FSMResponse {
+	t.Helper()
+
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %v", err)
+	}
+
+	return fsm.Apply(&raft.Log{Index: index, Data: data}).(*FSMResponse)
+}
+
+// poolState returns the JSON encoding of a pool snapshot for comparisons
+// Encoding strips monotonic clock readings that differ after a round trip
+func poolState(t *testing.T, pool *ipam.Pool) string {
+	t.Helper()
+
+	data, err := json.Marshal(pool.Snapshot())
+	if err != nil {
+		t.Fatalf("failed to marshal pool snapshot: %v", err)
+	}
+	return string(data)
+}
+
+// memorySink is an in-memory raft.SnapshotSink
+type memorySink struct {
+	data     []byte
+	canceled bool
+}
+
+func (s *memorySink) Write(p []byte) (int, error) {
+	s.data = append(s.data, p...)
+	return len(p), nil
+}
+
+func (s *memorySink) Close() error  { return nil }
+func (s *memorySink) ID() string    { return "memory" }
+func (s *memorySink) Cancel() error { s.canceled = true; return nil }
+
+func TestFSMSnapshot(t *testing.T) {
+	t.Run("Persist and restore full pool", func(t *testing.T) {
+		pool := newTestPool(t)
+		fsm := NewFSM(pool)
+
+		applyCommand(t, fsm, 1, Command{Type: CommandAllocateBlock, NodeID: "node1"})
+		applyCommand(t, fsm, 2, Command{Type: CommandAllocateBlock, NodeID: "node2"})
+		applyCommand(t, fsm, 3, Command{Type: CommandAllocateBlock, NodeID: "node1"})
+
+		for i := 0; i < 10; i++ {
+			pool.AllocateIPForNode("node1")
+		}
+
+		snapshot, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+
+		sink := &memorySink{}
+		if err := snapshot.Persist(sink); err != nil {
+			t.Fatalf("Persist failed: %v", err)
+		}
+		snapshot.Release()
+
+		restoredPool := newTestPool(t)
+		restoredFSM := NewFSM(restoredPool)
+		if err := restoredFSM.Restore(io.NopCloser(bytes.NewReader(sink.data))); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+
+		if poolState(t, restoredPool) != poolState(t, pool) {
+			t.Error("Restored pool differs from original")
+		}
+	})
+
+	t.Run("Snapshot is isolated from later applies", func(t *testing.T) {
+		pool := newTestPool(t)
+		fsm := NewFSM(pool)
+
+		applyCommand(t, fsm, 1, Command{Type: CommandAllocateBlock, NodeID: "node1"})
+
+		snapshot, _ := fsm.Snapshot()
+		applyCommand(t, fsm, 2, Command{Type: CommandAllocateBlock, NodeID: "node2"})
+
+		sink := &memorySink{}
+		snapshot.Persist(sink)
+
+		var data SnapshotData
+		if err := json.Unmarshal(sink.data, &data); err != nil {
+			t.Fatalf("failed to decode snapshot: %v", err)
+		}
+		if len(data.Pool.NodeBlocks) != 1 {
+			t.Errorf("Expected 1 node in snapshot, got %d", len(data.Pool.NodeBlocks))
+		}
+	})
+
+	t.Run("Restore rejects unknown version", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		err := fsm.Restore(io.NopCloser(bytes.NewReader([]byte(`{"version": 99}`))))
+		if err == nil {
+			t.Error("Expected error for unknown snapshot version")
+		}
+	})
+}
+
+func TestFSMLocalUsage(t *testing.T) {
+	// newOwnFSM returns an FSM with a block for node1 and a batcher that
+	// only submits when the test applies the batch by hand
+	newOwnFSM := func(t *testing.T) (*FSM, *ipam.Pool) {
+		pool := newTestPool(t)
+		fsm := NewFSM(pool)
+		fsm.origin = "origin"
+		fsm.usage = NewUsageBatcher(func([]IPChange) error { return nil }, time.Hour)
+		applyCommand(t, fsm, 1, Command{Type: CommandAllocateBlock, NodeID: "node1"})
+		return fsm, pool
+	}
+
+	// persist returns the persisted snapshot of an FSM
+	persist := func(t *testing.T, fsm *FSM) []byte {
+		snapshot, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+		sink := &memorySink{}
+		if err := snapshot.Persist(sink); err != nil {
+			t.Fatalf("Persist failed: %v", err)
+		}
+		return sink.data
+	}
+
+	// ownBatch builds the usage batch the origin submits for changes
+	ownBatch := func(t *testing.T, changes ...IPChange) Command {
+		cmd := newTestCommand(t, CommandUpdateUsage, "node1", UpdateUsageData{Changes: changes})
+		cmd.Origin = "origin"
+		return cmd
+	}
+
+	t.Run("Restore keeps local changes not committed yet", func(t *testing.T) {
+		fsm, pool := newOwnFSM(t)
+		data := persist(t, fsm)
+
+		ip, _, _ := pool.AllocateIPForNode("node1")
+		fsm.usage.Record(IPChange{NodeID: "node1", IP: ip.String(), Allocated: true})
+
+		// A snapshot installed before the batch commits
+		if err := fsm.Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected the local allocation to survive the restore, got %d used IPs", stats.UsedIPs)
+		}
+
+		// The batch commits later and still applies
+		applyCommand(t, fsm, 2, ownBatch(t, IPChange{NodeID: "node1", IP: ip.String(), Allocated: true}))
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("Restore keeps changes of the batch in flight", func(t *testing.T) {
+		fsm, pool := newOwnFSM(t)
+		data := persist(t, fsm)
+
+		ip, _, _ := pool.AllocateIPForNode("node1")
+		fsm.usage.submit = func([]IPChange) error {
+			return fsm.Restore(io.NopCloser(bytes.NewReader(data)))
+		}
+		fsm.usage.Record(IPChange{NodeID: "node1", IP: ip.String(), Allocated: true})
+		if err := fsm.usage.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected the local allocation to survive the restore, got %d used IPs", stats.UsedIPs)
+		}
+	})
+
+	t.Run("Snapshots leave out local changes not committed yet", func(t *testing.T) {
+		fsm, pool := newOwnFSM(t)
+		ip, _, _ := pool.AllocateIPForNode("node1")
+		change := IPChange{NodeID: "node1", IP: ip.String(), Allocated: true}
+		fsm.usage.Record(change)
+
+		usedIn := func(data []byte) int {
+			restored := newTestPool(t)
+			if err := NewFSM(restored).Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+			return restored.GetStats().UsedIPs
+		}
+
+		if used := usedIn(persist(t, fsm)); used != 0 {
+			t.Errorf("Expected the uncommitted allocation to be left out, got %d used IPs", used)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected the local pool to keep the allocation, got %d used IPs", stats.UsedIPs)
+		}
+
+		fsm.usage.Flush()
+		applyCommand(t, fsm, 2, ownBatch(t, change))
+		if used := usedIn(persist(t, fsm)); used != 1 {
+			t.Errorf("Expected the committed allocation in the snapshot, got %d used IPs", used)
+		}
+	})
+}
+
+func TestFSMAllocateBlock(t *testing.T) {
+	allocate := func(t *testing.T, fsm *FSM, index uint64, nodeID, cidr string) *FSMResponse {
+		cmd := newTestCommand(t, CommandAllocateBlock, nodeID, AllocateBlockData{CIDR: cidr})
+		return applyCommand(t, fsm, index, cmd)
+	}
+
+	t.Run("Replicas apply the CIDR from the log entry", func(t *testing.T) {
+		// Replicas whose pools would choose differently still converge
+		fsm1 := NewFSM(newTestPool(t))
+		pool2 := newTestPool(t)
+		pool2.AllocateBlockForNode("local-only")
+		fsm2 := NewFSM(pool2)
+
+		for _, fsm := range []*FSM{fsm1, fsm2} {
+			resp := allocate(t, fsm, 1, "node1", "10.244.9.0/24")
+			if !resp.Success {
+				t.Fatalf("AllocateBlock failed: %s", resp.Error)
+			}
+			if resp.Data["cidr"] != "10.244.9.0/24" {
+				t.Errorf("Expected 10.244.9.0/24, got %v", resp.Data["cidr"])
+			}
+		}
+	})
+
+	t.Run("Conflicting CIDR is rejected", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		allocate(t, fsm, 1, "node1", "10.244.1.0/24")
+		resp := allocate(t, fsm, 2, "node2", "10.244.1.0/24")
+		if resp.Success || !resp.Conflict {
+			t.Errorf("Expected conflict, got %+v", resp)
+		}
+
+		resp = allocate(t, fsm, 3, "node2", "192.168.0.0/24")
+		if resp.Success || resp.Conflict {
+			t.Errorf("Expected non-conflict failure for foreign CIDR, got %+v", resp)
+		}
+
+		blocks, _ := fsm.pool.GetNodeBlocks("node1")
+		if len(blocks) != 1 {
+			t.Errorf("Expected node1 to keep 1 block, got %d", len(blocks))
+		}
+	})
+
+	t.Run("Legacy entries without CIDR still apply", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		data := []byte(`{"type":"allocate_block","node_id":"node1"}`)
+		resp := fsm.Apply(&raft.Log{Index: 1, Data: data}).(*FSMResponse)
+		if !resp.Success || resp.Data["cidr"] != "10.244.0.0/24" {
+			t.Errorf("Expected legacy allocation of 10.244.0.0/24, got %+v", resp)
+		}
+	})
+}
+
+func TestFSMLogFormat(t *testing.T) {
+	// expectHalt fails unless applying data panics
+	expectHalt := func(t *testing.T, fsm *FSM, data []byte) {
+		t.Helper()
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected Apply to refuse the entry")
+			}
+		}()
+		fsm.Apply(&raft.Log{Index: 1, Data: data})
+	}
+
+	t.Run("Legacy JSON entries apply alongside binary ones", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		applyCommand(t, fsm, 1, newTestCommand(t, CommandAllocateBlock, "node1", AllocateBlockData{CIDR: "10.244.5.0/24"}))
+
+		data := []byte(`{"type":"release_block","node_id":"node1","data":{"cidr":"10.244.5.0/24"}}`)
+		if resp := fsm.Apply(&raft.Log{Index: 2, Data: data}).(*FSMResponse); !resp.Success {
+			t.Fatalf("Legacy release failed: %s", resp.Error)
+		}
+		if blocks, _ := fsm.pool.GetNodeBlocks("node1"); len(blocks) != 0 {
+			t.Errorf("Expected block to be released, got %d blocks", len(blocks))
+		}
+	})
+
+	t.Run("Refuses entries from newer format versions", func(t *testing.T) {
+		expectHalt(t, NewFSM(newTestPool(t)), []byte{logFormatVersion + 1, 0x80})
+	})
+
+	t.Run("Refuses unknown command types", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		data, _ := encodeCommand(Command{Type: 0x7f, NodeID: "node1"})
+		expectHalt(t, fsm, data)
+		expectHalt(t, fsm, []byte(`{"type":"future_command","node_id":"node1"}`))
+	})
+
+	t.Run("Skips ignorable unknown command types", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		resp := applyCommand(t, fsm, 1, Command{Type: IgnoreUnknownTypeFlag | 0x7f, NodeID: "node1"})
+		if !resp.Success {
+			t.Errorf("Expected ignorable command to be skipped, got %+v", resp)
+		}
+	})
+
+	t.Run("Malformed entries fail without halting", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		resp := fsm.Apply(&raft.Log{Index: 1, Data: []byte{logFormatVersion, 0xc1}}).(*FSMResponse)
+		if resp.Success {
+			t.Error("Expected malformed entry to fail")
+		}
+	})
+}
+
+func TestFSMRequestDedup(t *testing.T) {
+	allocate := func(t *testing.T, fsm *FSM, index uint64, requestID, cidr string) *FSMResponse {
+		cmd := newTestCommand(t, CommandAllocateBlock, "node1", AllocateBlockData{CIDR: cidr})
+		cmd.RequestID = requestID
+		return applyCommand(t, fsm, index, cmd)
+	}
+
+	t.Run("Replayed request returns the original response", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		first := allocate(t, fsm, 1, "request-1", "10.244.1.0/24")
+		replay := allocate(t, fsm, 2, "request-1", "10.244.2.0/24")
+		if !replay.Success || !replay.Replayed || replay.Data["cidr"] != first.Data["cidr"] {
+			t.Errorf("Expected original response %+v replayed, got %+v", first, replay)
+		}
+		if first.Replayed {
+			t.Error("Expected the first response not to be replayed")
+		}
+
+		if blocks, _ := fsm.pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Errorf("Expected 1 block, got %d", len(blocks))
+		}
+	})
+
+	t.Run("Conflicts are not remembered", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		allocate(t, fsm, 1, "request-1", "10.244.1.0/24")
+		if resp := allocate(t, fsm, 2, "request-2", "10.244.1.0/24"); !resp.Conflict {
+			t.Fatalf("Expected conflict, got %+v", resp)
+		}
+		if resp := allocate(t, fsm, 3, "request-2", "10.244.2.0/24"); !resp.Success {
+			t.Errorf("Expected resubmitted request to succeed, got %+v", resp)
+		}
+	})
+
+	t.Run("Table evicts the oldest requests", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+		fsm.requests = newDedupTable(2)
+
+		allocate(t, fsm, 1, "request-1", "10.244.1.0/24")
+		allocate(t, fsm, 2, "request-2", "10.244.2.0/24")
+		allocate(t, fsm, 3, "request-3", "10.244.3.0/24")
+
+		if _, ok := fsm.requests.get("request-1"); ok {
+			t.Error("Expected request-1 to be evicted")
+		}
+		if len(fsm.requests.records()) != 2 {
+			t.Errorf("Expected 2 remembered requests, got %d", len(fsm.requests.records()))
+		}
+	})
+
+	t.Run("Snapshot keeps the table", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+		first := allocate(t, fsm, 1, "request-1", "10.244.1.0/24")
+
+		snapshot, _ := fsm.Snapshot()
+		sink := &memorySink{}
+		if err := snapshot.Persist(sink); err != nil {
+			t.Fatalf("Persist failed: %v", err)
+		}
+
+		restored := NewFSM(newTestPool(t))
+		if err := restored.Restore(io.NopCloser(bytes.NewReader(sink.data))); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+
+		replay := allocate(t, restored, 2, "request-1", "10.244.2.0/24")
+		if !replay.Success || replay.Data["cidr"] != "10.244.1.0/24" {
+			t.Errorf("Expected original response after restore, got %+v", replay)
+		}
+		for key, value := range first.Data {
+			if replay.Data[key] != value {
+				t.Errorf("Expected %s %#v after restore, got %#v", key, value, replay.Data[key])
+			}
+		}
+		if blocks, _ := restored.pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Errorf("Expected 1 block, got %d", len(blocks))
+		}
+	})
+
+	t.Run("Version 1 snapshots still restore", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+		data := `{"version": 1, "pool": {"cluster_cidr": "10.244.0.0/16", "block_size": 24, "node_blocks": {}}}`
+
+		if err := fsm.Restore(io.NopCloser(bytes.NewReader([]byte(data)))); err != nil {
+			t.Errorf("Restore of version 1 snapshot failed: %v", err)
+		}
+	})
+}
+
+func TestSnapshotRestoresFreshNode(t *testing.T) {
+	snapshots := raft.NewInmemSnapshotStore()
+
+	// Run a single-node cluster and compact its log into a snapshot
+	pool := newTestPool(t)
+	config := newTestRaftConfig("node1")
+	config.TrailingLogs = 0
+
+	_, transport := raft.NewInmemTransport("")
+	logs := raft.NewInmemStore()
+	r, err := raft.NewRaft(config, NewFSM(pool), logs, raft.NewInmemStore(), snapshots, transport)
+	if err != nil {
+		t.Fatalf("NewRaft failed: %v", err)
+	}
+
+	bootstrap := raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: transport.LocalAddr()}}}
+	if err := r.BootstrapCluster(bootstrap).Error(); err != nil {
+		t.Fatalf("BootstrapCluster failed: %v", err)
+	}
+	waitForLeader(t, r)
+
+	for _, nodeID := range []string{"node1", "node2", "node1", "node3"} {
+		data, _ := encodeCommand(Command{Type: CommandAllocateBlock, NodeID: nodeID})
+		future := r.Apply(data, time.Second)
+		if err := future.Error(); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+		if resp := future.Response().(*FSMResponse); !resp.Success {
+			t.Fatalf("AllocateBlock failed: %s", resp.Error)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		pool.AllocateIPForNode("node2")
+	}
+
+	if err := r.Snapshot().Error(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if first, _ := logs.FirstIndex(); first != 0 {
+		t.Fatalf("Expected log to be compacted, first index is %d", first)
+	}
+	want := poolState(t, pool)
+
+	if err := r.Shutdown().Error(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	// Bring up a fresh node that only has the snapshot
+	freshPool := newTestPool(t)
+	_, freshTransport := raft.NewInmemTransport(transport.LocalAddr())
+	fresh, err := raft.NewRaft(newTestRaftConfig("node1"), NewFSM(freshPool),
+		raft.NewInmemStore(), raft.NewInmemStore(), snapshots, freshTransport)
+	if err != nil {
+		t.Fatalf("NewRaft for fresh node failed: %v", err)
+	}
+	defer fresh.Shutdown()
+
+	if got := poolState(t, freshPool); got != want {
+		t.Errorf("Fresh node pool differs from snapshot:\ngot  %s\nwant %s", got, want)
+	}
+
+	// The restored pool must not hand out blocks that are already owned
+	block, err := freshPool.AllocateBlockForNode("node4")
+	if err != nil {
+		t.Fatalf("AllocateBlockForNode failed: %v", err)
+	}
+	if block.CIDR.String() != "10.244.4.0/24" {
+		t.Errorf("Expected 10.244.4.0/24, got %s", block.CIDR)
+	}
+}
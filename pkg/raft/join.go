@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultJoinTimeout is the default time a new node keeps trying to join
+const DefaultJoinTimeout = 60 * time.Second
+
+// joinAddrs returns the addresses to contact when joining, JoinAddr first
+func (c *NodeConfig) joinAddrs() []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{c.JoinAddr}, c.Peers...) {
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// joinCluster asks the cluster to add this node as a voter
+// The addresses are walked in order until one of them leads to the leader,
+// retrying with backoff until timeout while the cluster is coming up
+func (n *Node) joinCluster(addrs []string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultJoinTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+
+	for {
+		var lastErr error
+		for _, addr := range addrs {
+			if addr == n.Addr() {
+				continue
+			}
+
+			err := n.joinVia(addr)
+			if err == nil {
+				log.Printf("Joined cluster via %s", addr)
+				return nil
+			}
+			lastErr = err
+		}
+		if lastErr == nil {
+			return errors.New("failed to join cluster: no address other than our own")
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("failed to join cluster: %w", lastErr)
+		}
+		log.Printf("Warning: failed to join cluster, retrying: %v", lastErr)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
+
+// joinVia asks the member at addr for the leader and joins through it
+func (n *Node) joinVia(addr string) error {
+	client, err := dialRPC(addr)
+	if err != nil {
+		return fmt.Errorf("failed to contact %s: %w", addr, err)
+	}
+	defer client.Close()
+
+	var leader LeaderReply
+	if err := client.Call("Forward.Leader", &LeaderArgs{}, &leader); err != nil {
+		return fmt.Errorf("failed to query leader from %s: %w", addr, err)
+	}
+	if leader.Address == "" {
+		return fmt.Errorf("%s: %w", addr, errNoLeader)
+	}
+
+	if leader.Address != addr {
+		leaderClient, err := dialRPC(leader.Address)
+		if err != nil {
+			return fmt.Errorf("failed to contact leader %s: %w", leader.Address, err)
+		}
+		defer leaderClient.Close()
+		client = leaderClient
+	}
+
+	var reply ForwardReply
+	args := &MembershipArgs{NodeID: n.config.NodeID, Address: n.Addr()}
+	if err := client.Call("Forward.Join", args, &reply); err != nil {
+		return fmt.Errorf("join via leader %s failed: %w", leader.Address, err)
+	}
+	if !reply.Response.Success {
+		return fmt.Errorf("join via leader %s failed: %s", leader.Address, reply.Response.Error)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jianzi123/ipam/pkg/ipam"
+)
+
+const (
+	// DefaultLeaseTTL is how long a lease renewal keeps a node alive
+	DefaultLeaseTTL = 30 * time.Second
+
+	// DefaultLeaseGracePeriod is how long an expired lease is tolerated
+	// before the node's blocks are reclaimed
+	DefaultLeaseGracePeriod = 10 * time.Minute
+
+	// maxReclaimRecords bounds the reclamation audit trail kept in the FSM
+	maxReclaimRecords = 1000
+)
+
+// errLeaseRenewed rejects a reclamation that raced with a renewal
+var errLeaseRenewed = errors.New("lease was renewed")
+
+// NodeLease tracks the liveness of a node that owns blocks
+// Timestamps come from the leader clock, in Unix nanoseconds
+type NodeLease struct {
+	NodeID    string `json:"node_id"`
+	RenewedAt int64  `json:"renewed_at"`
+
+	// Pinned nodes are never reclaimed
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// ReclaimRecord is the audit record of a reclaimed node
+type ReclaimRecord struct {
+	NodeID      string   `json:"node_id"`
+	Blocks      []string `json:"blocks"`
+	RenewedAt   int64    `json:"renewed_at"`
+	ReclaimedAt int64    `json:"reclaimed_at"`
+}
+
+// RenewLeaseData contains data for lease renewal
+type RenewLeaseData struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// PinNodeData contains data for pinning or unpinning a node
+type PinNodeData struct {
+	Pinned    bool  `json:"pinned"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// ReclaimNodeData contains data for reclaiming the blocks of a dead node
+// RenewedAt is the renewal the leader saw expire; a newer renewal cancels
+// the reclamation
+type ReclaimNodeData struct {
+	RenewedAt int64 `json:"renewed_at"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// applyRenewLease records a lease renewal
+func (f *FSM) applyRenewLease(cmd Command) *FSMResponse {
+	var data RenewLeaseData
+	if err := cmd.decodeData(&data); err != nil {
+		return &FSMResponse{Success: false, Error: err.Error()}
+	}
+
+	lease := f.lease(cmd.NodeID, data.Timestamp)
+	// A new leader's clock may lag; renewals never move a lease back
+	if data.Timestamp > lease.RenewedAt {
+		lease.RenewedAt = data.Timestamp
+	}
+
+	return &FSMResponse{Success: true}
+}
+
+// applyPinNode pins or unpins a node
+func (f *FSM) applyPinNode(cmd Command) *FSMResponse {
+	var data PinNodeData
+	if err := cmd.decodeData(&data); err != nil {
+		return &FSMResponse{Success: false, Error: err.Error()}
+	}
+
+	f.lease(cmd.NodeID, data.Timestamp).Pinned = data.Pinned
+	return &FSMResponse{Success: true}
+}
+
+// applyReclaimNode releases every block of a node whose lease expired
+func (f *FSM) applyReclaimNode(cmd Command) *FSMResponse {
+	var data ReclaimNodeData
+	if err := cmd.decodeData(&data); err != nil {
+		return &FSMResponse{Success: false, Error: err.Error()}
+	}
+
+	lease, exists := f.leases[cmd.NodeID]
+	if !exists {
+		return &FSMResponse{Success: false, Error: fmt.Sprintf("no lease for node %s", cmd.NodeID)}
+	}
+	if lease.Pinned {
+		return &FSMResponse{Success: false, Error: fmt.Sprintf("node %s is pinned", cmd.NodeID)}
+	}
+	if lease.RenewedAt != data.RenewedAt {
+		return &FSMResponse{Success: false, Error: errLeaseRenewed.Error()}
+	}
+
+	blocks, err := f.pool.ReclaimNode(cmd.NodeID)
+	if err != nil && !errors.Is(err, ipam.ErrNodeNotFound) {
+		return &FSMResponse{Success: false, Error: err.Error()}
+	}
+	delete(f.leases, cmd.NodeID)
+
+	f.reclaims = append(f.reclaims, ReclaimRecord{
+		NodeID:      cmd.NodeID,
+		Blocks:      blocks,
+		RenewedAt:   lease.RenewedAt,
+		ReclaimedAt: data.Timestamp,
+	})
+	if len(f.reclaims) > maxReclaimRecords {
+		f.reclaims = f.reclaims[len(f.reclaims)-maxReclaimRecords:]
+	}
+
+	return &FSMResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"node_id": cmd.NodeID,
+			"blocks":  blocks,
+		},
+	}
+}
+
+// lease returns the lease of a node, creating it renewed at timestamp
+func (f *FSM) lease(nodeID string, timestamp int64) *NodeLease {
+	lease, exists := f.leases[nodeID]
+	if !exists {
+		lease = &NodeLease{NodeID: nodeID, RenewedAt: timestamp}
+		f.leases[nodeID] = lease
+	}
+	return lease
+}
+
+// Leases returns a copy of all node leases, sorted by node ID
+func (f *FSM) Leases() []NodeLease {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.leaseList()
+}
+
+// leaseList copies the leases, sorted by node ID; the caller holds f.mu
+func (f *FSM) leaseList() []NodeLease {
+	leases := make([]NodeLease, 0, len(f.leases))
+	for _, lease := range f.leases {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].NodeID < leases[j].NodeID
+	})
+	return leases
+}
+
+// Reclamations returns the audit records of reclaimed nodes, oldest first
+func (f *FSM) Reclamations() []ReclaimRecord {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return append([]ReclaimRecord(nil), f.reclaims...)
+}
+
+// RenewLease renews the lease of a node through the leader
+func (n *Node) RenewLease(nodeID string) error {
+	return n.applyLease(&LeaseArgs{Type: CommandRenewLease, NodeID: nodeID})
+}
+
+// PinNode pins a node so its blocks are never reclaimed, or unpins it
+func (n *Node) PinNode(nodeID string, pinned bool) error {
+	return n.applyLease(&LeaseArgs{Type: CommandPinNode, NodeID: nodeID, Pinned: pinned})
+}
+
+// HoldLease makes this node renew the lease of nodeID periodically
+// The node always holds its own lease
+func (n *Node) HoldLease(nodeID string) {
+	n.leaseMu.Lock()
+	defer n.leaseMu.Unlock()
+
+	n.leaseHolders[nodeID] = true
+}
+
+// Leases returns the replicated node leases
+func (n *Node) Leases() []NodeLease {
+	return n.fsm.Leases()
+}
+
+// Reclamations returns the audit records of reclaimed nodes
+func (n *Node) Reclamations() []ReclaimRecord {
+	return n.fsm.Reclamations()
+}
+
+// applyLease submits a lease command, stamped with the leader clock
+func (n *Node) applyLease(args *LeaseArgs) error {
+	args.RequestID = n.newRequestID()
+	response, err := n.forward("Forward.Lease", args, func() (*ForwardReply, error) {
+		return n.leaseLocal(args)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return fmt.Errorf("command failed: %s", response.Error)
+	}
+	return nil
+}
+
+// leaseLocal applies a lease command on the leader
+func (n *Node) leaseLocal(args *LeaseArgs) (*ForwardReply, error) {
+	if !n.IsLeader() {
+		return nil, raft.ErrNotLeader
+	}
+
+	var payload interface{}
+	now := time.Now().UnixNano()
+	switch args.Type {
+	case CommandRenewLease:
+		payload = RenewLeaseData{Timestamp: now}
+	case CommandPinNode:
+		payload = PinNodeData{Pinned: args.Pinned, Timestamp: now}
+	default:
+		return nil, fmt.Errorf("%w: %s is not a lease command", ErrUnknownCommandType, args.Type)
+	}
+
+	cmd, err := newCommand(n.format, args.Type, args.NodeID, payload)
+	if err != nil {
+		return nil, err
+	}
+	cmd.RequestID = args.RequestID
+
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command: %w", err)
+	}
+	return n.applyLocal(data)
+}
+
+// runLeases renews held leases and, on the leader, reclaims expired ones
+func (n *Node) runLeases() {
+	defer close(n.leaseDone)
+
+	ticker := time.NewTicker(n.leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.renewLeases()
+			if n.IsLeader() && n.leaseGrace >= 0 {
+				n.reclaimExpired(time.Now())
+			}
+		case <-n.shutdownCh:
+			return
+		}
+	}
+}
+
+// renewLeases renews every lease held by this node
+func (n *Node) renewLeases() {
+	n.leaseMu.Lock()
+	nodeIDs := make([]string, 0, len(n.leaseHolders))
+	for nodeID := range n.leaseHolders {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	n.leaseMu.Unlock()
+	sort.Strings(nodeIDs)
+
+	for _, nodeID := range nodeIDs {
+		if err := n.RenewLease(nodeID); err != nil {
+			log.Printf("Warning: failed to renew lease of %s: %v", nodeID, err)
+		}
+	}
+}
+
+// reclaimExpired reclaims the blocks of nodes whose lease expired more
+// than the grace period before now. Nodes that own blocks without a lease,
+// such as those allocated before leases existed, are given a fresh lease
+func (n *Node) reclaimExpired(now time.Time) {
+	n.fsm.mu.RLock()
+	leases := n.fsm.leaseList()
+	n.fsm.mu.RUnlock()
+
+	leased := make(map[string]bool, len(leases))
+	for _, lease := range leases {
+		leased[lease.NodeID] = true
+
+		if lease.Pinned {
+			continue
+		}
+		deadline := time.Unix(0, lease.RenewedAt).Add(n.leaseTTL + n.leaseGrace)
+		if !now.After(deadline) {
+			continue
+		}
+
+		if err := n.reclaimNode(lease, now); err != nil {
+			log.Printf("Warning: failed to reclaim node %s: %v", lease.NodeID, err)
+		}
+	}
+
+	for _, nodeID := range n.pool.NodeIDs() {
+		if leased[nodeID] {
+			continue
+		}
+		if err := n.RenewLease(nodeID); err != nil {
+			log.Printf("Warning: failed to start lease of %s: %v", nodeID, err)
+		}
+	}
+}
+
+// reclaimNode submits the reclamation of a node with an expired lease
+func (n *Node) reclaimNode(lease NodeLease, now time.Time) error {
+	cmd, err := newCommand(n.format, CommandReclaimNode, lease.NodeID, ReclaimNodeData{
+		RenewedAt: lease.RenewedAt,
+		Timestamp: now.UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	response, err := n.applyCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("command failed: %s", response.Error)
+	}
+
+	log.Printf("Reclaimed blocks %v of node %s, lease last renewed at %s",
+		response.Data["blocks"], lease.NodeID, time.Unix(0, lease.RenewedAt).Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,191 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFSMLeases(t *testing.T) {
+	renew := func(t *testing.T, fsm *FSM, index uint64, nodeID string, timestamp int64) *FSMResponse {
+		return applyCommand(t, fsm, index, newTestCommand(t, CommandRenewLease, nodeID, RenewLeaseData{Timestamp: timestamp}))
+	}
+	reclaim := func(t *testing.T, fsm *FSM, index uint64, nodeID string, renewedAt int64) *FSMResponse {
+		return applyCommand(t, fsm, index, newTestCommand(t, CommandReclaimNode, nodeID, ReclaimNodeData{RenewedAt: renewedAt, Timestamp: 500}))
+	}
+
+	t.Run("Renewals never move a lease back", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		renew(t, fsm, 1, "node1", 200)
+		renew(t, fsm, 2, "node1", 100)
+
+		leases := fsm.Leases()
+		if len(leases) != 1 || leases[0].RenewedAt != 200 {
+			t.Errorf("Expected lease renewed at 200, got %+v", leases)
+		}
+	})
+
+	t.Run("Reclaim releases blocks and leaves an audit record", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		applyCommand(t, fsm, 1, newTestCommand(t, CommandAllocateBlock, "node1", AllocateBlockData{CIDR: "10.244.3.0/24"}))
+		fsm.pool.AllocateIPFromExistingBlocks("node1")
+		renew(t, fsm, 2, "node1", 100)
+
+		if resp := reclaim(t, fsm, 3, "node1", 100); !resp.Success {
+			t.Fatalf("Reclaim failed: %s", resp.Error)
+		}
+
+		if _, err := fsm.pool.GetNodeBlocks("node1"); err == nil {
+			t.Error("Expected node1 blocks to be reclaimed")
+		}
+		if len(fsm.Leases()) != 0 {
+			t.Errorf("Expected lease to be removed, got %+v", fsm.Leases())
+		}
+
+		records := fsm.Reclamations()
+		if len(records) != 1 || records[0].NodeID != "node1" || len(records[0].Blocks) != 1 ||
+			records[0].Blocks[0] != "10.244.3.0/24" || records[0].RenewedAt != 100 || records[0].ReclaimedAt != 500 {
+			t.Errorf("Unexpected audit records %+v", records)
+		}
+	})
+
+	t.Run("Reclaim racing a renewal is rejected", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		renew(t, fsm, 1, "node1", 100)
+		renew(t, fsm, 2, "node1", 300)
+
+		if resp := reclaim(t, fsm, 3, "node1", 100); resp.Success {
+			t.Error("Expected reclaim of a renewed lease to fail")
+		}
+		if len(fsm.Leases()) != 1 {
+			t.Error("Expected lease to survive")
+		}
+	})
+
+	t.Run("Pinned nodes are not reclaimed", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		applyCommand(t, fsm, 1, newTestCommand(t, CommandPinNode, "node1", PinNodeData{Pinned: true, Timestamp: 100}))
+		if resp := reclaim(t, fsm, 2, "node1", 100); resp.Success {
+			t.Error("Expected reclaim of a pinned node to fail")
+		}
+	})
+
+	t.Run("Snapshot keeps leases and audit records", func(t *testing.T) {
+		fsm := NewFSM(newTestPool(t))
+
+		renew(t, fsm, 1, "node1", 100)
+		renew(t, fsm, 2, "node2", 200)
+		reclaim(t, fsm, 3, "node1", 100)
+
+		snapshot, _ := fsm.Snapshot()
+		sink := &memorySink{}
+		if err := snapshot.Persist(sink); err != nil {
+			t.Fatalf("Persist failed: %v", err)
+		}
+
+		restored := NewFSM(newTestPool(t))
+		if err := restored.Restore(io.NopCloser(bytes.NewReader(sink.data))); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+
+		leases := restored.Leases()
+		if len(leases) != 1 || leases[0].NodeID != "node2" || leases[0].RenewedAt != 200 {
+			t.Errorf("Unexpected restored leases %+v", leases)
+		}
+		if records := restored.Reclamations(); len(records) != 1 || records[0].NodeID != "node1" {
+			t.Errorf("Unexpected restored audit records %+v", records)
+		}
+	})
+}
+
+func TestNodeLeases(t *testing.T) {
+	newLeaseNode := func(t *testing.T) *Node {
+		node, _ := newTestNode(t)
+		node.leaseTTL = time.Minute
+		node.leaseGrace = time.Minute
+		return node
+	}
+
+	t.Run("Renewals are stamped by the leader", func(t *testing.T) {
+		node := newLeaseNode(t)
+
+		before := time.Now().UnixNano()
+		if err := node.RenewLease("node1"); err != nil {
+			t.Fatalf("RenewLease failed: %v", err)
+		}
+
+		leases := node.Leases()
+		if len(leases) != 1 || leases[0].RenewedAt < before || leases[0].RenewedAt > time.Now().UnixNano() {
+			t.Errorf("Unexpected leases %+v", leases)
+		}
+	})
+
+	t.Run("Expired nodes are reclaimed after the grace period", func(t *testing.T) {
+		node := newLeaseNode(t)
+
+		if _, err := node.AllocateBlock("node1"); err != nil {
+			t.Fatalf("AllocateBlock failed: %v", err)
+		}
+		if err := node.RenewLease("node1"); err != nil {
+			t.Fatalf("RenewLease failed: %v", err)
+		}
+		renewedAt := time.Unix(0, node.Leases()[0].RenewedAt)
+
+		// Expired, but still within the grace period
+		node.reclaimExpired(renewedAt.Add(90 * time.Second))
+		if blocks, _ := node.pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Fatalf("Expected node1 to keep its block during the grace period")
+		}
+
+		node.reclaimExpired(renewedAt.Add(3 * time.Minute))
+		if _, err := node.pool.GetNodeBlocks("node1"); err == nil {
+			t.Error("Expected node1 blocks to be reclaimed")
+		}
+		if records := node.Reclamations(); len(records) != 1 || records[0].NodeID != "node1" {
+			t.Errorf("Expected an audit record for node1, got %+v", records)
+		}
+	})
+
+	t.Run("Pinned nodes are never reclaimed", func(t *testing.T) {
+		node := newLeaseNode(t)
+
+		node.AllocateBlock("node1")
+		if err := node.PinNode("node1", true); err != nil {
+			t.Fatalf("PinNode failed: %v", err)
+		}
+
+		node.reclaimExpired(time.Now().Add(time.Hour))
+		if blocks, _ := node.pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Error("Expected pinned node to keep its block")
+		}
+
+		// Unpinning makes the node eligible again
+		if err := node.PinNode("node1", false); err != nil {
+			t.Fatalf("PinNode failed: %v", err)
+		}
+		node.reclaimExpired(time.Now().Add(time.Hour))
+		if _, err := node.pool.GetNodeBlocks("node1"); err == nil {
+			t.Error("Expected unpinned node to be reclaimed")
+		}
+	})
+
+	t.Run("Nodes without a lease get one before they can expire", func(t *testing.T) {
+		node := newLeaseNode(t)
+
+		node.AllocateBlock("node1")
+		node.reclaimExpired(time.Now())
+
+		leases := node.Leases()
+		if len(leases) != 1 || leases[0].NodeID != "node1" {
+			t.Fatalf("Expected node1 to get a lease, got %+v", leases)
+		}
+		if blocks, _ := node.pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Error("Expected node1 to keep its block")
+		}
+	})
+}
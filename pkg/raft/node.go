@@ -1,11 +1,16 @@
 package raft
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/raft"
@@ -15,28 +20,88 @@ import (
 
 // NodeConfig contains configuration for a Raft node
 type NodeConfig struct {
-	NodeID          string        // Unique node identifier
-	BindAddr        string        // Address to bind Raft (e.g., "0.0.0.0:7000")
-	DataDir         string        // Directory for Raft data
-	Bootstrap       bool          // Bootstrap a new cluster
-	JoinAddr        string        // Address of existing node to join
+	NodeID           string        // Unique node identifier
+	BindAddr         string        // Address to bind Raft (e.g., "0.0.0.0:7000")
+	AdvertiseAddr    string        // Address other nodes use to reach this node
+	DataDir          string        // Directory for Raft data
+	Bootstrap        bool          // Bootstrap a new cluster
+	JoinAddr         string        // Address of existing node to join
+	Peers            []string      // Cluster members tried after JoinAddr
+	JoinTimeout      time.Duration // How long to keep trying to join
 	HeartbeatTimeout time.Duration // Heartbeat timeout
 	ElectionTimeout  time.Duration // Election timeout
 	CommitTimeout    time.Duration // Commit timeout
+	BatchInterval    time.Duration // Interval for batching IP usage updates
+	LogFormat        LogFormat     // Encoding of new log entries, binary by default
+	LeaseTTL         time.Duration // How long a lease renewal keeps a node alive
+	LeaseGracePeriod time.Duration // Time after lease expiry before blocks are reclaimed, negative disables
 }
 
+// maxAllocateBlockAttempts bounds retries when the chosen CIDR conflicts
+const maxAllocateBlockAttempts = 3
+
 // Node represents a Raft node
 type Node struct {
 	config *NodeConfig
 	raft   *raft.Raft
 	fsm    *FSM
 	pool   *ipam.Pool
+
+	// allocMu serializes block allocations on the leader
+	allocMu sync.Mutex
+
+	// format is the encoding of the commands this node writes
+	format LogFormat
+
+	// origin identifies this Node instance in the commands it submits
+	origin string
+	usage  *UsageBatcher
+
+	// requestSeq numbers the requests submitted by this Node instance
+	requestSeq atomic.Uint64
+
+	// addr is the advertised Raft address, which also serves the internal RPC
+	addr raft.ServerAddress
+
+	// leaseHolders are the nodes whose leases this node renews
+	leaseHolders map[string]bool
+	leaseMu      sync.Mutex
+	leaseTTL     time.Duration
+	leaseGrace   time.Duration
+	leaseDone    chan struct{}
+
+	shutdownCh chan struct{}
+	stopOnce   sync.Once
+
+	// stores are closed on shutdown so the data directory can be reopened
+	stores    []io.Closer
+	closeOnce sync.Once
 }
 
 // NewNode creates a new Raft node
 func NewNode(config *NodeConfig, pool *ipam.Pool) (*Node, error) {
+	format := LogFormatBinary
+	if config.LogFormat != "" {
+		var err error
+		if format, err = ParseLogFormat(string(config.LogFormat)); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create FSM
+	origin, err := newOriginID()
+	if err != nil {
+		return nil, err
+	}
 	fsm := NewFSM(pool)
+	fsm.origin = origin
+
+	// The FSM replays unreplicated local changes when Raft restores a
+	// snapshot, which may happen before NewRaft returns
+	var node *Node
+	fsm.usage = NewUsageBatcher(func(changes []IPChange) error {
+		return node.UpdateUsage(changes)
+	}, config.BatchInterval)
 
 	// Setup Raft configuration
 	raftConfig := raft.DefaultConfig()
@@ -76,44 +141,93 @@ func NewNode(config *NodeConfig, pool *ipam.Pool) (*Node, error) {
 	}
 
 	// Setup transport
-	addr, err := net.ResolveTCPAddr("tcp", config.BindAddr)
+	// Raft shares its port with the internal RPC used to forward writes
+	mux, err := newRPCMux(config.BindAddr, config.AdvertiseAddr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve bind address: %w", err)
+		return nil, fmt.Errorf("failed to create transport: %w", err)
 	}
 
-	transport, err := raft.NewTCPTransport(config.BindAddr, addr, 3, 10*time.Second, os.Stderr)
+	transport := raft.NewNetworkTransport(mux, 3, 10*time.Second, os.Stderr)
+
+	// Members restarting with existing state are already in the configuration
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create transport: %w", err)
+		transport.Close()
+		return nil, fmt.Errorf("failed to check existing state: %w", err)
 	}
 
 	// Create Raft instance
 	r, err := raft.NewRaft(raftConfig, fsm, logStore, stableStore, snapshotStore, transport)
 	if err != nil {
+		transport.Close()
 		return nil, fmt.Errorf("failed to create raft: %w", err)
 	}
 
-	node := &Node{
+	node = &Node{
 		config: config,
 		raft:   r,
 		fsm:    fsm,
 		pool:   pool,
+		format: format,
+		origin: origin,
+		addr:   transport.LocalAddr(),
+		stores: []io.Closer{logStore, stableStore},
+
+		leaseHolders: map[string]bool{config.NodeID: true},
+		leaseTTL:     config.LeaseTTL,
+		leaseGrace:   config.LeaseGracePeriod,
+		shutdownCh:   make(chan struct{}),
+	}
+	if node.leaseTTL <= 0 {
+		node.leaseTTL = DefaultLeaseTTL
 	}
+	if node.leaseGrace == 0 {
+		node.leaseGrace = DefaultLeaseGracePeriod
+	}
+	node.usage = fsm.usage
+	node.usage.Start()
+
+	if err := mux.rpcServer.RegisterName("Forward", &ForwardService{node: node}); err != nil {
+		r.Shutdown()
+		return nil, fmt.Errorf("failed to register forward service: %w", err)
+	}
+	mux.Start()
 
 	// Bootstrap cluster if needed
-	if config.Bootstrap {
+	if config.Bootstrap && !hasState {
 		configuration := raft.Configuration{
 			Servers: []raft.Server{
 				{
 					ID:      raft.ServerID(config.NodeID),
-					Address: raft.ServerAddress(config.BindAddr),
+					Address: node.addr,
 				},
 			},
 		}
-		if err := r.BootstrapCluster(configuration).Error(); err != nil {
+		if err := r.BootstrapCluster(configuration).Error(); err != nil && err != raft.ErrCantBootstrap {
+			node.Shutdown()
 			return nil, fmt.Errorf("failed to bootstrap cluster: %w", err)
 		}
 	}
 
+	// Join an existing cluster on first start
+	if !config.Bootstrap && !hasState {
+		if addrs := config.joinAddrs(); len(addrs) > 0 {
+			if err := node.joinCluster(addrs, config.JoinTimeout); err != nil {
+				node.Shutdown()
+				return nil, err
+			}
+		}
+	}
+
+	// Versions that only read JSON entries do not know leases, so leases
+	// wait until a rolling upgrade has finished
+	if format == LogFormatJSON {
+		log.Printf("Warning: node leases are disabled while writing JSON log entries")
+	} else {
+		node.leaseDone = make(chan struct{})
+		go node.runLeases()
+	}
+
 	return node, nil
 }
 
@@ -128,82 +242,352 @@ func (n *Node) Leader() string {
 	return string(addr)
 }
 
+// Addr returns the advertised Raft address of this node
+func (n *Node) Addr() string {
+	return string(n.addr)
+}
+
 // AllocateBlock allocates a new IP block for a node
-// This goes through Raft consensus
+// This goes through Raft consensus; followers forward it to the leader
 func (n *Node) AllocateBlock(nodeID string) (map[string]interface{}, error) {
-	cmd := Command{
-		Type:   CommandAllocateBlock,
-		NodeID: nodeID,
+	data, _, err := n.AllocateBlockWithID(nodeID, "")
+	return data, err
+}
+
+// AllocateBlockWithID allocates a new IP block for a node at most once per
+// request ID, so a client retrying a request gets the block of its first try
+// and replayed set. An empty request ID gets a new one
+func (n *Node) AllocateBlockWithID(nodeID, requestID string) (data map[string]interface{}, replayed bool, err error) {
+	if requestID == "" {
+		requestID = n.newRequestID()
+	} else {
+		// Keep client IDs apart from the ones nodes generate
+		requestID = "client-" + requestID
 	}
 
-	data, err := json.Marshal(cmd)
+	// Retries reuse the request ID so a block is allocated at most once
+	args := &AllocateBlockArgs{NodeID: nodeID, RequestID: requestID}
+	response, err := n.forward("Forward.AllocateBlock", args, func() (*ForwardReply, error) {
+		return n.allocateBlockLocal(args.RequestID, nodeID)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal command: %w", err)
+		return nil, false, err
 	}
 
-	future := n.raft.Apply(data, 10*time.Second)
-	if err := future.Error(); err != nil {
-		return nil, fmt.Errorf("raft apply failed: %w", err)
+	if !response.Success {
+		return nil, false, fmt.Errorf("command failed: %s", response.Error)
 	}
 
-	response := future.Response().(*FSMResponse)
-	if !response.Success {
-		return nil, fmt.Errorf("command failed: %s", response.Error)
+	return response.Data, response.Replayed, nil
+}
+
+// allocateBlockLocal allocates a block on the leader
+// The leader chooses the CIDR and records it in the log entry so that
+// every replica applies exactly the same block
+func (n *Node) allocateBlockLocal(requestID, nodeID string) (*ForwardReply, error) {
+	if !n.IsLeader() {
+		return nil, raft.ErrNotLeader
 	}
 
-	return response.Data, nil
+	// Serialize allocations so each choice sees the previous one applied
+	n.allocMu.Lock()
+	defer n.allocMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		cidr, err := n.pool.NextAvailableBlock()
+		if err != nil {
+			return &ForwardReply{Response: &FSMResponse{Success: false, Error: err.Error()}}, nil
+		}
+
+		cmd, err := newCommand(n.format, CommandAllocateBlock, nodeID, AllocateBlockData{CIDR: cidr})
+		if err != nil {
+			return nil, err
+		}
+		cmd.RequestID = requestID
+
+		data, err := encodeCommand(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal command: %w", err)
+		}
+
+		reply, err := n.applyLocal(data)
+		if err != nil {
+			return nil, err
+		}
+
+		// A new leader may not have applied every committed entry yet when it
+		// chose the CIDR; wait for them and choose again
+		if reply.Response.Success || !reply.Response.Conflict || attempt == maxAllocateBlockAttempts {
+			return reply, nil
+		}
+		if err := n.raft.Barrier(10 * time.Second).Error(); err != nil {
+			return nil, fmt.Errorf("raft barrier failed: %w", err)
+		}
+	}
 }
 
 // ReleaseBlock releases an IP block from a node
 func (n *Node) ReleaseBlock(nodeID, cidr string) error {
-	releaseData := ReleaseBlockData{CIDR: cidr}
-	dataBytes, err := json.Marshal(releaseData)
+	cmd, err := newCommand(n.format, CommandReleaseBlock, nodeID, ReleaseBlockData{CIDR: cidr})
 	if err != nil {
-		return fmt.Errorf("failed to marshal release data: %w", err)
+		return err
 	}
 
-	cmd := Command{
-		Type:   CommandReleaseBlock,
-		NodeID: nodeID,
-		Data:   dataBytes,
+	response, err := n.applyCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return fmt.Errorf("command failed: %s", response.Error)
 	}
 
-	data, err := json.Marshal(cmd)
+	return nil
+}
+
+// RecordIPAllocation queues a pod IP allocation for replication
+// The local pool must already reflect the allocation
+func (n *Node) RecordIPAllocation(nodeID string, ip net.IP) {
+	n.usage.Record(IPChange{NodeID: nodeID, IP: ip.String(), Allocated: true})
+}
+
+// RecordIPRelease queues a pod IP release for replication
+// The local pool must already reflect the release
+func (n *Node) RecordIPRelease(nodeID string, ip net.IP) {
+	n.usage.Record(IPChange{NodeID: nodeID, IP: ip.String(), Allocated: false})
+}
+
+// UpdateUsage replicates a batch of per-IP allocation changes
+// Replicas other than this one apply the changes to their pools
+func (n *Node) UpdateUsage(changes []IPChange) error {
+	cmd, err := newCommand(n.format, CommandUpdateUsage, n.config.NodeID, UpdateUsageData{Changes: changes})
 	if err != nil {
-		return fmt.Errorf("failed to marshal command: %w", err)
+		return err
 	}
+	cmd.Origin = n.origin
 
-	future := n.raft.Apply(data, 10*time.Second)
-	if err := future.Error(); err != nil {
-		return fmt.Errorf("raft apply failed: %w", err)
+	response, err := n.applyCommand(cmd)
+	if err != nil {
+		return err
 	}
 
-	response := future.Response().(*FSMResponse)
+	// Rejected changes are not retried; replicas already agree on the outcome
 	if !response.Success {
-		return fmt.Errorf("command failed: %s", response.Error)
+		log.Printf("Warning: usage update partially rejected: %s", response.Error)
 	}
 
 	return nil
 }
 
+// applyCommand encodes a command and applies it through the leader
+// The command keeps one request ID across retries
+func (n *Node) applyCommand(cmd Command) (*FSMResponse, error) {
+	if cmd.RequestID == "" {
+		cmd.RequestID = n.newRequestID()
+	}
+
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command: %w", err)
+	}
+
+	return n.forward("Forward.Apply", &ApplyArgs{Command: data}, func() (*ForwardReply, error) {
+		return n.applyLocal(data)
+	})
+}
+
+// applyLocal applies an encoded command on the leader
+// Commands this version cannot apply are rejected before they reach the
+// log, where they would halt every replica
+func (n *Node) applyLocal(data []byte) (*ForwardReply, error) {
+	cmd, err := decodeCommand(data)
+	if err == nil && commandNames[cmd.Type] == "" && cmd.Type&IgnoreUnknownTypeFlag == 0 {
+		err = fmt.Errorf("%w: %s", ErrUnknownCommandType, cmd.Type)
+	}
+	if err != nil {
+		return &ForwardReply{Response: &FSMResponse{Success: false, Error: err.Error()}}, nil
+	}
+
+	future := n.raft.Apply(data, 10*time.Second)
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("raft apply failed: %w", err)
+	}
+
+	return &ForwardReply{
+		Response: future.Response().(*FSMResponse),
+		Index:    future.Index(),
+	}, nil
+}
+
 // Join adds a new node to the Raft cluster
+// Followers forward the request to the leader
 func (n *Node) Join(nodeID, addr string) error {
-	if !n.IsLeader() {
-		return fmt.Errorf("not the leader")
+	response, err := n.forward("Forward.Join", &MembershipArgs{NodeID: nodeID, Address: addr}, func() (*ForwardReply, error) {
+		return n.joinLocal(nodeID, addr)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return fmt.Errorf("join failed: %s", response.Error)
+	}
+	return nil
+}
+
+// joinLocal adds a voter on the leader
+// Joining again with the same ID and address is a no-op, so members can
+// retry safely; a stale entry for the same ID or address is replaced
+func (n *Node) joinLocal(nodeID, addr string) (*ForwardReply, error) {
+	configFuture := n.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, fmt.Errorf("failed to get configuration: %w", err)
+	}
+
+	for _, server := range configFuture.Configuration().Servers {
+		sameID := server.ID == raft.ServerID(nodeID)
+		sameAddr := server.Address == raft.ServerAddress(addr)
+
+		if sameID && sameAddr && server.Suffrage == raft.Voter {
+			return &ForwardReply{Response: &FSMResponse{Success: true}}, nil
+		}
+
+		// AddVoter updates the address of an existing ID, but another ID
+		// on the same address has to go first
+		if sameAddr && !sameID {
+			if err := n.raft.RemoveServer(server.ID, 0, 0).Error(); err != nil {
+				return nil, fmt.Errorf("failed to remove stale server %s: %w", server.ID, err)
+			}
+		}
 	}
 
 	future := n.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
-	return future.Error()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("failed to add voter: %w", err)
+	}
+
+	return &ForwardReply{Response: &FSMResponse{Success: true}, Index: future.Index()}, nil
 }
 
 // Leave removes a node from the Raft cluster
+// Followers forward the request to the leader
 func (n *Node) Leave(nodeID string) error {
-	if !n.IsLeader() {
-		return fmt.Errorf("not the leader")
+	response, err := n.forward("Forward.Leave", &MembershipArgs{NodeID: nodeID}, func() (*ForwardReply, error) {
+		return n.leaveLocal(nodeID)
+	})
+	if err != nil {
+		return err
 	}
 
+	if !response.Success {
+		return fmt.Errorf("leave failed: %s", response.Error)
+	}
+	return nil
+}
+
+// leaveLocal removes a server on the leader
+func (n *Node) leaveLocal(nodeID string) (*ForwardReply, error) {
 	future := n.raft.RemoveServer(raft.ServerID(nodeID), 0, 0)
-	return future.Error()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("failed to remove server: %w", err)
+	}
+
+	return &ForwardReply{Response: &FSMResponse{Success: true}, Index: future.Index()}, nil
+}
+
+// forward runs a write on the current leader
+// The leader runs local directly; followers call method over the internal RPC
+// and wait until their own state includes the write. Attempts are retried
+// with backoff while leadership changes
+func (n *Node) forward(method string, args interface{}, local func() (*ForwardReply, error)) (*FSMResponse, error) {
+	deadline := time.Now().Add(forwardTimeout)
+	backoff := 50 * time.Millisecond
+
+	for {
+		reply, err := n.forwardOnce(method, args, local)
+		if err == nil {
+			// Followers only return once the write is visible locally
+			if !n.IsLeader() && reply.Index > 0 {
+				if err := n.waitForIndex(reply.Index, time.Until(deadline)); err != nil {
+					return nil, err
+				}
+			}
+			return reply.Response, nil
+		}
+
+		if n.raft.State() == raft.Shutdown {
+			return nil, raft.ErrRaftShutdown
+		}
+		if !isRetryable(err) || time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
+
+// forwardOnce makes a single attempt at running a write on the leader
+func (n *Node) forwardOnce(method string, args interface{}, local func() (*ForwardReply, error)) (*ForwardReply, error) {
+	if n.IsLeader() {
+		return local()
+	}
+
+	leader := n.Leader()
+	if leader == "" {
+		return nil, errNoLeader
+	}
+
+	client, err := dialRPC(leader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach leader %s: %w", leader, err)
+	}
+	defer client.Close()
+
+	var reply ForwardReply
+	if err := client.Call(method, args, &reply); err != nil {
+		return nil, fmt.Errorf("leader %s: %w", leader, err)
+	}
+	if reply.Response == nil {
+		reply.Response = &FSMResponse{Success: true}
+	}
+	return &reply, nil
+}
+
+// waitForIndex waits until the local FSM has applied the given log index
+func (n *Node) waitForIndex(index uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for n.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for index %d to be applied locally", index)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// WaitForSync waits until the local FSM has applied every entry committed
+// in the cluster, so the pool reflects the replicated state
+func (n *Node) WaitForSync(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for n.Leader() == "" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for sync: %w", errNoLeader)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n.IsLeader() {
+		if err := n.raft.Barrier(time.Until(deadline)).Error(); err != nil {
+			return fmt.Errorf("raft barrier failed: %w", err)
+		}
+		return nil
+	}
+
+	// A follower learns the commit index from the leader's heartbeats
+	return n.waitForIndex(n.raft.CommitIndex(), time.Until(deadline))
 }
 
 // Stats returns Raft statistics
@@ -212,9 +596,48 @@ func (n *Node) Stats() map[string]string {
 }
 
 // Shutdown gracefully shuts down the Raft node
+// Pending IP usage updates are replicated first
 func (n *Node) Shutdown() error {
-	future := n.raft.Shutdown()
-	return future.Error()
+	n.stopOnce.Do(func() {
+		if n.shutdownCh != nil {
+			close(n.shutdownCh)
+		}
+	})
+
+	if err := n.usage.Stop(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	if err := n.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if n.leaseDone != nil {
+		<-n.leaseDone
+	}
+
+	var err error
+	n.closeOnce.Do(func() {
+		for _, store := range n.stores {
+			if closeErr := store.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("failed to close raft store: %w", closeErr)
+			}
+		}
+	})
+	return err
+}
+
+// newRequestID returns an ID unique to one request of this Node instance
+func (n *Node) newRequestID() string {
+	return fmt.Sprintf("%s-%d", n.origin, n.requestSeq.Add(1))
+}
+
+// newOriginID returns a random identifier for a Node instance
+func newOriginID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate origin ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
 }
 
 // GetPool returns the underlying IP pool
@@ -0,0 +1,251 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jianzi123/ipam/pkg/ipam"
+)
+
+// testCluster is an in-memory Raft cluster of IPAM nodes
+type testCluster struct {
+	nodes []*Node
+	pools []*ipam.Pool
+}
+
+// newTestCluster starts an in-memory cluster with the given number of voters
+// Usage batches are only flushed when a test calls Flush
+func newTestCluster(t *testing.T, size int) *testCluster {
+	t.Helper()
+
+	cluster := &testCluster{}
+	var transports []*raft.InmemTransport
+	var servers []raft.Server
+
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("ipam-%d", i+1)
+		_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+		transports = append(transports, transport)
+		servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: transport.LocalAddr()})
+	}
+
+	// Fully connect the transports
+	for _, a := range transports {
+		for _, b := range transports {
+			if a != b {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+
+	for i, transport := range transports {
+		id := string(servers[i].ID)
+		pool := newTestPool(t)
+		fsm := NewFSM(pool)
+		fsm.origin = id + "-origin"
+
+		r, err := raft.NewRaft(newTestRaftConfig(id), fsm, raft.NewInmemStore(), raft.NewInmemStore(),
+			raft.NewInmemSnapshotStore(), transport)
+		if err != nil {
+			t.Fatalf("NewRaft failed: %v", err)
+		}
+		if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			t.Fatalf("BootstrapCluster failed: %v", err)
+		}
+
+		node := &Node{
+			config: &NodeConfig{NodeID: id},
+			raft:   r,
+			fsm:    fsm,
+			pool:   pool,
+			origin: fsm.origin,
+		}
+		node.usage = NewUsageBatcher(node.UpdateUsage, time.Hour)
+		fsm.usage = node.usage
+		t.Cleanup(func() { r.Shutdown() })
+
+		cluster.nodes = append(cluster.nodes, node)
+		cluster.pools = append(cluster.pools, pool)
+	}
+
+	cluster.leader(t)
+	return cluster
+}
+
+// leader waits for a leader to be elected and returns its index
+func (c *testCluster) leader(t *testing.T) int {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, node := range c.nodes {
+			if node.IsLeader() {
+				return i
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for leader election")
+	return -1
+}
+
+// newTestNode starts a single-node in-memory cluster and waits for leadership
+func newTestNode(t *testing.T) (*Node, *ipam.Pool) {
+	t.Helper()
+
+	cluster := newTestCluster(t, 1)
+	return cluster.nodes[0], cluster.pools[0]
+}
+
+// waitForApplied waits until every node has applied the leader's last index
+func (c *testCluster) waitForApplied(t *testing.T) {
+	t.Helper()
+
+	target := c.nodes[c.leader(t)].raft.LastIndex()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range c.nodes {
+		for node.raft.AppliedIndex() < target {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s to apply index %d", node.config.NodeID, target)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestNodeAllocateBlock(t *testing.T) {
+	t.Run("Leader chooses the CIDR", func(t *testing.T) {
+		node, pool := newTestNode(t)
+
+		for i, want := range []string{"10.244.0.0/24", "10.244.1.0/24", "10.244.2.0/24"} {
+			data, err := node.AllocateBlock("node1")
+			if err != nil {
+				t.Fatalf("AllocateBlock %d failed: %v", i, err)
+			}
+			if data["cidr"] != want {
+				t.Errorf("Expected %s, got %v", want, data["cidr"])
+			}
+		}
+
+		blocks, _ := pool.GetNodeBlocks("node1")
+		if len(blocks) != 3 {
+			t.Errorf("Expected 3 blocks, got %d", len(blocks))
+		}
+	})
+
+	t.Run("Retried request allocates once", func(t *testing.T) {
+		node, pool := newTestNode(t)
+
+		first, err := node.allocateBlockLocal("request-1", "node1")
+		if err != nil || !first.Response.Success {
+			t.Fatalf("allocateBlockLocal failed: %v %+v", err, first)
+		}
+		retry, err := node.allocateBlockLocal("request-1", "node1")
+		if err != nil || !retry.Response.Success {
+			t.Fatalf("Retried allocateBlockLocal failed: %v %+v", err, retry)
+		}
+
+		if retry.Response.Data["cidr"] != first.Response.Data["cidr"] {
+			t.Errorf("Expected retry to return %v, got %v", first.Response.Data["cidr"], retry.Response.Data["cidr"])
+		}
+		if blocks, _ := pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Errorf("Expected 1 block, got %d", len(blocks))
+		}
+	})
+
+	t.Run("Client retries with a request ID allocate once", func(t *testing.T) {
+		node, pool := newTestNode(t)
+
+		first, replayed, err := node.AllocateBlockWithID("node1", "request-1")
+		if err != nil || replayed {
+			t.Fatalf("AllocateBlockWithID failed: %v (replayed %v)", err, replayed)
+		}
+		retry, replayed, err := node.AllocateBlockWithID("node1", "request-1")
+		if err != nil || !replayed || retry["cidr"] != first["cidr"] {
+			t.Errorf("Expected retry to replay %v, got %v (replayed %v, %v)", first["cidr"], retry["cidr"], replayed, err)
+		}
+		if blocks, _ := pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Errorf("Expected 1 block, got %d", len(blocks))
+		}
+
+		// Without an ID every call is a new request
+		node.AllocateBlockWithID("node1", "")
+		node.AllocateBlockWithID("node1", "")
+		if blocks, _ := pool.GetNodeBlocks("node1"); len(blocks) != 3 {
+			t.Errorf("Expected 3 blocks, got %d", len(blocks))
+		}
+	})
+}
+
+func TestNodeUsageReplication(t *testing.T) {
+	t.Run("Followers learn pod IPs allocated on the leader", func(t *testing.T) {
+		cluster := newTestCluster(t, 3)
+		leader := cluster.nodes[cluster.leader(t)]
+		leaderPool := leader.pool
+
+		if _, err := leader.AllocateBlock("node1"); err != nil {
+			t.Fatalf("AllocateBlock failed: %v", err)
+		}
+
+		var ips []net.IP
+		for i := 0; i < 5; i++ {
+			ip, _, err := leaderPool.AllocateIPFromExistingBlocks("node1")
+			if err != nil {
+				t.Fatalf("AllocateIPFromExistingBlocks failed: %v", err)
+			}
+			leader.RecordIPAllocation("node1", ip)
+			ips = append(ips, ip)
+		}
+		leaderPool.ReleaseIP(ips[2], "node1")
+		leader.RecordIPRelease("node1", ips[2])
+
+		before := leader.raft.LastIndex()
+		if err := leader.usage.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		if entries := leader.raft.LastIndex() - before; entries != 1 {
+			t.Errorf("Expected 1 Raft entry for the batch, got %d", entries)
+		}
+		cluster.waitForApplied(t)
+
+		for i, pool := range cluster.pools {
+			stats := pool.GetStats()
+			if stats.UsedIPs != 4 {
+				t.Errorf("Node %d: expected 4 used IPs, got %d", i, stats.UsedIPs)
+			}
+
+			blocks, _ := pool.GetNodeBlocks("node1")
+			if blocks[0].Contains(ips[2]) {
+				t.Errorf("Node %d: released IP %s still allocated", i, ips[2])
+			}
+			if !blocks[0].Contains(ips[4]) {
+				t.Errorf("Node %d: IP %s not allocated", i, ips[4])
+			}
+		}
+	})
+
+	t.Run("Origin skips its own superseded batches", func(t *testing.T) {
+		node, pool := newTestNode(t)
+		node.AllocateBlock("node1")
+
+		ip, _, _ := pool.AllocateIPFromExistingBlocks("node1")
+		node.RecordIPAllocation("node1", ip)
+		if err := node.usage.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+
+		// Release again before the allocation is replayed
+		pool.ReleaseIP(ip, "node1")
+		node.RecordIPRelease("node1", ip)
+		if err := node.UpdateUsage([]IPChange{{NodeID: "node1", IP: ip.String(), Allocated: true}}); err != nil {
+			t.Fatalf("UpdateUsage failed: %v", err)
+		}
+
+		if stats := pool.GetStats(); stats.UsedIPs != 0 {
+			t.Errorf("Expected the stale batch to be skipped locally, got %d used IPs", stats.UsedIPs)
+		}
+	})
+}
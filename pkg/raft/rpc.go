@@ -0,0 +1,305 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Connection types, sent as the first byte of every connection to the Raft port
+// This lets Raft traffic and the internal RPC share a single listener
+const (
+	connTypeRaft    byte = 0x01
+	connTypeForward byte = 0x02
+)
+
+const (
+	// forwardTimeout bounds how long a write keeps retrying across leader changes
+	forwardTimeout = 15 * time.Second
+
+	// rpcDialTimeout bounds dialing the leader's internal RPC
+	rpcDialTimeout = 5 * time.Second
+
+	// connTypeTimeout bounds how long an inbound connection may take to identify itself
+	connTypeTimeout = 10 * time.Second
+)
+
+// errNoLeader is returned while the cluster has no known leader
+var errNoLeader = errors.New("no known leader")
+
+// rpcMux accepts connections on the Raft port and routes them by type
+// It implements raft.StreamLayer for the Raft network transport
+type rpcMux struct {
+	listener  net.Listener
+	advertise net.Addr
+	rpcServer *rpc.Server
+
+	raftConns  chan net.Conn
+	shutdownCh chan struct{}
+	closeOnce  sync.Once
+}
+
+// newRPCMux listens on bindAddr and advertises advertiseAddr to other nodes
+// Without advertiseAddr the bound address is advertised, so it must not be
+// an unspecified IP
+func newRPCMux(bindAddr, advertiseAddr string) (*rpcMux, error) {
+	var advertise *net.TCPAddr
+	if advertiseAddr != "" {
+		addr, err := net.ResolveTCPAddr("tcp", advertiseAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid advertise address %s: %w", advertiseAddr, err)
+		}
+		advertise = addr
+	}
+
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", bindAddr, err)
+	}
+
+	if advertise == nil {
+		advertise = listener.Addr().(*net.TCPAddr)
+	}
+	if advertise.IP.IsUnspecified() {
+		listener.Close()
+		return nil, fmt.Errorf("address %s is not advertisable, set an advertise address", advertise)
+	}
+
+	return &rpcMux{
+		listener:   listener,
+		advertise:  advertise,
+		rpcServer:  rpc.NewServer(),
+		raftConns:  make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
+	}, nil
+}
+
+// Start accepts connections until the mux is closed
+func (m *rpcMux) Start() {
+	go func() {
+		for {
+			conn, err := m.listener.Accept()
+			if err != nil {
+				select {
+				case <-m.shutdownCh:
+					return
+				default:
+					continue
+				}
+			}
+			go m.handleConn(conn)
+		}
+	}()
+}
+
+// handleConn reads the connection type and hands the connection off
+func (m *rpcMux) handleConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(connTypeTimeout))
+	var connType [1]byte
+	if _, err := io.ReadFull(conn, connType[:]); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch connType[0] {
+	case connTypeRaft:
+		select {
+		case m.raftConns <- conn:
+		case <-m.shutdownCh:
+			conn.Close()
+		}
+	case connTypeForward:
+		m.rpcServer.ServeConn(conn)
+	default:
+		conn.Close()
+	}
+}
+
+// Accept waits for the next Raft connection
+func (m *rpcMux) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.raftConns:
+		return conn, nil
+	case <-m.shutdownCh:
+		return nil, errors.New("raft transport closed")
+	}
+}
+
+// Close stops accepting connections
+func (m *rpcMux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.shutdownCh)
+		err = m.listener.Close()
+	})
+	return err
+}
+
+// Addr returns the advertised address
+func (m *rpcMux) Addr() net.Addr {
+	return m.advertise
+}
+
+// Dial opens a Raft connection to another node
+func (m *rpcMux) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dialConn(string(address), connTypeRaft, timeout)
+}
+
+// dialConn connects to a node's Raft port and announces the connection type
+func dialConn(address string, connType byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{connType}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialRPC opens an internal RPC client to the node at address
+func dialRPC(address string) (*rpc.Client, error) {
+	conn, err := dialConn(address, connTypeForward, rpcDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// ForwardReply is the result of a write executed on the leader
+type ForwardReply struct {
+	Response *FSMResponse
+
+	// Index is the Raft index of the write, used by followers to wait
+	// until their local state includes it
+	Index uint64
+}
+
+// AllocateBlockArgs are the arguments of Forward.AllocateBlock
+type AllocateBlockArgs struct {
+	NodeID    string
+	RequestID string
+}
+
+// ApplyArgs are the arguments of Forward.Apply
+type ApplyArgs struct {
+	Command []byte
+}
+
+// MembershipArgs are the arguments of Forward.Join and Forward.Leave
+type MembershipArgs struct {
+	NodeID  string
+	Address string
+}
+
+// LeaseArgs are the arguments of Forward.Lease
+type LeaseArgs struct {
+	Type      CommandType
+	NodeID    string
+	Pinned    bool
+	RequestID string
+}
+
+// LeaderArgs are the arguments of Forward.Leader
+type LeaderArgs struct{}
+
+// LeaderReply is the leader known to the queried node
+type LeaderReply struct {
+	Address string
+}
+
+// ForwardService executes writes forwarded by followers
+// Methods only succeed on the leader; followers retry elsewhere otherwise
+type ForwardService struct {
+	node *Node
+}
+
+// Leader returns the address of the current leader, if known
+func (s *ForwardService) Leader(args *LeaderArgs, reply *LeaderReply) error {
+	reply.Address = s.node.Leader()
+	return nil
+}
+
+// AllocateBlock allocates a block, choosing the CIDR on the leader
+func (s *ForwardService) AllocateBlock(args *AllocateBlockArgs, reply *ForwardReply) error {
+	result, err := s.node.allocateBlockLocal(args.RequestID, args.NodeID)
+	if err != nil {
+		return err
+	}
+	*reply = *result
+	return nil
+}
+
+// Apply applies an encoded command
+func (s *ForwardService) Apply(args *ApplyArgs, reply *ForwardReply) error {
+	result, err := s.node.applyLocal(args.Command)
+	if err != nil {
+		return err
+	}
+	*reply = *result
+	return nil
+}
+
+// Lease applies a lease command, stamped with the leader clock
+func (s *ForwardService) Lease(args *LeaseArgs, reply *ForwardReply) error {
+	result, err := s.node.leaseLocal(args)
+	if err != nil {
+		return err
+	}
+	*reply = *result
+	return nil
+}
+
+// Join adds a voter to the cluster
+func (s *ForwardService) Join(args *MembershipArgs, reply *ForwardReply) error {
+	result, err := s.node.joinLocal(args.NodeID, args.Address)
+	if err != nil {
+		return err
+	}
+	*reply = *result
+	return nil
+}
+
+// Leave removes a server from the cluster
+func (s *ForwardService) Leave(args *MembershipArgs, reply *ForwardReply) error {
+	result, err := s.node.leaveLocal(args.NodeID)
+	if err != nil {
+		return err
+	}
+	*reply = *result
+	return nil
+}
+
+// isRetryable reports whether a write may succeed on a later attempt,
+// typically after a new leader has been elected
+func isRetryable(err error) bool {
+	// Errors returned by the leader arrive as plain strings
+	for _, retryable := range []error{
+		raft.ErrNotLeader,
+		raft.ErrLeadershipLost,
+		raft.ErrLeadershipTransferInProgress,
+		raft.ErrRaftShutdown,
+		errNoLeader,
+	} {
+		if errors.Is(err, retryable) || strings.Contains(err.Error(), retryable.Error()) {
+			return true
+		}
+	}
+
+	// The leader went away mid-call
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, rpc.ErrShutdown) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
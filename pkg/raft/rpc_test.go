@@ -0,0 +1,310 @@
+package raft
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/jianzi123/ipam/pkg/ipam"
+)
+
+// newTCPNode starts a Node on a loopback port with its own data directory
+func newTCPNode(t *testing.T, id string, bootstrap bool) (*Node, *ipam.Pool) {
+	t.Helper()
+
+	return startTCPNode(t, newTCPNodeConfig(t, id, bootstrap))
+}
+
+// newTCPNodeConfig returns a NodeConfig tuned for fast loopback tests
+func newTCPNodeConfig(t *testing.T, id string, bootstrap bool) *NodeConfig {
+	return &NodeConfig{
+		NodeID:           id,
+		BindAddr:         "127.0.0.1:0",
+		DataDir:          t.TempDir(),
+		Bootstrap:        bootstrap,
+		JoinTimeout:      10 * time.Second,
+		HeartbeatTimeout: 500 * time.Millisecond,
+		ElectionTimeout:  500 * time.Millisecond,
+		CommitTimeout:    10 * time.Millisecond,
+		BatchInterval:    time.Hour,
+	}
+}
+
+// startTCPNode starts a Node with the given config and a fresh pool
+func startTCPNode(t *testing.T, config *NodeConfig) (*Node, *ipam.Pool) {
+	t.Helper()
+
+	pool := newTestPool(t)
+	node, err := NewNode(config, pool)
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	t.Cleanup(func() { node.Shutdown() })
+
+	return node, pool
+}
+
+// configuration returns the Raft configuration seen by node and its index
+func configuration(t *testing.T, node *Node) (raft.Configuration, uint64) {
+	t.Helper()
+
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatalf("GetConfiguration failed: %v", err)
+	}
+	return future.Configuration(), future.Index()
+}
+
+// waitForNodeLeader waits until every node agrees on a leader and returns it
+func waitForNodeLeader(t *testing.T, nodes ...*Node) *Node {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader *Node
+		for _, node := range nodes {
+			if node.IsLeader() {
+				leader = node
+			}
+		}
+
+		if leader != nil {
+			agreed := true
+			for _, node := range nodes {
+				if node.Leader() != leader.Addr() {
+					agreed = false
+				}
+			}
+			if agreed {
+				return leader
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for nodes to agree on a leader")
+	return nil
+}
+
+func TestNodeForwarding(t *testing.T) {
+	node1, _ := newTCPNode(t, "ipam-1", true)
+	waitForNodeLeader(t, node1)
+
+	node2, pool2 := newTCPNode(t, "ipam-2", false)
+	node3, _ := newTCPNode(t, "ipam-3", false)
+
+	if err := node1.Join("ipam-2", node2.Addr()); err != nil {
+		t.Fatalf("Join on leader failed: %v", err)
+	}
+	waitForNodeLeader(t, node1, node2)
+
+	// Membership changes are forwarded too
+	if err := node2.Join("ipam-3", node3.Addr()); err != nil {
+		t.Fatalf("Join forwarded by follower failed: %v", err)
+	}
+	nodes := []*Node{node1, node2, node3}
+	waitForNodeLeader(t, nodes...)
+
+	t.Run("Block allocation from a follower", func(t *testing.T) {
+		data, err := node2.AllocateBlock("node-a")
+		if err != nil {
+			t.Fatalf("AllocateBlock on follower failed: %v", err)
+		}
+
+		// The follower sees its own write as soon as the call returns
+		blocks, err := pool2.GetNodeBlocks("node-a")
+		if err != nil || len(blocks) != 1 || blocks[0].CIDR.String() != data["cidr"] {
+			t.Fatalf("Follower pool missing block %v: %v %v", data["cidr"], blocks, err)
+		}
+
+		if err := node3.ReleaseBlock("node-a", blocks[0].CIDR.String()); err != nil {
+			t.Fatalf("ReleaseBlock on follower failed: %v", err)
+		}
+	})
+
+	t.Run("Command errors are returned to the follower", func(t *testing.T) {
+		if err := node2.ReleaseBlock("node-a", "10.244.200.0/24"); err == nil {
+			t.Error("Expected release of unknown block to fail")
+		}
+	})
+
+	t.Run("Leader rejects commands it cannot apply", func(t *testing.T) {
+		response, err := node2.applyCommand(Command{Type: 0x7f, NodeID: "node-a"})
+		if err != nil {
+			t.Fatalf("applyCommand failed: %v", err)
+		}
+		if response.Success {
+			t.Error("Expected unknown command to be rejected")
+		}
+	})
+
+	t.Run("Usage batches from a follower", func(t *testing.T) {
+		if _, err := node2.AllocateBlock("node-b"); err != nil {
+			t.Fatalf("AllocateBlock failed: %v", err)
+		}
+
+		ip, _, err := pool2.AllocateIPFromExistingBlocks("node-b")
+		if err != nil {
+			t.Fatalf("AllocateIPFromExistingBlocks failed: %v", err)
+		}
+		node2.RecordIPAllocation("node-b", ip)
+		if err := node2.usage.Flush(); err != nil {
+			t.Fatalf("Flush on follower failed: %v", err)
+		}
+
+		leader := waitForNodeLeader(t, nodes...)
+		blocks, _ := leader.pool.GetNodeBlocks("node-b")
+		if !blocks[0].Contains(ip) {
+			t.Errorf("Leader does not know follower allocation %s", ip)
+		}
+	})
+
+	t.Run("Retries after the leader changes", func(t *testing.T) {
+		leader := waitForNodeLeader(t, nodes...)
+		var followers []*Node
+		for _, node := range nodes {
+			if node != leader {
+				followers = append(followers, node)
+			}
+		}
+
+		if err := leader.Shutdown(); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+
+		if _, err := followers[0].AllocateBlock("node-c"); err != nil {
+			t.Fatalf("AllocateBlock after leader loss failed: %v", err)
+		}
+
+		newLeader := waitForNodeLeader(t, followers...)
+		if blocks, err := newLeader.pool.GetNodeBlocks("node-c"); err != nil || len(blocks) != 1 {
+			t.Errorf("New leader missing block for node-c: %v %v", blocks, err)
+		}
+	})
+}
+
+func TestNodeJoin(t *testing.T) {
+	node1, _ := newTCPNode(t, "ipam-1", true)
+	waitForNodeLeader(t, node1)
+
+	// JoinAddr points at the leader
+	config2 := newTCPNodeConfig(t, "ipam-2", false)
+	config2.JoinAddr = node1.Addr()
+	node2, _ := startTCPNode(t, config2)
+
+	// Peers are walked past unreachable members, and a follower leads to the leader
+	config3 := newTCPNodeConfig(t, "ipam-3", false)
+	config3.Peers = []string{"127.0.0.1:1", node2.Addr()}
+	node3, _ := startTCPNode(t, config3)
+
+	waitForNodeLeader(t, node1, node2, node3)
+
+	t.Run("All nodes are voters", func(t *testing.T) {
+		servers, _ := configuration(t, node1)
+		if len(servers.Servers) != 3 {
+			t.Fatalf("Expected 3 servers, got %+v", servers.Servers)
+		}
+		for _, server := range servers.Servers {
+			if server.Suffrage != raft.Voter {
+				t.Errorf("Expected %s to be a voter", server.ID)
+			}
+		}
+	})
+
+	t.Run("Repeated join is a no-op", func(t *testing.T) {
+		_, before := configuration(t, node1)
+		if err := node2.Join("ipam-3", node3.Addr()); err != nil {
+			t.Fatalf("Repeated join failed: %v", err)
+		}
+		if _, after := configuration(t, node1); after != before {
+			t.Errorf("Configuration changed from index %d to %d", before, after)
+		}
+	})
+
+	t.Run("Restarted member does not join again", func(t *testing.T) {
+		_, before := configuration(t, node1)
+
+		config3.BindAddr = node3.Addr()
+		if err := node3.Shutdown(); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+		restarted, _ := startTCPNode(t, config3)
+		waitForNodeLeader(t, node1, node2, restarted)
+
+		if _, after := configuration(t, node1); after != before {
+			t.Errorf("Configuration changed from index %d to %d", before, after)
+		}
+	})
+
+	t.Run("Restarted bootstrap node keeps its state", func(t *testing.T) {
+		config := newTCPNodeConfig(t, "solo", true)
+		node, _ := startTCPNode(t, config)
+		waitForNodeLeader(t, node)
+		if _, err := node.AllocateBlock("node1"); err != nil {
+			t.Fatalf("AllocateBlock failed: %v", err)
+		}
+
+		config.BindAddr = node.Addr()
+		node.Shutdown()
+		restarted, pool := startTCPNode(t, config)
+		if err := restarted.WaitForSync(10 * time.Second); err != nil {
+			t.Fatalf("WaitForSync failed: %v", err)
+		}
+		if blocks, err := pool.GetNodeBlocks("node1"); err != nil || len(blocks) != 1 {
+			t.Errorf("Expected node1 block after sync, got %v (%v)", blocks, err)
+		}
+	})
+
+	t.Run("Join fails without a reachable member", func(t *testing.T) {
+		config := newTCPNodeConfig(t, "ipam-4", false)
+		config.JoinAddr = "127.0.0.1:1"
+		config.JoinTimeout = 500 * time.Millisecond
+
+		if node, err := NewNode(config, newTestPool(t)); err == nil {
+			node.Shutdown()
+			t.Error("Expected join to fail")
+		}
+	})
+}
+
+func TestRPCMux(t *testing.T) {
+	t.Run("Rejects unspecified bind address", func(t *testing.T) {
+		if _, err := newRPCMux("0.0.0.0:0", ""); err == nil {
+			t.Error("Expected error for unspecified bind address")
+		}
+	})
+
+	t.Run("Advertises the configured address", func(t *testing.T) {
+		mux, err := newRPCMux("0.0.0.0:0", "127.0.0.1:7000")
+		if err != nil {
+			t.Fatalf("newRPCMux failed: %v", err)
+		}
+		defer mux.Close()
+
+		if mux.Addr().String() != "127.0.0.1:7000" {
+			t.Errorf("Expected 127.0.0.1:7000, got %s", mux.Addr())
+		}
+	})
+
+	t.Run("Drops unknown connection types", func(t *testing.T) {
+		mux, err := newRPCMux("127.0.0.1:0", "")
+		if err != nil {
+			t.Fatalf("newRPCMux failed: %v", err)
+		}
+		defer mux.Close()
+		mux.Start()
+
+		conn, err := dialConn(mux.Addr().String(), 0xff, time.Second)
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("Expected connection to be closed")
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Error("Expected connection to be closed, read timed out")
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package raft
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBatchInterval is the default interval for replicating IP usage updates
+const DefaultBatchInterval = 1 * time.Second
+
+// UsageBatcher collects per-IP allocation changes made on the local pool
+// and replicates them through Raft in batches to keep Raft writes infrequent
+type UsageBatcher struct {
+	submit   func([]IPChange) error
+	interval time.Duration
+
+	// pending holds the latest change per IP that has not been submitted yet
+	pending map[string]IPChange
+
+	// inflight holds the batch being submitted
+	inflight map[string]IPChange
+
+	// base holds the committed state of every IP with local changes that
+	// are not committed yet, so snapshots can leave those changes out
+	base map[string]IPChange
+	mu   sync.Mutex
+
+	// flushMu serializes flushes so batches are committed in order
+	flushMu sync.Mutex
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewUsageBatcher creates a batcher that hands each batch to submit
+func NewUsageBatcher(submit func([]IPChange) error, interval time.Duration) *UsageBatcher {
+	if interval <= 0 {
+		interval = DefaultBatchInterval
+	}
+
+	return &UsageBatcher{
+		submit:   submit,
+		interval: interval,
+		pending:  make(map[string]IPChange),
+		base:     make(map[string]IPChange),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Record queues an IP change for the next batch
+// A newer change for the same IP replaces the queued one
+func (b *UsageBatcher) Record(change IPChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := changeKey(change)
+	if _, ok := b.base[key]; !ok {
+		committed := change
+		committed.Allocated = !change.Allocated
+		b.base[key] = committed
+	}
+	b.pending[key] = change
+}
+
+// Pending returns the number of changes waiting to be replicated
+func (b *UsageBatcher) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.pending)
+}
+
+// Start starts the periodic flush loop
+func (b *UsageBatcher) Start() {
+	go func() {
+		defer close(b.doneCh)
+
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.Flush(); err != nil {
+					log.Printf("Warning: failed to replicate IP usage: %v", err)
+				}
+			case <-b.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the flush loop and replicates any remaining changes
+// It is safe to call Stop more than once
+func (b *UsageBatcher) Stop() error {
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+		<-b.doneCh
+	})
+	return b.Flush()
+}
+
+// Flush replicates all pending changes as a single batch
+// Changes that fail to replicate are kept for the next flush
+func (b *UsageBatcher) Flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = make(map[string]IPChange)
+	b.inflight = batch
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.inflight = nil
+		b.mu.Unlock()
+	}()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	changes := sortedChanges(batch)
+
+	if err := b.submit(changes); err != nil {
+		// Requeue, keeping any change recorded while the batch was in flight
+		b.mu.Lock()
+		for key, change := range batch {
+			if _, newer := b.pending[key]; !newer {
+				b.pending[key] = change
+			}
+		}
+		b.mu.Unlock()
+		return fmt.Errorf("failed to replicate %d IP changes: %w", len(changes), err)
+	}
+
+	return nil
+}
+
+// commit records that a change this batcher submitted was committed, and
+// reports whether it is still the latest local change of its IP
+// A change superseded by a pending one must not be applied locally again
+func (b *UsageBatcher) commit(change IPChange) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := changeKey(change)
+	if _, newer := b.pending[key]; newer {
+		if _, ok := b.base[key]; ok {
+			b.base[key] = change
+		}
+		return false
+	}
+
+	delete(b.base, key)
+	return true
+}
+
+// unapplied returns the local changes that may be missing from committed
+// state: the batch in flight and the pending changes
+func (b *UsageBatcher) unapplied() []IPChange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changes := make(map[string]IPChange, len(b.inflight)+len(b.pending))
+	for key, change := range b.inflight {
+		changes[key] = change
+	}
+	for key, change := range b.pending {
+		changes[key] = change
+	}
+	return sortedChanges(changes)
+}
+
+// rebase sets the committed state of an IP with local changes, after the
+// pool was restored from a snapshot
+func (b *UsageBatcher) rebase(committed IPChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.base[changeKey(committed)] = committed
+}
+
+// uncommitted returns the committed state of every IP with local changes
+// that are not committed yet
+func (b *UsageBatcher) uncommitted() []IPChange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return sortedChanges(b.base)
+}
+
+// sortedChanges returns the changes of a map ordered by key
+func sortedChanges(changes map[string]IPChange) []IPChange {
+	list := make([]IPChange, 0, len(changes))
+	for _, change := range changes {
+		list = append(list, change)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return changeKey(list[i]) < changeKey(list[j])
+	})
+	return list
+}
+
+// changeKey returns the coalescing key of a change
+func changeKey(change IPChange) string {
+	return change.NodeID + "/" + change.IP
+}
@@ -0,0 +1,86 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUsageBatcher(t *testing.T) {
+	t.Run("Coalesces changes per IP", func(t *testing.T) {
+		var batches [][]IPChange
+		batcher := NewUsageBatcher(func(changes []IPChange) error {
+			batches = append(batches, changes)
+			return nil
+		}, 0)
+
+		batcher.Record(IPChange{NodeID: "node1", IP: "10.244.0.2", Allocated: true})
+		batcher.Record(IPChange{NodeID: "node1", IP: "10.244.0.1", Allocated: true})
+		batcher.Record(IPChange{NodeID: "node1", IP: "10.244.0.2", Allocated: false})
+
+		if err := batcher.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+
+		if len(batches) != 1 || len(batches[0]) != 2 {
+			t.Fatalf("Expected 1 batch of 2 changes, got %v", batches)
+		}
+		if batches[0][0].IP != "10.244.0.1" || batches[0][1].Allocated {
+			t.Errorf("Unexpected batch contents: %+v", batches[0])
+		}
+
+		// Nothing left to flush
+		batcher.Flush()
+		if len(batches) != 1 {
+			t.Errorf("Expected empty flush to be skipped, got %d batches", len(batches))
+		}
+	})
+
+	t.Run("Requeues failed batches", func(t *testing.T) {
+		fail := true
+		var committed []IPChange
+		batcher := NewUsageBatcher(func(changes []IPChange) error {
+			if fail {
+				return errors.New("not the leader")
+			}
+			committed = append(committed, changes...)
+			return nil
+		}, 0)
+
+		batcher.Record(IPChange{NodeID: "node1", IP: "10.244.0.1", Allocated: true})
+		batcher.Record(IPChange{NodeID: "node1", IP: "10.244.0.2", Allocated: true})
+		if err := batcher.Flush(); err == nil {
+			t.Fatal("Expected flush error")
+		}
+		if batcher.Pending() != 2 {
+			t.Errorf("Expected 2 pending changes, got %d", batcher.Pending())
+		}
+
+		// A newer change recorded after the failure wins over the requeued one
+		batcher.Record(IPChange{NodeID: "node1", IP: "10.244.0.2", Allocated: false})
+
+		fail = false
+		if err := batcher.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		if len(committed) != 2 || committed[1].Allocated {
+			t.Errorf("Unexpected committed changes: %+v", committed)
+		}
+	})
+
+	t.Run("Stop flushes remaining changes", func(t *testing.T) {
+		var committed []IPChange
+		batcher := NewUsageBatcher(func(changes []IPChange) error {
+			committed = append(committed, changes...)
+			return nil
+		}, 0)
+		batcher.Start()
+
+		batcher.Record(IPChange{NodeID: "node1", IP: "10.244.0.1", Allocated: true})
+		if err := batcher.Stop(); err != nil {
+			t.Fatalf("Stop failed: %v", err)
+		}
+		if len(committed) != 1 {
+			t.Errorf("Expected 1 committed change, got %d", len(committed))
+		}
+	})
+}
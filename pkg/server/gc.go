@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jianzi123/ipam/pkg/store"
+)
+
+const (
+	// DefaultGCInterval is the time between garbage collection passes
+	DefaultGCInterval = 5 * time.Minute
+
+	// DefaultGCMinAge is how long a new mapping is kept before it is checked,
+	// so a container being set up is not collected before it shows as live
+	DefaultGCMinAge = 10 * time.Minute
+)
+
+// GCConfig configures the garbage collection of IP mappings
+type GCConfig struct {
+	NodeID   string          // Only mappings of this node are collected
+	Lister   ContainerLister // Source of truth for live containers
+	Interval time.Duration   // Time between passes, DefaultGCInterval when zero
+	MinAge   time.Duration   // Mappings younger than this are kept, DefaultGCMinAge when zero
+	DryRun   bool            // Report stale mappings without releasing them
+}
+
+// GCReport summarizes a garbage collection pass
+type GCReport struct {
+	// Checked is the number of mappings compared against the live containers
+	Checked int
+
+	// Stale mappings belong to containers that are gone
+	Stale []store.IPMapping
+
+	// Released is the number of stale mappings whose IPs were released
+	// It stays zero in dry-run mode
+	Released int
+}
+
+// GarbageCollector releases the IPs of containers that no longer run
+type GarbageCollector struct {
+	server *IPAMServer
+	config GCConfig
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// NewGarbageCollector creates a garbage collector for the mappings of a server
+func NewGarbageCollector(server *IPAMServer, config GCConfig) *GarbageCollector {
+	if config.Interval == 0 {
+		config.Interval = DefaultGCInterval
+	}
+	if config.MinAge == 0 {
+		config.MinAge = DefaultGCMinAge
+	}
+
+	return &GarbageCollector{
+		server: server,
+		config: config,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// Start runs a pass every interval until Stop
+func (gc *GarbageCollector) Start() {
+	go func() {
+		defer close(gc.doneCh)
+
+		ticker := time.NewTicker(gc.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				report, err := gc.Collect()
+				if err != nil {
+					log.Printf("Warning: IP mapping garbage collection failed: %v", err)
+					continue
+				}
+				if len(report.Stale) > 0 {
+					log.Printf("Garbage collection checked %d IP mappings, %d stale, %d released",
+						report.Checked, len(report.Stale), report.Released)
+				}
+			case <-gc.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the collection loop and waits for a running pass
+func (gc *GarbageCollector) Stop() {
+	gc.stopOnce.Do(func() {
+		close(gc.stopCh)
+		<-gc.doneCh
+	})
+}
+
+// Collect runs a single pass, releasing the IPs of containers the lister no
+// longer reports in both the pool and the store
+func (gc *GarbageCollector) Collect() (*GCReport, error) {
+	s := gc.server
+	if s.store == nil {
+		return nil, errors.New("no IP mapping store")
+	}
+	if err := s.checkReady(); err != nil {
+		return nil, err
+	}
+
+	mappings, err := s.store.ListMappingsByNode(gc.config.NodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IP mappings: %w", err)
+	}
+
+	cutoff := time.Now().Add(-gc.config.MinAge)
+	var candidates []store.IPMapping
+	for _, mapping := range mappings {
+		if mapping.AllocatedAt.Before(cutoff) {
+			candidates = append(candidates, mapping)
+		}
+	}
+
+	report := &GCReport{Checked: len(candidates)}
+	if len(candidates) == 0 {
+		return report, nil
+	}
+
+	live, err := gc.config.Lister.ListLive(candidates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list live containers: %w", err)
+	}
+
+	for _, mapping := range candidates {
+		if live[mapping.ContainerID] {
+			continue
+		}
+		report.Stale = append(report.Stale, mapping)
+
+		if gc.config.DryRun {
+			log.Printf("Dry run: would release IPs of container %s interface %q", mapping.ContainerID, mapping.IfName)
+			continue
+		}
+
+		released, err := gc.release(mapping)
+		if err != nil {
+			log.Printf("Warning: failed to release IPs of container %s interface %q: %v",
+				mapping.ContainerID, mapping.IfName, err)
+			continue
+		}
+		if released {
+			log.Printf("Released IPs of container %s interface %q, the container is gone",
+				mapping.ContainerID, mapping.IfName)
+			report.Released++
+		}
+	}
+
+	return report, nil
+}
+
+// release releases a stale mapping unless it changed since it was listed
+func (gc *GarbageCollector) release(listed store.IPMapping) (bool, error) {
+	s := gc.server
+
+	unlock := s.lockContainer(listed.ContainerID)
+	defer unlock()
+
+	mapping, err := s.store.GetIPMapping(listed.ContainerID, listed.IfName)
+	if errors.Is(err, store.ErrMappingNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !mapping.AllocatedAt.Equal(listed.AllocatedAt) {
+		return false, nil
+	}
+
+	if err := s.releaseMapping(mapping); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/jianzi123/ipam/pkg/api/proto"
+	"github.com/jianzi123/ipam/pkg/store"
+)
+
+func TestContainerLister(t *testing.T) {
+	mappings := []store.IPMapping{
+		{ContainerID: "container-1"},
+		{ContainerID: "container-2"},
+	}
+
+	t.Run("File lists one container per line", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "live")
+		if err := os.WriteFile(path, []byte("# running\ncontainer-1\n\n  container-3  \n"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		live, err := (&FileLister{Path: path}).ListLive(mappings)
+		if err != nil {
+			t.Fatalf("ListLive failed: %v", err)
+		}
+		if len(live) != 2 || !live["container-1"] || !live["container-3"] {
+			t.Errorf("Unexpected live containers %v", live)
+		}
+	})
+
+	t.Run("Directory lists one entry per container", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "container-2"), nil, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		live, err := (&FileLister{Path: dir}).ListLive(mappings)
+		if err != nil {
+			t.Fatalf("ListLive failed: %v", err)
+		}
+		if len(live) != 1 || !live["container-2"] {
+			t.Errorf("Unexpected live containers %v", live)
+		}
+	})
+
+	t.Run("Missing path is an error", func(t *testing.T) {
+		if _, err := (&FileLister{Path: filepath.Join(t.TempDir(), "missing")}).ListLive(mappings); err == nil {
+			t.Error("Expected an error for a missing path")
+		}
+	})
+
+	t.Run("Netns lists containers whose namespace exists", func(t *testing.T) {
+		root := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(root, "var/run/netns"), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "var/run/netns/cni-1"), nil, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		live, err := (&NetnsLister{Root: root}).ListLive([]store.IPMapping{
+			{ContainerID: "container-1", Netns: "/var/run/netns/cni-1"},
+			{ContainerID: "container-2", Netns: "/var/run/netns/cni-2"},
+			{ContainerID: "container-3"},
+		})
+		if err != nil {
+			t.Fatalf("ListLive failed: %v", err)
+		}
+		if len(live) != 2 || !live["container-1"] || !live["container-3"] {
+			t.Errorf("Expected container-1 and container-3 without a namespace to be live, got %v", live)
+		}
+	})
+}
+
+func TestGarbageCollector(t *testing.T) {
+	// newServer serves a pool with three containers on node1 and one on node2
+	newServer := func(t *testing.T) (*IPAMServer, *store.MemoryStore) {
+		ipamStore := store.NewMemoryStore()
+		srv := NewIPAMServer(newTestPool(t), nil, ipamStore)
+		if _, err := srv.Reconcile(); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+
+		for _, req := range []*pb.AllocateIPRequest{
+			{NodeId: "node1", ContainerId: "container-1", IfName: "eth0"},
+			{NodeId: "node1", ContainerId: "container-2", IfName: "eth0"},
+			{NodeId: "node1", ContainerId: "container-2", IfName: "net1"},
+			{NodeId: "node2", ContainerId: "container-3", IfName: "eth0"},
+		} {
+			if _, err := srv.AllocateIP(context.Background(), req); err != nil {
+				t.Fatalf("AllocateIP failed: %v", err)
+			}
+		}
+		return srv, ipamStore
+	}
+
+	// liveFile lists container-1 as the only live container
+	liveFile := func(t *testing.T) ContainerLister {
+		path := filepath.Join(t.TempDir(), "live")
+		if err := os.WriteFile(path, []byte("container-1\n"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		return &FileLister{Path: path}
+	}
+
+	t.Run("Releases the IPs of gone containers on its node", func(t *testing.T) {
+		srv, ipamStore := newServer(t)
+		gc := NewGarbageCollector(srv, GCConfig{NodeID: "node1", Lister: liveFile(t), MinAge: time.Nanosecond})
+
+		report, err := gc.Collect()
+		if err != nil {
+			t.Fatalf("Collect failed: %v", err)
+		}
+		if report.Checked != 3 || len(report.Stale) != 2 || report.Released != 2 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+
+		if mappings, _ := ipamStore.ListMappingsByContainer("container-2"); len(mappings) != 0 {
+			t.Errorf("Expected mappings of container-2 to be deleted, got %+v", mappings)
+		}
+		if _, err := ipamStore.GetIPMapping("container-1", "eth0"); err != nil {
+			t.Errorf("Expected container-1 to be kept: %v", err)
+		}
+		if _, err := ipamStore.GetIPMapping("container-3", "eth0"); err != nil {
+			t.Errorf("Expected container-3 on node2 to be kept: %v", err)
+		}
+		if stats := srv.pool.GetStats(); stats.UsedIPs != 2 {
+			t.Errorf("Expected 2 used IPs, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("Collects mappings recorded for the daemon's node", func(t *testing.T) {
+		// The daemon's node ID is not the hostname the CNI plugin used to send
+		srv, ipamStore := newServer(t)
+		srv.SetNodeID("ipam-1")
+		if _, err := srv.AllocateIP(context.Background(), &pb.AllocateIPRequest{ContainerId: "container-4", IfName: "eth0"}); err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+
+		gc := NewGarbageCollector(srv, GCConfig{NodeID: "ipam-1", Lister: liveFile(t), MinAge: time.Nanosecond})
+		report, err := gc.Collect()
+		if err != nil {
+			t.Fatalf("Collect failed: %v", err)
+		}
+		if report.Checked != 1 || report.Released != 1 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		if _, err := ipamStore.GetIPMapping("container-4", "eth0"); err == nil {
+			t.Error("Expected the mapping of container-4 to be deleted")
+		}
+	})
+
+	t.Run("Dry run only reports", func(t *testing.T) {
+		srv, ipamStore := newServer(t)
+		gc := NewGarbageCollector(srv, GCConfig{NodeID: "node1", Lister: liveFile(t), MinAge: time.Nanosecond, DryRun: true})
+
+		report, err := gc.Collect()
+		if err != nil {
+			t.Fatalf("Collect failed: %v", err)
+		}
+		if len(report.Stale) != 2 || report.Released != 0 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+		if mappings, _ := ipamStore.ListIPMappings(); len(mappings) != 4 {
+			t.Errorf("Expected all 4 mappings to be kept, got %d", len(mappings))
+		}
+		if stats := srv.pool.GetStats(); stats.UsedIPs != 4 {
+			t.Errorf("Expected 4 used IPs, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("New mappings are kept", func(t *testing.T) {
+		srv, _ := newServer(t)
+		gc := NewGarbageCollector(srv, GCConfig{NodeID: "node1", Lister: liveFile(t), MinAge: time.Hour})
+
+		report, err := gc.Collect()
+		if err != nil {
+			t.Fatalf("Collect failed: %v", err)
+		}
+		if report.Checked != 0 || len(report.Stale) != 0 {
+			t.Errorf("Unexpected report %+v", report)
+		}
+	})
+
+	t.Run("Lister failure releases nothing", func(t *testing.T) {
+		srv, _ := newServer(t)
+		lister := &FileLister{Path: filepath.Join(t.TempDir(), "missing")}
+		gc := NewGarbageCollector(srv, GCConfig{NodeID: "node1", Lister: lister, MinAge: time.Nanosecond})
+
+		if _, err := gc.Collect(); err == nil {
+			t.Error("Expected Collect to fail")
+		}
+		if stats := srv.pool.GetStats(); stats.UsedIPs != 4 {
+			t.Errorf("Expected 4 used IPs, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("Runs periodically until stopped", func(t *testing.T) {
+		srv, ipamStore := newServer(t)
+		gc := NewGarbageCollector(srv, GCConfig{
+			NodeID:   "node1",
+			Lister:   liveFile(t),
+			Interval: 10 * time.Millisecond,
+			MinAge:   time.Nanosecond,
+		})
+		gc.Start()
+		defer gc.Stop()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if mappings, _ := ipamStore.ListMappingsByNode("node1"); len(mappings) == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Stale mappings were not collected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		gc.Stop()
+	})
+}
@@ -2,250 +2,813 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jianzi123/ipam/pkg/allocator"
+	pb "github.com/jianzi123/ipam/pkg/api/proto"
 	"github.com/jianzi123/ipam/pkg/ipam"
 	"github.com/jianzi123/ipam/pkg/raft"
 	"github.com/jianzi123/ipam/pkg/store"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // IPAMServer implements the IPAM gRPC service
 type IPAMServer struct {
+	pb.UnimplementedIPAMServer
+
 	pool     *ipam.Pool
 	raftNode *raft.Node
-	store    *store.Store
+	store    store.MappingStore
+
+	// ready is set once stored mappings are replayed into the pool
+	ready atomic.Bool
+
+	// auditEnabled records allocation changes in the store's audit log
+	auditEnabled bool
+
+	// nodeID is the node requests without a node ID are served for
+	nodeID string
+
+	// blockMu keeps concurrent allocations from each adding a block to a
+	// node that just ran out of IPs
+	blockMu sync.Mutex
+
+	// containerLocks serializes requests for the same container, guarded by containerMu
+	containerMu    sync.Mutex
+	containerLocks map[string]*containerLock
+}
+
+// containerLock is a lock shared by the requests of one container
+type containerLock struct {
+	mu   sync.Mutex
+	refs int
 }
 
 // NewIPAMServer creates a new IPAM server
-func NewIPAMServer(pool *ipam.Pool, raftNode *raft.Node, store *store.Store) *IPAMServer {
-	return &IPAMServer{
-		pool:     pool,
-		raftNode: raftNode,
-		store:    store,
+// Without a store there is nothing to reconcile and it serves right away
+func NewIPAMServer(pool *ipam.Pool, raftNode *raft.Node, store store.MappingStore) *IPAMServer {
+	s := &IPAMServer{
+		pool:           pool,
+		raftNode:       raftNode,
+		store:          store,
+		auditEnabled:   store != nil,
+		containerLocks: make(map[string]*containerLock),
 	}
+	s.ready.Store(store == nil)
+	return s
 }
 
-// AllocateIPRequest represents IP allocation request
-type AllocateIPRequest struct {
-	NodeID       string
-	PodName      string
-	PodNamespace string
-	ContainerID  string
+// SetAudit enables or disables the audit log, it is enabled by default when
+// there is a store
+// It must be called before the server starts serving
+func (s *IPAMServer) SetAudit(enabled bool) {
+	s.auditEnabled = enabled && s.store != nil
 }
 
-// AllocateIPResponse represents IP allocation response
-type AllocateIPResponse struct {
-	IP      string
-	CIDR    string
-	Gateway string
-	Routes  []Route
+// SetNodeID sets the node of this daemon, which requests without a node ID
+// are served for, so the CNI plugin records mappings under the ID the
+// garbage collector checks
+// It must be called before the server starts serving
+func (s *IPAMServer) SetNodeID(nodeID string) {
+	s.nodeID = nodeID
 }
 
-// Route represents a routing entry
-type Route struct {
-	Dst string
-	GW  string
+// requestNodeID returns the node ID of a request, the daemon's own if the
+// request has none
+func (s *IPAMServer) requestNodeID(nodeID string) string {
+	if nodeID == "" {
+		return s.nodeID
+	}
+	return nodeID
 }
 
-// ReleaseIPRequest represents IP release request
-type ReleaseIPRequest struct {
-	NodeID      string
-	IP          string
-	ContainerID string
+// recordAudit appends events to the audit log
+// A failure is logged but never fails the request that made the change
+func (s *IPAMServer) recordAudit(events ...store.AuditEvent) {
+	if !s.auditEnabled || len(events) == 0 {
+		return
+	}
+	if err := s.store.AppendAudit(events...); err != nil {
+		fmt.Printf("Warning: failed to record audit events: %v\n", err)
+	}
 }
 
-// ReleaseIPResponse represents IP release response
-type ReleaseIPResponse struct {
-	Success bool
-	Message string
+// recordBlockAudit records a block assigned to or taken from a node
+func (s *IPAMServer) recordBlockAudit(eventType store.AuditEventType, nodeID, blockCIDR string) {
+	s.recordAudit(store.AuditEvent{Type: eventType, NodeID: nodeID, BlockCIDR: blockCIDR})
 }
 
-// AllocateIP allocates an IP address for a pod
-func (s *IPAMServer) AllocateIP(ctx context.Context, req *AllocateIPRequest) (*AllocateIPResponse, error) {
+// AllocateIP allocates an IP address for a pod, the one it asks for if any
+func (s *IPAMServer) AllocateIP(ctx context.Context, req *pb.AllocateIPRequest) (*pb.AllocateIPResponse, error) {
+	req.NodeId = s.requestNodeID(req.NodeId)
+	if req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "node_id is required")
+	}
+	var requested net.IP
+	if req.Ip != "" {
+		if requested = net.ParseIP(req.Ip); requested == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid IP %q", req.Ip)
+		}
+	}
+	if err := s.checkReady(); err != nil {
+		return nil, err
+	}
+
+	// A retried ADD for the same interface gets the IP it already holds
+	if s.store != nil {
+		if req.ContainerId == "" {
+			return nil, status.Error(codes.InvalidArgument, "container_id is required")
+		}
+
+		unlock := s.lockContainer(req.ContainerId)
+		defer unlock()
+
+		mapping, err := s.store.GetIPMapping(req.ContainerId, req.IfName)
+		if err == nil {
+			return s.existingAllocation(req, requested, mapping)
+		}
+		if !errors.Is(err, store.ErrMappingNotFound) {
+			return nil, status.Errorf(codes.Internal, "failed to look up IP mapping: %v", err)
+		}
+	}
+
 	// Allocate IP from pool
-	ip, block, err := s.pool.AllocateIPForNode(req.NodeID)
+	ip, block, err := s.allocateRequested(req, requested)
 	if err != nil {
-		return nil, fmt.Errorf("failed to allocate IP: %w", err)
+		return nil, statusError(err, "failed to allocate IP")
 	}
 
 	// Calculate CIDR notation
 	ones, _ := block.CIDR.Mask.Size()
 	cidr := fmt.Sprintf("%s/%d", ip.String(), ones)
 
-	// Save container ID -> IP mapping
+	// Save container interface -> IP mapping, giving the IP back if that
+	// fails so the pool and the store never disagree
 	if s.store != nil {
 		mapping := store.IPMapping{
-			ContainerID:  req.ContainerID,
+			ContainerID:  req.ContainerId,
+			IfName:       req.IfName,
+			Netns:        req.Netns,
 			PodName:      req.PodName,
 			PodNamespace: req.PodNamespace,
-			NodeID:       req.NodeID,
-			IP:           ip.String(),
-			CIDR:         cidr,
-			BlockCIDR:    block.CIDR.String(),
+			NodeID:       req.NodeId,
+			IPs: []store.IPAddress{
+				{IP: ip.String(), CIDR: cidr, BlockCIDR: block.CIDR.String()},
+			},
 		}
 		if err := s.store.SaveIPMapping(mapping); err != nil {
-			// Log error but don't fail the allocation
-			fmt.Printf("Warning: failed to save IP mapping: %v\n", err)
+			// No pod got the IP, so it is freed without a cool-down
+			if rbErr := s.pool.SetIPState(req.NodeId, ip, false); rbErr != nil {
+				fmt.Printf("Warning: failed to roll back allocation of %s: %v\n", ip, rbErr)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to save IP mapping: %v", err)
 		}
+		s.recordAudit(mappingAudit(store.AuditAllocate, &mapping)...)
 	}
 
-	// Calculate gateway IP (first usable IP in block)
-	gatewayIP := s.calculateGateway(block.CIDR)
+	// Replicate the allocation so a new leader knows the IP is in use, and
+	// keep the node's lease alive while this daemon serves it
+	if s.raftNode != nil {
+		s.raftNode.RecordIPAllocation(req.NodeId, ip)
+		s.raftNode.HoldLease(req.NodeId)
+	}
 
-	response := &AllocateIPResponse{
-		IP:      ip.String(),
-		CIDR:    fmt.Sprintf("%s/%d", ip.String(), ones),
-		Gateway: gatewayIP,
-		Routes: []Route{
-			{Dst: "0.0.0.0/0", GW: ""},
+	response := allocateResponse(ip.String(), cidr, block.Gateway)
+
+	// Async: Check if the node needs a new block (< 20% remaining)
+	go s.checkAndAllocateBlock(req.NodeId)
+
+	return response, nil
+}
+
+// existingAllocation returns the allocation recorded for a retried request
+// A retry that does not match the original request is rejected
+func (s *IPAMServer) existingAllocation(req *pb.AllocateIPRequest, requested net.IP, mapping *store.IPMapping) (*pb.AllocateIPResponse, error) {
+	if len(mapping.IPs) == 0 {
+		return nil, status.Errorf(codes.Internal, "mapping of container %s interface %q holds no IP",
+			req.ContainerId, req.IfName)
+	}
+	addr := mapping.IPs[0]
+
+	switch {
+	case mapping.NodeID != req.NodeId:
+		return nil, status.Errorf(codes.AlreadyExists, "container %s already has IP %s on node %s, not %s",
+			req.ContainerId, addr.IP, mapping.NodeID, req.NodeId)
+	case mapping.PodNamespace != req.PodNamespace || mapping.PodName != req.PodName:
+		return nil, status.Errorf(codes.AlreadyExists, "container %s already has IP %s for pod %s/%s, not %s/%s",
+			req.ContainerId, addr.IP, mapping.PodNamespace, mapping.PodName, req.PodNamespace, req.PodName)
+	case requested != nil && !mapping.HasIP(requested.String()):
+		return nil, status.Errorf(codes.AlreadyExists, "container %s already has IP %s, not %s",
+			req.ContainerId, addr.IP, requested)
+	}
+
+	_, blockCIDR, err := net.ParseCIDR(addr.BlockCIDR)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid block %q in mapping of container %s", addr.BlockCIDR, req.ContainerId)
+	}
+
+	return allocateResponse(addr.IP, addr.CIDR, s.pool.Reservation().GatewayFor(blockCIDR)), nil
+}
+
+// allocateResponse builds the response for an IP allocated from a block
+// with the given gateway, which is nil if the block has none
+func allocateResponse(ip, cidr string, gateway net.IP) *pb.AllocateIPResponse {
+	var gw string
+	if gateway != nil {
+		gw = gateway.String()
+	}
+
+	return &pb.AllocateIPResponse{
+		Ip:      ip,
+		Cidr:    cidr,
+		Gateway: gw,
+		Routes: []*pb.Route{
+			{Dst: "0.0.0.0/0", Gw: ""},
 		},
 	}
+}
 
-	// Async: Check if we need to allocate a new block (< 20% remaining)
-	go s.checkAndAllocateBlock(req.NodeID, block)
+// lockContainer locks the requests of a container and returns the unlock function
+func (s *IPAMServer) lockContainer(containerID string) func() {
+	s.containerMu.Lock()
+	lock, exists := s.containerLocks[containerID]
+	if !exists {
+		lock = &containerLock{}
+		s.containerLocks[containerID] = lock
+	}
+	lock.refs++
+	s.containerMu.Unlock()
 
-	return response, nil
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		s.containerMu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(s.containerLocks, containerID)
+		}
+		s.containerMu.Unlock()
+	}
 }
 
 // ReleaseIP releases an IP address
-func (s *IPAMServer) ReleaseIP(ctx context.Context, req *ReleaseIPRequest) (*ReleaseIPResponse, error) {
-	ip := net.ParseIP(req.IP)
+// With a container ID, the IPs recorded for the container are released
+func (s *IPAMServer) ReleaseIP(ctx context.Context, req *pb.ReleaseIPRequest) (*pb.ReleaseIPResponse, error) {
+	if err := s.checkReady(); err != nil {
+		return nil, err
+	}
+	req.NodeId = s.requestNodeID(req.NodeId)
+	if s.store != nil && req.ContainerId != "" {
+		return s.releaseContainer(req), nil
+	}
+
+	// Without a store the IP cannot be looked up by container, and failing
+	// would keep a CNI DEL from ever completing
+	if req.Ip == "" {
+		fmt.Printf("Warning: no IP to release for container %s without a store\n", req.ContainerId)
+		return &pb.ReleaseIPResponse{
+			Success: true,
+			Message: "no IP given and no store to look it up, nothing released",
+		}, nil
+	}
+
+	ip := net.ParseIP(req.Ip)
 	if ip == nil {
-		return &ReleaseIPResponse{
+		return &pb.ReleaseIPResponse{
 			Success: false,
-			Message: fmt.Sprintf("invalid IP address: %s", req.IP),
+			Message: fmt.Sprintf("invalid IP address: %s", req.Ip),
 		}, nil
 	}
 
+	// A mapping recording the IP is deleted along with it
+	if s.store != nil {
+		mapping, err := s.store.GetMappingByIP(ip.String())
+		if err == nil && mapping.NodeID == req.NodeId {
+			return s.releaseContainer(&pb.ReleaseIPRequest{
+				NodeId:      req.NodeId,
+				Ip:          ip.String(),
+				ContainerId: mapping.ContainerID,
+				IfName:      mapping.IfName,
+			}), nil
+		}
+		if err != nil && !errors.Is(err, store.ErrMappingNotFound) {
+			return &pb.ReleaseIPResponse{
+				Success: false,
+				Message: fmt.Sprintf("failed to look up IP mapping: %v", err),
+			}, nil
+		}
+	}
+
 	// Release IP from pool
-	if err := s.pool.ReleaseIP(ip, req.NodeID); err != nil {
-		return &ReleaseIPResponse{
+	// An IP already free, or whose block is gone, counts as released so a
+	// repeated DEL succeeds
+	if err := s.pool.ReleaseIP(ip, req.NodeId); err != nil {
+		if errors.Is(err, allocator.ErrIPNotAllocated) || errors.Is(err, ipam.ErrNodeNotFound) ||
+			errors.Is(err, ipam.ErrBlockNotFound) {
+			return &pb.ReleaseIPResponse{
+				Success: true,
+				Message: fmt.Sprintf("IP %s already released", ip),
+			}, nil
+		}
+		return &pb.ReleaseIPResponse{
 			Success: false,
 			Message: fmt.Sprintf("failed to release IP: %v", err),
 		}, nil
 	}
 
-	// Remove container ID -> IP mapping
-	if s.store != nil {
-		if err := s.store.DeleteIPMapping(req.ContainerID); err != nil {
-			// Log error but don't fail the release
-			fmt.Printf("Warning: failed to delete IP mapping: %v\n", err)
-		}
+	// Replicate the release to the other replicas
+	if s.raftNode != nil {
+		s.raftNode.RecordIPRelease(req.NodeId, ip)
 	}
+	s.recordAudit(store.AuditEvent{Type: store.AuditRelease, NodeID: req.NodeId, IP: ip.String()})
 
-	return &ReleaseIPResponse{
+	return &pb.ReleaseIPResponse{
 		Success: true,
 		Message: "IP released successfully",
 	}, nil
 }
 
+// releaseContainer releases the IPs of a container and deletes its mappings
+// With an interface name only that interface is released, otherwise all of
+// them are. Releasing a container that holds no IP succeeds, so repeated
+// DELs do too
+func (s *IPAMServer) releaseContainer(req *pb.ReleaseIPRequest) *pb.ReleaseIPResponse {
+	unlock := s.lockContainer(req.ContainerId)
+	defer unlock()
+
+	mappings, err := s.store.ListMappingsByContainer(req.ContainerId)
+	if err != nil {
+		return &pb.ReleaseIPResponse{
+			Success: false,
+			Message: fmt.Sprintf("failed to look up IP mappings: %v", err),
+		}
+	}
+
+	mappings = interfaceMappings(mappings, req.IfName)
+	if len(mappings) == 0 {
+		return &pb.ReleaseIPResponse{
+			Success: true,
+			Message: fmt.Sprintf("no IP allocated to container %s", req.ContainerId),
+		}
+	}
+
+	if req.Ip != "" {
+		mappings = mappingsWithIP(mappings, req.Ip)
+		if len(mappings) == 0 {
+			return &pb.ReleaseIPResponse{
+				Success: false,
+				Message: fmt.Sprintf("container %s does not hold IP %s", req.ContainerId, req.Ip),
+			}
+		}
+	}
+
+	var released []string
+	for i := range mappings {
+		if err := s.releaseMapping(&mappings[i]); err != nil {
+			return &pb.ReleaseIPResponse{
+				Success: false,
+				Message: err.Error(),
+			}
+		}
+		for _, addr := range mappings[i].IPs {
+			released = append(released, addr.IP)
+		}
+	}
+
+	return &pb.ReleaseIPResponse{
+		Success: true,
+		Message: fmt.Sprintf("IP %s released successfully", strings.Join(released, ", ")),
+	}
+}
+
+// releaseMapping releases the IPs of a mapping and deletes it
+func (s *IPAMServer) releaseMapping(mapping *store.IPMapping) error {
+	ips := make([]net.IP, len(mapping.IPs))
+	for i, addr := range mapping.IPs {
+		if ips[i] = net.ParseIP(addr.IP); ips[i] == nil {
+			return fmt.Errorf("invalid IP address %q in mapping of container %s", addr.IP, mapping.ContainerID)
+		}
+	}
+
+	// An IP may already be free, reserved since it was handed out, or its
+	// block gone if the node was reclaimed; the stale mapping is still deleted
+	var released []net.IP
+	for _, ip := range ips {
+		err := s.pool.ReleaseIPFor(ip, mapping.NodeID, mapping.ContainerID)
+		if err == nil {
+			released = append(released, ip)
+			continue
+		}
+		if !errors.Is(err, allocator.ErrIPNotAllocated) && !errors.Is(err, allocator.ErrIPReserved) &&
+			!errors.Is(err, ipam.ErrNodeNotFound) && !errors.Is(err, ipam.ErrBlockNotFound) {
+			s.rollbackRelease(mapping.NodeID, released)
+			return fmt.Errorf("failed to release IP: %w", err)
+		}
+	}
+
+	// Take the IPs back if the mapping cannot be deleted so the pool and the
+	// store never disagree
+	if err := s.store.DeleteIPMapping(mapping.ContainerID, mapping.IfName); err != nil {
+		s.rollbackRelease(mapping.NodeID, released)
+		return fmt.Errorf("failed to delete IP mapping: %w", err)
+	}
+
+	// Replicate the release to the other replicas
+	if s.raftNode != nil {
+		for _, ip := range released {
+			s.raftNode.RecordIPRelease(mapping.NodeID, ip)
+		}
+	}
+	s.recordAudit(mappingAudit(store.AuditRelease, mapping)...)
+	return nil
+}
+
+// mappingAudit returns one audit event per IP of a mapping
+func mappingAudit(eventType store.AuditEventType, mapping *store.IPMapping) []store.AuditEvent {
+	events := make([]store.AuditEvent, len(mapping.IPs))
+	for i, addr := range mapping.IPs {
+		events[i] = store.AuditEvent{
+			Type:         eventType,
+			NodeID:       mapping.NodeID,
+			ContainerID:  mapping.ContainerID,
+			IfName:       mapping.IfName,
+			PodName:      mapping.PodName,
+			PodNamespace: mapping.PodNamespace,
+			IP:           addr.IP,
+			BlockCIDR:    addr.BlockCIDR,
+		}
+	}
+	return events
+}
+
+// rollbackRelease marks released IPs allocated again
+func (s *IPAMServer) rollbackRelease(nodeID string, released []net.IP) {
+	for _, ip := range released {
+		if err := s.pool.SetIPState(nodeID, ip, true); err != nil {
+			fmt.Printf("Warning: failed to roll back release of %s: %v\n", ip, err)
+		}
+	}
+}
+
+// interfaceMappings returns the mappings of an interface, or all of them
+// when no interface is named
+// Mappings recorded without an interface name match any interface
+func interfaceMappings(mappings []store.IPMapping, ifName string) []store.IPMapping {
+	if ifName == "" {
+		return mappings
+	}
+
+	var selected []store.IPMapping
+	for _, mapping := range mappings {
+		if mapping.IfName == ifName || mapping.IfName == "" {
+			selected = append(selected, mapping)
+		}
+	}
+	return selected
+}
+
+// mappingsWithIP returns the mappings holding ip
+func mappingsWithIP(mappings []store.IPMapping, ip string) []store.IPMapping {
+	var selected []store.IPMapping
+	for _, mapping := range mappings {
+		if mapping.HasIP(ip) {
+			selected = append(selected, mapping)
+		}
+	}
+	return selected
+}
+
 // GetNodeBlocks returns all IP blocks for a node
-func (s *IPAMServer) GetNodeBlocks(ctx context.Context, nodeID string) ([]*BlockInfo, error) {
-	blocks, err := s.pool.GetNodeBlocks(nodeID)
+func (s *IPAMServer) GetNodeBlocks(ctx context.Context, req *pb.GetNodeBlocksRequest) (*pb.GetNodeBlocksResponse, error) {
+	blocks, err := s.pool.GetNodeBlocks(req.NodeId)
 	if err != nil {
-		return nil, err
+		return nil, statusError(err, "failed to get node blocks")
 	}
 
-	result := make([]*BlockInfo, len(blocks))
+	result := make([]*pb.IPBlock, len(blocks))
 	for i, block := range blocks {
-		result[i] = &BlockInfo{
-			CIDR:      block.CIDR.String(),
-			NodeID:    block.NodeID,
-			Total:     block.Total,
-			Used:      block.Used,
-			Available: block.Available(),
-			CreatedAt: block.CreatedAt.Unix(),
-		}
+		result[i] = blockInfo(block)
 	}
 
-	return result, nil
+	return &pb.GetNodeBlocksResponse{Blocks: result}, nil
 }
 
 // GetPoolStats returns pool statistics
-func (s *IPAMServer) GetPoolStats(ctx context.Context) (*PoolStatsResponse, error) {
+func (s *IPAMServer) GetPoolStats(ctx context.Context, req *pb.GetPoolStatsRequest) (*pb.GetPoolStatsResponse, error) {
 	stats := s.pool.GetStats()
 
-	nodeStats := make(map[string]*NodeStatsInfo)
+	nodeStats := make(map[string]*pb.NodeStats)
 	for nodeID, ns := range stats.NodeStats {
-		nodeStats[nodeID] = &NodeStatsInfo{
-			NodeID:       ns.NodeID,
-			Blocks:       ns.Blocks,
-			TotalIPs:     ns.TotalIPs,
-			UsedIPs:      ns.UsedIPs,
-			AvailableIPs: ns.AvailableIPs,
+		nodeStats[nodeID] = &pb.NodeStats{
+			NodeId:         ns.NodeID,
+			Blocks:         int32(ns.Blocks),
+			TotalIps:       int32(ns.TotalIPs),
+			UsedIps:        int32(ns.UsedIPs),
+			AvailableIps:   int32(ns.AvailableIPs),
+			QuarantinedIps: int32(ns.QuarantinedIPs),
 		}
 	}
 
-	return &PoolStatsResponse{
-		TotalNodes:   stats.TotalNodes,
-		TotalBlocks:  stats.TotalBlocks,
-		TotalIPs:     stats.TotalIPs,
-		UsedIPs:      stats.UsedIPs,
-		AvailableIPs: stats.AvailableIPs,
-		NodeStats:    nodeStats,
+	return &pb.GetPoolStatsResponse{
+		TotalNodes:     int32(stats.TotalNodes),
+		TotalBlocks:    int32(stats.TotalBlocks),
+		TotalIps:       int32(stats.TotalIPs),
+		UsedIps:        int32(stats.UsedIPs),
+		AvailableIps:   int32(stats.AvailableIPs),
+		QuarantinedIps: int32(stats.QuarantinedIPs),
+		NodeStats:      nodeStats,
 	}, nil
 }
 
-// BlockInfo represents IP block information
-type BlockInfo struct {
-	CIDR      string
-	NodeID    string
-	Total     int
-	Used      int
-	Available int
-	CreatedAt int64
-}
-
-// PoolStatsResponse represents pool statistics
-type PoolStatsResponse struct {
-	TotalNodes   int
-	TotalBlocks  int
-	TotalIPs     int
-	UsedIPs      int
-	AvailableIPs int
-	NodeStats    map[string]*NodeStatsInfo
-}
-
-// NodeStatsInfo represents node statistics
-type NodeStatsInfo struct {
-	NodeID       string
-	Blocks       int
-	TotalIPs     int
-	UsedIPs      int
-	AvailableIPs int
-}
-
-// checkAndAllocateBlock checks if a new block is needed and allocates it
-func (s *IPAMServer) checkAndAllocateBlock(nodeID string, currentBlock *allocator.IPBlock) {
-	// Check if remaining capacity < 20%
-	if currentBlock.Available() < int(float64(currentBlock.Total)*0.2) {
-		// Allocate new block through Raft
-		if s.raftNode != nil && s.raftNode.IsLeader() {
-			_, err := s.raftNode.AllocateBlock(nodeID)
-			if err != nil {
-				fmt.Printf("Warning: failed to pre-allocate block for node %s: %v\n", nodeID, err)
-			}
+// AllocateBlock allocates a new IP block for a node
+// With Raft, the block is assigned through consensus
+func (s *IPAMServer) AllocateBlock(ctx context.Context, req *pb.AllocateBlockRequest) (*pb.AllocateBlockResponse, error) {
+	if req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "node_id is required")
+	}
+
+	cidr, err := s.allocateBlockWithID(req.NodeId, req.RequestId)
+	if err != nil {
+		return nil, statusError(err, "failed to allocate block")
+	}
+
+	// With Raft the block is applied to the local pool before AllocateBlock
+	// returns
+	blocks, err := s.pool.GetNodeBlocks(req.NodeId)
+	if err != nil {
+		return nil, statusError(err, "failed to get allocated block")
+	}
+	for _, block := range blocks {
+		if block.CIDR.String() == cidr {
+			return &pb.AllocateBlockResponse{Block: blockInfo(block)}, nil
 		}
 	}
+
+	return nil, status.Errorf(codes.Internal, "allocated block %s not found for node %s", cidr, req.NodeId)
 }
 
-// calculateGateway calculates the gateway IP for a block
-func (s *IPAMServer) calculateGateway(cidr *net.IPNet) string {
-	// Gateway is typically the first usable IP in the subnet
-	ip := cidr.IP.To4()
+// ReleaseBlock releases an IP block from a node
+// With Raft, the release is replicated through consensus
+func (s *IPAMServer) ReleaseBlock(ctx context.Context, req *pb.ReleaseBlockRequest) (*pb.ReleaseBlockResponse, error) {
+	var err error
+	if s.raftNode != nil {
+		err = s.raftNode.ReleaseBlock(req.NodeId, req.Cidr)
+	} else {
+		err = s.pool.ReleaseBlockForNode(req.NodeId, req.Cidr)
+	}
+	if err != nil {
+		return &pb.ReleaseBlockResponse{
+			Success: false,
+			Message: fmt.Sprintf("failed to release block: %v", err),
+		}, nil
+	}
+
+	s.recordBlockAudit(store.AuditBlockRelease, req.NodeId, req.Cidr)
+
+	return &pb.ReleaseBlockResponse{
+		Success: true,
+		Message: "Block released successfully",
+	}, nil
+}
+
+// QueryAuditLog returns the recorded allocation changes matching a query
+func (s *IPAMServer) QueryAuditLog(ctx context.Context, req *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+	if s.store == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no store to keep an audit log")
+	}
+
+	events, err := s.store.QueryAudit(store.AuditQuery{
+		IP:          req.Ip,
+		ContainerID: req.ContainerId,
+		NodeID:      req.NodeId,
+		Since:       unixTime(req.Since),
+		Until:       unixTime(req.Until),
+		Limit:       int(req.Limit),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to query audit log: %v", err)
+	}
+
+	result := make([]*pb.AuditEvent, len(events))
+	for i, event := range events {
+		result[i] = &pb.AuditEvent{
+			Time:         event.Time.Unix(),
+			Type:         string(event.Type),
+			NodeId:       event.NodeID,
+			ContainerId:  event.ContainerID,
+			IfName:       event.IfName,
+			PodName:      event.PodName,
+			PodNamespace: event.PodNamespace,
+			Ip:           event.IP,
+			BlockCidr:    event.BlockCIDR,
+		}
+	}
+
+	return &pb.QueryAuditLogResponse{Events: result}, nil
+}
+
+// GetIPHistory returns who held an IP during a period
+func (s *IPAMServer) GetIPHistory(ctx context.Context, req *pb.GetIPHistoryRequest) (*pb.GetIPHistoryResponse, error) {
+	if s.store == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no store to keep an audit log")
+	}
+	ip := net.ParseIP(req.Ip)
 	if ip == nil {
-		return ""
+		return nil, status.Errorf(codes.InvalidArgument, "invalid IP address: %s", req.Ip)
 	}
 
-	// First usable IP (network address + 1)
-	addr := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
-	addr += 1
+	holdings, err := store.IPHolders(s.store, ip.String(), unixTime(req.Since), unixTime(req.Until))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to query audit log: %v", err)
+	}
 
-	gatewayIP := net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
-	return gatewayIP.String()
+	result := make([]*pb.IPHolding, len(holdings))
+	for i, holding := range holdings {
+		result[i] = &pb.IPHolding{
+			Ip:           holding.IP,
+			NodeId:       holding.NodeID,
+			ContainerId:  holding.ContainerID,
+			IfName:       holding.IfName,
+			PodName:      holding.PodName,
+			PodNamespace: holding.PodNamespace,
+			From:         unixSeconds(holding.From),
+			To:           unixSeconds(holding.To),
+		}
+	}
+
+	return &pb.GetIPHistoryResponse{Holdings: result}, nil
+}
+
+// unixTime converts Unix seconds to a time, keeping 0 as the zero time
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// unixSeconds converts a time to Unix seconds, keeping the zero time as 0
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// blockInfo converts a block to its API representation
+func blockInfo(block *allocator.IPBlock) *pb.IPBlock {
+	return &pb.IPBlock{
+		Cidr:      block.CIDR.String(),
+		NodeId:    block.NodeID,
+		Total:     int32(block.Total),
+		Used:      int32(block.Used),
+		Available: int32(block.Available()),
+		CreatedAt: block.CreatedAt.Unix(),
+	}
+}
+
+// statusError converts a pool error to a gRPC status error
+func statusError(err error, msg string) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, ipam.ErrNodeNotFound), errors.Is(err, ipam.ErrBlockNotFound):
+		code = codes.NotFound
+	case errors.Is(err, ipam.ErrCIDRExhausted), errors.Is(err, allocator.ErrNoAvailableIP):
+		code = codes.ResourceExhausted
+	case errors.Is(err, ipam.ErrInvalidCIDR), errors.Is(err, allocator.ErrInvalidIP), errors.Is(err, allocator.ErrIPReserved):
+		code = codes.InvalidArgument
+	case errors.Is(err, ipam.ErrIPOutOfRange):
+		code = codes.OutOfRange
+	case errors.Is(err, allocator.ErrIPInUse):
+		code = codes.AlreadyExists
+	}
+	return status.Errorf(code, "%s: %v", msg, err)
+}
+
+// allocateRequested allocates the requested IP, or any free IP of the node
+// when requested is nil
+func (s *IPAMServer) allocateRequested(req *pb.AllocateIPRequest, requested net.IP) (net.IP, *allocator.IPBlock, error) {
+	if requested == nil {
+		return s.allocateFromPool(req.NodeId, req.ContainerId)
+	}
+
+	block, err := s.pool.AllocateSpecificIP(req.NodeId, requested)
+	if err != nil {
+		return nil, nil, err
+	}
+	return requested, block, nil
+}
+
+// allocateFromPool allocates an IP for a container from the node's blocks,
+// adding a block when the node has no free IPs left
+func (s *IPAMServer) allocateFromPool(nodeID string, containerID string) (net.IP, *allocator.IPBlock, error) {
+	ip, block, err := s.pool.AllocateIPFromExistingBlocksFor(nodeID, containerID)
+	if err == nil || !needsBlock(err) {
+		return ip, block, err
+	}
+
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+
+	// Another request may have added a block while this one waited
+	ip, block, err = s.pool.AllocateIPFromExistingBlocksFor(nodeID, containerID)
+	if err == nil || !needsBlock(err) {
+		return ip, block, err
+	}
+
+	if _, err := s.allocateBlock(nodeID); err != nil {
+		return nil, nil, fmt.Errorf("failed to allocate block for node %s: %w", nodeID, err)
+	}
+
+	return s.pool.AllocateIPFromExistingBlocksFor(nodeID, containerID)
+}
+
+// needsBlock reports whether an allocation failed for lack of free IPs on
+// the node
+func needsBlock(err error) bool {
+	return errors.Is(err, ipam.ErrNodeNotFound) || errors.Is(err, allocator.ErrNoAvailableIP)
+}
+
+// allocateBlock assigns a new block to a node and returns its CIDR
+// With Raft, the block is assigned through consensus instead of locally and
+// followers forward to the leader
+func (s *IPAMServer) allocateBlock(nodeID string) (string, error) {
+	return s.allocateBlockWithID(nodeID, "")
+}
+
+// allocateBlockWithID assigns a new block to a node at most once per request
+// ID, which only Raft remembers
+// A retry gets the block of its first try, which is audited once
+func (s *IPAMServer) allocateBlockWithID(nodeID, requestID string) (string, error) {
+	var cidr string
+	if s.raftNode != nil {
+		result, replayed, err := s.raftNode.AllocateBlockWithID(nodeID, requestID)
+		if err != nil {
+			return "", err
+		}
+		cidr, _ = result["cidr"].(string)
+		if replayed {
+			return cidr, nil
+		}
+	} else {
+		block, err := s.pool.AllocateBlockForNode(nodeID)
+		if err != nil {
+			return "", err
+		}
+		cidr = block.CIDR.String()
+	}
+
+	s.recordBlockAudit(store.AuditBlockAllocate, nodeID, cidr)
+	return cidr, nil
+}
+
+// preallocThreshold is the share of a node's IPs left free below which it
+// gets another block ahead of demand
+const preallocThreshold = 0.2
+
+// checkAndAllocateBlock checks if a node needs a new block and allocates it
+// Pre-allocation goes through Raft only, a standalone pool adds blocks on demand
+func (s *IPAMServer) checkAndAllocateBlock(nodeID string) {
+	if s.raftNode == nil || !s.needsPrealloc(nodeID) {
+		return
+	}
+
+	// Check again under the lock, so concurrent checks see the block added
+	// by the first one instead of each adding their own
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+
+	if !s.needsPrealloc(nodeID) {
+		return
+	}
+	if _, err := s.allocateBlock(nodeID); err != nil {
+		fmt.Printf("Warning: failed to pre-allocate block for node %s: %v\n", nodeID, err)
+	}
+}
+
+// needsPrealloc reports whether less than preallocThreshold of the IPs
+// across all blocks of a node is free
+func (s *IPAMServer) needsPrealloc(nodeID string) bool {
+	blocks, err := s.pool.GetNodeBlocks(nodeID)
+	if err != nil {
+		return false
+	}
+
+	total, available := 0, 0
+	for _, block := range blocks {
+		total += block.Total
+		available += block.Available()
+	}
+	return available < int(float64(total)*preallocThreshold)
 }
 
 // Server represents the gRPC server
@@ -256,9 +819,10 @@ type Server struct {
 }
 
 // NewServer creates a new gRPC server
-func NewServer(pool *ipam.Pool, raftNode *raft.Node, store *store.Store) *Server {
+func NewServer(pool *ipam.Pool, raftNode *raft.Node, store store.MappingStore) *Server {
 	ipamServer := NewIPAMServer(pool, raftNode, store)
 	grpcServer := grpc.NewServer()
+	pb.RegisterIPAMServer(grpcServer, ipamServer)
 
 	return &Server{
 		grpcServer: grpcServer,
@@ -278,7 +842,12 @@ func (s *Server) Start(address string) error {
 }
 
 // StartUnix starts the gRPC server on a Unix socket
+// A socket left behind by a previous run is removed first
 func (s *Server) StartUnix(socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %w", socketPath, err)
+	}
+
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
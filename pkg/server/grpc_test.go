@@ -0,0 +1,681 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/jianzi123/ipam/pkg/api/proto"
+	"github.com/jianzi123/ipam/pkg/ipam"
+	"github.com/jianzi123/ipam/pkg/raft"
+	"github.com/jianzi123/ipam/pkg/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestPool creates a pool with /24 blocks in 10.244.0.0/16
+func newTestPool(t *testing.T) *ipam.Pool {
+	t.Helper()
+
+	pool, err := ipam.NewPool(ipam.PoolConfig{
+		ClusterCIDR: "10.244.0.0/16",
+		BlockSize:   24,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	return pool
+}
+
+// newTestRaftNode starts a single-voter Raft node on a loopback port
+func newTestRaftNode(t *testing.T, pool *ipam.Pool) *raft.Node {
+	t.Helper()
+
+	node, err := raft.NewNode(&raft.NodeConfig{
+		NodeID:           "node1",
+		BindAddr:         "127.0.0.1:0",
+		DataDir:          t.TempDir(),
+		Bootstrap:        true,
+		HeartbeatTimeout: 500 * time.Millisecond,
+		ElectionTimeout:  500 * time.Millisecond,
+		CommitTimeout:    10 * time.Millisecond,
+		BatchInterval:    10 * time.Millisecond,
+	}, pool)
+	if err != nil {
+		t.Fatalf("NewNode failed: %v", err)
+	}
+	t.Cleanup(func() { node.Shutdown() })
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !node.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("Node did not become leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return node
+}
+
+// faultyStore is an in-memory store that cannot save the mappings of one
+// container
+type faultyStore struct {
+	*store.MemoryStore
+	containerID string
+}
+
+func (s *faultyStore) SaveIPMapping(mapping store.IPMapping) error {
+	if mapping.ContainerID == s.containerID {
+		return errors.New("injected save failure")
+	}
+	return s.MemoryStore.SaveIPMapping(mapping)
+}
+
+// startTestServer serves the IPAM service backed by an in-memory store on a
+// temporary Unix socket and returns a client connected to it
+func startTestServer(t *testing.T, pool *ipam.Pool, raftNode *raft.Node) (pb.IPAMClient, *store.MemoryStore) {
+	t.Helper()
+
+	ipamStore := store.NewMemoryStore()
+	return serveStore(t, pool, raftNode, ipamStore), ipamStore
+}
+
+// serveStore serves the IPAM service backed by ipamStore on a temporary Unix
+// socket and returns a client connected to it
+func serveStore(t *testing.T, pool *ipam.Pool, raftNode *raft.Node, ipamStore store.MappingStore) pb.IPAMClient {
+	t.Helper()
+	t.Cleanup(func() { ipamStore.Close() })
+
+	socketPath := filepath.Join(t.TempDir(), "ipam.sock")
+	srv := NewServer(pool, raftNode, ipamStore)
+	if _, err := srv.GetIPAMServer().Reconcile(); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	go srv.StartUnix(socketPath)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("unix://"+socketPath, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewIPAMClient(conn)
+}
+
+func TestIPAMServer(t *testing.T) {
+	run := func(t *testing.T, withRaft bool) {
+		pool := newTestPool(t)
+		var raftNode *raft.Node
+		if withRaft {
+			raftNode = newTestRaftNode(t, pool)
+		}
+		client, ipamStore := startTestServer(t, pool, raftNode)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// Wait for the server to accept connections
+		allocated, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{
+			NodeId:       "node1",
+			PodName:      "pod-1",
+			PodNamespace: "default",
+			ContainerId:  "container-1",
+		}, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+		if allocated.Ip == "" || allocated.Cidr != allocated.Ip+"/24" || allocated.Gateway == "" || len(allocated.Routes) != 1 {
+			t.Errorf("Unexpected allocation %+v", allocated)
+		}
+		if allocated.Gateway == allocated.Ip {
+			t.Errorf("Expected the gateway %s not to be handed out", allocated.Gateway)
+		}
+
+		mapping, err := ipamStore.GetIPMapping("container-1", "")
+		if err != nil || !mapping.HasIP(allocated.Ip) || mapping.PodName != "pod-1" {
+			t.Errorf("Expected mapping for container-1 to %s, got %+v (%v)", allocated.Ip, mapping, err)
+		}
+
+		blocks, err := client.GetNodeBlocks(ctx, &pb.GetNodeBlocksRequest{NodeId: "node1"})
+		if err != nil {
+			t.Fatalf("GetNodeBlocks failed: %v", err)
+		}
+		if len(blocks.Blocks) != 1 || blocks.Blocks[0].NodeId != "node1" || blocks.Blocks[0].Used != 1 {
+			t.Fatalf("Unexpected blocks %+v", blocks.Blocks)
+		}
+		firstBlock := blocks.Blocks[0].Cidr
+
+		allocatedBlock, err := client.AllocateBlock(ctx, &pb.AllocateBlockRequest{NodeId: "node1"})
+		if err != nil {
+			t.Fatalf("AllocateBlock failed: %v", err)
+		}
+		if allocatedBlock.Block.Cidr == firstBlock || allocatedBlock.Block.Used != 0 || allocatedBlock.Block.Total == 0 {
+			t.Errorf("Unexpected block %+v", allocatedBlock.Block)
+		}
+
+		stats, err := client.GetPoolStats(ctx, &pb.GetPoolStatsRequest{})
+		if err != nil {
+			t.Fatalf("GetPoolStats failed: %v", err)
+		}
+		if stats.TotalNodes != 1 || stats.TotalBlocks != 2 || stats.UsedIps != 1 || stats.NodeStats["node1"].Blocks != 2 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+
+		released, err := client.ReleaseBlock(ctx, &pb.ReleaseBlockRequest{NodeId: "node1", Cidr: allocatedBlock.Block.Cidr})
+		if err != nil || !released.Success {
+			t.Errorf("ReleaseBlock failed: %v %+v", err, released)
+		}
+
+		// A block with allocated IPs cannot be released
+		released, err = client.ReleaseBlock(ctx, &pb.ReleaseBlockRequest{NodeId: "node1", Cidr: firstBlock})
+		if err != nil || released.Success {
+			t.Errorf("Expected release of a block in use to fail, got %v %+v", err, released)
+		}
+
+		releasedIP, err := client.ReleaseIP(ctx, &pb.ReleaseIPRequest{NodeId: "node1", Ip: allocated.Ip, ContainerId: "container-1"})
+		if err != nil || !releasedIP.Success {
+			t.Errorf("ReleaseIP failed: %v %+v", err, releasedIP)
+		}
+		if _, err := ipamStore.GetIPMapping("container-1", ""); err == nil {
+			t.Error("Expected mapping for container-1 to be deleted")
+		}
+
+		if stats, _ := client.GetPoolStats(ctx, &pb.GetPoolStatsRequest{}); stats.UsedIps != 0 {
+			t.Errorf("Expected no used IPs, got %d", stats.UsedIps)
+		}
+
+		events, err := client.QueryAuditLog(ctx, &pb.QueryAuditLogRequest{NodeId: "node1"})
+		if err != nil {
+			t.Fatalf("QueryAuditLog failed: %v", err)
+		}
+		var types []string
+		for _, event := range events.Events {
+			types = append(types, event.Type)
+		}
+		if strings.Join(types, " ") != "block_allocate allocate block_allocate block_release release" {
+			t.Errorf("Unexpected audit events %v", types)
+		}
+		if event := events.Events[1]; event.Ip != allocated.Ip || event.ContainerId != "container-1" ||
+			event.PodName != "pod-1" || event.BlockCidr != firstBlock || event.Time == 0 {
+			t.Errorf("Unexpected allocate event %+v", event)
+		}
+	}
+
+	t.Run("Serves every RPC without Raft", func(t *testing.T) {
+		run(t, false)
+	})
+
+	t.Run("Serves every RPC with Raft", func(t *testing.T) {
+		run(t, true)
+	})
+
+	t.Run("Retried AllocateIP returns the same IP", func(t *testing.T) {
+		pool := newTestPool(t)
+		client, _ := startTestServer(t, pool, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		req := &pb.AllocateIPRequest{
+			NodeId:       "node1",
+			PodName:      "pod-1",
+			PodNamespace: "default",
+			ContainerId:  "container-1",
+			IfName:       "eth0",
+		}
+		first, err := client.AllocateIP(ctx, req, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+
+		retried, err := client.AllocateIP(ctx, req)
+		if err != nil {
+			t.Fatalf("Retried AllocateIP failed: %v", err)
+		}
+		if retried.Ip != first.Ip || retried.Cidr != first.Cidr || retried.Gateway != first.Gateway {
+			t.Errorf("Expected retry to return %+v, got %+v", first, retried)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP, got %d", stats.UsedIPs)
+		}
+
+		// Concurrent retries all get the same IP
+		var wg sync.WaitGroup
+		ips := make([]string, 10)
+		for i := range ips {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				resp, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-2"})
+				if err != nil {
+					t.Errorf("AllocateIP failed: %v", err)
+					return
+				}
+				ips[i] = resp.Ip
+			}(i)
+		}
+		wg.Wait()
+		for _, ip := range ips {
+			if ip != ips[0] {
+				t.Errorf("Expected concurrent retries to share one IP, got %v", ips)
+				break
+			}
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 2 {
+			t.Errorf("Expected 2 used IPs, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("Mismatched retry is rejected", func(t *testing.T) {
+		client, _ := startTestServer(t, newTestPool(t), nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		req := &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "eth0"}
+		if _, err := client.AllocateIP(ctx, req, grpc.WaitForReady(true)); err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+
+		_, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node2", ContainerId: "container-1", IfName: "eth0"})
+		if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("Expected AlreadyExists for a different node, got %v", err)
+		}
+
+		_, err = client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "eth0",
+			PodName: "pod-2"})
+		if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("Expected AlreadyExists for a different pod, got %v", err)
+		}
+	})
+
+	t.Run("AllocateIP with a requested IP", func(t *testing.T) {
+		pool := newTestPool(t)
+		pool.AllocateBlockCIDRForNode("node1", "10.244.7.0/24")
+		client, ipamStore := startTestServer(t, pool, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		req := &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "eth0", Ip: "10.244.7.42"}
+		resp, err := client.AllocateIP(ctx, req, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+		if resp.Ip != "10.244.7.42" || resp.Cidr != "10.244.7.42/24" || resp.Gateway != "10.244.7.1" {
+			t.Errorf("Unexpected response %+v", resp)
+		}
+		if mapping, err := ipamStore.GetIPMapping("container-1", "eth0"); err != nil || !mapping.HasIP("10.244.7.42") {
+			t.Errorf("Expected a mapping of 10.244.7.42, got %+v (%v)", mapping, err)
+		}
+
+		// A retry gets the same IP, but not another one
+		if retried, err := client.AllocateIP(ctx, req); err != nil || retried.Ip != resp.Ip {
+			t.Errorf("Expected retry to return %s, got %+v (%v)", resp.Ip, retried, err)
+		}
+		_, err = client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "eth0",
+			Ip: "10.244.7.43"})
+		if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("Expected AlreadyExists for a retry asking for another IP, got %v", err)
+		}
+
+		for _, c := range []struct {
+			ip   string
+			code codes.Code
+		}{
+			{"10.244.7.42", codes.AlreadyExists},
+			{"10.244.7.1", codes.InvalidArgument},
+			{"10.244.8.5", codes.OutOfRange},
+			{"not-an-ip", codes.InvalidArgument},
+		} {
+			_, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-2", Ip: c.ip})
+			if status.Code(err) != c.code {
+				t.Errorf("%s: expected %v, got %v", c.ip, c.code, err)
+			}
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("Each interface gets its own IP", func(t *testing.T) {
+		pool := newTestPool(t)
+		client, ipamStore := startTestServer(t, pool, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		eth0, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "eth0"},
+			grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("AllocateIP for eth0 failed: %v", err)
+		}
+		net1, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "net1"})
+		if err != nil {
+			t.Fatalf("AllocateIP for net1 failed: %v", err)
+		}
+		if eth0.Ip == net1.Ip {
+			t.Errorf("Expected distinct IPs, both interfaces got %s", eth0.Ip)
+		}
+
+		retried, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "net1"})
+		if err != nil || retried.Ip != net1.Ip {
+			t.Errorf("Expected retry for net1 to return %s, got %+v (%v)", net1.Ip, retried, err)
+		}
+
+		mappings, err := ipamStore.ListMappingsByContainer("container-1")
+		if err != nil || len(mappings) != 2 {
+			t.Fatalf("Expected 2 mappings for container-1, got %+v (%v)", mappings, err)
+		}
+
+		// Without an interface name every interface is released
+		released, err := client.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-1"})
+		if err != nil || !released.Success {
+			t.Fatalf("ReleaseIP failed: %v %+v", err, released)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 0 {
+			t.Errorf("Expected both IPs to be released, got %d used", stats.UsedIPs)
+		}
+		if mappings, _ := ipamStore.ListMappingsByContainer("container-1"); len(mappings) != 0 {
+			t.Errorf("Expected mappings of container-1 to be deleted, got %+v", mappings)
+		}
+	})
+
+	t.Run("ReleaseIP by container ID", func(t *testing.T) {
+		pool := newTestPool(t)
+		client, ipamStore := startTestServer(t, pool, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		allocated, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "eth0"},
+			grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+
+		// Another interface of the container holds nothing
+		released, err := client.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-1", IfName: "net1"})
+		if err != nil || !released.Success {
+			t.Errorf("Expected release of an unknown interface to succeed, got %v %+v", err, released)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected the IP of eth0 to stay allocated, got %d used", stats.UsedIPs)
+		}
+
+		released, err = client.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-1", Ip: "10.244.255.1"})
+		if err != nil || released.Success {
+			t.Errorf("Expected release of another IP to fail, got %v %+v", err, released)
+		}
+
+		released, err = client.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-1", IfName: "eth0"})
+		if err != nil || !released.Success {
+			t.Fatalf("ReleaseIP failed: %v %+v", err, released)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 0 {
+			t.Errorf("Expected %s to be released, got %d used", allocated.Ip, stats.UsedIPs)
+		}
+		if _, err := ipamStore.GetIPMapping("container-1", "eth0"); err == nil {
+			t.Error("Expected mapping for container-1 to be deleted")
+		}
+
+		// Repeated DELs succeed
+		released, err = client.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-1", IfName: "eth0"})
+		if err != nil || !released.Success {
+			t.Errorf("Expected repeated release to succeed, got %v %+v", err, released)
+		}
+	})
+
+	t.Run("ReleaseIP without a store or IP succeeds", func(t *testing.T) {
+		pool := newTestPool(t)
+		srv := NewIPAMServer(pool, nil, nil)
+
+		allocated, err := srv.AllocateIP(context.Background(), &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1"})
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+
+		// A CNI DEL without prevResult gives only the container
+		released, err := srv.ReleaseIP(context.Background(), &pb.ReleaseIPRequest{NodeId: "node1", ContainerId: "container-1", IfName: "eth0"})
+		if err != nil || !released.Success {
+			t.Errorf("Expected release without an IP to succeed, got %v %+v", err, released)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected %s to stay allocated, got %d used", allocated.Ip, stats.UsedIPs)
+		}
+
+		released, err = srv.ReleaseIP(context.Background(), &pb.ReleaseIPRequest{NodeId: "node1", Ip: allocated.Ip, ContainerId: "container-1"})
+		if err != nil || !released.Success {
+			t.Fatalf("ReleaseIP failed: %v %+v", err, released)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 0 {
+			t.Errorf("Expected %s to be released, got %d used", allocated.Ip, stats.UsedIPs)
+		}
+
+		// A repeated DEL with prevResult succeeds too
+		released, err = srv.ReleaseIP(context.Background(), &pb.ReleaseIPRequest{NodeId: "node1", Ip: allocated.Ip, ContainerId: "container-1"})
+		if err != nil || !released.Success {
+			t.Errorf("Expected repeated release to succeed, got %v %+v", err, released)
+		}
+		released, err = srv.ReleaseIP(context.Background(), &pb.ReleaseIPRequest{NodeId: "node2", Ip: allocated.Ip, ContainerId: "container-1"})
+		if err != nil || !released.Success {
+			t.Errorf("Expected release on a node without blocks to succeed, got %v %+v", err, released)
+		}
+	})
+
+	t.Run("Pool and store change together", func(t *testing.T) {
+		pool, err := ipam.NewPool(ipam.PoolConfig{
+			ClusterCIDR: "10.244.0.0/16",
+			BlockSize:   24,
+			Quarantine:  time.Hour,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create pool: %v", err)
+		}
+		ipamStore := &faultyStore{MemoryStore: store.NewMemoryStore(), containerID: "unsaveable"}
+		client := serveStore(t, pool, nil, ipamStore)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err = client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "unsaveable"},
+			grpc.WaitForReady(true))
+		if status.Code(err) != codes.Internal {
+			t.Errorf("Expected Internal when the mapping cannot be saved, got %v", err)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 0 || stats.QuarantinedIPs != 0 {
+			t.Errorf("Expected the allocation to be rolled back without a cool-down, got %s", stats)
+		}
+
+		// Releasing by IP deletes the mapping as well
+		allocated, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1"})
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+		released, err := client.ReleaseIP(ctx, &pb.ReleaseIPRequest{NodeId: "node1", Ip: allocated.Ip})
+		if err != nil || !released.Success {
+			t.Fatalf("ReleaseIP failed: %v %+v", err, released)
+		}
+		if _, err := ipamStore.GetIPMapping("container-1", ""); err == nil {
+			t.Error("Expected mapping for container-1 to be deleted")
+		}
+
+		// With the store unavailable nothing changes in the pool
+		if _, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-2"}); err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+		ipamStore.Close()
+
+		if _, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-3"}); err == nil {
+			t.Error("Expected AllocateIP to fail without a store")
+		}
+		released, err = client.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-2"})
+		if err != nil || released.Success {
+			t.Errorf("Expected ReleaseIP to fail without a store, got %v %+v", err, released)
+		}
+		if stats := pool.GetStats(); stats.UsedIPs != 1 {
+			t.Errorf("Expected 1 used IP, got %d", stats.UsedIPs)
+		}
+	})
+
+	t.Run("Audit log answers who held an IP", func(t *testing.T) {
+		client, ipamStore := startTestServer(t, newTestPool(t), nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		start := time.Now().Add(-time.Second).Unix()
+		first, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{
+			NodeId: "node1", ContainerId: "container-1", IfName: "eth0", PodName: "web-1", PodNamespace: "default",
+		}, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+		if _, err := client.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-1"}); err != nil {
+			t.Fatalf("ReleaseIP failed: %v", err)
+		}
+
+		// Hand the same IP to the next container
+		ipamStore.AppendAudit(store.AuditEvent{Type: store.AuditAllocate, NodeID: "node1",
+			ContainerID: "container-2", IfName: "eth0", PodName: "web-2", PodNamespace: "default", IP: first.Ip})
+
+		history, err := client.GetIPHistory(ctx, &pb.GetIPHistoryRequest{Ip: first.Ip, Since: start})
+		if err != nil {
+			t.Fatalf("GetIPHistory failed: %v", err)
+		}
+		if len(history.Holdings) != 2 {
+			t.Fatalf("Expected 2 holders of %s, got %+v", first.Ip, history.Holdings)
+		}
+		if h := history.Holdings[0]; h.ContainerId != "container-1" || h.PodName != "web-1" || h.From == 0 || h.To == 0 {
+			t.Errorf("Unexpected first holding %+v", h)
+		}
+		if h := history.Holdings[1]; h.ContainerId != "container-2" || h.To != 0 {
+			t.Errorf("Expected container-2 to still hold %s, got %+v", first.Ip, h)
+		}
+
+		// A period before the allocation has no holders
+		history, err = client.GetIPHistory(ctx, &pb.GetIPHistoryRequest{Ip: first.Ip, Since: start - 60, Until: start})
+		if err != nil || len(history.Holdings) != 0 {
+			t.Errorf("Expected no holders before the allocation, got %+v (%v)", history, err)
+		}
+
+		events, err := client.QueryAuditLog(ctx, &pb.QueryAuditLogRequest{ContainerId: "container-1", Limit: 1})
+		if err != nil || len(events.Events) != 1 || events.Events[0].Type != string(store.AuditRelease) {
+			t.Errorf("Expected the release of container-1, got %+v (%v)", events, err)
+		}
+
+		if _, err := client.GetIPHistory(ctx, &pb.GetIPHistoryRequest{Ip: "not-an-ip"}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for an invalid IP, got %v", err)
+		}
+	})
+
+	t.Run("Audit log can be disabled", func(t *testing.T) {
+		ipamStore := store.NewMemoryStore()
+		srv := NewIPAMServer(newTestPool(t), nil, ipamStore)
+		srv.SetAudit(false)
+		if _, err := srv.Reconcile(); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+
+		if _, err := srv.AllocateIP(context.Background(), &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-1"}); err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+		if events, _ := ipamStore.QueryAudit(store.AuditQuery{}); len(events) != 0 {
+			t.Errorf("Expected no audit events, got %+v", events)
+		}
+
+		// Without a store there is no log to query
+		_, err := NewIPAMServer(newTestPool(t), nil, nil).QueryAuditLog(context.Background(), &pb.QueryAuditLogRequest{})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("Expected FailedPrecondition without a store, got %v", err)
+		}
+	})
+
+	t.Run("Pre-allocation adds one block for the whole node", func(t *testing.T) {
+		pool := newTestPool(t)
+		srv := NewIPAMServer(pool, newTestRaftNode(t, pool), nil)
+		if _, err := srv.allocateBlock("node1"); err != nil {
+			t.Fatalf("allocateBlock failed: %v", err)
+		}
+
+		// Leave less than 20% of the block free
+		for i := 0; i < 210; i++ {
+			if _, _, err := pool.AllocateIPFromExistingBlocks("node1"); err != nil {
+				t.Fatalf("Allocation %d failed: %v", i, err)
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				srv.checkAndAllocateBlock("node1")
+			}()
+		}
+		wg.Wait()
+
+		// The new block counts, though the first one is still short
+		srv.checkAndAllocateBlock("node1")
+		if blocks, _ := pool.GetNodeBlocks("node1"); len(blocks) != 2 {
+			t.Errorf("Expected 2 blocks, got %d", len(blocks))
+		}
+	})
+
+	t.Run("Retried AllocateBlock returns the same block", func(t *testing.T) {
+		pool := newTestPool(t)
+		client, ipamStore := startTestServer(t, pool, newTestRaftNode(t, pool))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		req := &pb.AllocateBlockRequest{NodeId: "node1", RequestId: "request-1"}
+		first, err := client.AllocateBlock(ctx, req, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatalf("AllocateBlock failed: %v", err)
+		}
+		retry, err := client.AllocateBlock(ctx, req)
+		if err != nil || retry.Block.Cidr != first.Block.Cidr {
+			t.Errorf("Expected retry to return %s, got %+v (%v)", first.Block.Cidr, retry, err)
+		}
+		if blocks, _ := pool.GetNodeBlocks("node1"); len(blocks) != 1 {
+			t.Errorf("Expected 1 block, got %d", len(blocks))
+		}
+		if events, _ := ipamStore.QueryAudit(store.AuditQuery{}); len(events) != 1 {
+			t.Errorf("Expected 1 block_allocate event, got %+v", events)
+		}
+	})
+
+	t.Run("Errors carry gRPC status codes", func(t *testing.T) {
+		client, _ := startTestServer(t, newTestPool(t), nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err := client.AllocateIP(ctx, &pb.AllocateIPRequest{}, grpc.WaitForReady(true))
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for a missing node ID, got %v", err)
+		}
+
+		_, err = client.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for a missing container ID, got %v", err)
+		}
+
+		_, err = client.GetNodeBlocks(ctx, &pb.GetNodeBlocksRequest{NodeId: "unknown"})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Expected NotFound for an unknown node, got %v", err)
+		}
+
+		released, err := client.ReleaseIP(ctx, &pb.ReleaseIPRequest{NodeId: "node1", Ip: "not-an-ip"})
+		if err != nil || released.Success {
+			t.Errorf("Expected release of an invalid IP to fail, got %v %+v", err, released)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jianzi123/ipam/pkg/store"
+)
+
+// ContainerLister tells which containers are still running
+type ContainerLister interface {
+	// ListLive returns the IDs of the live containers among those of mappings
+	// Containers missing from the result are treated as gone
+	ListLive(mappings []store.IPMapping) (map[string]bool, error)
+}
+
+// FileLister reads the live container IDs from a path kept up to date by
+// the runtime or a node agent
+// A directory holds one entry per container, named by its ID; a file holds
+// one ID per line, with blank lines and lines starting with '#' ignored.
+// A missing path is an error rather than an empty list
+type FileLister struct {
+	Path string
+}
+
+// ListLive returns the container IDs found at the path
+func (l *FileLister) ListLive(mappings []store.IPMapping) (map[string]bool, error) {
+	info, err := os.Stat(l.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read live containers: %w", err)
+	}
+
+	live := make(map[string]bool)
+	if info.IsDir() {
+		entries, err := os.ReadDir(l.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read live containers: %w", err)
+		}
+		for _, entry := range entries {
+			live[entry.Name()] = true
+		}
+		return live, nil
+	}
+
+	data, err := os.ReadFile(l.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read live containers: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		live[line] = true
+	}
+	return live, nil
+}
+
+// NetnsLister treats a container as live while its network namespace path
+// exists
+// Mappings recorded without a namespace, or whose namespace cannot be
+// checked, are kept
+type NetnsLister struct {
+	// Root is prepended to namespace paths, for a daemon that sees the host
+	// filesystem under a mount such as /host
+	Root string
+}
+
+// ListLive returns the containers whose namespace path still exists
+func (l *NetnsLister) ListLive(mappings []store.IPMapping) (map[string]bool, error) {
+	live := make(map[string]bool)
+	for _, mapping := range mappings {
+		if mapping.Netns == "" {
+			live[mapping.ContainerID] = true
+			continue
+		}
+
+		_, err := os.Stat(filepath.Join(l.Root, mapping.Netns))
+		if err == nil || !os.IsNotExist(err) {
+			live[mapping.ContainerID] = true
+		}
+	}
+	return live, nil
+}
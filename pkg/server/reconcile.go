@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/jianzi123/ipam/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReconcileReport summarizes the replay of stored mappings into the pool
+type ReconcileReport struct {
+	// Restored is the number of stored IPs marked allocated in the pool
+	Restored int
+
+	// Orphaned IPs fall outside every block of their node
+	// Their mappings are kept in the store for an operator to inspect
+	Orphaned []OrphanedMapping
+}
+
+// OrphanedMapping is a stored IP that could not be replayed
+type OrphanedMapping struct {
+	Mapping store.IPMapping
+	IP      string
+	Reason  error
+}
+
+// Reconcile replays the stored IP mappings into the pool bitmaps so that
+// IPs in use before a restart are not handed out again
+// The pool blocks must already be restored, for example from Raft
+// Allocations and releases are refused until Reconcile succeeds
+func (s *IPAMServer) Reconcile() (*ReconcileReport, error) {
+	report := &ReconcileReport{}
+	if s.store == nil {
+		s.ready.Store(true)
+		return report, nil
+	}
+
+	mappings, err := s.store.ListIPMappings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IP mappings: %w", err)
+	}
+
+	for _, mapping := range mappings {
+		for _, addr := range mapping.IPs {
+			ip := net.ParseIP(addr.IP)
+			if ip == nil {
+				report.Orphaned = append(report.Orphaned, OrphanedMapping{
+					Mapping: mapping,
+					IP:      addr.IP,
+					Reason:  fmt.Errorf("invalid IP address %q", addr.IP),
+				})
+				continue
+			}
+
+			if err := s.pool.SetIPState(mapping.NodeID, ip, true); err != nil {
+				report.Orphaned = append(report.Orphaned, OrphanedMapping{Mapping: mapping, IP: addr.IP, Reason: err})
+				continue
+			}
+
+			// Replicate in case the allocation never reached the cluster
+			if s.raftNode != nil {
+				s.raftNode.RecordIPAllocation(mapping.NodeID, ip)
+			}
+			report.Restored++
+		}
+	}
+
+	s.ready.Store(true)
+	return report, nil
+}
+
+// checkReady refuses requests until the stored mappings are replayed
+func (s *IPAMServer) checkReady() error {
+	if !s.ready.Load() {
+		return status.Error(codes.Unavailable, "IP mappings are still being restored")
+	}
+	return nil
+}
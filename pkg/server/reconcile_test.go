@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/jianzi123/ipam/pkg/api/proto"
+	"github.com/jianzi123/ipam/pkg/ipam"
+	"github.com/jianzi123/ipam/pkg/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReconcile(t *testing.T) {
+	t.Run("Stored mappings are replayed into the pool", func(t *testing.T) {
+		ipamStore := store.NewMemoryStore()
+		defer ipamStore.Close()
+
+		// The blocks survive the restart, the bitmaps do not
+		pool := newTestPool(t)
+		if _, err := pool.AllocateBlockCIDRForNode("node1", "10.244.1.0/24"); err != nil {
+			t.Fatalf("AllocateBlockCIDRForNode failed: %v", err)
+		}
+
+		for _, mapping := range []store.IPMapping{
+			{ContainerID: "container-1", IfName: "eth0", NodeID: "node1",
+				IPs: []store.IPAddress{{IP: "10.244.1.1", CIDR: "10.244.1.1/24", BlockCIDR: "10.244.1.0/24"}}},
+			{ContainerID: "container-2", IfName: "eth0", NodeID: "node1",
+				IPs: []store.IPAddress{{IP: "10.244.1.2", CIDR: "10.244.1.2/24", BlockCIDR: "10.244.1.0/24"}}},
+			{ContainerID: "container-3", IfName: "eth0", NodeID: "node2",
+				IPs: []store.IPAddress{{IP: "10.244.2.1", CIDR: "10.244.2.1/24", BlockCIDR: "10.244.2.0/24"}}},
+		} {
+			if err := ipamStore.SaveIPMapping(mapping); err != nil {
+				t.Fatalf("SaveIPMapping failed: %v", err)
+			}
+		}
+
+		srv := NewIPAMServer(pool, nil, ipamStore)
+		ctx := context.Background()
+
+		_, err := srv.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-4"})
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected Unavailable before reconciling, got %v", err)
+		}
+		_, err = srv.ReleaseIP(ctx, &pb.ReleaseIPRequest{ContainerId: "container-1"})
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected Unavailable before reconciling, got %v", err)
+		}
+
+		report, err := srv.Reconcile()
+		if err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+		if report.Restored != 2 {
+			t.Errorf("Expected 2 restored mappings, got %d", report.Restored)
+		}
+		if len(report.Orphaned) != 1 || report.Orphaned[0].IP != "10.244.2.1" ||
+			!errors.Is(report.Orphaned[0].Reason, ipam.ErrNodeNotFound) {
+			t.Errorf("Expected container-3 to be orphaned, got %+v", report.Orphaned)
+		}
+
+		// The next pod gets a free IP
+		allocated, err := srv.AllocateIP(ctx, &pb.AllocateIPRequest{NodeId: "node1", ContainerId: "container-4"})
+		if err != nil {
+			t.Fatalf("AllocateIP failed: %v", err)
+		}
+		if allocated.Ip == "10.244.1.1" || allocated.Ip == "10.244.1.2" {
+			t.Errorf("Allocated %s, which is already in use", allocated.Ip)
+		}
+
+		// Orphaned mappings stay in the store
+		if _, err := ipamStore.GetIPMapping("container-3", "eth0"); err != nil {
+			t.Errorf("Expected container-3 mapping to be kept: %v", err)
+		}
+	})
+
+	t.Run("Serves right away without a store", func(t *testing.T) {
+		srv := NewIPAMServer(newTestPool(t), nil, nil)
+
+		if _, err := srv.AllocateIP(context.Background(), &pb.AllocateIPRequest{NodeId: "node1"}); err != nil {
+			t.Errorf("AllocateIP failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,268 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// bucketAuditLog holds audit events keyed by time and sequence
+const bucketAuditLog = "audit_log"
+
+// DefaultAuditRetention is how long audit events are kept
+const DefaultAuditRetention = 30 * 24 * time.Hour
+
+// AuditEventType identifies the change an audit event records
+type AuditEventType string
+
+const (
+	// AuditAllocate records an IP assigned to a container interface
+	AuditAllocate AuditEventType = "allocate"
+
+	// AuditRelease records an IP given back to the pool
+	AuditRelease AuditEventType = "release"
+
+	// AuditBlockAllocate records a block assigned to a node
+	AuditBlockAllocate AuditEventType = "block_allocate"
+
+	// AuditBlockRelease records a block taken from a node
+	AuditBlockRelease AuditEventType = "block_release"
+)
+
+// AuditEvent records an IP or block changing hands
+// IP events carry one IP each; block events carry only the block
+type AuditEvent struct {
+	Time         time.Time      `json:"time"`
+	Type         AuditEventType `json:"type"`
+	NodeID       string         `json:"node_id"`
+	ContainerID  string         `json:"container_id,omitempty"`
+	IfName       string         `json:"if_name,omitempty"`
+	PodName      string         `json:"pod_name,omitempty"`
+	PodNamespace string         `json:"pod_namespace,omitempty"`
+	IP           string         `json:"ip,omitempty"`
+	BlockCIDR    string         `json:"block_cidr,omitempty"`
+}
+
+// AuditQuery selects audit events; zero fields match everything
+type AuditQuery struct {
+	IP          string
+	ContainerID string
+	NodeID      string
+	Since       time.Time // Inclusive
+	Until       time.Time // Exclusive
+	Limit       int       // Keeps the newest events
+}
+
+// AuditLog is an append-only trail of allocation changes
+type AuditLog interface {
+	// AppendAudit records events, stamping those without a time with now
+	AppendAudit(events ...AuditEvent) error
+
+	// QueryAudit returns the matching events, oldest first
+	QueryAudit(query AuditQuery) ([]AuditEvent, error)
+
+	// PruneAudit deletes the events recorded before a time
+	PruneAudit(before time.Time) (int, error)
+}
+
+// IPHolding is a period during which a container held an IP
+type IPHolding struct {
+	IP           string
+	NodeID       string
+	ContainerID  string
+	IfName       string
+	PodName      string
+	PodNamespace string
+	From         time.Time // Zero if allocated before the oldest kept event
+	To           time.Time // Zero while still held
+}
+
+// IPHolders returns who held ip at any time between since and until
+// A zero until means up to now
+func IPHolders(log AuditLog, ip string, since, until time.Time) ([]IPHolding, error) {
+	events, err := log.QueryAudit(AuditQuery{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+
+	// An IP has one holder at a time, so an allocation also ends any
+	// holding whose release was not recorded
+	var holdings []IPHolding
+	current := -1
+	for _, event := range events {
+		switch event.Type {
+		case AuditAllocate:
+			if current >= 0 {
+				holdings[current].To = event.Time
+			}
+			holdings = append(holdings, holdingOf(event))
+			holdings[len(holdings)-1].From = event.Time
+			current = len(holdings) - 1
+		case AuditRelease:
+			if current >= 0 {
+				holdings[current].To = event.Time
+				current = -1
+				continue
+			}
+			holding := holdingOf(event)
+			holding.To = event.Time
+			holdings = append(holdings, holding)
+		}
+	}
+
+	var overlapping []IPHolding
+	for _, holding := range holdings {
+		if !holding.To.IsZero() && holding.To.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !holding.From.IsZero() && !holding.From.Before(until) {
+			continue
+		}
+		overlapping = append(overlapping, holding)
+	}
+	return overlapping, nil
+}
+
+// holdingOf returns the holding an IP event refers to, without its period
+func holdingOf(event AuditEvent) IPHolding {
+	return IPHolding{
+		IP:           event.IP,
+		NodeID:       event.NodeID,
+		ContainerID:  event.ContainerID,
+		IfName:       event.IfName,
+		PodName:      event.PodName,
+		PodNamespace: event.PodNamespace,
+	}
+}
+
+// matches reports whether an event is selected by the query, ignoring limits
+func (q *AuditQuery) matches(event *AuditEvent) bool {
+	switch {
+	case q.IP != "" && event.IP != q.IP:
+		return false
+	case q.ContainerID != "" && event.ContainerID != q.ContainerID:
+		return false
+	case q.NodeID != "" && event.NodeID != q.NodeID:
+		return false
+	case !q.Since.IsZero() && event.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !event.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// AppendAudit records events
+func (s *Store) AppendAudit(events ...AuditEvent) error {
+	now := time.Now()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketAuditLog))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", bucketAuditLog)
+		}
+
+		for _, event := range events {
+			if event.Time.IsZero() {
+				event.Time = now
+			}
+
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return fmt.Errorf("failed to marshal audit event: %w", err)
+			}
+			if err := bucket.Put(auditKey(event.Time, seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// QueryAudit returns the matching events, oldest first
+func (s *Store) QueryAudit(query AuditQuery) ([]AuditEvent, error) {
+	var events []AuditEvent
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketAuditLog))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", bucketAuditLog)
+		}
+
+		cursor := bucket.Cursor()
+		k, v := cursor.First()
+		if !query.Since.IsZero() {
+			k, v = cursor.Seek(auditKey(query.Since, 0))
+		}
+		var end []byte
+		if !query.Until.IsZero() {
+			end = auditKey(query.Until, 0)
+		}
+
+		for ; k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = cursor.Next() {
+			var event AuditEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return fmt.Errorf("failed to unmarshal audit event: %w", err)
+			}
+			if query.matches(&event) {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return limitEvents(events, query.Limit), nil
+}
+
+// PruneAudit deletes the events recorded before a time
+func (s *Store) PruneAudit(before time.Time) (int, error) {
+	deleted := 0
+	end := auditKey(before, 0)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketAuditLog))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", bucketAuditLog)
+		}
+
+		// Deleting through the cursor moves it to the next key
+		cursor := bucket.Cursor()
+		for k, _ := cursor.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+
+	return deleted, err
+}
+
+// auditKey orders audit events by time, then by append order
+func auditKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// limitEvents keeps the newest limit events
+func limitEvents(events []AuditEvent, limit int) []AuditEvent {
+	if limit > 0 && len(events) > limit {
+		return events[len(events)-limit:]
+	}
+	return events
+}
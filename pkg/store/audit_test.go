@@ -0,0 +1,131 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	base := time.Date(2024, 5, 7, 9, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time { return base.Add(time.Duration(hours) * time.Hour) }
+
+	run := func(t *testing.T, store MappingStore) {
+		// 10.244.3.17 goes from container-1 to container-2, whose release was
+		// never recorded, then to container-3
+		err := store.AppendAudit(
+			AuditEvent{Time: at(0), Type: AuditBlockAllocate, NodeID: "node1", BlockCIDR: "10.244.3.0/24"},
+			AuditEvent{Time: at(1), Type: AuditAllocate, NodeID: "node1", ContainerID: "container-1", IfName: "eth0",
+				PodName: "web-1", PodNamespace: "default", IP: "10.244.3.17", BlockCIDR: "10.244.3.0/24"},
+			AuditEvent{Time: at(3), Type: AuditRelease, NodeID: "node1", ContainerID: "container-1", IfName: "eth0",
+				PodName: "web-1", PodNamespace: "default", IP: "10.244.3.17", BlockCIDR: "10.244.3.0/24"},
+			AuditEvent{Time: at(5), Type: AuditAllocate, NodeID: "node1", ContainerID: "container-2", IfName: "eth0",
+				IP: "10.244.3.17"},
+			AuditEvent{Time: at(8), Type: AuditAllocate, NodeID: "node1", ContainerID: "container-3", IfName: "eth0",
+				IP: "10.244.3.17"},
+		)
+		if err != nil {
+			t.Fatalf("AppendAudit failed: %v", err)
+		}
+
+		// Events out of time order are returned in time order
+		store.AppendAudit(AuditEvent{Time: at(2), Type: AuditAllocate, NodeID: "node2", ContainerID: "container-4",
+			IP: "10.244.4.2"})
+		store.AppendAudit(AuditEvent{Type: AuditRelease, NodeID: "node2", ContainerID: "container-4", IP: "10.244.4.2"})
+
+		events, err := store.QueryAudit(AuditQuery{})
+		if err != nil || len(events) != 7 {
+			t.Fatalf("Expected 7 events, got %d (%v)", len(events), err)
+		}
+		if events[2].ContainerID != "container-4" || events[6].Time.Before(at(8)) {
+			t.Errorf("Expected events in time order, got %+v", events)
+		}
+
+		if events, _ := store.QueryAudit(AuditQuery{IP: "10.244.3.17"}); len(events) != 4 {
+			t.Errorf("Expected 4 events for 10.244.3.17, got %+v", events)
+		}
+		if events, _ := store.QueryAudit(AuditQuery{NodeID: "node2"}); len(events) != 2 {
+			t.Errorf("Expected 2 events on node2, got %+v", events)
+		}
+		if events, _ := store.QueryAudit(AuditQuery{ContainerID: "container-1"}); len(events) != 2 {
+			t.Errorf("Expected 2 events of container-1, got %+v", events)
+		}
+		if events, _ := store.QueryAudit(AuditQuery{Since: at(1), Until: at(5)}); len(events) != 3 {
+			t.Errorf("Expected 3 events from hour 1 up to hour 5, got %+v", events)
+		}
+		if events, _ := store.QueryAudit(AuditQuery{IP: "10.244.3.17", Limit: 1}); len(events) != 1 ||
+			events[0].ContainerID != "container-3" {
+			t.Errorf("Expected only the newest event, got %+v", events)
+		}
+
+		holdings, err := IPHolders(store, "10.244.3.17", at(2), at(6))
+		if err != nil {
+			t.Fatalf("IPHolders failed: %v", err)
+		}
+		if len(holdings) != 2 || holdings[0].ContainerID != "container-1" || holdings[0].PodName != "web-1" ||
+			!holdings[0].From.Equal(at(1)) || !holdings[0].To.Equal(at(3)) ||
+			holdings[1].ContainerID != "container-2" || !holdings[1].To.Equal(at(8)) {
+			t.Errorf("Expected container-1 and container-2 between hours 2 and 6, got %+v", holdings)
+		}
+		if holdings, _ := IPHolders(store, "10.244.3.17", at(9), time.Time{}); len(holdings) != 1 ||
+			holdings[0].ContainerID != "container-3" || !holdings[0].To.IsZero() {
+			t.Errorf("Expected container-3 to still hold the IP, got %+v", holdings)
+		}
+
+		deleted, err := store.PruneAudit(at(3))
+		if err != nil || deleted != 3 {
+			t.Errorf("Expected 3 events pruned, got %d (%v)", deleted, err)
+		}
+		if events, _ := store.QueryAudit(AuditQuery{}); len(events) != 4 || !events[0].Time.Equal(at(3)) {
+			t.Errorf("Expected events from hour 3 on, got %+v", events)
+		}
+
+		// A release whose allocation was pruned still names the holder
+		if holdings, _ := IPHolders(store, "10.244.3.17", at(0), at(4)); len(holdings) != 1 ||
+			holdings[0].ContainerID != "container-1" || !holdings[0].From.IsZero() {
+			t.Errorf("Expected container-1 from before the kept events, got %+v", holdings)
+		}
+
+		store.Close()
+		if err := store.AppendAudit(AuditEvent{Type: AuditRelease}); err == nil {
+			t.Error("Expected AppendAudit to fail after Close")
+		}
+	}
+
+	t.Run("Bolt backend", func(t *testing.T) {
+		store, err := Open(BackendBolt, filepath.Join(t.TempDir(), "ipam.db"))
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		run(t, store)
+	})
+
+	t.Run("Memory backend", func(t *testing.T) {
+		store, err := Open(BackendMemory, "")
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		run(t, store)
+	})
+
+	t.Run("Events survive a restart", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "ipam.db")
+		store, err := NewStore(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		store.AppendAudit(AuditEvent{Type: AuditAllocate, NodeID: "node1", IP: "10.244.1.5"})
+		store.Close()
+
+		store, err = NewStore(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to reopen store: %v", err)
+		}
+		defer store.Close()
+
+		events, err := store.QueryAudit(AuditQuery{IP: "10.244.1.5"})
+		if err != nil || len(events) != 1 || events[0].Time.IsZero() {
+			t.Errorf("Expected the stamped event to be kept, got %+v (%v)", events, err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// MappingStore persists the IP mappings of container interfaces along with
+// an audit trail of allocation changes
+type MappingStore interface {
+	AuditLog
+
+	// SaveIPMapping saves the mapping of a container interface, replacing
+	// any mapping of the same interface
+	SaveIPMapping(mapping IPMapping) error
+
+	// GetIPMapping retrieves the mapping of a container interface
+	GetIPMapping(containerID, ifName string) (*IPMapping, error)
+
+	// ListMappingsByContainer returns the mappings of every interface of a
+	// container, ordered by interface name
+	ListMappingsByContainer(containerID string) ([]IPMapping, error)
+
+	// DeleteIPMapping deletes the mapping of a container interface
+	DeleteIPMapping(containerID, ifName string) error
+
+	// ListIPMappings returns all IP mappings
+	ListIPMappings() ([]IPMapping, error)
+
+	// ListMappingsByNode returns all IP mappings for a specific node
+	ListMappingsByNode(nodeID string) ([]IPMapping, error)
+
+	// GetMappingByIP finds the mapping holding an IP address
+	GetMappingByIP(ip string) (*IPMapping, error)
+
+	// CleanupStaleEntries removes mappings older than maxAge
+	CleanupStaleEntries(maxAge time.Duration) (int, error)
+
+	// GetStats returns store statistics
+	GetStats() (*StoreStats, error)
+
+	// Close closes the store
+	Close() error
+}
+
+// Backend selects a MappingStore implementation
+type Backend string
+
+const (
+	// BackendBolt keeps mappings in a BoltDB file that survives restarts
+	BackendBolt Backend = "bolt"
+
+	// BackendMemory keeps mappings in memory only, for tests and ephemeral
+	// single-node setups
+	BackendMemory Backend = "memory"
+)
+
+// ParseBackend parses a backend name
+func ParseBackend(name string) (Backend, error) {
+	switch backend := Backend(name); backend {
+	case BackendBolt, BackendMemory:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown store backend %q", name)
+	}
+}
+
+// Open opens a mapping store of the given backend
+// dbPath is only used by backends that write to disk
+func Open(backend Backend, dbPath string) (MappingStore, error) {
+	switch backend {
+	case BackendBolt:
+		store, err := NewStore(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
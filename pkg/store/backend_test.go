@@ -0,0 +1,110 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMappingStore(t *testing.T) {
+	run := func(t *testing.T, store MappingStore) {
+		store.SaveIPMapping(IPMapping{ContainerID: "container-1", IfName: "net1", NodeID: "node1",
+			IPs: []IPAddress{{IP: "10.245.1.5"}}})
+		store.SaveIPMapping(IPMapping{ContainerID: "container-1", IfName: "eth0", NodeID: "node1",
+			IPs: []IPAddress{{IP: "10.244.1.5"}, {IP: "fd00::5"}}})
+		store.SaveIPMapping(IPMapping{ContainerID: "container-10", IfName: "eth0", NodeID: "node2",
+			IPs: []IPAddress{{IP: "10.244.2.5"}}})
+
+		mapping, err := store.GetIPMapping("container-1", "eth0")
+		if err != nil || len(mapping.IPs) != 2 || mapping.AllocatedAt.IsZero() {
+			t.Fatalf("Unexpected mapping %+v (%v)", mapping, err)
+		}
+
+		// Callers get copies
+		mapping.IPs[0].IP = "10.244.9.9"
+		if mapping, _ := store.GetIPMapping("container-1", "eth0"); !mapping.HasIP("10.244.1.5") {
+			t.Errorf("Expected the stored mapping to be unchanged, got %+v", mapping)
+		}
+
+		if _, err := store.GetIPMapping("container-1", "net2"); !errors.Is(err, ErrMappingNotFound) {
+			t.Errorf("Expected ErrMappingNotFound, got %v", err)
+		}
+
+		mappings, err := store.ListMappingsByContainer("container-1")
+		if err != nil || len(mappings) != 2 || mappings[0].IfName != "eth0" || mappings[1].IfName != "net1" {
+			t.Errorf("Expected eth0 and net1 of container-1, got %+v (%v)", mappings, err)
+		}
+		if mappings, _ := store.ListIPMappings(); len(mappings) != 3 {
+			t.Errorf("Expected 3 mappings, got %+v", mappings)
+		}
+		if mappings, _ := store.ListMappingsByNode("node1"); len(mappings) != 2 {
+			t.Errorf("Expected 2 mappings on node1, got %+v", mappings)
+		}
+		if mapping, err := store.GetMappingByIP("fd00::5"); err != nil || mapping.IfName != "eth0" {
+			t.Errorf("Expected eth0 of container-1 for fd00::5, got %+v (%v)", mapping, err)
+		}
+		if stats, err := store.GetStats(); err != nil || stats.TotalMappings != 3 ||
+			stats.MappingsByNode["node1"] != 2 || stats.MappingsByNode["node2"] != 1 {
+			t.Errorf("Unexpected stats %+v (%v)", stats, err)
+		}
+
+		// Replacing a mapping moves its index entries
+		store.SaveIPMapping(IPMapping{ContainerID: "container-1", IfName: "eth0", NodeID: "node1",
+			IPs: []IPAddress{{IP: "10.244.1.6"}}})
+		if _, err := store.GetMappingByIP("fd00::5"); !errors.Is(err, ErrMappingNotFound) {
+			t.Errorf("Expected fd00::5 to be unindexed, got %v", err)
+		}
+
+		if err := store.DeleteIPMapping("container-1", "eth0"); err != nil {
+			t.Fatalf("DeleteIPMapping failed: %v", err)
+		}
+		if err := store.DeleteIPMapping("container-1", "eth0"); err != nil {
+			t.Errorf("Repeated DeleteIPMapping failed: %v", err)
+		}
+		if _, err := store.GetMappingByIP("10.244.1.6"); !errors.Is(err, ErrMappingNotFound) {
+			t.Errorf("Expected 10.244.1.6 to be unindexed, got %v", err)
+		}
+
+		// A negative age puts the cutoff in the future, so all are stale
+		if deleted, err := store.CleanupStaleEntries(-time.Minute); err != nil || deleted != 2 {
+			t.Errorf("Expected 2 stale mappings, got %d (%v)", deleted, err)
+		}
+		if _, err := store.GetMappingByIP("10.245.1.5"); !errors.Is(err, ErrMappingNotFound) {
+			t.Errorf("Expected 10.245.1.5 to be unindexed, got %v", err)
+		}
+
+		store.Close()
+		if err := store.SaveIPMapping(IPMapping{ContainerID: "container-2", IfName: "eth0"}); err == nil {
+			t.Error("Expected SaveIPMapping to fail after Close")
+		}
+		if _, err := store.ListMappingsByContainer("container-1"); err == nil {
+			t.Error("Expected ListMappingsByContainer to fail after Close")
+		}
+	}
+
+	t.Run("Bolt backend", func(t *testing.T) {
+		store, err := Open(BackendBolt, filepath.Join(t.TempDir(), "ipam.db"))
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		run(t, store)
+	})
+
+	t.Run("Memory backend", func(t *testing.T) {
+		store, err := Open(BackendMemory, "")
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		run(t, store)
+	})
+
+	t.Run("Unknown backends are rejected", func(t *testing.T) {
+		if _, err := ParseBackend("etcd"); err == nil {
+			t.Error("Expected ParseBackend to reject etcd")
+		}
+		if _, err := Open(Backend("etcd"), ""); err == nil {
+			t.Error("Expected Open to reject etcd")
+		}
+	})
+}
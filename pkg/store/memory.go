@@ -0,0 +1,272 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrStoreClosed is returned by a MemoryStore after Close
+var ErrStoreClosed = errors.New("store is closed")
+
+// MemoryStore keeps IP mappings in memory
+// Nothing survives a restart, so it suits tests and single-node setups
+// whose pool is rebuilt from scratch anyway
+type MemoryStore struct {
+	mu       sync.RWMutex
+	mappings map[string]IPMapping // keyed by mappingKey
+	ipIndex  map[string]string    // IP -> mapping key
+	audit    []AuditEvent         // ordered by time
+	closed   bool
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mappings: make(map[string]IPMapping),
+		ipIndex:  make(map[string]string),
+	}
+}
+
+// Close closes the store, later calls fail with ErrStoreClosed
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+// SaveIPMapping saves the mapping of a container interface, replacing any
+// mapping of the same interface
+func (s *MemoryStore) SaveIPMapping(mapping IPMapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	mapping = cloneMapping(mapping)
+	mapping.AllocatedAt = time.Now()
+	key := string(mappingKey(mapping.ContainerID, mapping.IfName))
+
+	if old, exists := s.mappings[key]; exists {
+		s.deleteIndexes(key, old)
+	}
+	s.mappings[key] = mapping
+	for _, addr := range mapping.IPs {
+		if addr.IP != "" {
+			s.ipIndex[addr.IP] = key
+		}
+	}
+	return nil
+}
+
+// GetIPMapping retrieves the mapping of a container interface
+func (s *MemoryStore) GetIPMapping(containerID, ifName string) (*IPMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	mapping, exists := s.mappings[string(mappingKey(containerID, ifName))]
+	if !exists {
+		return nil, fmt.Errorf("%w for container %s interface %q", ErrMappingNotFound, containerID, ifName)
+	}
+
+	mapping = cloneMapping(mapping)
+	return &mapping, nil
+}
+
+// ListMappingsByContainer returns the mappings of every interface of a container
+func (s *MemoryStore) ListMappingsByContainer(containerID string) ([]IPMapping, error) {
+	return s.list(func(m *IPMapping) bool { return m.ContainerID == containerID })
+}
+
+// DeleteIPMapping deletes the mapping of a container interface
+func (s *MemoryStore) DeleteIPMapping(containerID, ifName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	key := string(mappingKey(containerID, ifName))
+	if mapping, exists := s.mappings[key]; exists {
+		s.deleteIndexes(key, mapping)
+		delete(s.mappings, key)
+	}
+	return nil
+}
+
+// ListIPMappings returns all IP mappings
+func (s *MemoryStore) ListIPMappings() ([]IPMapping, error) {
+	return s.list(func(*IPMapping) bool { return true })
+}
+
+// ListMappingsByNode returns all IP mappings for a specific node
+func (s *MemoryStore) ListMappingsByNode(nodeID string) ([]IPMapping, error) {
+	return s.list(func(m *IPMapping) bool { return m.NodeID == nodeID })
+}
+
+// GetMappingByIP finds the mapping holding an IP address
+func (s *MemoryStore) GetMappingByIP(ip string) (*IPMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	key, exists := s.ipIndex[ip]
+	if !exists {
+		return nil, fmt.Errorf("%w for IP %s", ErrMappingNotFound, ip)
+	}
+
+	mapping := cloneMapping(s.mappings[key])
+	return &mapping, nil
+}
+
+// CleanupStaleEntries removes mappings older than the specified duration
+func (s *MemoryStore) CleanupStaleEntries(maxAge time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	deleted := 0
+	cutoff := time.Now().Add(-maxAge)
+	for key, mapping := range s.mappings {
+		if mapping.AllocatedAt.Before(cutoff) {
+			s.deleteIndexes(key, mapping)
+			delete(s.mappings, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// GetStats returns store statistics
+func (s *MemoryStore) GetStats() (*StoreStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	stats := &StoreStats{
+		TotalMappings:  len(s.mappings),
+		MappingsByNode: make(map[string]int),
+	}
+	for _, mapping := range s.mappings {
+		if mapping.NodeID != "" {
+			stats.MappingsByNode[mapping.NodeID]++
+		}
+	}
+	return stats, nil
+}
+
+// AppendAudit records events
+func (s *MemoryStore) AppendAudit(events ...AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	now := time.Now()
+	for _, event := range events {
+		if event.Time.IsZero() {
+			event.Time = now
+		}
+
+		// Keep time order like the Bolt keys, after events of the same time
+		i := sort.Search(len(s.audit), func(i int) bool { return s.audit[i].Time.After(event.Time) })
+		s.audit = append(s.audit, AuditEvent{})
+		copy(s.audit[i+1:], s.audit[i:])
+		s.audit[i] = event
+	}
+	return nil
+}
+
+// QueryAudit returns the matching events, oldest first
+func (s *MemoryStore) QueryAudit(query AuditQuery) ([]AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	var events []AuditEvent
+	for i := range s.audit {
+		if query.matches(&s.audit[i]) {
+			events = append(events, s.audit[i])
+		}
+	}
+	return limitEvents(events, query.Limit), nil
+}
+
+// PruneAudit deletes the events recorded before a time
+func (s *MemoryStore) PruneAudit(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	deleted := sort.Search(len(s.audit), func(i int) bool { return !s.audit[i].Time.Before(before) })
+	s.audit = append([]AuditEvent(nil), s.audit[deleted:]...)
+	return deleted, nil
+}
+
+// list returns copies of the mappings matching filter, ordered by key like
+// the Bolt store
+func (s *MemoryStore) list(filter func(*IPMapping) bool) ([]IPMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	var keys []string
+	for key, mapping := range s.mappings {
+		if filter(&mapping) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var mappings []IPMapping
+	for _, key := range keys {
+		mappings = append(mappings, cloneMapping(s.mappings[key]))
+	}
+	return mappings, nil
+}
+
+// deleteIndexes removes the IP index entries owned by a mapping
+func (s *MemoryStore) deleteIndexes(key string, mapping IPMapping) {
+	for _, addr := range mapping.IPs {
+		if s.ipIndex[addr.IP] == key {
+			delete(s.ipIndex, addr.IP)
+		}
+	}
+}
+
+// cloneMapping copies a mapping so callers cannot change stored addresses
+func cloneMapping(mapping IPMapping) IPMapping {
+	mapping.IPs = append([]IPAddress(nil), mapping.IPs...)
+	return mapping
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// SchemaVersion is the version of the database layout written by this build
+const SchemaVersion = 4
+
+// keySchemaVersion records the schema version in the metadata bucket
+const keySchemaVersion = "schema_version"
+
+// ErrNewerSchema is returned when opening a database written by a newer version
+var ErrNewerSchema = errors.New("database schema is newer than this version supports")
+
+// migration upgrades a database to version from the version before it
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *bolt.Tx) error
+}
+
+// migrations lists every schema change in order
+// Each one runs exactly once per database; never edit a released one
+var migrations = []migration{
+	{version: 1, name: "create mapping buckets", apply: createMappingBuckets},
+	{version: 2, name: "build IP and node indexes", apply: buildIndexes},
+	{version: 3, name: "key mappings by container and interface", apply: keyByInterface},
+	{version: 4, name: "create audit log", apply: createAuditLog},
+}
+
+// migrate brings the database up to SchemaVersion
+// All pending migrations run in the caller's transaction, so a failure leaves
+// the file as it was
+func migrate(tx *bolt.Tx) error {
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: database is at version %d, this version supports up to %d",
+			ErrNewerSchema, version, SchemaVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.apply(tx); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		if version > 0 {
+			log.Printf("Migrated store to schema version %d: %s", m.version, m.name)
+		}
+	}
+
+	metadata, err := tx.CreateBucketIfNotExists([]byte(bucketMetadata))
+	if err != nil {
+		return err
+	}
+	return metadata.Put([]byte(keySchemaVersion), []byte(strconv.Itoa(SchemaVersion)))
+}
+
+// schemaVersion returns the schema version of the database
+// Files from before versioning have no version but do have the mappings
+// bucket, which makes them version 1; an empty file is version 0
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	if metadata := tx.Bucket([]byte(bucketMetadata)); metadata != nil {
+		if data := metadata.Get([]byte(keySchemaVersion)); data != nil {
+			version, err := strconv.Atoi(string(data))
+			if err != nil {
+				return 0, fmt.Errorf("invalid schema version %q: %w", data, err)
+			}
+			return version, nil
+		}
+	}
+
+	if tx.Bucket([]byte(bucketIPMappings)) != nil {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// createMappingBuckets creates the buckets of the original layout
+func createMappingBuckets(tx *bolt.Tx) error {
+	for _, name := range []string{bucketIPMappings, bucketMetadata} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndexes creates the index buckets and fills them from the mappings
+func buildIndexes(tx *bolt.Tx) error {
+	for _, name := range []string{bucketIPIndex, bucketNodeIndex} {
+		if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket([]byte(bucketIPMappings)).ForEach(func(k, v []byte) error {
+		var mapping IPMapping
+		if err := json.Unmarshal(v, &mapping); err != nil {
+			return fmt.Errorf("failed to unmarshal mapping %s: %w", k, err)
+		}
+		return putIndexes(tx, mapping)
+	})
+}
+
+// keyByInterface moves each mapping from its container ID key to a container
+// ID and interface name key, turning its single address into a list
+func keyByInterface(tx *bolt.Tx) error {
+	bucket := tx.Bucket([]byte(bucketIPMappings))
+
+	// Mappings as written up to version 2
+	type legacyMapping struct {
+		IPMapping
+		IP        string `json:"ip"`
+		CIDR      string `json:"cidr"`
+		BlockCIDR string `json:"block_cidr"`
+	}
+
+	// Collect first, Bolt cursors do not survive changes to the bucket
+	type entry struct {
+		key     []byte
+		mapping IPMapping
+	}
+	var entries []entry
+	err := bucket.ForEach(func(k, v []byte) error {
+		var legacy legacyMapping
+		if err := json.Unmarshal(v, &legacy); err != nil {
+			return fmt.Errorf("failed to unmarshal mapping %s: %w", k, err)
+		}
+
+		mapping := legacy.IPMapping
+		if mapping.ContainerID == "" {
+			mapping.ContainerID = string(k)
+		}
+		if legacy.IP != "" {
+			mapping.IPs = []IPAddress{{IP: legacy.IP, CIDR: legacy.CIDR, BlockCIDR: legacy.BlockCIDR}}
+		}
+		entries = append(entries, entry{key: append([]byte(nil), k...), mapping: mapping})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		data, err := json.Marshal(e.mapping)
+		if err != nil {
+			return fmt.Errorf("failed to marshal mapping %s: %w", e.key, err)
+		}
+		if err := bucket.Delete(e.key); err != nil {
+			return err
+		}
+		if err := bucket.Put(mappingKey(e.mapping.ContainerID, e.mapping.IfName), data); err != nil {
+			return err
+		}
+	}
+
+	// The index entries refer to the old keys
+	return buildIndexes(tx)
+}
+
+// createAuditLog creates the audit log bucket
+func createAuditLog(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(bucketAuditLog))
+	return err
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// readSchemaVersion reads the schema version stored in the database at dbPath
+func readSchemaVersion(t *testing.T, dbPath string) string {
+	t.Helper()
+
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var version string
+	db.View(func(tx *bolt.Tx) error {
+		if metadata := tx.Bucket([]byte(bucketMetadata)); metadata != nil {
+			version = string(metadata.Get([]byte(keySchemaVersion)))
+		}
+		return nil
+	})
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	t.Run("New databases get the current version", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "ipam.db")
+
+		store, err := NewStore(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		store.Close()
+
+		if version := readSchemaVersion(t, dbPath); version != strconv.Itoa(SchemaVersion) {
+			t.Errorf("Expected schema version %d, got %q", SchemaVersion, version)
+		}
+
+		// Reopening leaves the version alone
+		store, err = NewStore(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to reopen store: %v", err)
+		}
+		store.Close()
+
+		if version := readSchemaVersion(t, dbPath); version != strconv.Itoa(SchemaVersion) {
+			t.Errorf("Expected schema version %d after reopening, got %q", SchemaVersion, version)
+		}
+	})
+
+	t.Run("Unversioned databases are upgraded", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "ipam.db")
+
+		// The layout written before versioning, keyed by container ID
+		db, err := bolt.Open(dbPath, 0600, nil)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			if err := createMappingBuckets(tx); err != nil {
+				return err
+			}
+			bucket := tx.Bucket([]byte(bucketIPMappings))
+			if err := bucket.Put([]byte("container-1"), []byte(`{"container_id":"container-1","if_name":"eth0",`+
+				`"node_id":"node1","ip":"10.244.1.5","cidr":"10.244.1.5/24","block_cidr":"10.244.1.0/24"}`)); err != nil {
+				return err
+			}
+			return bucket.Put([]byte("container-2"), []byte(`{"container_id":"container-2","node_id":"node1","ip":"10.244.1.6"}`))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write mappings: %v", err)
+		}
+		db.Close()
+
+		store, err := NewStore(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+
+		mapping, err := store.GetIPMapping("container-1", "eth0")
+		if err != nil {
+			t.Fatalf("Expected container-1 to be keyed by interface: %v", err)
+		}
+		expected := IPAddress{IP: "10.244.1.5", CIDR: "10.244.1.5/24", BlockCIDR: "10.244.1.0/24"}
+		if len(mapping.IPs) != 1 || mapping.IPs[0] != expected {
+			t.Errorf("Expected IPs [%v], got %v", expected, mapping.IPs)
+		}
+
+		// Mappings without an interface name keep an empty one
+		if mappings, err := store.ListMappingsByContainer("container-2"); err != nil || len(mappings) != 1 ||
+			!mappings[0].HasIP("10.244.1.6") {
+			t.Errorf("Expected container-2 to hold 10.244.1.6, got %+v (%v)", mappings, err)
+		}
+		if mapping, err := store.GetMappingByIP("10.244.1.5"); err != nil || mapping.ContainerID != "container-1" {
+			t.Errorf("Expected container-1 by IP, got %+v (%v)", mapping, err)
+		}
+		if mappings, _ := store.ListMappingsByNode("node1"); len(mappings) != 2 {
+			t.Errorf("Expected 2 mappings on node1, got %+v", mappings)
+		}
+		if err := store.AppendAudit(AuditEvent{Type: AuditAllocate, IP: "10.244.1.7"}); err != nil {
+			t.Errorf("Expected an audit log to be created: %v", err)
+		}
+		store.Close()
+
+		if version := readSchemaVersion(t, dbPath); version != strconv.Itoa(SchemaVersion) {
+			t.Errorf("Expected schema version %d, got %q", SchemaVersion, version)
+		}
+	})
+
+	t.Run("Newer databases are refused", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "ipam.db")
+
+		db, err := bolt.Open(dbPath, 0600, nil)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			metadata, err := tx.CreateBucket([]byte(bucketMetadata))
+			if err != nil {
+				return err
+			}
+			return metadata.Put([]byte(keySchemaVersion), []byte(strconv.Itoa(SchemaVersion+1)))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write version: %v", err)
+		}
+		db.Close()
+
+		if _, err := NewStore(dbPath); !errors.Is(err, ErrNewerSchema) {
+			t.Fatalf("Expected ErrNewerSchema, got %v", err)
+		}
+
+		// The file is left untouched
+		if version := readSchemaVersion(t, dbPath); version != strconv.Itoa(SchemaVersion+1) {
+			t.Errorf("Expected schema version %d to be kept, got %q", SchemaVersion+1, version)
+		}
+	})
+
+	t.Run("Migrations are numbered up to the current version", func(t *testing.T) {
+		for i, m := range migrations {
+			if m.version != i+1 {
+				t.Errorf("Migration %q has version %d, expected %d", m.name, m.version, i+1)
+			}
+		}
+		if last := migrations[len(migrations)-1].version; last != SchemaVersion {
+			t.Errorf("Last migration is version %d, SchemaVersion is %d", last, SchemaVersion)
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -12,23 +14,64 @@ const (
 	// Bucket names
 	bucketIPMappings = "ip_mappings"
 	bucketMetadata   = "metadata"
+
+	// bucketIPIndex maps an IP to the key of the mapping holding it
+	bucketIPIndex = "ip_index"
+
+	// bucketNodeIndex holds a bucket per node listing its mapping keys
+	bucketNodeIndex = "node_index"
+
+	// keySeparator joins the container ID and interface name of a mapping key
+	// CNI container IDs and Linux interface names cannot contain it
+	keySeparator = "/"
 )
 
+// ErrMappingNotFound is returned when no mapping matches a lookup
+var ErrMappingNotFound = errors.New("mapping not found")
+
 // Store manages persistent storage for IPAM
 type Store struct {
 	db *bolt.DB
 }
 
-// IPMapping represents a container ID to IP mapping
+// IPMapping represents the addresses of one interface of a container
+// Mappings are keyed by container ID and interface name
 type IPMapping struct {
-	ContainerID  string    `json:"container_id"`
-	PodName      string    `json:"pod_name"`
-	PodNamespace string    `json:"pod_namespace"`
-	NodeID       string    `json:"node_id"`
-	IP           string    `json:"ip"`
-	CIDR         string    `json:"cidr"`
-	BlockCIDR    string    `json:"block_cidr"`
-	AllocatedAt  time.Time `json:"allocated_at"`
+	ContainerID  string      `json:"container_id"`
+	IfName       string      `json:"if_name,omitempty"`
+	Netns        string      `json:"netns,omitempty"`
+	PodName      string      `json:"pod_name"`
+	PodNamespace string      `json:"pod_namespace"`
+	NodeID       string      `json:"node_id"`
+	IPs          []IPAddress `json:"ips"`
+	AllocatedAt  time.Time   `json:"allocated_at"`
+}
+
+// IPAddress is an address assigned to an interface
+type IPAddress struct {
+	IP        string `json:"ip"`
+	CIDR      string `json:"cidr"`
+	BlockCIDR string `json:"block_cidr"`
+}
+
+// HasIP reports whether the mapping holds ip
+func (m *IPMapping) HasIP(ip string) bool {
+	for _, addr := range m.IPs {
+		if addr.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingKey returns the key of the mapping of a container interface
+func mappingKey(containerID, ifName string) []byte {
+	return []byte(containerID + keySeparator + ifName)
+}
+
+// containerPrefix returns the prefix shared by the keys of a container
+func containerPrefix(containerID string) []byte {
+	return []byte(containerID + keySeparator)
 }
 
 // NewStore creates a new store
@@ -40,19 +83,10 @@ func NewStore(dbPath string) (*Store, error) {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Create buckets
-	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte(bucketIPMappings)); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(bucketMetadata)); err != nil {
-			return err
-		}
-		return nil
-	})
-	if err != nil {
+	// Create buckets, or upgrade a database written by an older version
+	if err := db.Update(migrate); err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create buckets: %w", err)
+		return nil, err
 	}
 
 	return &Store{db: db}, nil
@@ -63,9 +97,11 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
-// SaveIPMapping saves a container ID to IP mapping
+// SaveIPMapping saves the mapping of a container interface, replacing any
+// mapping of the same interface
 func (s *Store) SaveIPMapping(mapping IPMapping) error {
 	mapping.AllocatedAt = time.Now()
+	key := mappingKey(mapping.ContainerID, mapping.IfName)
 
 	return s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketIPMappings))
@@ -73,17 +109,30 @@ func (s *Store) SaveIPMapping(mapping IPMapping) error {
 			return fmt.Errorf("bucket %s not found", bucketIPMappings)
 		}
 
+		// Drop the index entries of the mapping being replaced
+		if data := bucket.Get(key); data != nil {
+			var old IPMapping
+			if err := json.Unmarshal(data, &old); err == nil {
+				if err := deleteIndexes(tx, old); err != nil {
+					return err
+				}
+			}
+		}
+
 		data, err := json.Marshal(mapping)
 		if err != nil {
 			return fmt.Errorf("failed to marshal mapping: %w", err)
 		}
 
-		return bucket.Put([]byte(mapping.ContainerID), data)
+		if err := bucket.Put(key, data); err != nil {
+			return err
+		}
+		return putIndexes(tx, mapping)
 	})
 }
 
-// GetIPMapping retrieves a mapping by container ID
-func (s *Store) GetIPMapping(containerID string) (*IPMapping, error) {
+// GetIPMapping retrieves the mapping of a container interface
+func (s *Store) GetIPMapping(containerID, ifName string) (*IPMapping, error) {
 	var mapping IPMapping
 
 	err := s.db.View(func(tx *bolt.Tx) error {
@@ -92,9 +141,9 @@ func (s *Store) GetIPMapping(containerID string) (*IPMapping, error) {
 			return fmt.Errorf("bucket %s not found", bucketIPMappings)
 		}
 
-		data := bucket.Get([]byte(containerID))
+		data := bucket.Get(mappingKey(containerID, ifName))
 		if data == nil {
-			return fmt.Errorf("mapping not found for container %s", containerID)
+			return fmt.Errorf("%w for container %s interface %q", ErrMappingNotFound, containerID, ifName)
 		}
 
 		return json.Unmarshal(data, &mapping)
@@ -107,15 +156,59 @@ func (s *Store) GetIPMapping(containerID string) (*IPMapping, error) {
 	return &mapping, nil
 }
 
-// DeleteIPMapping deletes a mapping by container ID
-func (s *Store) DeleteIPMapping(containerID string) error {
+// ListMappingsByContainer returns the mappings of every interface of a container
+func (s *Store) ListMappingsByContainer(containerID string) ([]IPMapping, error) {
+	var mappings []IPMapping
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketIPMappings))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s not found", bucketIPMappings)
+		}
+
+		prefix := containerPrefix(containerID)
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var mapping IPMapping
+			if err := json.Unmarshal(v, &mapping); err != nil {
+				return err
+			}
+			if mapping.ContainerID == containerID {
+				mappings = append(mappings, mapping)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mappings, nil
+}
+
+// DeleteIPMapping deletes the mapping of a container interface
+func (s *Store) DeleteIPMapping(containerID, ifName string) error {
+	key := mappingKey(containerID, ifName)
+
 	return s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketIPMappings))
 		if bucket == nil {
 			return fmt.Errorf("bucket %s not found", bucketIPMappings)
 		}
 
-		return bucket.Delete([]byte(containerID))
+		data := bucket.Get(key)
+		if data == nil {
+			return nil
+		}
+
+		var mapping IPMapping
+		if err := json.Unmarshal(data, &mapping); err == nil {
+			if err := deleteIndexes(tx, mapping); err != nil {
+				return err
+			}
+		}
+		return bucket.Delete(key)
 	})
 }
 
@@ -156,14 +249,22 @@ func (s *Store) ListMappingsByNode(nodeID string) ([]IPMapping, error) {
 			return fmt.Errorf("bucket %s not found", bucketIPMappings)
 		}
 
-		return bucket.ForEach(func(k, v []byte) error {
+		nodeBucket := tx.Bucket([]byte(bucketNodeIndex)).Bucket([]byte(nodeID))
+		if nodeBucket == nil {
+			return nil
+		}
+
+		return nodeBucket.ForEach(func(k, _ []byte) error {
+			data := bucket.Get(k)
+			if data == nil {
+				return fmt.Errorf("node index of %s refers to missing mapping %s", nodeID, k)
+			}
+
 			var mapping IPMapping
-			if err := json.Unmarshal(v, &mapping); err != nil {
+			if err := json.Unmarshal(data, &mapping); err != nil {
 				return err
 			}
-			if mapping.NodeID == nodeID {
-				mappings = append(mappings, mapping)
-			}
+			mappings = append(mappings, mapping)
 			return nil
 		})
 	})
@@ -175,9 +276,9 @@ func (s *Store) ListMappingsByNode(nodeID string) ([]IPMapping, error) {
 	return mappings, nil
 }
 
-// GetMappingByIP finds a mapping by IP address
+// GetMappingByIP finds the mapping holding an IP address
 func (s *Store) GetMappingByIP(ip string) (*IPMapping, error) {
-	var result *IPMapping
+	var mapping IPMapping
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketIPMappings))
@@ -185,31 +286,28 @@ func (s *Store) GetMappingByIP(ip string) (*IPMapping, error) {
 			return fmt.Errorf("bucket %s not found", bucketIPMappings)
 		}
 
-		return bucket.ForEach(func(k, v []byte) error {
-			var mapping IPMapping
-			if err := json.Unmarshal(v, &mapping); err != nil {
-				return err
-			}
-			if mapping.IP == ip {
-				result = &mapping
-				return nil // Stop iteration
-			}
-			return nil
-		})
+		key := tx.Bucket([]byte(bucketIPIndex)).Get([]byte(ip))
+		if key == nil {
+			return fmt.Errorf("%w for IP %s", ErrMappingNotFound, ip)
+		}
+
+		data := bucket.Get(key)
+		if data == nil {
+			return fmt.Errorf("IP index of %s refers to missing mapping %s", ip, key)
+		}
+		return json.Unmarshal(data, &mapping)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if result == nil {
-		return nil, fmt.Errorf("no mapping found for IP %s", ip)
-	}
-
-	return result, nil
+	return &mapping, nil
 }
 
 // CleanupStaleEntries removes mappings older than the specified duration
+// Age alone cannot tell a dead container from a long-running pod; the
+// server's GarbageCollector checks liveness instead
 func (s *Store) CleanupStaleEntries(maxAge time.Duration) (int, error) {
 	deleted := 0
 	cutoff := time.Now().Add(-maxAge)
@@ -220,22 +318,25 @@ func (s *Store) CleanupStaleEntries(maxAge time.Duration) (int, error) {
 			return fmt.Errorf("bucket %s not found", bucketIPMappings)
 		}
 
-		// Collect keys to delete
-		var toDelete [][]byte
+		// Collect mappings to delete
+		var toDelete []IPMapping
 		bucket.ForEach(func(k, v []byte) error {
 			var mapping IPMapping
 			if err := json.Unmarshal(v, &mapping); err != nil {
 				return nil // Skip malformed entries
 			}
 			if mapping.AllocatedAt.Before(cutoff) {
-				toDelete = append(toDelete, k)
+				toDelete = append(toDelete, mapping)
 			}
 			return nil
 		})
 
-		// Delete collected keys
-		for _, key := range toDelete {
-			if err := bucket.Delete(key); err != nil {
+		// Delete collected mappings
+		for _, mapping := range toDelete {
+			if err := deleteIndexes(tx, mapping); err != nil {
+				return err
+			}
+			if err := bucket.Delete(mappingKey(mapping.ContainerID, mapping.IfName)); err != nil {
 				return err
 			}
 			deleted++
@@ -259,19 +360,23 @@ func (s *Store) GetStats() (*StoreStats, error) {
 
 		stats.TotalMappings = bucket.Stats().KeyN
 
-		// Count by node
+		// Count by node from the node index
 		nodeCount := make(map[string]int)
-		bucket.ForEach(func(k, v []byte) error {
-			var mapping IPMapping
-			if err := json.Unmarshal(v, &mapping); err != nil {
+		nodeIndex := tx.Bucket([]byte(bucketNodeIndex))
+		err := nodeIndex.ForEach(func(nodeID, _ []byte) error {
+			nodeBucket := nodeIndex.Bucket(nodeID)
+			if nodeBucket == nil {
 				return nil
 			}
-			nodeCount[mapping.NodeID]++
+			cursor := nodeBucket.Cursor()
+			for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+				nodeCount[string(nodeID)]++
+			}
 			return nil
 		})
 
 		stats.MappingsByNode = nodeCount
-		return nil
+		return err
 	})
 
 	if err != nil {
@@ -286,3 +391,59 @@ type StoreStats struct {
 	TotalMappings  int
 	MappingsByNode map[string]int
 }
+
+// putIndexes adds the index entries of a mapping
+func putIndexes(tx *bolt.Tx, mapping IPMapping) error {
+	key := mappingKey(mapping.ContainerID, mapping.IfName)
+
+	for _, addr := range mapping.IPs {
+		if addr.IP == "" {
+			continue
+		}
+		if err := tx.Bucket([]byte(bucketIPIndex)).Put([]byte(addr.IP), key); err != nil {
+			return fmt.Errorf("failed to index IP %s: %w", addr.IP, err)
+		}
+	}
+
+	if mapping.NodeID != "" {
+		nodeBucket, err := tx.Bucket([]byte(bucketNodeIndex)).CreateBucketIfNotExists([]byte(mapping.NodeID))
+		if err != nil {
+			return fmt.Errorf("failed to index node %s: %w", mapping.NodeID, err)
+		}
+		if err := nodeBucket.Put(key, []byte{}); err != nil {
+			return fmt.Errorf("failed to index node %s: %w", mapping.NodeID, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteIndexes removes the index entries of a mapping
+// Entries that were taken over by another mapping are left alone
+func deleteIndexes(tx *bolt.Tx, mapping IPMapping) error {
+	key := mappingKey(mapping.ContainerID, mapping.IfName)
+
+	ipIndex := tx.Bucket([]byte(bucketIPIndex))
+	for _, addr := range mapping.IPs {
+		if owner := ipIndex.Get([]byte(addr.IP)); owner != nil && bytes.Equal(owner, key) {
+			if err := ipIndex.Delete([]byte(addr.IP)); err != nil {
+				return err
+			}
+		}
+	}
+
+	nodeIndex := tx.Bucket([]byte(bucketNodeIndex))
+	nodeBucket := nodeIndex.Bucket([]byte(mapping.NodeID))
+	if nodeBucket == nil {
+		return nil
+	}
+	if err := nodeBucket.Delete(key); err != nil {
+		return err
+	}
+
+	// Drop the bucket of a node without mappings
+	if k, _ := nodeBucket.Cursor().First(); k == nil {
+		return nodeIndex.DeleteBucket([]byte(mapping.NodeID))
+	}
+	return nil
+}
@@ -2,7 +2,10 @@ package store
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -23,12 +26,11 @@ func TestStore(t *testing.T) {
 	t.Run("Save and get IP mapping", func(t *testing.T) {
 		mapping := IPMapping{
 			ContainerID:  "container-123",
+			IfName:       "eth0",
 			PodName:      "test-pod",
 			PodNamespace: "default",
 			NodeID:       "node1",
-			IP:           "10.244.1.5",
-			CIDR:         "10.244.1.5/24",
-			BlockCIDR:    "10.244.1.0/24",
+			IPs:          []IPAddress{{IP: "10.244.1.5", CIDR: "10.244.1.5/24", BlockCIDR: "10.244.1.0/24"}},
 		}
 
 		// Save mapping
@@ -37,7 +39,7 @@ func TestStore(t *testing.T) {
 		}
 
 		// Get mapping
-		retrieved, err := store.GetIPMapping("container-123")
+		retrieved, err := store.GetIPMapping("container-123", "eth0")
 		if err != nil {
 			t.Fatalf("Failed to get mapping: %v", err)
 		}
@@ -45,8 +47,8 @@ func TestStore(t *testing.T) {
 		if retrieved.ContainerID != mapping.ContainerID {
 			t.Errorf("Expected container ID %s, got %s", mapping.ContainerID, retrieved.ContainerID)
 		}
-		if retrieved.IP != mapping.IP {
-			t.Errorf("Expected IP %s, got %s", mapping.IP, retrieved.IP)
+		if len(retrieved.IPs) != 1 || retrieved.IPs[0] != mapping.IPs[0] {
+			t.Errorf("Expected IPs %v, got %v", mapping.IPs, retrieved.IPs)
 		}
 	})
 
@@ -54,12 +56,11 @@ func TestStore(t *testing.T) {
 		// Add another mapping
 		mapping2 := IPMapping{
 			ContainerID:  "container-456",
+			IfName:       "eth0",
 			PodName:      "test-pod-2",
 			PodNamespace: "default",
 			NodeID:       "node1",
-			IP:           "10.244.1.6",
-			CIDR:         "10.244.1.6/24",
-			BlockCIDR:    "10.244.1.0/24",
+			IPs:          []IPAddress{{IP: "10.244.1.6", CIDR: "10.244.1.6/24", BlockCIDR: "10.244.1.0/24"}},
 		}
 		store.SaveIPMapping(mapping2)
 
@@ -86,11 +87,11 @@ func TestStore(t *testing.T) {
 	})
 
 	t.Run("Delete mapping", func(t *testing.T) {
-		if err := store.DeleteIPMapping("container-123"); err != nil {
+		if err := store.DeleteIPMapping("container-123", "eth0"); err != nil {
 			t.Fatalf("Failed to delete mapping: %v", err)
 		}
 
-		_, err := store.GetIPMapping("container-123")
+		_, err := store.GetIPMapping("container-123", "eth0")
 		if err == nil {
 			t.Error("Expected error when getting deleted mapping")
 		}
@@ -115,12 +116,11 @@ func TestStore(t *testing.T) {
 		// Add an old mapping
 		oldMapping := IPMapping{
 			ContainerID:  "old-container",
+			IfName:       "eth0",
 			PodName:      "old-pod",
 			PodNamespace: "default",
 			NodeID:       "node1",
-			IP:           "10.244.1.7",
-			CIDR:         "10.244.1.7/24",
-			BlockCIDR:    "10.244.1.0/24",
+			IPs:          []IPAddress{{IP: "10.244.1.7", CIDR: "10.244.1.7/24", BlockCIDR: "10.244.1.0/24"}},
 			AllocatedAt:  time.Now().Add(-2 * time.Hour),
 		}
 
@@ -128,7 +128,7 @@ func TestStore(t *testing.T) {
 		store.db.Update(func(tx *bolt.Tx) error {
 			bucket := tx.Bucket([]byte(bucketIPMappings))
 			data, _ := json.Marshal(oldMapping)
-			return bucket.Put([]byte(oldMapping.ContainerID), data)
+			return bucket.Put(mappingKey(oldMapping.ContainerID, oldMapping.IfName), data)
 		})
 
 		// Cleanup entries older than 1 hour
@@ -141,4 +141,148 @@ func TestStore(t *testing.T) {
 			t.Errorf("Expected 1 deleted entry, got %d", deleted)
 		}
 	})
+	t.Run("Indexes follow updates", func(t *testing.T) {
+		store, err := NewStore(filepath.Join(t.TempDir(), "ipam.db"))
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		defer store.Close()
+
+		store.SaveIPMapping(IPMapping{ContainerID: "container-1", IfName: "eth0", NodeID: "node1",
+			IPs: []IPAddress{{IP: "10.244.1.5"}}})
+		store.SaveIPMapping(IPMapping{ContainerID: "container-1", IfName: "eth0", NodeID: "node2",
+			IPs: []IPAddress{{IP: "10.244.2.5"}}})
+
+		if _, err := store.GetMappingByIP("10.244.1.5"); !errors.Is(err, ErrMappingNotFound) {
+			t.Errorf("Expected the old IP to be unindexed, got %v", err)
+		}
+		if mapping, err := store.GetMappingByIP("10.244.2.5"); err != nil || mapping.ContainerID != "container-1" {
+			t.Errorf("Expected container-1 for the new IP, got %+v (%v)", mapping, err)
+		}
+		if mappings, _ := store.ListMappingsByNode("node1"); len(mappings) != 0 {
+			t.Errorf("Expected no mappings on node1, got %+v", mappings)
+		}
+		if mappings, _ := store.ListMappingsByNode("node2"); len(mappings) != 1 {
+			t.Errorf("Expected 1 mapping on node2, got %+v", mappings)
+		}
+
+		store.DeleteIPMapping("container-1", "eth0")
+		if _, err := store.GetMappingByIP("10.244.2.5"); !errors.Is(err, ErrMappingNotFound) {
+			t.Errorf("Expected the deleted IP to be unindexed, got %v", err)
+		}
+		if stats, _ := store.GetStats(); len(stats.MappingsByNode) != 0 {
+			t.Errorf("Expected no nodes in stats, got %v", stats.MappingsByNode)
+		}
+	})
+
+	t.Run("Existing databases get their indexes built", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "ipam.db")
+
+		// A database written before the indexes existed
+		db, err := bolt.Open(dbPath, 0600, nil)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucket([]byte(bucketIPMappings))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte("container-1"), []byte(`{"container_id":"container-1","node_id":"node1","ip":"10.244.1.5"}`))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write mapping: %v", err)
+		}
+		db.Close()
+
+		store, err := NewStore(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		defer store.Close()
+
+		if mapping, err := store.GetMappingByIP("10.244.1.5"); err != nil || mapping.ContainerID != "container-1" {
+			t.Errorf("Expected container-1 by IP, got %+v (%v)", mapping, err)
+		}
+		if mappings, _ := store.ListMappingsByNode("node1"); len(mappings) != 1 {
+			t.Errorf("Expected 1 mapping on node1, got %+v", mappings)
+		}
+	})
+
+	t.Run("Interfaces of a container are kept apart", func(t *testing.T) {
+		store, err := NewStore(filepath.Join(t.TempDir(), "ipam.db"))
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		defer store.Close()
+
+		// A dual-stack eth0 and a second network on net1
+		store.SaveIPMapping(IPMapping{ContainerID: "container-1", IfName: "eth0", NodeID: "node1",
+			IPs: []IPAddress{{IP: "10.244.1.5"}, {IP: "fd00::5"}}})
+		store.SaveIPMapping(IPMapping{ContainerID: "container-1", IfName: "net1", NodeID: "node1",
+			IPs: []IPAddress{{IP: "10.245.1.5"}}})
+		store.SaveIPMapping(IPMapping{ContainerID: "container-10", IfName: "eth0", NodeID: "node1",
+			IPs: []IPAddress{{IP: "10.244.1.6"}}})
+
+		mappings, err := store.ListMappingsByContainer("container-1")
+		if err != nil || len(mappings) != 2 || mappings[0].IfName != "eth0" || mappings[1].IfName != "net1" {
+			t.Fatalf("Expected eth0 and net1 of container-1, got %+v (%v)", mappings, err)
+		}
+		for _, ip := range []string{"10.244.1.5", "fd00::5"} {
+			if mapping, err := store.GetMappingByIP(ip); err != nil || mapping.IfName != "eth0" {
+				t.Errorf("Expected eth0 for %s, got %+v (%v)", ip, mapping, err)
+			}
+		}
+		if stats, _ := store.GetStats(); stats.TotalMappings != 3 || stats.MappingsByNode["node1"] != 3 {
+			t.Errorf("Expected 3 mappings on node1, got %+v", stats)
+		}
+
+		store.DeleteIPMapping("container-1", "eth0")
+		if _, err := store.GetMappingByIP("fd00::5"); !errors.Is(err, ErrMappingNotFound) {
+			t.Errorf("Expected fd00::5 to be unindexed, got %v", err)
+		}
+		if mapping, err := store.GetIPMapping("container-1", "net1"); err != nil || !mapping.HasIP("10.245.1.5") {
+			t.Errorf("Expected net1 to be kept, got %+v (%v)", mapping, err)
+		}
+	})
+}
+
+func BenchmarkStoreGetMappingByIP(b *testing.B) {
+	store, err := NewStore(filepath.Join(b.TempDir(), "ipam.db"))
+	if err != nil {
+		b.Fatalf("Failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	// Ten thousand pods spread over 40 nodes
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketIPMappings))
+		for i := 0; i < 10000; i++ {
+			mapping := IPMapping{
+				ContainerID: fmt.Sprintf("container-%d", i),
+				IfName:      "eth0",
+				NodeID:      fmt.Sprintf("node%d", i%40),
+				IPs:         []IPAddress{{IP: fmt.Sprintf("10.244.%d.%d", i/250, i%250+1)}},
+			}
+			data, _ := json.Marshal(mapping)
+			if err := bucket.Put(mappingKey(mapping.ContainerID, mapping.IfName), data); err != nil {
+				return err
+			}
+			if err := putIndexes(tx, mapping); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("Failed to populate store: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := i % 10000
+		if _, err := store.GetMappingByIP(fmt.Sprintf("10.244.%d.%d", n/250, n%250+1)); err != nil {
+			b.Fatalf("GetMappingByIP failed: %v", err)
+		}
+	}
 }